@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+)
+
+// actorChange is sent to feed subscribers when the state of an actor changes.
+type actorChange struct {
+	Height  abi.ChainEpoch  `json:"height"`
+	TipSet  types.TipSetKey `json:"tipset"`
+	Actor   string          `json:"actor"`
+	Code    cid.Cid         `json:"code"`
+	Head    cid.Cid         `json:"head"`
+	Nonce   uint64          `json:"nonce"`
+	Balance types.BigInt    `json:"balance"`
+}
+
+type actorSubscription struct {
+	actors map[string]bool // ID addresses the subscriber is interested in
+	ch     chan actorChange
+}
+
+// actorFeed computes the actors whose state changed with each new head and
+// streams the changes to subscribers as server sent events, filtered by the
+// actors each subscriber asked for.
+type actorFeed struct {
+	api lotusapi.FullNode
+
+	mu   sync.Mutex
+	subs map[*actorSubscription]struct{}
+}
+
+func newActorFeed(api lotusapi.FullNode) *actorFeed {
+	return &actorFeed{
+		api:  api,
+		subs: map[*actorSubscription]struct{}{},
+	}
+}
+
+// onHead is registered with the chain follower.
+func (f *actorFeed) onHead(ctx context.Context, prev, head *types.TipSet) {
+	if prev == nil || !f.hasSubscribers() {
+		return
+	}
+
+	changed, err := f.api.StateChangedActors(ctx, prev.ParentState(), head.ParentState())
+	if err != nil {
+		log.Println("failed to compute changed actors", "height", head.Height(), "error", err)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, act := range changed {
+		ev := actorChange{
+			Height:  head.Height(),
+			TipSet:  head.Key(),
+			Actor:   addr,
+			Code:    act.Code,
+			Head:    act.Head,
+			Nonce:   act.Nonce,
+			Balance: act.Balance,
+		}
+		for sub := range f.subs {
+			if !sub.actors[addr] {
+				continue
+			}
+			select {
+			case sub.ch <- ev:
+			default:
+				log.Println("dropping actor change for slow subscriber", "actor", addr)
+			}
+		}
+	}
+}
+
+func (f *actorFeed) hasSubscribers() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs) > 0
+}
+
+func (f *actorFeed) subscribe(actors map[string]bool) *actorSubscription {
+	sub := &actorSubscription{
+		actors: actors,
+		ch:     make(chan actorChange, 64),
+	}
+	f.mu.Lock()
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+	return sub
+}
+
+func (f *actorFeed) unsubscribe(sub *actorSubscription) {
+	f.mu.Lock()
+	delete(f.subs, sub)
+	f.mu.Unlock()
+}
+
+// resolve converts the actor addresses to the ID addresses used by the state
+// tree.
+func (f *actorFeed) resolve(ctx context.Context, values []string) (map[string]bool, error) {
+	actors := map[string]bool{}
+	for _, s := range splitValues(values) {
+		addr, err := address.NewFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid actor address %q: %w", s, err)
+		}
+		id, err := f.api.StateLookupID(ctx, addr, types.EmptyTSK)
+		if err != nil {
+			return nil, fmt.Errorf("lookup actor %q: %w", s, err)
+		}
+		actors[id.String()] = true
+	}
+	return actors, nil
+}
+
+func (f *actorFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	actors, err := f.resolve(r.Context(), r.URL.Query()["actor"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(actors) == 0 {
+		http.Error(w, "at least one actor must be specified", http.StatusBadRequest)
+		return
+	}
+
+	sub := f.subscribe(actors)
+	defer f.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sub.ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("failed to marshal actor change", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: actor\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
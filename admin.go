@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAPI serves operational endpoints under /admin.
+type adminAPI struct {
+	pool        *upstreamPool
+	jobs        *jobScheduler
+	shadow      *shadowMirror   // optional
+	tracer      *callTracer     // optional
+	tokens      *tokenIssuer    // optional
+	shapes      *shapeRecorder  // optional
+	heatmap     *latencyHeatmap // optional
+	audit       *auditLog
+	capture     *payloadCapture
+	expiry      *tokenExpiry
+	tokenLimits *tokenLimits // optional
+	revocations *revocationList
+	router      *backendRouter
+	cacheExport *cacheExport // optional
+	config      []configFlag // flags as resolved at startup
+
+	ready      *readiness
+	drainGrace time.Duration
+}
+
+func (a *adminAPI) route(r *mux.Router) {
+	// Every endpoint needs admin permission, whatever identity got the
+	// request past authentication.
+	handle := func(path string, h http.Handler) *mux.Route {
+		return r.Handle(path, requireAdmin(h))
+	}
+	handle("/admin/drain", http.HandlerFunc(a.drainProxy)).Methods(http.MethodPost)
+	handle("/admin/upstreams", http.HandlerFunc(a.upstreams)).Methods(http.MethodGet)
+	handle("/admin/upstreams/weight", http.HandlerFunc(a.setWeight)).Methods(http.MethodPost)
+	handle("/admin/upstreams/drain", http.HandlerFunc(a.drain)).Methods(http.MethodPost)
+	handle("/admin/upstreams/drill", http.HandlerFunc(a.startDrill)).Methods(http.MethodPost)
+	handle("/admin/upstreams/drill", http.HandlerFunc(a.stopDrill)).Methods(http.MethodDelete)
+	handle("/admin/audit", http.HandlerFunc(a.auditEntries)).Methods(http.MethodGet)
+	handle("/admin/capture", http.HandlerFunc(a.captures)).Methods(http.MethodGet)
+	handle("/admin/capture", http.HandlerFunc(a.startCapture)).Methods(http.MethodPost)
+	handle("/admin/capture", http.HandlerFunc(a.stopCapture)).Methods(http.MethodDelete)
+	handle("/admin/config", http.HandlerFunc(a.configDump)).Methods(http.MethodGet)
+	handle("/admin/revocations", http.HandlerFunc(a.listRevocations)).Methods(http.MethodGet)
+	handle("/admin/token-expiry", http.HandlerFunc(a.tokenExpiry)).Methods(http.MethodGet)
+	handle("/admin/revocations", http.HandlerFunc(a.addRevocation)).Methods(http.MethodPost)
+	handle("/admin/jobs", http.HandlerFunc(a.pendingJobs)).Methods(http.MethodGet)
+	handle("/admin/jobs/pause", http.HandlerFunc(a.pauseJobs)).Methods(http.MethodPost)
+	handle("/admin/jobs/resume", http.HandlerFunc(a.resumeJobs)).Methods(http.MethodPost)
+	if a.shadow != nil {
+		handle("/admin/shadow", http.HandlerFunc(a.shadowDiffs)).Methods(http.MethodGet)
+	}
+	if a.tracer != nil {
+		handle("/admin/traces", http.HandlerFunc(a.traces)).Methods(http.MethodGet)
+	}
+	if a.shapes != nil {
+		handle("/admin/unknown-methods", http.HandlerFunc(a.unknownMethods)).Methods(http.MethodGet)
+	}
+	if a.heatmap != nil {
+		handle("/admin/latency", http.HandlerFunc(a.latency)).Methods(http.MethodGet)
+	}
+	if a.cacheExport != nil {
+		handle("/admin/cache/export", a.cacheExport).Methods(http.MethodGet)
+	}
+	if a.tokenLimits != nil {
+		handle("/admin/token-usage", http.HandlerFunc(a.tokenUsage)).Methods(http.MethodGet)
+	}
+	if a.tokens != nil {
+		handle("/admin/tokens", http.HandlerFunc(a.listTokens)).Methods(http.MethodGet)
+		handle("/admin/tokens", http.HandlerFunc(a.mintToken)).Methods(http.MethodPost)
+		handle("/admin/tokens/{id}", http.HandlerFunc(a.revokeToken)).Methods(http.MethodDelete)
+	}
+}
+
+// upstreams lists the upstreams in the pool followed by those still draining.
+func (a *adminAPI) upstreams(w http.ResponseWriter, r *http.Request) {
+	var statuses []upstreamStatus
+	for _, u := range a.pool.all() {
+		statuses = append(statuses, u.status())
+	}
+	for _, u := range a.pool.draining() {
+		statuses = append(statuses, u.status())
+	}
+	writeJSON(w, statuses)
+}
+
+// setWeight changes the weight of the upstream given by the addr parameter.
+func (a *adminAPI) setWeight(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	u := a.pool.find(addr)
+	if u == nil {
+		http.Error(w, fmt.Sprintf("unknown upstream %q", addr), http.StatusNotFound)
+		return
+	}
+
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight < 0 {
+		http.Error(w, "weight must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	u.setWeight(weight)
+	writeJSON(w, u.status())
+}
+
+// drain stops sending new calls to the upstream given by the addr parameter
+// and removes it from the pool once the calls it serves finish, moving its
+// subscriptions to the other upstreams.
+func (a *adminAPI) drain(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	u, err := a.pool.drain(addr)
+	switch {
+	case errors.Is(err, errUnknownUpstream):
+		http.Error(w, fmt.Sprintf("unknown upstream %q", addr), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, u.status())
+}
+
+// startDrill fails an upstream for the duration parameter to rehearse
+// failover. The upstream is restored automatically, and both ends of the
+// drill are recorded in the audit log.
+func (a *adminAPI) startDrill(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil {
+		http.Error(w, "duration must be a duration such as 5m", http.StatusBadRequest)
+		return
+	}
+	u, err := a.pool.startDrill(addr, d, func() {
+		a.audit.record(nil, "drill-end", addr, "restored after "+d.String())
+	})
+	switch {
+	case errors.Is(err, errUnknownUpstream):
+		http.Error(w, fmt.Sprintf("unknown upstream %q", addr), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.audit.record(r, "drill-start", addr, "failed for "+d.String())
+	writeJSON(w, u.status())
+}
+
+// stopDrill restores an upstream before its drill ends.
+func (a *adminAPI) stopDrill(w http.ResponseWriter, r *http.Request) {
+	addr := r.FormValue("addr")
+	u, err := a.pool.stopDrill(addr)
+	switch {
+	case errors.Is(err, errUnknownUpstream):
+		http.Error(w, fmt.Sprintf("unknown upstream %q", addr), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	a.audit.record(r, "drill-stop", addr, "restored early")
+	writeJSON(w, u.status())
+}
+
+func (a *adminAPI) auditEntries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.audit.list())
+}
+
+// captures lists the tokens flagged for payload capture and their captured
+// calls.
+func (a *adminAPI) captures(w http.ResponseWriter, r *http.Request) {
+	flags, calls := a.capture.list()
+	writeJSON(w, map[string]interface{}{"flags": flags, "calls": calls})
+}
+
+// startCapture flags the token of the JSON capture request in the body for
+// payload capture.
+func (a *adminAPI) startCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := req.flag(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.capture.flag(r, f)
+	writeJSON(w, f)
+}
+
+// stopCapture clears the flag of the token given by the owner or jti
+// parameter before it expires.
+func (a *adminAPI) stopCapture(w http.ResponseWriter, r *http.Request) {
+	f := captureFlag{Owner: r.FormValue("owner"), JTI: r.FormValue("jti")}
+	if (f.Owner == "") == (f.JTI == "") {
+		http.Error(w, errCaptureFlag.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.capture.unflag(r, f.key()) {
+		http.Error(w, "no capture for "+f.key(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// configDump serves the effective configuration, with secrets redacted, so
+// that support can see exactly what a deployment is running.
+func (a *adminAPI) configDump(w http.ResponseWriter, r *http.Request) {
+	runtime := runtimeOverrides{
+		Upstreams:  map[string][]upstreamStatus{},
+		JobsPaused: a.jobs.isPaused(),
+		Draining:   a.ready.isDraining(),
+	}
+	for name, pool := range a.router.groups {
+		statuses := []upstreamStatus{}
+		for _, u := range pool.all() {
+			statuses = append(statuses, u.status())
+		}
+		for _, u := range pool.draining() {
+			statuses = append(statuses, u.status())
+		}
+		runtime.Upstreams[name] = statuses
+	}
+	writeJSON(w, configDump{Flags: a.config, Runtime: runtime})
+}
+
+type drainStatus struct {
+	Draining   time.Time `json:"draining"`
+	ShutdownAt time.Time `json:"shutdown_at"`
+}
+
+// drainProxy makes /readyz report the proxy not ready so that load balancers
+// stop sending it new traffic, and shuts the proxy down once the drain grace
+// period has passed. Draining again does not extend the grace period.
+func (a *adminAPI) drainProxy(w http.ResponseWriter, r *http.Request) {
+	started := a.ready.drain()
+	writeJSON(w, drainStatus{
+		Draining:   started,
+		ShutdownAt: started.Add(a.drainGrace),
+	})
+}
+
+func (a *adminAPI) pendingJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.jobs.pending())
+}
+
+func (a *adminAPI) pauseJobs(w http.ResponseWriter, r *http.Request) {
+	a.jobs.pause()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) resumeJobs(w http.ResponseWriter, r *http.Request) {
+	a.jobs.resume()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shadowDiffs lists the most recent calls that the shadow upstream answered
+// differently from the primary.
+func (a *adminAPI) shadowDiffs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.shadow.diffs())
+}
+
+// traces lists the most recent calls sampled for tracing.
+func (a *adminAPI) traces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.tracer.traces())
+}
+
+// latency serves the latency heatmap, optionally filtered by the method and
+// upstream parameters and limited to the buckets after the since parameter,
+// a duration such as 15m.
+func (a *adminAPI) latency(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "since must be a duration such as 15m", http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+	writeJSON(w, a.heatmap.view(r.FormValue("method"), r.FormValue("upstream"), since))
+}
+
+func (a *adminAPI) listTokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.tokens.list())
+}
+
+// mintToken mints a scoped token from the JSON request in the body. The
+// token is only ever returned here.
+func (a *adminAPI) mintToken(w http.ResponseWriter, r *http.Request) {
+	var req mintRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid token request: %v", err), http.StatusBadRequest)
+		return
+	}
+	minted, err := a.tokens.mint(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, minted)
+}
+
+func (a *adminAPI) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	grant, err := a.tokens.revoke(id)
+	if errors.Is(err, errUnknownToken) {
+		http.Error(w, fmt.Sprintf("unknown token %q", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, grant)
+}
+
+// tokenUsage lists the calls each token owner made against its quotas.
+func (a *adminAPI) tokenUsage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.tokenLimits.list())
+}
+
+// tokenExpiry lists the lotus tokens used in the last day, soonest to expire
+// first.
+func (a *adminAPI) tokenExpiry(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.expiry.list(time.Now()))
+}
+
+func (a *adminAPI) listRevocations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.revocations.list())
+}
+
+// addRevocation revokes the tokens with the jti, or the token with the hash,
+// of the JSON revocation in the body.
+func (a *adminAPI) addRevocation(w http.ResponseWriter, r *http.Request) {
+	var req revocation
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rev, err := a.revocations.revoke(revocation{JTI: req.JTI, Hash: req.Hash, Reason: req.Reason})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	detail := "jti " + rev.JTI
+	if rev.Hash != "" {
+		detail = "hash " + rev.Hash
+	}
+	a.audit.record(r, "token-revoke", "", detail)
+	writeJSON(w, rev)
+}
+
+// unknownMethods lists the shapes of the calls made to methods the proxy
+// passes through without knowing them.
+func (a *adminAPI) unknownMethods(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.shapes.list())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// apiInfo is the address of a lotus node API and the token used to call it.
+type apiInfo struct {
+	addr      string // host:port
+	token     string // empty to use the token given by flag
+	tls       bool   // connect over tls
+	websocket bool   // connect over a websocket whatever the upstream transport
+	path      string // rpc endpoint path, empty for the default of the api
+	namespace string // rpc method namespace, empty for Filecoin
+}
+
+// defaultNamespace is the namespace lotus registers its api methods under.
+const defaultNamespace = "Filecoin"
+
+// parseAPIInfo parses a node API given as host:port, as a url such as
+// wss://node.example.com:443, optionally with the rpc endpoint path and
+// method namespace of nodes that do not use the lotus defaults, as in
+// https://gateway.example.com/rpc/v1?namespace=Custom, as a multiaddr such as
+// /ip4/127.0.0.1/tcp/2345/http, or in the <token>:<multiaddr> form of the
+// lotus MINER_API_INFO and FULLNODE_API_INFO variables. Any of these may also
+// be given a token as <token>@<address>.
+func parseAPIInfo(s string) (apiInfo, error) {
+	var info apiInfo
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		info.token, s = s[:i], s[i+1:]
+	}
+	if i := strings.Index(s, "://"); i > 0 {
+		switch scheme := strings.ToLower(s[:i]); scheme {
+		case "http", "https", "ws", "wss":
+			info.tls = strings.HasSuffix(scheme, "s")
+			info.websocket = strings.HasPrefix(scheme, "ws")
+		default:
+			return apiInfo{}, fmt.Errorf("unsupported api scheme %q", scheme)
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return apiInfo{}, fmt.Errorf("invalid api url %q: %w", s, err)
+		}
+		if u.Host == "" || u.User != nil || u.Fragment != "" {
+			return apiInfo{}, fmt.Errorf("invalid api url %q", s)
+		}
+		info.addr = u.Host
+		info.path = strings.TrimSuffix(u.Path, "/")
+		info.namespace = u.Query().Get("namespace")
+		return info, nil
+	}
+	if i := strings.Index(s, ":/"); i > 0 && info.token == "" {
+		info.token, s = s[:i], s[i+1:]
+	}
+	if !strings.HasPrefix(s, "/") {
+		if strings.Contains(s, "/") {
+			return apiInfo{}, fmt.Errorf("invalid api address %q", s)
+		}
+		info.addr = s
+		return info, nil
+	}
+
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return apiInfo{}, fmt.Errorf("invalid api multiaddr %q: %w", s, err)
+	}
+	_, addr, err := manet.DialArgs(m)
+	if err != nil {
+		return apiInfo{}, fmt.Errorf("invalid api multiaddr %q: %w", s, err)
+	}
+	info.addr = addr
+	for _, p := range m.Protocols() {
+		switch p.Name {
+		case "tls", "https":
+			info.tls = true
+		case "wss":
+			info.tls, info.websocket = true, true
+		case "ws":
+			info.websocket = true
+		}
+	}
+	return info, nil
+}
+
+// parseAPIInfos parses repeated and comma separated api flag values.
+func parseAPIInfos(values []string) ([]apiInfo, error) {
+	var infos []apiInfo
+	for _, v := range upstreamAddrs(values) {
+		info, err := parseAPIInfo(v)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// rpcNamespace returns the namespace of the api methods.
+func (i apiInfo) rpcNamespace() string {
+	if i.namespace != "" {
+		return i.namespace
+	}
+	return defaultNamespace
+}
+
+// tokenOr returns the token of the api, or def when it has none.
+func (i apiInfo) tokenOr(def string) string {
+	if i.token != "" {
+		return i.token
+	}
+	return def
+}
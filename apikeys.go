@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// apiKeyReloadInterval is how often the key file is checked for changes
+// made by the auth commands.
+const apiKeyReloadInterval = 5 * time.Second
+
+var errAPIKeyRevoked = errors.New("api key has been revoked")
+
+// apiKey is a key accepted in the X-API-Key header, for tooling that cannot
+// send bearer tokens. Keys are <id>.<secret>, and only the hash of the
+// secret is kept.
+type apiKey struct {
+	ID      string     `json:"id"`
+	Hash    string     `json:"hash"` // hex sha256 of the secret
+	Perm    string     `json:"perm"`
+	Label   string     `json:"label,omitempty"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// newAPIKey returns a new key granting perm, and the key to hand out.
+func newAPIKey(perm, label string, now time.Time) (apiKey, string, error) {
+	if _, err := permissionsUpTo(perm); err != nil {
+		return apiKey{}, "", err
+	}
+	var id [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return apiKey{}, "", err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return apiKey{}, "", err
+	}
+	k := apiKey{
+		ID:      hex.EncodeToString(id[:]),
+		Hash:    tokenHash(hex.EncodeToString(secret[:])),
+		Perm:    perm,
+		Label:   label,
+		Created: now.UTC(),
+	}
+	return k, k.ID + "." + hex.EncodeToString(secret[:]), nil
+}
+
+// loadAPIKeys reads the keys of a key file, which is empty when missing.
+func loadAPIKeys(path string) ([]apiKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse api keys %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// saveAPIKeys replaces the keys of a key file at once, so that a running
+// proxy never reads half of it.
+func saveAPIKeys(path string, keys []apiKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write api keys: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write api keys: %w", err)
+	}
+	return nil
+}
+
+// apiKeyStore holds the keys of a key file, reloading them when the file
+// changes.
+type apiKeyStore struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]apiKey // by id
+	modTime time.Time
+}
+
+func newAPIKeyStore(path string) (*apiKeyStore, error) {
+	s := &apiKeyStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the key file if it changed since it was last read.
+func (s *apiKeyStore) load() error {
+	var modTime time.Time
+	if info, err := os.Stat(s.path); err == nil {
+		modTime = info.ModTime()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.mu.RLock()
+	unchanged := s.keys != nil && modTime.Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	list, err := loadAPIKeys(s.path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]apiKey, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.mu.Lock()
+	s.keys, s.modTime = keys, modTime
+	s.mu.Unlock()
+	return nil
+}
+
+// run reloads the key file whenever it changes.
+func (s *apiKeyStore) run(ctx context.Context) {
+	ticker := time.NewTicker(apiKeyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.load(); err != nil {
+			log.Println("failed to reload api keys", "path", s.path, "error", err)
+		}
+	}
+}
+
+// authenticate returns the payload granted to key. The owner of the calls
+// made with it is its label, or its id.
+func (s *apiKeyStore) authenticate(key string) (*jwtPayload, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, errUnrecognizedToken
+	}
+	s.mu.RLock()
+	k, ok := s.keys[parts[0]]
+	s.mu.RUnlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(tokenHash(parts[1])), []byte(k.Hash)) != 1 {
+		return nil, errUnrecognizedToken
+	}
+	if k.Revoked != nil {
+		return nil, errAPIKeyRevoked
+	}
+	allow, err := permissionsUpTo(k.Perm)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtPayload{
+		Payload: jwt.Payload{Subject: k.Label, JWTID: k.ID},
+		Allow:   allow,
+		hash:    tokenHash(key),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// auditSize bounds the entries kept by the audit log.
+const auditSize = 500
+
+// auditEntry records an operator action, or its automatic end.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Upstream string    `json:"upstream,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Remote   string    `json:"remote,omitempty"` // address the action was requested from
+}
+
+// auditLog keeps the most recent operator actions, such as failure drills,
+// so that their effects can be told apart from real incidents. Entries are
+// also logged, and do not survive a restart.
+type auditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+// record adds an entry for action, made by the client of r when it is not
+// nil.
+func (a *auditLog) record(r *http.Request, action, upstream, detail string) {
+	e := auditEntry{
+		Time:     time.Now(),
+		Action:   action,
+		Upstream: upstream,
+		Detail:   detail,
+	}
+	if r != nil {
+		e.Remote = r.RemoteAddr
+	}
+	log.Println("audit", "action", e.Action, "upstream", e.Upstream, "detail", e.Detail, "remote", e.Remote)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+	if len(a.entries) > auditSize {
+		a.entries = append([]auditEntry(nil), a.entries[len(a.entries)-auditSize:]...)
+	}
+}
+
+// list returns the entries, oldest first.
+func (a *auditLog) list() []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]auditEntry{}, a.entries...)
+}
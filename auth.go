@@ -1,19 +1,389 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
+	"time"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	errTokenExpired = errors.New("token has expired")
+	errTokenNotYet  = errors.New("token is not valid yet")
 )
 
-func ValidateToken(next http.Handler) http.Handler {
+// jwtPayload is the payload of lotus api tokens. Lotus does not set the
+// registered claims, but tokens that do are checked against them.
+type jwtPayload struct {
+	jwt.Payload
+	Allow []string
+
+	// Methods and DenyMethods restrict the methods tokens signed by the
+	// proxy may call, when set.
+	Methods     []string `json:",omitempty"`
+	DenyMethods []string `json:",omitempty"`
+
+	// Miners restricts the miners tokens signed by the proxy may reach,
+	// when set.
+	Miners []string `json:",omitempty"`
+
+	hash   string          // of the token, for revocation
+	acl    methodACL       // parsed from Methods and DenyMethods
+	miners map[string]bool // parsed from Miners, nil when unrestricted
+}
+
+type jwtPayloadKey struct{}
+
+// jwtPayloadFrom returns the payload of the lotus token of the request ctx
+// belongs to, or nil.
+func jwtPayloadFrom(ctx context.Context) *jwtPayload {
+	p, _ := ctx.Value(jwtPayloadKey{}).(*jwtPayload)
+	return p
+}
+
+type adminTokenKey struct{}
+
+// isAdminToken reports whether the request ctx belongs to was made with the
+// admin token.
+func isAdminToken(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminTokenKey{}).(bool)
+	return admin
+}
+
+// requireAdmin rejects requests made neither with the admin token nor with a
+// token granting admin permission with 403. Minted tokens are rejected
+// whatever their methods, as they are limited to rpc calls.
+func requireAdmin(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if grantFrom(ctx) != nil {
+			http.Error(w, "minted tokens cannot reach /admin", http.StatusForbidden)
+			return
+		}
+		if p := jwtPayloadFrom(ctx); !isAdminToken(ctx) && (p == nil || !p.allows("admin")) {
+			http.Error(w, "/admin needs admin permission", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// allows reports whether the token grants perm.
+func (p *jwtPayload) allows(perm string) bool {
+	for _, a := range p.Allow {
+		if a == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionInterceptor rejects calls to methods whose permission, as given
+// by the perm tags of the lotus api structs, the lotus token of the request
+// does not grant. As in lotus, each permission must be granted explicitly.
+func permissionInterceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		payload := jwtPayloadFrom(ctx)
+		if payload == nil || payload.allows(call.Perm) {
+			return next(ctx, call)
+		}
+		return call.errorResult(fmt.Errorf("%s needs %s permission: %w", call.Method, call.Perm, errTokenScope))
+	}
+}
+
+var errUnrecognizedToken = errors.New("token not recognized")
+
+// Authenticator accepts bearer tokens of one kind, such as lotus tokens
+// signed with a known secret.
+type Authenticator interface {
+	// Authenticate returns the identity token was accepted as. It returns
+	// errUnrecognizedToken for tokens of other kinds, which the next
+	// authenticator is asked about, and any other error for tokens of its
+	// kind that are rejected.
+	Authenticate(ctx context.Context, token string) (*identity, error)
+}
+
+// identity is what a token was accepted as.
+type identity struct {
+	admin   bool        // the admin token, allowed everything
+	grant   *tokenGrant // a minted token, limited to rpc calls
+	payload *jwtPayload // a token with lotus permissions
+}
+
+// authStack checks the bearer token of each request against each of its
+// authenticators in turn. Without any authenticator every bearer token is
+// rejected. Requests without a token may be authenticated by their client
+// certificate instead.
+type authStack struct {
+	authenticators []Authenticator
+	revocations    *revocationList // optional
+	certs          clientCertPerms
+	apiKeys        *apiKeyStore   // optional
+	localAllow     []string       // granted to calls from loopback without a token, if any
+	public         *jwtPayload    // of rpc calls made without a token, if --public-read is set
+	throttle       *authThrottle  // optional
+	signer         *requestSigner // optional
+}
+
+// ValidateToken rejects requests without an acceptable token or client
+// certificate, and not let through from loopback or as public reads, with
+// 401, and requests whose token allows nothing or does not reach the path
+// with 403. Addresses banned for failing authentication too often are
+// rejected with 429 whatever their credentials.
+func (a *authStack) ValidateToken(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if a.throttle.rejectBanned(w, r) {
+			return
+		}
+		if key := r.Header.Get("X-API-Key"); key != "" && a.apiKeys != nil {
+			payload, err := a.apiKeys.authenticate(key)
+			if err != nil {
+				a.throttle.reject(w, r, fmt.Sprintf("invalid api key: %v", err))
+				return
+			}
+			if a.revocations.revoked(payload.Payload.JWTID, payload.hash) {
+				a.throttle.reject(w, r, errTokenRevoked.Error())
+				return
+			}
+			a.throttle.succeeded(r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, payload)))
+			return
+		}
+		if r.Header.Get(signatureHeader) != "" && a.signer != nil {
+			payload, err := a.signer.authenticate(r, time.Now())
+			if err != nil {
+				a.throttle.reject(w, r, fmt.Sprintf("invalid signature: %v", err))
+				return
+			}
+			if a.revocations.revoked(payload.Payload.JWTID, "") {
+				a.throttle.reject(w, r, errTokenRevoked.Error())
+				return
+			}
+			a.throttle.succeeded(r)
+			ctx := withReplayChecked(context.WithValue(r.Context(), jwtPayloadKey{}, payload))
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		token := r.Header.Get("Authorization")
 		if !strings.HasPrefix(token, "Bearer ") {
+			payload := a.certs.identify(r.TLS)
+			if payload == nil && len(a.localAllow) > 0 && isRPCPath(r.URL.Path) && fromLocalProcess(r) {
+				payload = localPayload(a.localAllow)
+			}
+			if payload == nil && a.public != nil && isRPCPath(r.URL.Path) {
+				payload = a.public
+			}
+			if payload != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, payload)))
+				return
+			}
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		// TODO: Validate token
-		next.ServeHTTP(w, r)
+		token = strings.TrimPrefix(token, "Bearer ")
+		id, err := a.authenticate(r.Context(), token)
+		if err != nil {
+			a.throttle.reject(w, r, fmt.Sprintf("invalid token: %v", err))
+			return
+		}
+		a.throttle.succeeded(r)
+		if id.admin {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, true)))
+			return
+		}
+		hash := tokenHash(token)
+		var jti string
+		if id.payload != nil {
+			jti = id.payload.Payload.JWTID
+		}
+		if a.revocations.revoked(jti, hash) {
+			a.throttle.reject(w, r, errTokenRevoked.Error())
+			return
+		}
+
+		if id.grant != nil {
+			if !isRPCPath(r.URL.Path) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenGrantKey{}, id.grant)))
+			return
+		}
+		if len(id.payload.Allow) == 0 {
+			http.Error(w, "token allows no permissions", http.StatusForbidden)
+			return
+		}
+		id.payload.hash = hash
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, id.payload)))
 	}
 	return http.HandlerFunc(fn)
 }
+
+// authenticate returns the identity given by the first authenticator that
+// recognizes token.
+func (a *authStack) authenticate(ctx context.Context, token string) (*identity, error) {
+	for _, auth := range a.authenticators {
+		id, err := auth.Authenticate(ctx, token)
+		if errors.Is(err, errUnrecognizedToken) {
+			continue
+		}
+		return id, err
+	}
+	return nil, errUnrecognizedToken
+}
+
+// newAuthenticators returns the authenticators selected by --auth-backend,
+// or those configured by flags when it is not set. Tokens are verified by
+// upstream only when selected.
+func newAuthenticators(cctx *cli.Context, tokens *tokenIssuer, upstream lotusapi.StorageMiner, expiry *tokenExpiry) ([]Authenticator, error) {
+	backends := splitValues(cctx.StringSlice("auth-backend"))
+	if len(backends) == 0 {
+		if tokens != nil {
+			backends = append(backends, "tokens")
+		}
+		if cctx.String("jwt-secret-file") != "" || cctx.String("token-secret-file") != "" || len(cctx.StringSlice("accept-secret-file")) > 0 {
+			backends = append(backends, "jwt")
+		}
+		if cctx.String("oidc-issuer") != "" {
+			backends = append(backends, "oidc")
+		}
+	}
+
+	var authenticators []Authenticator
+	for _, backend := range backends {
+		switch backend {
+		case "tokens":
+			if tokens == nil {
+				return nil, fmt.Errorf("auth backend tokens needs --admin-token")
+			}
+			authenticators = append(authenticators, tokens)
+		case "jwt":
+			auth := jwtAuthenticator{expiry: expiry}
+			files := append([]string{cctx.String("jwt-secret-file"), cctx.String("token-secret-file")}, cctx.StringSlice("accept-secret-file")...)
+			for _, file := range files {
+				if file == "" {
+					continue
+				}
+				secret, err := loadJWTSecret(file)
+				if err != nil {
+					return nil, err
+				}
+				auth.secrets = append(auth.secrets, secret)
+			}
+			if len(auth.secrets) == 0 {
+				return nil, fmt.Errorf("auth backend jwt needs --jwt-secret-file, --token-secret-file or --accept-secret-file")
+			}
+			authenticators = append(authenticators, &auth)
+		case "oidc":
+			issuer, audience := cctx.String("oidc-issuer"), cctx.String("oidc-audience")
+			if issuer == "" || audience == "" {
+				return nil, fmt.Errorf("auth backend oidc needs --oidc-issuer and --oidc-audience")
+			}
+			groupPerms, err := parseGroupPerms(cctx.StringSlice("oidc-group-perm"))
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, newOIDCAuthenticator(issuer, audience, cctx.String("oidc-perm-claim"), cctx.String("oidc-groups-claim"), groupPerms))
+		case "upstream":
+			authenticators = append(authenticators, newUpstreamAuthenticator(upstream, cctx.Duration("auth-verify-cache-ttl")))
+		default:
+			return nil, fmt.Errorf("unknown auth backend %q, expected tokens, jwt, oidc or upstream", backend)
+		}
+	}
+	return authenticators, nil
+}
+
+// jwtAuthenticator accepts lotus api tokens signed with one of secrets, such
+// as those of the lotus node and of the proxy itself, and the secrets they
+// replace while tokens signed with those are being rotated.
+type jwtAuthenticator struct {
+	secrets []*jwt.HMACSHA
+	expiry  *tokenExpiry // optional
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	now := time.Now()
+	payload, err := a.verify(token, now)
+	if err != nil {
+		return nil, err
+	}
+	payload.hash = tokenHash(token)
+	a.expiry.seen(payload, now)
+	payload.acl, err = newMethodACL(payload.Methods, payload.DenyMethods)
+	if err != nil {
+		return nil, fmt.Errorf("token method rules: %w", err)
+	}
+	payload.miners, err = parseTokenMiners(payload.Miners)
+	if err != nil {
+		return nil, fmt.Errorf("token miners: %w", err)
+	}
+	return &identity{payload: payload}, nil
+}
+
+// verify checks the signature of a lotus api token against each secret and
+// its expiry, if set. Tokens signed otherwise are not recognized.
+func (a *jwtAuthenticator) verify(token string, now time.Time) (*jwtPayload, error) {
+	var (
+		payload jwtPayload
+		err     = errUnrecognizedToken
+	)
+	for _, secret := range a.secrets {
+		payload = jwtPayload{}
+		if _, err = jwt.Verify([]byte(token), secret, &payload); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errUnrecognizedToken
+	}
+	if exp := payload.Payload.ExpirationTime; exp != nil && !now.Before(exp.Time) {
+		return nil, errTokenExpired
+	}
+	if nbf := payload.Payload.NotBefore; nbf != nil && now.Before(nbf.Time) {
+		return nil, errTokenNotYet
+	}
+	return &payload, nil
+}
+
+func isRPCPath(path string) bool {
+	return path == "/rpc/v0" || path == "/rpc/v1"
+}
+
+// loadJWTSecret reads the hmac secret lotus signs api tokens with, either
+// from a lotus keystore file holding the jwt-hmac-secret key or from a file
+// holding the secret hex encoded.
+func loadJWTSecret(file string) (*jwt.HMACSHA, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read jwt secret: %w", err)
+	}
+
+	var key struct {
+		Type       string
+		PrivateKey []byte
+	}
+	if err := json.Unmarshal(b, &key); err == nil {
+		if len(key.PrivateKey) == 0 {
+			return nil, fmt.Errorf("no private key in %s", file)
+		}
+		return jwt.NewHS256(key.PrivateKey), nil
+	}
+
+	secret, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("%s holds neither a lotus key nor a hex encoded secret", file)
+	}
+	return jwt.NewHS256(secret), nil
+}
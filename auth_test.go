@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// staticAuthenticator accepts the tokens it maps to an identity.
+type staticAuthenticator map[string]*identity
+
+func (s staticAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	id, ok := s[token]
+	if !ok {
+		return nil, errUnrecognizedToken
+	}
+	return id, nil
+}
+
+func TestRequireAdmin(t *testing.T) {
+	grant := &tokenGrant{ID: "g", Expires: time.Now().Add(time.Hour)}
+	tests := []struct {
+		name string
+		ctx  func(context.Context) context.Context
+		want int
+	}{
+		{"no token", func(ctx context.Context) context.Context { return ctx }, http.StatusForbidden},
+		{"admin token", func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, adminTokenKey{}, true)
+		}, http.StatusOK},
+		{"admin permission", func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, jwtPayloadKey{}, &jwtPayload{Allow: []string{"read", "write", "sign", "admin"}})
+		}, http.StatusOK},
+		{"write permission", func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, jwtPayloadKey{}, &jwtPayload{Allow: []string{"read", "write"}})
+		}, http.StatusForbidden},
+		{"minted token", func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, tokenGrantKey{}, grant)
+		}, http.StatusForbidden},
+		{"minted token with admin marker", func(ctx context.Context) context.Context {
+			return context.WithValue(context.WithValue(ctx, adminTokenKey{}, true), tokenGrantKey{}, grant)
+		}, http.StatusForbidden},
+	}
+	h := requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/tokens", nil)
+			r = r.WithContext(tt.ctx(r.Context()))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTokenPaths(t *testing.T) {
+	auth := &authStack{
+		authenticators: []Authenticator{staticAuthenticator{
+			"admin":  {admin: true},
+			"minted": {grant: &tokenGrant{ID: "g", Expires: time.Now().Add(time.Hour)}},
+			"reader": {payload: &jwtPayload{Allow: []string{"read"}}},
+			"none":   {payload: &jwtPayload{}},
+		}},
+		localAllow: []string{"read"},
+		public:     &jwtPayload{Allow: []string{"read"}},
+	}
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2345}
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2345}
+
+	tests := []struct {
+		name    string
+		path    string
+		token   string
+		local   net.Addr
+		remote  string
+		headers map[string]string
+		want    int
+	}{
+		{"admin token on rpc", "/rpc/v1", "admin", remote, "192.0.2.7:1", nil, http.StatusOK},
+		{"admin token on admin", "/admin/tokens", "admin", remote, "192.0.2.7:1", nil, http.StatusOK},
+		{"minted token on rpc", "/rpc/v0", "minted", remote, "192.0.2.7:1", nil, http.StatusOK},
+		{"minted token on admin", "/admin/tokens", "minted", remote, "192.0.2.7:1", nil, http.StatusForbidden},
+		{"minted token on miner route", "/miner/f01234/rpc/v0", "minted", remote, "192.0.2.7:1", nil, http.StatusForbidden},
+		{"lotus token", "/rpc/v0", "reader", remote, "192.0.2.7:1", nil, http.StatusOK},
+		{"lotus token allowing nothing", "/rpc/v0", "none", remote, "192.0.2.7:1", nil, http.StatusForbidden},
+		{"unknown token", "/rpc/v0", "other", remote, "192.0.2.7:1", nil, http.StatusUnauthorized},
+		{"public read on rpc", "/rpc/v1", "", remote, "192.0.2.7:1", nil, http.StatusOK},
+		{"public read on admin", "/admin/tokens", "", remote, "192.0.2.7:1", nil, http.StatusUnauthorized},
+		{"loopback on rpc", "/rpc/v0", "", loopback, "127.0.0.1:1", nil, http.StatusOK},
+		{"loopback on admin", "/admin/tokens", "", loopback, "127.0.0.1:1", nil, http.StatusUnauthorized},
+		{"loopback same origin", "/rpc/v0", "", loopback, "127.0.0.1:1", map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+	}
+	h := auth.ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			r.RemoteAddr = tt.remote
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, tt.local))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// Browser and forwarded requests to loopback are not let through as
+	// local calls.
+	local := &authStack{localAllow: []string{"read"}}
+	h = local.ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, headers := range []map[string]string{
+		{"Origin": "https://example.com"},
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Sec-Fetch-Site": "same-site"},
+		{"X-Forwarded-For": "192.0.2.7"},
+		{"Forwarded": "for=192.0.2.7"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+		r.RemoteAddr = "127.0.0.1:1"
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, loopback))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("request with %v: status = %d, want %d", headers, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Without any authenticator no bearer token is accepted.
+	r := httptest.NewRequest(http.MethodPost, "/admin/tokens", nil)
+	r.RemoteAddr = "192.0.2.7:1"
+	r.Header.Set("Authorization", "Bearer anything")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bearer token without authenticators: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestJWTAuthenticatorTokens(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	auth := &authStack{authenticators: []Authenticator{&jwtAuthenticator{secrets: []*jwt.HMACSHA{jwt.NewHS256(secret)}}}}
+	now := time.Now()
+	sign := func(alg jwt.Algorithm, p jwtPayload) string {
+		token, err := jwt.Sign(p, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(token)
+	}
+	read := []string{"read"}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", sign(jwt.NewHS256(secret), jwtPayload{Allow: read}), http.StatusOK},
+		{"valid until exp", sign(jwt.NewHS256(secret), jwtPayload{Payload: jwt.Payload{ExpirationTime: jwt.NumericDate(now.Add(time.Hour))}, Allow: read}), http.StatusOK},
+		{"garbage", "garbage", http.StatusUnauthorized},
+		{"garbage segments", "a.b.c", http.StatusUnauthorized},
+		{"empty", "", http.StatusUnauthorized},
+		{"wrong signature", sign(jwt.NewHS256([]byte("another secret")), jwtPayload{Allow: read}), http.StatusUnauthorized},
+		{"wrong algorithm", sign(jwt.NewHS512(secret), jwtPayload{Allow: read}), http.StatusUnauthorized},
+		{"expired", sign(jwt.NewHS256(secret), jwtPayload{Payload: jwt.Payload{ExpirationTime: jwt.NumericDate(now.Add(-time.Minute))}, Allow: read}), http.StatusUnauthorized},
+		{"not yet valid", sign(jwt.NewHS256(secret), jwtPayload{Payload: jwt.Payload{NotBefore: jwt.NumericDate(now.Add(time.Hour))}, Allow: read}), http.StatusUnauthorized},
+		{"no permissions", sign(jwt.NewHS256(secret), jwtPayload{}), http.StatusForbidden},
+		{"invalid method rule", sign(jwt.NewHS256(secret), jwtPayload{Allow: read, Methods: []string{"/State(/"}}), http.StatusUnauthorized},
+	}
+	h := auth.ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+			r.RemoteAddr = "192.0.2.7:1"
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadJWTSecret(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secret := []byte("0123456789abcdef")
+	keystore, err := json.Marshal(map[string]interface{}{"Type": "jwt-hmac-secret", "PrivateKey": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"lotus keystore", write("keystore", string(keystore)), true},
+		{"hex", write("hex", hex.EncodeToString(secret)+"\n"), true},
+		{"missing", filepath.Join(dir, "missing"), false},
+		{"unreadable", dir, false},
+		{"empty", write("empty", ""), false},
+		{"keystore without key", write("nokey", `{"Type":"jwt-hmac-secret"}`), false},
+		{"neither", write("neither", "not a secret"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg, err := loadJWTSecret(tt.path)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("load succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			token, err := jwt.Sign(jwtPayload{Allow: []string{"read"}}, jwt.NewHS256(secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := (&jwtAuthenticator{secrets: []*jwt.HMACSHA{alg}}).verify(string(token), time.Now()); err != nil {
+				t.Errorf("token signed with the secret: %v", err)
+			}
+		})
+	}
+}
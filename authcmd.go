@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/urfave/cli/v2"
+)
+
+// permissions lists the lotus api permissions, each implying those before
+// it, as lotus grants them when creating tokens.
+var permissions = []string{"read", "write", "sign", "admin"}
+
+// authCommand creates the secret the proxy signs its own tokens with, and
+// tokens signed with it, so that teams can be handed credentials without the
+// token of the lotus node.
+var authCommand = &cli.Command{
+	Name:  "auth",
+	Usage: "Manage the tokens the proxy signs itself",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "new-secret",
+			Usage:     "Write a new secret for --token-secret-file",
+			ArgsUsage: "<file>",
+			Action:    newTokenSecret,
+		},
+		{
+			Name:  "create-token",
+			Usage: "Create a token signed with --token-secret-file",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "perm",
+					Usage:    "Permission to grant, one of " + strings.Join(permissions, ", ") + ", which also grants those before it.",
+					Required: true,
+				},
+				&cli.DurationFlag{
+					Name:  "expiry",
+					Usage: "Time after which the token expires, 0 for never.",
+					Value: 30 * 24 * time.Hour,
+				},
+				&cli.StringFlag{
+					Name:  "label",
+					Usage: "Subject of the token, such as the team it is given to.",
+				},
+				&cli.StringSliceFlag{
+					Name:  "method",
+					Usage: "Method rule the token may call, which makes it unable to call any other. May be repeated.",
+				},
+				&cli.StringSliceFlag{
+					Name:  "deny-method",
+					Usage: "Method rule the token may not call. May be repeated.",
+				},
+				&cli.StringSliceFlag{
+					Name:  "miner",
+					Usage: "Address of a miner the token may reach, which makes it unable to reach any other. May be repeated.",
+				},
+			},
+			Action: createToken,
+		},
+		{
+			Name:  "add-key",
+			Usage: "Add a key to --api-key-file, for clients that send X-API-Key headers rather than tokens",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "perm",
+					Usage:    "Permission to grant, one of " + strings.Join(permissions, ", ") + ", which also grants those before it.",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "label",
+					Usage: "Owner of the key, such as the tool it is given to.",
+				},
+			},
+			Action: addAPIKey,
+		},
+		{
+			Name:      "revoke-key",
+			Usage:     "Revoke a key of --api-key-file",
+			ArgsUsage: "<id>",
+			Action:    revokeAPIKey,
+		},
+		{
+			Name:   "list-keys",
+			Usage:  "List the keys of --api-key-file",
+			Action: listAPIKeys,
+		},
+		{
+			Name:  "add-signing-key",
+			Usage: "Add a key to --signing-key-file, for clients that sign their requests rather than send tokens",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "perm",
+					Usage:    "Permission to grant, one of " + strings.Join(permissions, ", ") + ", which also grants those before it.",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "label",
+					Usage: "Owner of the key, such as the pipeline it is given to.",
+				},
+			},
+			Action: addSigningKey,
+		},
+		{
+			Name:      "revoke-signing-key",
+			Usage:     "Revoke a key of --signing-key-file",
+			ArgsUsage: "<id>",
+			Action:    revokeSigningKey,
+		},
+	},
+}
+
+func newTokenSecret(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected the file to write the secret to")
+	}
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cctx.Args().First(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create secret file: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(secret[:])); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write secret file: %w", err)
+	}
+	return f.Close()
+}
+
+func createToken(cctx *cli.Context) error {
+	file := cctx.String("token-secret-file")
+	if file == "" {
+		return fmt.Errorf("--token-secret-file must be set")
+	}
+	secret, err := loadJWTSecret(file)
+	if err != nil {
+		return err
+	}
+
+	allow, err := permissionsUpTo(cctx.String("perm"))
+	if err != nil {
+		return err
+	}
+	methods, denyMethods := splitValues(cctx.StringSlice("method")), splitValues(cctx.StringSlice("deny-method"))
+	if _, err := newMethodACL(methods, denyMethods); err != nil {
+		return err
+	}
+	miners := splitValues(cctx.StringSlice("miner"))
+	if _, err := parseTokenMiners(miners); err != nil {
+		return err
+	}
+	var jti [16]byte
+	if _, err := rand.Read(jti[:]); err != nil {
+		return err
+	}
+	now := time.Now()
+	payload := jwtPayload{
+		Payload: jwt.Payload{
+			Subject:  cctx.String("label"),
+			IssuedAt: jwt.NumericDate(now),
+			JWTID:    hex.EncodeToString(jti[:]),
+		},
+		Allow:       allow,
+		Methods:     methods,
+		DenyMethods: denyMethods,
+		Miners:      miners,
+	}
+	if expiry := cctx.Duration("expiry"); expiry > 0 {
+		payload.Payload.ExpirationTime = jwt.NumericDate(now.Add(expiry))
+	}
+
+	token, err := jwt.Sign(payload, secret)
+	if err != nil {
+		return fmt.Errorf("sign token: %w", err)
+	}
+	// The jti, needed to revoke the token, goes to stderr so that stdout
+	// holds the token alone.
+	fmt.Fprintln(os.Stderr, "jti:", payload.Payload.JWTID)
+	fmt.Println(string(token))
+	return nil
+}
+
+func apiKeyFile(cctx *cli.Context) (string, error) {
+	file := cctx.String("api-key-file")
+	if file == "" {
+		return "", fmt.Errorf("--api-key-file must be set")
+	}
+	return file, nil
+}
+
+func addAPIKey(cctx *cli.Context) error {
+	file, err := apiKeyFile(cctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadAPIKeys(file)
+	if err != nil {
+		return err
+	}
+	k, key, err := newAPIKey(cctx.String("perm"), cctx.String("label"), time.Now())
+	if err != nil {
+		return err
+	}
+	if err := saveAPIKeys(file, append(keys, k)); err != nil {
+		return err
+	}
+	// As with tokens, the id goes to stderr so that stdout holds the key
+	// alone.
+	fmt.Fprintln(os.Stderr, "id:", k.ID)
+	fmt.Println(key)
+	return nil
+}
+
+func revokeAPIKey(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected the id of the key to revoke")
+	}
+	file, err := apiKeyFile(cctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadAPIKeys(file)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if keys[i].ID != cctx.Args().First() {
+			continue
+		}
+		if keys[i].Revoked == nil {
+			now := time.Now().UTC()
+			keys[i].Revoked = &now
+		}
+		return saveAPIKeys(file, keys)
+	}
+	return fmt.Errorf("no key with id %q", cctx.Args().First())
+}
+
+func listAPIKeys(cctx *cli.Context) error {
+	file, err := apiKeyFile(cctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadAPIKeys(file)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		state := "active"
+		if k.Revoked != nil {
+			state = "revoked " + k.Revoked.Format(time.RFC3339)
+		}
+		fmt.Printf("%-16s %-5s %-20s %s %s\n", k.ID, k.Perm, k.Label, k.Created.Format(time.RFC3339), state)
+	}
+	return nil
+}
+
+func signingKeyFile(cctx *cli.Context) (string, error) {
+	file := cctx.String("signing-key-file")
+	if file == "" {
+		return "", fmt.Errorf("--signing-key-file must be set")
+	}
+	return file, nil
+}
+
+func addSigningKey(cctx *cli.Context) error {
+	file, err := signingKeyFile(cctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadSigningKeys(file)
+	if err != nil {
+		return err
+	}
+	k, err := newSigningKey(cctx.String("perm"), cctx.String("label"), time.Now())
+	if err != nil {
+		return err
+	}
+	if err := saveSigningKeys(file, append(keys, k)); err != nil {
+		return err
+	}
+	// The id goes to stderr so that stdout holds the secret alone.
+	fmt.Fprintln(os.Stderr, "id:", k.ID)
+	fmt.Println(k.Secret)
+	return nil
+}
+
+func revokeSigningKey(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected the id of the key to revoke")
+	}
+	file, err := signingKeyFile(cctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadSigningKeys(file)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if keys[i].ID != cctx.Args().First() {
+			continue
+		}
+		if keys[i].Revoked == nil {
+			now := time.Now().UTC()
+			keys[i].Revoked = &now
+		}
+		return saveSigningKeys(file, keys)
+	}
+	return fmt.Errorf("no key with id %q", cctx.Args().First())
+}
+
+// permissionsUpTo returns perm and the permissions it implies.
+func permissionsUpTo(perm string) ([]string, error) {
+	for i, p := range permissions {
+		if p == perm {
+			return append([]string(nil), permissions[:i+1]...), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown permission %q, expected one of %s", perm, strings.Join(permissions, ", "))
+}
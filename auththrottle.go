@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxAuthFailureDelay bounds the delay of the answer to a failed
+// authentication.
+const maxAuthFailureDelay = 5 * time.Second
+
+// maxAuthBan bounds the ban of an address, however often it is banned again.
+const maxAuthBan = 24 * time.Hour
+
+// authFailures are the recent failed authentications of a client address.
+type authFailures struct {
+	count    int       // within the window
+	first    time.Time // of the failures counted
+	bans     int       // bans so far, doubling the next one
+	banUntil time.Time
+}
+
+// authThrottle blunts brute forcing of tokens by counting failed
+// authentications per client address. Each failure is answered after a delay
+// that doubles with every failure within window, and an address reaching
+// threshold failures is banned for ban, doubling with each ban, during which
+// its requests are rejected whatever their token.
+type authThrottle struct {
+	threshold int
+	window    time.Duration
+	delay     time.Duration
+	ban       time.Duration
+
+	mu     sync.Mutex
+	addrs  map[string]*authFailures
+	pruned time.Time
+}
+
+func newAuthThrottle(threshold int, window, delay, ban time.Duration) *authThrottle {
+	return &authThrottle{
+		threshold: threshold,
+		window:    window,
+		delay:     delay,
+		ban:       ban,
+		addrs:     map[string]*authFailures{},
+	}
+}
+
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// banned returns how long the address of r stays banned, or 0.
+func (t *authThrottle) banned(r *http.Request, now time.Time) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.addrs[clientHost(r)]
+	if !ok || !now.Before(f.banUntil) {
+		return 0
+	}
+	return f.banUntil.Sub(now)
+}
+
+// failed records a failed authentication from the address of r and returns
+// how long to delay its answer.
+func (t *authThrottle) failed(r *http.Request, now time.Time) time.Duration {
+	if t == nil {
+		return 0
+	}
+	reportEvent(r.Context(), authFailure)
+	host := clientHost(r)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	f, ok := t.addrs[host]
+	if !ok {
+		f = &authFailures{}
+		t.addrs[host] = f
+	}
+	if f.count == 0 || now.Sub(f.first) > t.window {
+		f.count, f.first = 0, now
+	}
+	f.count++
+
+	if t.threshold > 0 && f.count >= t.threshold {
+		ban := t.ban << f.bans
+		if ban <= 0 || ban > maxAuthBan {
+			ban = maxAuthBan
+		}
+		f.bans++
+		f.count = 0
+		f.banUntil = now.Add(ban)
+		reportEvent(r.Context(), authBan)
+		log.Println("banning address after failed authentications", "addr", host, "failures", t.threshold, "until", f.banUntil)
+		return 0
+	}
+	delay := t.delay << (f.count - 1)
+	if delay <= 0 || delay > maxAuthFailureDelay {
+		delay = maxAuthFailureDelay
+	}
+	return delay
+}
+
+// succeeded forgets the failures of the address of r, but not its bans.
+func (t *authThrottle) succeeded(r *http.Request) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.addrs[clientHost(r)]; ok {
+		f.count = 0
+	}
+}
+
+// prune forgets, at most once a window, the addresses without recent
+// failures whose bans, if any, expired long ago. It must be called with the
+// lock held.
+func (t *authThrottle) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.window {
+		return
+	}
+	t.pruned = now
+	for host, f := range t.addrs {
+		if now.Sub(f.first) > t.window && now.Sub(f.banUntil) > maxAuthBan {
+			delete(t.addrs, host)
+		}
+	}
+}
+
+// reject answers a request whose credentials were refused, after the delay
+// its address has earned.
+func (t *authThrottle) reject(w http.ResponseWriter, r *http.Request, msg string) {
+	if delay := t.failed(r, time.Now()); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// rejectBanned answers the requests of banned addresses with 429, and
+// reports whether it did.
+func (t *authThrottle) rejectBanned(w http.ResponseWriter, r *http.Request) bool {
+	wait := t.banned(r, time.Now())
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthThrottleFailures(t *testing.T) {
+	th := newAuthThrottle(4, time.Minute, 100*time.Millisecond, time.Minute)
+	now := time.Now()
+	r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	other := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+
+	steps := []struct {
+		name      string
+		req       *http.Request
+		at        time.Time
+		wantDelay time.Duration
+		wantBan   time.Duration
+	}{
+		{"first failure", r, now, 100 * time.Millisecond, 0},
+		{"second failure", r, now.Add(time.Second), 200 * time.Millisecond, 0},
+		{"other address", other, now.Add(time.Second), 100 * time.Millisecond, 0},
+		{"third failure", r, now.Add(2 * time.Second), 400 * time.Millisecond, 0},
+		{"threshold", r, now.Add(3 * time.Second), 0, time.Minute},
+	}
+	for _, s := range steps {
+		if got := th.failed(s.req, s.at); got != s.wantDelay {
+			t.Errorf("%s: delay = %s, want %s", s.name, got, s.wantDelay)
+		}
+		if got := th.banned(s.req, s.at); got != s.wantBan {
+			t.Errorf("%s: ban = %s, want %s", s.name, got, s.wantBan)
+		}
+	}
+	if got := th.banned(other, now.Add(3*time.Second)); got != 0 {
+		t.Errorf("other address banned for %s", got)
+	}
+	if got := th.banned(r, now.Add(3*time.Second+time.Minute)); got != 0 {
+		t.Errorf("ban not lifted after it expired, %s left", got)
+	}
+}
+
+func TestAuthThrottleBanDoubles(t *testing.T) {
+	th := newAuthThrottle(2, time.Hour, time.Millisecond, time.Minute)
+	now := time.Now()
+	r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		th.failed(r, now)
+		th.failed(r, now)
+		if got := th.banned(r, now); got != want {
+			t.Errorf("ban %d = %s, want %s", i+1, got, want)
+		}
+		now = now.Add(want)
+	}
+}
+
+func TestAuthThrottleSucceeded(t *testing.T) {
+	th := newAuthThrottle(3, time.Minute, 100*time.Millisecond, time.Minute)
+	now := time.Now()
+	r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	th.failed(r, now)
+	th.failed(r, now)
+	th.succeeded(r)
+	if got := th.failed(r, now); got != 100*time.Millisecond {
+		t.Errorf("delay after a success = %s, want the first delay", got)
+	}
+	if got := th.banned(r, now); got != 0 {
+		t.Errorf("banned for %s after a success reset the failures", got)
+	}
+}
+
+func TestAuthThrottleRejectsBanned(t *testing.T) {
+	th := newAuthThrottle(1, time.Minute, time.Millisecond, time.Minute)
+	auth := &authStack{
+		authenticators: []Authenticator{staticAuthenticator{"good": {admin: true}}},
+		throttle:       th,
+	}
+	h := auth.ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	call := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/rpc/v0", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := call("bad"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := call("good")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("good token while banned: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("ban answered without Retry-After")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// defaultBackend is the name of the backend group of the --api nodes, which
+// serves every method not routed to another group.
+const defaultBackend = "default"
+
+// backendRoutes send the methods that match each rule to the backend group
+// at the same index, and else the methods named by methods to their group.
+type backendRoutes struct {
+	rules   methodRules
+	groups  []string
+	methods map[string]string
+}
+
+// backendRouter sends each call to the pool of the backend group its method
+// is routed to.
+type backendRouter struct {
+	routes   backendRoutes
+	groups   map[string]*upstreamPool
+	rewrites paramRewrites
+}
+
+// group returns the backend group that serves calls to method.
+func (r *backendRouter) group(method string) string {
+	if i := r.routes.rules.find(method); i >= 0 {
+		return r.routes.groups[i]
+	}
+	if group, ok := r.routes.methods[method]; ok {
+		return group
+	}
+	return defaultBackend
+}
+
+// pool returns the pool that serves calls to method.
+func (r *backendRouter) pool(method string) *upstreamPool {
+	return r.groups[r.group(method)]
+}
+
+// invoke sends the call to its group, with the params rewritten for it.
+func (r *backendRouter) invoke(ctx context.Context, call *Call) []reflect.Value {
+	group := r.group(call.Method)
+	rewritten, err := r.rewrites.apply(group, call)
+	if err != nil {
+		return call.errorResult(err)
+	}
+	return r.groups[group].invoke(ctx, rewritten)
+}
+
+// load returns the number of calls being answered and subscriptions open
+// across the upstreams of every group, including those draining.
+func (r *backendRouter) load() (calls, streams int) {
+	count := func(upstreams []*upstream) {
+		for _, u := range upstreams {
+			calls += int(atomic.LoadInt32(&u.inflight))
+			streams += int(atomic.LoadInt32(&u.streams))
+		}
+	}
+	for _, p := range r.groups {
+		count(p.all())
+		count(p.draining())
+	}
+	return calls, streams
+}
+
+// setAuthToken replaces the token of the upstreams of every group given
+// without one.
+func (r *backendRouter) setAuthToken(token string) {
+	for _, p := range r.groups {
+		p.setAuthToken(token)
+	}
+}
+
+func (r *backendRouter) close() {
+	for _, p := range r.groups {
+		p.close()
+	}
+}
+
+// parseBackendGroups parses values of the form <group>=<api>, where api takes
+// the same forms as --api, into the nodes of each group.
+func parseBackendGroups(values []string) (map[string][]apiInfo, error) {
+	groups := map[string][]apiInfo{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid backend group %q, expected <group>=<api>", v)
+		}
+		if parts[0] == defaultBackend {
+			return nil, fmt.Errorf("backend group %q is reserved for the --api nodes", defaultBackend)
+		}
+		api, err := parseAPIInfo(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		groups[parts[0]] = append(groups[parts[0]], api)
+	}
+	return groups, nil
+}
+
+// parseBackendRoutes parses values of the form <method rule>=<group>. The
+// group must be defaultBackend or one of groups.
+func parseBackendRoutes(values []string, groups map[string][]apiInfo) (backendRoutes, error) {
+	var routes backendRoutes
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return backendRoutes{}, fmt.Errorf("invalid backend route %q, expected <method rule>=<group>", v)
+		}
+		rule, err := parseMethodRule(parts[0])
+		if err != nil {
+			return backendRoutes{}, err
+		}
+		if _, ok := groups[parts[1]]; !ok && parts[1] != defaultBackend {
+			return backendRoutes{}, fmt.Errorf("backend route %q names unknown group %q", v, parts[1])
+		}
+		routes.rules = append(routes.rules, rule)
+		routes.groups = append(routes.groups, parts[1])
+	}
+	return routes, nil
+}
+
+// fullNodeBackend is the backend group serving the methods of the full node
+// api under --serve-fullnode.
+const fullNodeBackend = "fullnode"
+
+// serveFullNode adds the --fullnode-api node to the fullnode backend group,
+// unless it is given with --backend-group, and returns the routes of the
+// methods of the full node api the miner api lacks to that group, so that
+// one endpoint serves both apis.
+func serveFullNode(api apiInfo, groups map[string][]apiInfo) map[string]string {
+	if _, ok := groups[fullNodeBackend]; !ok {
+		// The calls reaching the node are v1 calls, whichever endpoint of
+		// the proxy they were made on.
+		if api.path == "" {
+			api.path = "/rpc/v1"
+		}
+		groups[fullNodeBackend] = []apiInfo{api}
+	}
+	methods := map[string]string{}
+	for method := range apiOnlyMethods(&lotusapi.FullNodeStruct{}, &lotusapi.StorageMinerStruct{}) {
+		methods[method] = fullNodeBackend
+	}
+	return methods
+}
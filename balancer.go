@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// balancer chooses which of a set of candidate upstreams serves a call. Both
+// balancers honour the effective weight of each upstream.
+type balancer interface {
+	choose(candidates []*upstream) *upstream
+}
+
+func newBalancer(name string) (balancer, error) {
+	switch name {
+	case "round-robin":
+		return &roundRobinBalancer{current: map[*upstream]int{}}, nil
+	case "latency":
+		return &latencyBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", name)
+	}
+}
+
+// roundRobinBalancer rotates through the candidates using smooth weighted
+// round robin, which interleaves upstreams in proportion to their weights.
+// With equal weights it is plain round robin.
+type roundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[*upstream]int
+}
+
+func (b *roundRobinBalancer) choose(candidates []*upstream) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *upstream
+	total := 0
+	for _, u := range candidates {
+		w := u.effectiveWeight()
+		total += w
+		b.current[u] += w
+		if best == nil || b.current[u] > b.current[best] {
+			best = u
+		}
+	}
+	if total == 0 {
+		return candidates[0]
+	}
+	b.current[best] -= total
+	return best
+}
+
+// latencyBalancer samples two candidates at random, in proportion to their
+// weights, and chooses the one with the lower average latency. This favours
+// fast upstreams without sending every call to a single node.
+type latencyBalancer struct{}
+
+func (b *latencyBalancer) choose(candidates []*upstream) *upstream {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i := weightedIndex(candidates, -1)
+	j := weightedIndex(candidates, i)
+	if j < 0 {
+		return candidates[i]
+	}
+
+	if candidates[j].latency.value() < candidates[i].latency.value() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// weightedIndex returns the index of a candidate chosen at random in
+// proportion to weight, skipping the candidate at exclude. It returns the
+// first eligible candidate when all weights are zero and -1 when there is
+// none.
+func weightedIndex(candidates []*upstream, exclude int) int {
+	total := 0
+	first := -1
+	for i, u := range candidates {
+		if i == exclude {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		total += u.effectiveWeight()
+	}
+	if total == 0 {
+		return first
+	}
+
+	n := rand.Intn(total)
+	for i, u := range candidates {
+		if i == exclude {
+			continue
+		}
+		if n -= u.effectiveWeight(); n < 0 {
+			return i
+		}
+	}
+	return first
+}
+
+// ewmaDecay is the weight given to each new observation.
+const ewmaDecay = 0.3
+
+// ewma is an exponentially weighted moving average.
+type ewma struct {
+	mu  sync.Mutex
+	avg float64
+	set bool
+}
+
+func (e *ewma) observe(v float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.set {
+		e.avg = v
+		e.set = true
+		return
+	}
+	e.avg = ewmaDecay*v + (1-ewmaDecay)*e.avg
+}
+
+func (e *ewma) value() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.avg
+}
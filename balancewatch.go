@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"go.opencensus.io/tag"
+)
+
+// balanceWatch is an address whose balance must stay above a minimum.
+type balanceWatch struct {
+	addr address.Address
+	min  types.BigInt
+	low  bool
+}
+
+// balanceAlert is published when a watched balance crosses its minimum.
+type balanceAlert struct {
+	Address address.Address `json:"address"`
+	Balance types.FIL       `json:"balance"`
+	Minimum types.FIL       `json:"minimum"`
+}
+
+// parseBalanceWatches parses values of the form <address>=<minimum FIL>.
+func parseBalanceWatches(values []string) ([]*balanceWatch, error) {
+	var watches []*balanceWatch
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid balance watch %q, expected <address>=<minimum FIL>", v)
+		}
+		addr, err := address.NewFromString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance watch address %q: %w", parts[0], err)
+		}
+		min, err := types.ParseFIL(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance watch minimum %q: %w", parts[1], err)
+		}
+		watches = append(watches, &balanceWatch{
+			addr: addr,
+			min:  types.BigInt(min),
+		})
+	}
+	return watches, nil
+}
+
+// balanceWatcher checks the balance of each watched address on every new
+// head, reporting it as a metric and publishing an event whenever a balance
+// falls below or recovers above its minimum.
+type balanceWatcher struct {
+	api     lotusapi.FullNode
+	events  *eventBus
+	watches []*balanceWatch
+}
+
+func newBalanceWatcher(api lotusapi.FullNode, events *eventBus, watches []*balanceWatch) *balanceWatcher {
+	return &balanceWatcher{
+		api:     api,
+		events:  events,
+		watches: watches,
+	}
+}
+
+// onHead is registered with the chain follower.
+func (w *balanceWatcher) onHead(ctx context.Context, prev, head *types.TipSet) {
+	for _, bw := range w.watches {
+		act, err := w.api.StateGetActor(ctx, bw.addr, head.Key())
+		if err != nil {
+			log.Println("failed to get watched balance", "address", bw.addr, "error", err)
+			continue
+		}
+
+		low := types.BigCmp(act.Balance, bw.min) < 0
+
+		mctx, _ := tag.New(ctx, tag.Upsert(addressTag, bw.addr.String()))
+		reportMeasurement(mctx, walletBalance.M(attoFilToFil(act.Balance)))
+		lowValue := int64(0)
+		if low {
+			lowValue = 1
+		}
+		reportMeasurement(mctx, walletBalanceLow.M(lowValue))
+
+		if low == bw.low {
+			continue
+		}
+		bw.low = low
+
+		typ := "balance.recovered"
+		if low {
+			typ = "balance.low"
+		}
+		w.events.publish(typ, balanceAlert{
+			Address: bw.addr,
+			Balance: types.FIL(act.Balance),
+			Minimum: types.FIL(bw.min),
+		})
+	}
+}
+
+func attoFilToFil(v types.BigInt) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(v.Int), big.NewFloat(1e18)).Float64()
+	return f
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/tag"
+)
+
+// boostMethods are the methods of the boost api served, with the permission
+// boost itself requires for them: the deal and ask lookups deal-making
+// partners need. Deals are looked up with admin permission, which tokens
+// minted for the BoostDeal methods stand in for.
+var boostMethods = map[string]string{
+	"BoostDeal":                    "admin",
+	"BoostDealBySignedProposalCid": "admin",
+	"MarketGetAsk":                 "read",
+	"MarketGetRetrievalAsk":        "read",
+	"MarketListIncompleteDeals":    "read",
+	"MarketListRetrievalDeals":     "read",
+	"ActorSectorSize":              "read",
+	"Version":                      "read",
+}
+
+// boostNode is a boost node served through the proxy, so that its deal state
+// can be queried on the same endpoint as chain data. The proxy has no types
+// for the boost api, so calls are forwarded as they are.
+type boostNode struct {
+	url       string
+	header    http.Header
+	namespace string
+	acls      methodACLs
+	cache     *responseCache
+	ttl       time.Duration // 0 to not cache
+	calls     rawCalls
+}
+
+func newBoostNode(authToken string, api apiInfo, acls methodACLs, ttl time.Duration) *boostNode {
+	header := http.Header{}
+	if authToken != "" {
+		header.Set("Authorization", "Bearer "+authToken)
+	}
+	return &boostNode{
+		url:       httpRPCURL(api),
+		header:    header,
+		namespace: api.rpcNamespace(),
+		acls:      acls,
+		cache:     newResponseCache(),
+		ttl:       ttl,
+	}
+}
+
+// permits checks the token of r may call method.
+func (b *boostNode) permits(r *http.Request, method string) error {
+	perm, ok := boostMethods[method]
+	if !ok {
+		return fmt.Errorf("%s is not served for boost: %w", method, errTokenScope)
+	}
+	if g := grantFrom(r.Context()); g != nil {
+		if !g.rules.match(method) {
+			return fmt.Errorf("%s: %w", method, errTokenScope)
+		}
+	} else if p := jwtPayloadFrom(r.Context()); p != nil && !p.allows(perm) {
+		return fmt.Errorf("%s needs %s permission: %w", method, perm, errTokenScope)
+	}
+	if !b.acls.permits(r.Context(), method) {
+		return fmt.Errorf("%s: %w", method, errTokenScope)
+	}
+	return nil
+}
+
+// ServeHTTP answers the posted calls to boostMethods, passed through calls,
+// from the cache when it holds their result.
+func (b *boostNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, req, err := peekRawRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req == nil {
+		http.Error(w, "boost calls must be posted one at a time", http.StatusBadRequest)
+		return
+	}
+	method := strings.TrimPrefix(req.Method, b.namespace+".")
+	mctx, _ := tag.New(r.Context(), tag.Upsert(methodTag, method))
+	reportEvent(mctx, rpcRequest)
+	if err := b.permits(r, method); err != nil {
+		writeRPCError(w, http.StatusForbidden, codeForbidden, err)
+		return
+	}
+	b.calls.serve(w, r, req, method, boostMethods[method], func(ctx context.Context) (json.RawMessage, error) {
+		return b.answer(ctx, w, method, body, req)
+	})
+}
+
+// answer writes the response to the call of req to method, from the cache
+// when it holds its result, and returns the result or error.
+func (b *boostNode) answer(ctx context.Context, w http.ResponseWriter, method string, body []byte, req *rawRequest) (json.RawMessage, error) {
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	var key string
+	if b.ttl > 0 {
+		key, _ = rawCacheKey(method, req.Params)
+	}
+	if key != "" {
+		cctx, _ := tag.New(cacheContext(ctx, "boost"), tag.Upsert(methodTag, method))
+		reportEvent(cctx, getRequest)
+		if result, ok := b.cache.getRaw(key); ok {
+			reportEvent(cctx, getHit)
+			writeRawResult(w, req.ID, result)
+			return result, nil
+		}
+	}
+
+	status, resp, err := postRaw(ctx, b.url, b.header.Clone(), body)
+	if err != nil && clientGone(ctx) {
+		reportEvent(mctx, rpcCanceled)
+		return nil, err
+	}
+	if err != nil {
+		reportEvent(mctx, rpcFailure)
+		log.Println("boost call failed", "method", method, "error", err)
+		writeRPCError(w, http.StatusBadGateway, codeTransport, err)
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+
+	result, err := rawOutcome(resp)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("boost call answered with status %d", status)
+	}
+	if err != nil {
+		reportEvent(mctx, rpcFailure)
+		return nil, err
+	}
+	if key != "" && len(result) > 0 {
+		b.cache.putRaw(key, result, b.ttl)
+	}
+	return result, nil
+}
+
+// route registers the boost api under /boost/.
+func (b *boostNode) route(r *mux.Router) {
+	r.Handle("/boost/rpc/v0", b)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// breakerConfig configures the circuit breaker of each upstream.
+type breakerConfig struct {
+	maxFailures int           // consecutive failures that open the breaker, zero disables it
+	errorRate   float64       // failure ratio within a window that opens the breaker
+	minRequests int           // requests within a window before the error rate applies
+	window      time.Duration // length of the error rate window
+	openTimeout time.Duration // time the breaker stays open before probing
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker stops calls to an upstream that keeps failing. It opens
+// after too many consecutive failures or too high an error rate, rejects
+// calls while open and, once the open timeout has passed, lets a single
+// probe call through to decide whether to close again. The outcomes of calls
+// allowed before the last change of state are ignored, so that calls made
+// while closed cannot decide the probe or trip the breaker again.
+type circuitBreaker struct {
+	cfg  breakerConfig
+	addr string // of the upstream, tagging the status metric
+
+	mu          sync.Mutex
+	state       breakerState
+	generation  uint64 // changes of state so far
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+func newCircuitBreaker(cfg breakerConfig, addr string) *circuitBreaker {
+	if cfg.maxFailures <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		cfg:         cfg,
+		addr:        addr,
+		windowStart: time.Now(),
+	}
+}
+
+// ready reports whether a call would currently be allowed, without
+// reserving the probe of a half open breaker. A nil breaker is always ready.
+func (b *circuitBreaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.cfg.openTimeout
+	case breakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// allow reports whether a call may proceed, and the generation of the state
+// it was allowed in. Callers that are allowed must report the outcome with
+// record, or abandon, given that generation.
+func (b *circuitBreaker) allow() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.openTimeout {
+			return 0, false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return b.generation, true
+	case breakerHalfOpen:
+		if b.probing {
+			return 0, false
+		}
+		b.probing = true
+		return b.generation, true
+	default:
+		return b.generation, true
+	}
+}
+
+// record reports the outcome of a call allowed in generation.
+func (b *circuitBreaker) record(generation uint64, ok bool) {
+	if b == nil {
+		return
+	}
+	ctx := context.Background()
+	reportEvent(ctx, circuitRequest)
+	if !ok {
+		reportEvent(ctx, circuitFailure)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if ok {
+			b.reset()
+			b.setState(breakerClosed)
+		} else {
+			b.trip()
+		}
+		return
+	}
+
+	if time.Since(b.windowStart) > b.cfg.window {
+		b.requests, b.failures = 0, 0
+		b.windowStart = time.Now()
+	}
+	b.requests++
+	if ok {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.consecutive >= b.cfg.maxFailures ||
+		(b.requests >= b.cfg.minRequests && float64(b.failures)/float64(b.requests) >= b.cfg.errorRate) {
+		b.trip()
+	}
+}
+
+// abandon releases a call that was allowed but ended without an outcome,
+// such as one cancelled by the client.
+func (b *circuitBreaker) abandon(generation uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation == b.generation && b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) stateName() string {
+	if b == nil {
+		return "disabled"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// trip opens the breaker and must be called with the lock held.
+func (b *circuitBreaker) trip() {
+	b.reset()
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) reset() {
+	b.consecutive, b.requests, b.failures = 0, 0, 0
+	b.windowStart = time.Now()
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	b.generation++
+	status := int64(0)
+	if s == breakerOpen {
+		status = 1
+	}
+	reportMeasurement(upstreamContext(context.Background(), b.addr), circuitStatus.M(status))
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// responseCache holds the results of proxied calls keyed by method and params.
+// Results are held both as typed values, for calls made through the proxied
+// API, and as the raw JSON served to http clients. With a codec, typed values
+// are stored encoded and decoded on each hit.
+type responseCache struct {
+	revalidate *revalidator // optional
+	codec      cacheCodec   // optional
+	learn      *ttlLearner  // optional
+	pins       []string     // patterns of keys that are never dropped
+	maxEntries int          // of entries and raw together, 0 for no cap
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	raw     map[string]rawEntry
+	flights map[string]*flight
+	sweptAt time.Time // when expired entries were last dropped
+}
+
+// cacheSweepInterval is how often a cache drops the expired entries no get
+// has dropped, on the next put.
+const cacheSweepInterval = time.Minute
+
+// cacheMaxEntries caps the entries of each cache created, set by
+// --cache-max-entries.
+var cacheMaxEntries = 100000
+
+type cacheEntry struct {
+	results []reflect.Value
+	data    []byte       // encoded result value, replacing results when set
+	typ     reflect.Type // type of the encoded result value
+	expires time.Time
+	ttl     time.Duration
+	pinned  bool                      // kept past expiry and refreshed ahead of it
+	hits    int64                     // gets served since the entry was filled
+	refill  func(ctx context.Context) // repeats the call that filled the entry
+	tipSets []types.TipSetKey         // fixing the result, which is then immutable
+}
+
+// flight is a fill of a key from upstream that concurrent misses wait for.
+type flight struct {
+	done      chan struct{}
+	results   []reflect.Value
+	abandoned bool // by the client that made the fill
+}
+
+type rawEntry struct {
+	result  json.RawMessage
+	expires time.Time
+	hits    int64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		maxEntries: cacheMaxEntries,
+		entries:    map[string]*cacheEntry{},
+		raw:        map[string]rawEntry{},
+		flights:    map[string]*flight{},
+	}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (c *responseCache) get(key string) ([]reflect.Value, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	if time.Now().After(e.expires) && !e.pinned {
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+	e.hits++
+	c.mu.Unlock()
+
+	if e.data == nil {
+		return e.results, true
+	}
+	v, err := c.codec.decode(e.data, e.typ)
+	if err != nil {
+		log.Println("failed to decode cached result", "key", key, "error", err)
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return []reflect.Value{v, reflect.Zero(errorType)}, true
+}
+
+// contains reports whether key holds an unexpired entry without counting a
+// hit.
+func (c *responseCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return ok && time.Now().Before(e.expires)
+}
+
+// len returns the number of typed and raw entries held, including expired
+// ones not yet dropped.
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries) + len(c.raw)
+}
+
+// containsRaw reports whether key holds an unexpired raw entry without
+// counting a hit.
+func (c *responseCache) containsRaw(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.raw[key]
+	return ok && time.Now().Before(e.expires)
+}
+
+// put caches results for key. tipSets are those named by the call when they
+// fix its results.
+func (c *responseCache) put(key string, results []reflect.Value, ttl time.Duration, refill func(ctx context.Context), tipSets []types.TipSetKey) {
+	e := &cacheEntry{
+		results: results,
+		expires: time.Now().Add(ttl),
+		ttl:     ttl,
+		pinned:  c.isPinned(key),
+		refill:  refill,
+		tipSets: tipSets,
+	}
+	if c.codec != nil && len(results) == 2 {
+		data, err := c.codec.encode(results[0].Interface())
+		if err != nil {
+			log.Println("failed to encode result for cache", "key", key, "error", err)
+		} else {
+			e.results, e.data, e.typ = nil, data, results[0].Type()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+	c.trim(time.Now())
+}
+
+// trim drops the expired entries every cacheSweepInterval, and the entries
+// closest to expiry while the cache holds more than maxEntries, leaving a
+// tenth of it free so that a full cache is not scanned on every put. Pinned
+// entries are never dropped. It must be called with the lock held.
+func (c *responseCache) trim(now time.Time) {
+	over := c.maxEntries > 0 && len(c.entries)+len(c.raw) > c.maxEntries
+	if !over && now.Sub(c.sweptAt) < cacheSweepInterval {
+		return
+	}
+	c.sweptAt = now
+	for key, e := range c.entries {
+		if !e.pinned && now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key, e := range c.raw {
+		if now.After(e.expires) {
+			delete(c.raw, key)
+		}
+	}
+	if c.maxEntries == 0 || len(c.entries)+len(c.raw) <= c.maxEntries {
+		return
+	}
+
+	type victim struct {
+		key     string
+		raw     bool
+		expires time.Time
+	}
+	victims := make([]victim, 0, len(c.entries)+len(c.raw))
+	for key, e := range c.entries {
+		if !e.pinned {
+			victims = append(victims, victim{key: key, expires: e.expires})
+		}
+	}
+	for key, e := range c.raw {
+		victims = append(victims, victim{key: key, raw: true, expires: e.expires})
+	}
+	sort.Slice(victims, func(i, j int) bool {
+		return victims[i].expires.Before(victims[j].expires)
+	})
+	n := len(c.entries) + len(c.raw) - c.maxEntries + c.maxEntries/10
+	if n > len(victims) {
+		n = len(victims)
+	}
+	for _, v := range victims[:n] {
+		if v.raw {
+			delete(c.raw, v.key)
+		} else {
+			delete(c.entries, v.key)
+		}
+	}
+	log.Println("cache full, dropped the entries closest to expiry", "dropped", n, "max", c.maxEntries)
+}
+
+// fill calls fn to fetch the results for key, sharing a single call between
+// concurrent fills of the same key so that a burst of misses reaches
+// upstream once. When the client of the shared call goes away, those
+// waiting for it fill the key again rather than fail with it.
+func (c *responseCache) fill(ctx context.Context, key string, fn func() []reflect.Value) []reflect.Value {
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		if f.abandoned && ctx.Err() == nil {
+			return c.fill(ctx, key, fn)
+		}
+		return f.results
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	f.results = fn()
+	f.abandoned = resultError(f.results) != nil && clientGone(ctx)
+	return f.results
+}
+
+func (c *responseCache) getRaw(key string) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.raw[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.raw, key)
+		return nil, false
+	}
+	e.hits++
+	c.raw[key] = e
+	return e.result, true
+}
+
+func (c *responseCache) putRaw(key string, result json.RawMessage, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.raw[key] = rawEntry{
+		result:  result,
+		expires: time.Now().Add(ttl),
+	}
+	c.trim(time.Now())
+}
+
+// hot returns the keys of at most n unexpired entries that were hit, the most
+// hit first.
+func (c *responseCache) hot(n int) []string {
+	c.mu.Lock()
+	hits := map[string]int64{}
+	now := time.Now()
+	for key, e := range c.entries {
+		if e.hits > 0 && now.Before(e.expires) {
+			hits[key] += e.hits
+		}
+	}
+	for key, e := range c.raw {
+		if e.hits > 0 && now.Before(e.expires) {
+			hits[key] += e.hits
+		}
+	}
+	c.mu.Unlock()
+
+	keys := make([]string, 0, len(hits))
+	for key := range hits {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return hits[keys[i]] > hits[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// export returns the JSON encoded result held for key and the time left
+// before it expires.
+func (c *responseCache) export(key string) (json.RawMessage, time.Duration, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.raw[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.result, e.expires.Sub(now), true
+	}
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || !now.Before(e.expires) {
+		return nil, 0, false
+	}
+
+	var v interface{}
+	switch {
+	case e.data != nil:
+		dv, err := c.codec.decode(e.data, e.typ)
+		if err != nil {
+			return nil, 0, false
+		}
+		v = dv.Interface()
+	case len(e.results) == 2:
+		v = e.results[0].Interface()
+	default:
+		return nil, 0, false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, 0, false
+	}
+	return b, e.expires.Sub(now), true
+}
+
+// immutable returns the keys of the unexpired entries whose results are fixed
+// by the tipsets they name, starting with prefix, with those tipsets.
+func (c *responseCache) immutable(prefix string) map[string][]types.TipSetKey {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := map[string][]types.TipSetKey{}
+	for key, e := range c.entries {
+		if len(e.tipSets) > 0 && strings.HasPrefix(key, prefix) && now.Before(e.expires) {
+			keys[key] = e.tipSets
+		}
+	}
+	return keys
+}
+
+// invalidatePrefix removes all entries whose key starts with prefix. Removed
+// entries that were hit are queued for revalidation when a revalidator is
+// configured.
+func (c *responseCache) invalidatePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+			n++
+			switch {
+			case e.refill == nil:
+			case e.pinned:
+				go c.refresh(context.Background(), key, e)
+			case c.revalidate != nil && e.hits > 0:
+				key, refill := key, e.refill
+				c.revalidate.add(key, e.hits, func(ctx context.Context) {
+					if !c.contains(key) {
+						refill(ctx)
+					}
+				})
+			}
+		}
+	}
+	for key := range c.raw {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.raw, key)
+			n++
+		}
+	}
+	return n
+}
+
+// isPinned reports whether key matches one of the pinned patterns.
+func (c *responseCache) isPinned(key string) bool {
+	for _, pattern := range c.pins {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshPins refreshes pinned entries that are about to expire, so that
+// their keys are always answered from the cache.
+func (c *responseCache) refreshPins(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due := map[string]*cacheEntry{}
+		now := time.Now()
+		c.mu.Lock()
+		for key, e := range c.entries {
+			if e.pinned && e.refill != nil && e.expires.Sub(now) < e.ttl/5 {
+				due[key] = e
+			}
+		}
+		c.mu.Unlock()
+
+		for key, e := range due {
+			c.refresh(ctx, key, e)
+		}
+	}
+}
+
+func (c *responseCache) refresh(ctx context.Context, key string, e *cacheEntry) {
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	defer cancel()
+	e.refill(ctx)
+	if !c.contains(key) {
+		log.Println("failed to refresh pinned cache entry", "key", key)
+	}
+}
+
+// cacheKey returns the key used to cache a call to method with params.
+func cacheKey(method string, params []interface{}) (string, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return method + ":" + string(b), nil
+}
+
+// methodPrefix returns the key prefix shared by all cached calls to method.
+func methodPrefix(method string) string {
+	return method + ":"
+}
+
+// cachingInterceptor serves calls to the read-only methods listed in ttls
+// from the cache, filling it from upstream on a miss. Calls to other methods
+// whose answer is fixed by the tipsets they name are cached for tipSetTTL,
+// when it is not 0. Failed calls are not cached.
+func cachingInterceptor(cache *responseCache, name string, ttls map[string]time.Duration, tipSetTTL time.Duration) Interceptor {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, call *Call) []reflect.Value {
+			ttl, ok := ttls[call.Method]
+			pinned := false
+			if !ok && tipSetTTL > 0 && call.tipSetPinned() {
+				ttl, ok, pinned = tipSetTTL, true, true
+			}
+			if !ok || !call.readOnly() {
+				return next(ctx, call)
+			}
+
+			key, err := cacheKey(call.Method, call.Params())
+			if err != nil {
+				return next(ctx, call)
+			}
+
+			mctx := cacheContext(ctx, name)
+			reportEvent(mctx, getRequest)
+			stop := startTimer(mctx, getDuration)
+			defer stop()
+
+			info := callInfoFrom(ctx)
+			if results, ok := cache.get(key); ok {
+				reportEvent(mctx, getHit)
+				info.setCache("hit")
+				return results
+			}
+			// Results filled over http, or fetched from a peer replica, are
+			// held as raw JSON only.
+			if raw, ok := cache.getRaw(key); ok && call.Type.NumOut() == 2 {
+				if v, err := (jsonCodec{}).decode(raw, call.Type.Out(0)); err == nil {
+					reportEvent(mctx, getHit)
+					info.setCache("hit")
+					return []reflect.Value{v, reflect.Zero(errorType)}
+				}
+			}
+			reportEvent(mctx, getMiss)
+			info.setCache("miss")
+
+			var fill func(ctx context.Context) []reflect.Value
+			refill := func(ctx context.Context) {
+				fill(ctx)
+			}
+			fill = func(ctx context.Context) []reflect.Value {
+				return cache.fill(ctx, key, func() []reflect.Value {
+					results := next(ctx, call)
+					if resultError(results) == nil {
+						ttl := ttl
+						if cache.learn != nil && !pinned {
+							ttl = cache.learn.observe(call.Method, key, results, ttl)
+						}
+						var tipSets []types.TipSetKey
+						if pinned {
+							tipSets = call.tipSetKeys()
+						}
+						cache.put(key, results, ttl, refill, tipSets)
+					}
+					return results
+				})
+			}
+
+			results := fill(ctx)
+			if err := resultError(results); err != nil {
+				reportEvent(mctx, getFailure)
+			}
+			return results
+		}
+	}
+}
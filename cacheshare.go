@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// maxSharedEntrySize bounds the size of an imported cache entry.
+const maxSharedEntrySize = 64 << 20
+
+// sharedEntry is an immutable cache entry exported to another proxy.
+type sharedEntry struct {
+	Key    string          `json:"key"`
+	Result json.RawMessage `json:"result"`
+	Epoch  int64           `json:"epoch,omitempty"` // of the latest tipset the entry names, when known
+}
+
+// epochRange selects entries by the epoch of their tipsets. A bound of -1 is
+// open.
+type epochRange struct {
+	from, to int64
+}
+
+func (e epochRange) open() bool {
+	return e.from < 0 && e.to < 0
+}
+
+func (e epochRange) contains(epoch int64) bool {
+	return (e.from < 0 || epoch >= e.from) && (e.to < 0 || epoch <= e.to)
+}
+
+// tipSetHeights resolves the epochs of tipsets through a full node,
+// remembering them as they never change.
+type tipSetHeights struct {
+	api lotusapi.FullNode
+
+	mu      sync.Mutex
+	heights map[types.TipSetKey]abi.ChainEpoch
+}
+
+func newTipSetHeights(api lotusapi.FullNode) *tipSetHeights {
+	return &tipSetHeights{api: api, heights: map[types.TipSetKey]abi.ChainEpoch{}}
+}
+
+func (h *tipSetHeights) height(ctx context.Context, tsk types.TipSetKey) (abi.ChainEpoch, error) {
+	h.mu.Lock()
+	height, ok := h.heights[tsk]
+	h.mu.Unlock()
+	if ok {
+		return height, nil
+	}
+	ts, err := h.api.ChainGetTipSet(ctx, tsk)
+	if err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	h.heights[tsk] = ts.Height()
+	h.mu.Unlock()
+	return ts.Height(), nil
+}
+
+// cacheExport serves the immutable entries of a cache to the proxies of other
+// environments, so that a staging proxy starts with the historical results of
+// production rather than deriving them again from its own node.
+type cacheExport struct {
+	cache   *responseCache
+	heights *tipSetHeights // optional, needed to select entries by epoch
+}
+
+// ServeHTTP writes the immutable entries whose key starts with the prefix
+// parameter, and whose tipsets are within the from and to epochs when given,
+// as JSON lines.
+func (e *cacheExport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p := jwtPayloadFrom(r.Context()); p != nil && !p.allows("admin") {
+		http.Error(w, "exporting the cache needs admin permission", http.StatusForbidden)
+		return
+	}
+	epochs := epochRange{from: -1, to: -1}
+	for name, bound := range map[string]*int64{"from": &epochs.from, "to": &epochs.to} {
+		v := r.FormValue(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, name+" must be a non-negative epoch", http.StatusBadRequest)
+			return
+		}
+		*bound = n
+	}
+	if !epochs.open() && e.heights == nil {
+		http.Error(w, "selecting entries by epoch needs --fullnode-api", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for key, tipSets := range e.cache.immutable(r.FormValue("prefix")) {
+		entry := sharedEntry{Key: key}
+		if !epochs.open() {
+			epoch, err := e.epoch(r.Context(), tipSets)
+			if err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				log.Println("failed to resolve tipset of cache entry", "key", key, "error", err)
+				continue
+			}
+			if !epochs.contains(epoch) {
+				continue
+			}
+			entry.Epoch = epoch
+		}
+		result, _, ok := e.cache.export(key)
+		if !ok {
+			continue
+		}
+		entry.Result = result
+		if err := enc.Encode(entry); err != nil {
+			return
+		}
+	}
+}
+
+// epoch returns the epoch of the latest of tipSets.
+func (e *cacheExport) epoch(ctx context.Context, tipSets []types.TipSetKey) (int64, error) {
+	var epoch int64
+	for _, tsk := range tipSets {
+		h, err := e.heights.height(ctx, tsk)
+		if err != nil {
+			return 0, err
+		}
+		if int64(h) > epoch {
+			epoch = int64(h)
+		}
+	}
+	return epoch, nil
+}
+
+// cacheImport pulls the immutable entries another proxy exports into a
+// cache, holding them for ttl.
+type cacheImport struct {
+	cache    *responseCache
+	base     string // url of the exporting proxy
+	token    string // admin token of the exporting proxy
+	prefixes []string
+	epochs   epochRange
+	ttl      time.Duration
+	client   *http.Client
+}
+
+// run imports the entries of each prefix, or of all keys when none is
+// given, and returns the number imported.
+func (i *cacheImport) run(ctx context.Context) (int, error) {
+	prefixes := i.prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	n := 0
+	for _, prefix := range prefixes {
+		m, err := i.pull(ctx, prefix)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (i *cacheImport) pull(ctx context.Context, prefix string) (int, error) {
+	q := url.Values{"prefix": {prefix}}
+	if i.epochs.from >= 0 {
+		q.Set("from", strconv.FormatInt(i.epochs.from, 10))
+	}
+	if i.epochs.to >= 0 {
+		q.Set("to", strconv.FormatInt(i.epochs.to, 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(i.base, "/")+"/admin/cache/export?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+i.token)
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("export answered %s", resp.Status)
+	}
+
+	n := 0
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxSharedEntrySize)
+	for scanner.Scan() {
+		var e sharedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("decode cache entry: %w", err)
+		}
+		if e.Key == "" || len(e.Result) == 0 || i.cache.contains(e.Key) || i.cache.containsRaw(e.Key) {
+			continue
+		}
+		i.cache.putRaw(e.Key, e.Result, i.ttl)
+		n++
+	}
+	return n, scanner.Err()
+}
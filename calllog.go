@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// callLogFlushInterval bounds how long entries of the call log stay
+// buffered before they reach the file.
+const callLogFlushInterval = time.Second
+
+// builtinRedactedMethods take params that must never be written to the call
+// log, such as private keys and the data given to sign.
+var builtinRedactedMethods = []string{
+	"Auth*",
+	"Wallet*",
+	"*Import*",
+	"*Export*",
+}
+
+// callLogEntry records one call made through the proxy.
+type callLogEntry struct {
+	Time       time.Time       `json:"time"`
+	Identity   string          `json:"identity,omitempty"` // owner of the token, if any
+	Remote     string          `json:"remote,omitempty"`   // address of the client
+	Method     string          `json:"method"`
+	ParamsHash string          `json:"params_hash,omitempty"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Redacted   bool            `json:"redacted,omitempty"`
+	Status     string          `json:"status"` // ok, error or canceled
+	Error      string          `json:"error,omitempty"`
+	LatencyMs  float64         `json:"latency_ms"`
+}
+
+// callLog appends an entry for every call to a file of JSON lines, so that
+// who made a call, such as the push of a message, can be found after an
+// incident. Its interceptor is also applied to the calls answered from raw
+// JSON. Params are recorded by their hash, and also as they are when
+// withParams is set, except for the methods matching redact.
+type callLog struct {
+	withParams bool
+	redact     methodRules
+
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func newCallLog(path string, withParams bool, redact []string) (*callLog, error) {
+	rules, err := parseMethodRules(append(append([]string{}, builtinRedactedMethods...), redact...))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open call log: %w", err)
+	}
+	return &callLog{
+		withParams: withParams,
+		redact:     rules,
+		f:          f,
+		w:          bufio.NewWriter(f),
+	}, nil
+}
+
+// interceptor records each call once it returns.
+func (l *callLog) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		start := time.Now()
+		results := next(ctx, call)
+		l.record(ctx, call, results, start)
+		return results
+	}
+}
+
+func (l *callLog) record(ctx context.Context, call *Call, results []reflect.Value, start time.Time) {
+	e := callLogEntry{
+		Time:      start.UTC(),
+		Identity:  tokenOwner(ctx),
+		Remote:    sessionFrom(ctx).remoteAddr(),
+		Method:    call.Method,
+		Status:    "ok",
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	// Params that cannot be encoded, such as readers, are left out.
+	if params, err := json.Marshal(call.Params()); err == nil {
+		sum := sha256.Sum256(params)
+		e.ParamsHash = hex.EncodeToString(sum[:])
+		switch {
+		case l.redact.match(call.Method):
+			e.Redacted = true
+		case l.withParams:
+			e.Params = params
+		}
+	}
+	if err := resultError(results); err != nil {
+		e.Status, e.Error = "error", err.Error()
+		if clientGone(ctx) {
+			e.Status = "canceled"
+		}
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(b, '\n'))
+}
+
+// run flushes the buffered entries to the file every callLogFlushInterval.
+func (l *callLog) run(ctx context.Context) {
+	ticker := time.NewTicker(callLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.flush(); err != nil {
+			log.Println("failed to write call log", "error", err)
+		}
+	}
+}
+
+func (l *callLog) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Flush()
+}
+
+// close flushes the buffered entries and closes the file.
+func (l *callLog) close() {
+	if err := l.flush(); err != nil {
+		log.Println("failed to write call log", "error", err)
+	}
+	l.f.Close() //nolint:errcheck
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestCallLogRecordsRawCalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calls.log")
+	l, err := newCallLog(path, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	payload := &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, Allow: []string{"read", "write"}}
+	ctx := context.WithValue(context.Background(), jwtPayloadKey{}, payload)
+	calls := rawCalls{l.interceptor}
+
+	params := json.RawMessage(`["0x02f8", 1]`)
+	err = calls.call(ctx, newRawCall("eth_sendRawTransaction", "write", params), func(ctx context.Context) (json.RawMessage, error) {
+		return json.RawMessage(`"0xabc"`), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = calls.call(ctx, newRawCall("eth_call", permRead, nil), func(ctx context.Context) (json.RawMessage, error) {
+		return nil, errors.New("execution reverted")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	var sent, failed callLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(`["0x02f8",1]`))
+	if sent.Method != "eth_sendRawTransaction" || sent.Identity != "team-a" || sent.Status != "ok" || sent.ParamsHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("entry = %+v, want the ok call of team-a with the hash of its params", sent)
+	}
+	if string(sent.Params) != `["0x02f8",1]` {
+		t.Errorf("params = %s, want those sent", sent.Params)
+	}
+	if failed.Method != "eth_call" || failed.Status != "error" || failed.Error != "execution reverted" {
+		t.Errorf("entry = %+v, want the failed call", failed)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// captureSize bounds the captured calls kept, whatever their age.
+const captureSize = 1000
+
+// captureFlag marks the calls of a token owner, or of the token with a jti,
+// for capture until it expires.
+type captureFlag struct {
+	Owner   string    `json:"owner,omitempty"`
+	JTI     string    `json:"jti,omitempty"` // jti claim, or id of a minted token
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (f captureFlag) key() string {
+	if f.JTI != "" {
+		return "jti " + f.JTI
+	}
+	return "owner " + f.Owner
+}
+
+// capturedCall is a call of a flagged token with its params and result.
+type capturedCall struct {
+	Time      time.Time       `json:"time"`
+	Owner     string          `json:"owner,omitempty"`
+	JTI       string          `json:"jti,omitempty"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Redacted  bool            `json:"redacted,omitempty"`  // params and result left out
+	Truncated bool            `json:"truncated,omitempty"` // params or result cut to the size limit, and no longer JSON
+	LatencyMs float64         `json:"latency_ms"`
+}
+
+// payloadCapture records the full params and results of the calls of
+// flagged tokens, to debug a misbehaving integration without capturing the
+// traffic of everyone, including the calls answered from raw JSON. Flags are set and cleared at runtime through the
+// admin api and recorded in the audit log. Params and results are cut to
+// maxBytes, and captured calls are kept in memory for retention.
+type payloadCapture struct {
+	maxBytes  int
+	retention time.Duration
+	redact    methodRules
+	audit     *auditLog
+
+	mu    sync.Mutex
+	flags map[string]captureFlag // by key
+	calls []capturedCall         // oldest first
+}
+
+func newPayloadCapture(maxBytes int, retention time.Duration, audit *auditLog) *payloadCapture {
+	return &payloadCapture{
+		maxBytes:  maxBytes,
+		retention: retention,
+		redact:    mustParseMethodRules(builtinRedactedMethods),
+		audit:     audit,
+		flags:     map[string]captureFlag{},
+	}
+}
+
+// tokenJTI returns the jti of the token of the request ctx belongs to, or
+// the id of its grant when it was minted by the proxy.
+func tokenJTI(ctx context.Context) string {
+	if g := grantFrom(ctx); g != nil {
+		return g.ID
+	}
+	if p := jwtPayloadFrom(ctx); p != nil {
+		return p.Payload.JWTID
+	}
+	return ""
+}
+
+// flagged reports whether the calls of the token with owner and jti are
+// captured.
+func (c *payloadCapture) flagged(owner, jti string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.flags) == 0 {
+		return false
+	}
+	for _, key := range []string{"owner " + owner, "jti " + jti} {
+		f, ok := c.flags[key]
+		if !ok {
+			continue
+		}
+		if now.Before(f.Expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// interceptor captures the calls of flagged tokens.
+func (c *payloadCapture) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		owner, jti := tokenOwner(ctx), tokenJTI(ctx)
+		if (owner == "" && jti == "") || !c.flagged(owner, jti, time.Now()) {
+			return next(ctx, call)
+		}
+		start := time.Now()
+		results := next(ctx, call)
+
+		e := capturedCall{
+			Time:      start.UTC(),
+			Owner:     owner,
+			JTI:       jti,
+			Method:    call.Method,
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err := resultError(results); err != nil {
+			e.Error = err.Error()
+		}
+		if c.redact.match(call.Method) {
+			e.Redacted = true
+		} else {
+			e.Params = c.limit(call.Params(), &e.Truncated)
+			// Subscription channels are captured as opened, not as their
+			// values, and the results of raw calls streamed to the client,
+			// such as passthrough calls, are left out.
+			if len(results) == 2 && e.Error == "" && !call.returnsChannel() && !streamedRaw(results[0]) {
+				e.Result = c.limit(results[0].Interface(), &e.Truncated)
+			}
+		}
+		c.add(e)
+		return results
+	}
+}
+
+// streamedRaw reports whether result is the missing result of a raw call
+// streamed to the client.
+func streamedRaw(result reflect.Value) bool {
+	raw, ok := result.Interface().(json.RawMessage)
+	return ok && raw == nil
+}
+
+// limit returns v encoded, cut to maxBytes as a JSON string when longer.
+func (c *payloadCapture) limit(v interface{}, truncated *bool) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal("unencodable: " + err.Error())
+	}
+	if len(data) <= c.maxBytes {
+		return data
+	}
+	*truncated = true
+	cut, _ := json.Marshal(string(data[:c.maxBytes]))
+	return cut
+}
+
+func (c *payloadCapture) add(e capturedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, e)
+	c.prune(time.Now())
+}
+
+// prune drops the calls past the retention or the size bound. It must be
+// called with the lock held.
+func (c *payloadCapture) prune(now time.Time) {
+	i := 0
+	for i < len(c.calls) && (now.Sub(c.calls[i].Time) > c.retention || len(c.calls)-i > captureSize) {
+		i++
+	}
+	if i > 0 {
+		c.calls = append([]capturedCall(nil), c.calls[i:]...)
+	}
+}
+
+// flag starts capturing the calls of f until it expires, replacing any flag
+// of the same token.
+func (c *payloadCapture) flag(r *http.Request, f captureFlag) {
+	c.mu.Lock()
+	c.flags[f.key()] = f
+	c.mu.Unlock()
+	c.audit.record(r, "capture-start", "", fmt.Sprintf("%s until %s: %s", f.key(), f.Expires.Format(time.RFC3339), f.Reason))
+
+	time.AfterFunc(time.Until(f.Expires), func() {
+		c.mu.Lock()
+		current, ok := c.flags[f.key()]
+		expired := ok && current.Expires.Equal(f.Expires)
+		if expired {
+			delete(c.flags, f.key())
+		}
+		c.mu.Unlock()
+		if expired {
+			c.audit.record(nil, "capture-end", "", f.key())
+		}
+	})
+}
+
+// unflag stops capturing the calls of the token with key.
+func (c *payloadCapture) unflag(r *http.Request, key string) bool {
+	c.mu.Lock()
+	_, ok := c.flags[key]
+	delete(c.flags, key)
+	c.mu.Unlock()
+	if ok {
+		c.audit.record(r, "capture-stop", "", key)
+	}
+	return ok
+}
+
+// list returns the flags in effect and the calls captured, oldest first.
+func (c *payloadCapture) list() ([]captureFlag, []capturedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(time.Now())
+	flags := make([]captureFlag, 0, len(c.flags))
+	for _, f := range c.flags {
+		flags = append(flags, f)
+	}
+	return flags, append([]capturedCall{}, c.calls...)
+}
+
+var errCaptureFlag = errors.New("exactly one of owner and jti must be given")
+
+// captureRequest is the body of a request to flag a token for capture.
+type captureRequest struct {
+	Owner    string `json:"owner"`
+	JTI      string `json:"jti"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+func (req captureRequest) flag(now time.Time) (captureFlag, error) {
+	if (req.Owner == "") == (req.JTI == "") {
+		return captureFlag{}, errCaptureFlag
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return captureFlag{}, fmt.Errorf("duration must be a positive duration such as 30m")
+	}
+	return captureFlag{Owner: req.Owner, JTI: req.JTI, Reason: req.Reason, Expires: now.Add(d).UTC()}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestPayloadCaptureRawCalls(t *testing.T) {
+	c := newPayloadCapture(64, time.Hour, newAuditLog())
+	c.flag(httptest.NewRequest(http.MethodPost, "/admin/capture", nil), captureFlag{Owner: "team-a", Expires: time.Now().Add(time.Hour)})
+	calls := rawCalls{c.interceptor}
+	flagged := context.WithValue(context.Background(), jwtPayloadKey{}, &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, Allow: []string{"read"}})
+	other := context.WithValue(context.Background(), jwtPayloadKey{}, &jwtPayload{Payload: jwt.Payload{Subject: "team-b"}, Allow: []string{"read"}})
+
+	answers := []struct {
+		ctx    context.Context
+		method string
+		result json.RawMessage
+		err    error
+	}{
+		{flagged, "eth_getBalance", json.RawMessage(`"0x1"`), nil},
+		{other, "eth_getBalance", json.RawMessage(`"0x2"`), nil},
+		{flagged, "eth_call", nil, errors.New("execution reverted")},
+		{flagged, "ExtensionMethod", nil, nil}, // streamed
+	}
+	for _, a := range answers {
+		err := calls.call(a.ctx, newRawCall(a.method, permRead, json.RawMessage(`["0xf00", "latest"]`)), func(ctx context.Context) (json.RawMessage, error) {
+			return a.result, a.err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, captured := c.list()
+	if len(captured) != 3 {
+		t.Fatalf("captured %d calls, want the 3 of team-a", len(captured))
+	}
+	for i, want := range []capturedCall{
+		{Method: "eth_getBalance", Params: json.RawMessage(`["0xf00","latest"]`), Result: json.RawMessage(`"0x1"`)},
+		{Method: "eth_call", Params: json.RawMessage(`["0xf00","latest"]`), Error: "execution reverted"},
+		{Method: "ExtensionMethod", Params: json.RawMessage(`["0xf00","latest"]`)},
+	} {
+		got := captured[i]
+		if got.Owner != "team-a" || got.Method != want.Method || string(got.Params) != string(want.Params) || string(got.Result) != string(want.Result) || got.Error != want.Error {
+			t.Errorf("call %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
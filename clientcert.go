@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// loadListenerTLS returns tls settings for the listener presenting the
+// certificate of certFile and keyFile. With caFile, clients must present a
+// certificate issued by one of its authorities.
+func loadListenerTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load listener certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca bundle: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// clientCertPerms maps the names of client certificates, their common name
+// or one of their subject alternative names, to the lotus permissions calls
+// made with them and without a token are granted. Certificates are verified
+// by the listener, so only their names are checked here.
+type clientCertPerms map[string][]string
+
+// parseClientCertPerms parses values of the form <name>=<permission>, the
+// permission also granting those before it.
+func parseClientCertPerms(values []string) (clientCertPerms, error) {
+	perms := clientCertPerms{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid client certificate permission %q, expected <name>=<permission>", v)
+		}
+		allow, err := permissionsUpTo(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		perms[parts[0]] = allow
+	}
+	return perms, nil
+}
+
+// identify returns the payload granted to the client certificate of a
+// connection, or nil when it has none or its names are not mapped. The
+// payload has the matching name as its subject, so that it is the owner of
+// the calls made with the certificate.
+func (c clientCertPerms) identify(state *tls.ConnectionState) *jwtPayload {
+	if len(c) == 0 || state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, name := range names {
+		if allow, ok := c[name]; ok && name != "" {
+			return &jwtPayload{Payload: jwt.Payload{Subject: name}, Allow: allow}
+		}
+	}
+	return nil
+}
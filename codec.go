@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// cacheCodec encodes the results held by a response cache, trading the CPU
+// spent encoding and decoding them for the memory they take.
+type cacheCodec interface {
+	encode(v interface{}) ([]byte, error)
+	decode(data []byte, typ reflect.Type) (reflect.Value, error)
+}
+
+// newCacheCodec returns the codec with the given name. The "none" codec keeps
+// results as decoded values and is returned as nil. There is no zstd codec, as
+// gzip-json compresses results without another dependency.
+func newCacheCodec(name string) (cacheCodec, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "json":
+		return jsonCodec{}, nil
+	case "gzip-json":
+		return gzipJSONCodec{}, nil
+	case "cbor":
+		return cborCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache codec %q", name)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) decode(data []byte, typ reflect.Type) (reflect.Value, error) {
+	v := reflect.New(typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
+
+type gzipJSONCodec struct{}
+
+func (gzipJSONCodec) encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipJSONCodec) decode(data []byte, typ reflect.Type) (reflect.Value, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return jsonCodec{}.decode(b, typ)
+}
+
+// cborCodec encodes the results of chain types in their CBOR form, which is
+// more compact than JSON and cheaper to decode. Results of other types, which
+// have no CBOR form, are encoded as JSON. The first byte of the encoding tells
+// which was used.
+type cborCodec struct{}
+
+const (
+	cborEncoded byte = iota
+	cborJSONEncoded
+)
+
+func (cborCodec) encode(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if m, ok := v.(cbg.CBORMarshaler); ok && !(rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		buf := bytes.NewBuffer([]byte{cborEncoded})
+		if err := m.MarshalCBOR(buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{cborJSONEncoded}, data...), nil
+}
+
+func (cborCodec) decode(data []byte, typ reflect.Type) (reflect.Value, error) {
+	if len(data) == 0 {
+		return reflect.Value{}, fmt.Errorf("empty cbor cache entry")
+	}
+	if data[0] == cborJSONEncoded {
+		return jsonCodec{}.decode(data[1:], typ)
+	}
+	// Pointer results are decoded into a new value of their element type,
+	// others into a new value of their own type.
+	elem := typ
+	if typ.Kind() == reflect.Ptr {
+		elem = typ.Elem()
+	}
+	v := reflect.New(elem)
+	u, ok := v.Interface().(cbg.CBORUnmarshaler)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%s has no cbor form", typ)
+	}
+	if err := u.UnmarshalCBOR(bytes.NewReader(data[1:])); err != nil {
+		return reflect.Value{}, err
+	}
+	if typ.Kind() == reflect.Ptr {
+		return v, nil
+	}
+	return v.Elem(), nil
+}
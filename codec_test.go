@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestCacheCodecsRoundTrip(t *testing.T) {
+	from, to := mustIDAddress(t, 1000), mustIDAddress(t, 1001)
+	msg := &types.Message{
+		From:       from,
+		To:         to,
+		Nonce:      7,
+		Value:      big.NewInt(42),
+		GasLimit:   1000,
+		GasFeeCap:  big.NewInt(100),
+		GasPremium: big.NewInt(1),
+		Params:     []byte{1, 2, 3},
+	}
+	type plain struct {
+		Name  string
+		Count int
+	}
+	values := []struct {
+		name string
+		v    interface{}
+	}{
+		{"chain type", msg},
+		{"nil chain type", (*types.Message)(nil)},
+		{"other type", plain{"sector", 3}},
+		{"slice", []string{"a", "b"}},
+	}
+	for _, name := range []string{"json", "gzip-json", "cbor"} {
+		codec, err := newCacheCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range values {
+			data, err := codec.encode(tt.v)
+			if err != nil {
+				t.Fatalf("%s: encode %s: %v", name, tt.name, err)
+			}
+			got, err := codec.decode(data, reflect.TypeOf(tt.v))
+			if err != nil {
+				t.Fatalf("%s: decode %s: %v", name, tt.name, err)
+			}
+			if !reflect.DeepEqual(got.Interface(), tt.v) {
+				t.Errorf("%s: %s = %#v, want %#v", name, tt.name, got.Interface(), tt.v)
+			}
+		}
+	}
+	if _, err := newCacheCodec("zstd-json"); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+func TestCBORCodecUsesCBOR(t *testing.T) {
+	msg := &types.Message{From: mustIDAddress(t, 1000), To: mustIDAddress(t, 1001), Value: big.Zero(), GasFeeCap: big.Zero(), GasPremium: big.Zero()}
+	data, err := cborCodec{}.encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != cborEncoded {
+		t.Errorf("chain type encoded with tag %d, want cbor", data[0])
+	}
+	data, err = cborCodec{}.encode(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != cborJSONEncoded {
+		t.Errorf("other type encoded with tag %d, want json", data[0])
+	}
+}
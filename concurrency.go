@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// concurrencySlots bounds the calls of one token owner or client address
+// being answered at once.
+type concurrencySlots struct {
+	slots chan struct{}
+	users int // calls holding or waiting for a slot
+}
+
+// concurrencyLimits bounds the calls each token owner, and optionally each
+// client address, has in flight at once, so that one client opening hundreds
+// of parallel heavy calls cannot monopolize the upstream nodes. Calls over
+// the limit wait up to queueTimeout for a slot and are then rejected as rate
+// limited. Limits given for * apply to each owner without a limit of its
+// own.
+type concurrencyLimits struct {
+	owners       map[string]int
+	perIP        int // 0 for no limit
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*concurrencySlots // by "owner " or "ip " key
+}
+
+func newConcurrencyLimits(owners map[string]int, perIP int, queueTimeout time.Duration) *concurrencyLimits {
+	return &concurrencyLimits{
+		owners:       owners,
+		perIP:        perIP,
+		queueTimeout: queueTimeout,
+		slots:        map[string]*concurrencySlots{},
+	}
+}
+
+// acquire takes a slot of key, among max, waiting until the deadline of ctx
+// or queueTimeout, and returns the function releasing it.
+func (l *concurrencyLimits) acquire(ctx context.Context, key string, max int) (func(), error) {
+	l.mu.Lock()
+	s, ok := l.slots[key]
+	if !ok {
+		s = &concurrencySlots{slots: make(chan struct{}, max)}
+		l.slots[key] = s
+	}
+	s.users++
+	l.mu.Unlock()
+
+	done := func() {
+		l.mu.Lock()
+		s.users--
+		if s.users == 0 {
+			delete(l.slots, key)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		select {
+		case s.slots <- struct{}{}:
+		case <-timer.C:
+			done()
+			return nil, &rateLimitError{owner: strings.SplitN(key, " ", 2)[1], what: fmt.Sprintf("concurrency limit of %d calls", max), retryAfter: time.Second}
+		case <-ctx.Done():
+			done()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		<-s.slots
+		done()
+	}, nil
+}
+
+// interceptor holds the calls over the concurrency limits of their token
+// owner or client address until others finish, or rejects them.
+func (l *concurrencyLimits) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if owner := tokenOwner(ctx); owner != "" {
+			max, ok := l.owners[owner]
+			if !ok {
+				max, ok = l.owners["*"]
+			}
+			if ok {
+				release, err := l.acquire(ctx, "owner "+owner, max)
+				if err != nil {
+					return call.errorResult(err)
+				}
+				defer release()
+			}
+		}
+		if l.perIP > 0 {
+			if host, _, err := net.SplitHostPort(sessionFrom(ctx).remoteAddr()); err == nil {
+				release, err := l.acquire(ctx, "ip "+host, l.perIP)
+				if err != nil {
+					return call.errorResult(err)
+				}
+				defer release()
+			}
+		}
+		return next(ctx, call)
+	}
+}
+
+// parseTokenConcurrency parses values of the form <owner>=<calls>.
+func parseTokenConcurrency(values []string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid token concurrency %q, expected <owner>=<calls>", v)
+		}
+		calls, err := strconv.Atoi(parts[1])
+		if err != nil || calls < 1 {
+			return nil, fmt.Errorf("invalid calls in token concurrency %q", v)
+		}
+		limits[parts[0]] = calls
+	}
+	return limits, nil
+}
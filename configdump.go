@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// redacted replaces secrets in the configuration dump.
+const redacted = "[redacted]"
+
+// secretFlags hold a secret as their whole value.
+var secretFlags = map[string]bool{
+	"api-token":          true,
+	"cache-import-token": true,
+	"admin-token":        true,
+	"consul-token":       true,
+	"fullnode-api-token": true,
+	"gossip-secret":      true,
+	"vault-token":        true,
+}
+
+// apiFlags hold node addresses that may carry a token, in the forms accepted
+// by parseAPIInfo.
+var apiFlags = map[string]bool{
+	"api":          true,
+	"miner-api":    true,
+	"write-api":    true,
+	"fallback-api": true,
+	"shadow-api":   true,
+	"fullnode-api": true,
+	"wallet-api":   true,
+	"boost-api":    true,
+}
+
+// urlFlags hold urls whose path or query may carry a secret, as those of
+// chat webhooks do.
+var urlFlags = map[string]bool{
+	"webhook-url":      true,
+	"shutdown-webhook": true,
+}
+
+// configFlag is the effective value of a flag and where it came from: the
+// command line, the environment or the flag default.
+type configFlag struct {
+	Name   string      `json:"name"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// effectiveConfig returns the value of every flag of the proxy as resolved at
+// startup, with secrets redacted, ordered by name.
+func effectiveConfig(cctx *cli.Context) []configFlag {
+	fromArgs := map[string]bool{}
+	for _, name := range cctx.LocalFlagNames() {
+		fromArgs[name] = true
+	}
+
+	var flags []configFlag
+	for _, f := range cctx.App.Flags {
+		name := f.Names()[0]
+		source := "default"
+		switch {
+		case fromArgs[name]:
+			source = "flag"
+		case cctx.IsSet(name):
+			source = "env"
+		}
+
+		var value interface{}
+		switch f.(type) {
+		case *cli.StringSliceFlag:
+			values := append([]string{}, cctx.StringSlice(name)...)
+			for i, v := range values {
+				values[i] = redactFlag(name, v)
+			}
+			value = values
+		case *cli.StringFlag:
+			value = redactFlag(name, cctx.String(name))
+		case *cli.DurationFlag:
+			value = cctx.Duration(name).String()
+		default:
+			value = cctx.Value(name)
+		}
+		flags = append(flags, configFlag{Name: name, Value: value, Source: source})
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Name < flags[j].Name
+	})
+	return flags
+}
+
+// redactFlag returns the value of the named flag with any secret it holds
+// replaced.
+func redactFlag(name, v string) string {
+	switch {
+	case v == "":
+		return v
+	case secretFlags[name]:
+		return redacted
+	case apiFlags[name]:
+		return redactAPIInfos(v)
+	case name == "backend-group" || name == "worker-api":
+		if parts := strings.SplitN(v, "=", 2); len(parts) == 2 {
+			return parts[0] + "=" + redactAPIInfos(parts[1])
+		}
+		return redacted
+	case urlFlags[name]:
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" {
+			return redacted
+		}
+		return u.Scheme + "://" + u.Host + "/" + redacted
+	default:
+		return v
+	}
+}
+
+// redactAPIInfos replaces the tokens of comma separated node addresses.
+func redactAPIInfos(v string) string {
+	addrs := strings.Split(v, ",")
+	for i, addr := range addrs {
+		addrs[i] = redactAPIInfo(strings.TrimSpace(addr))
+	}
+	return strings.Join(addrs, ",")
+}
+
+// redactAPIInfo replaces the token of a node address given in either the
+// <token>@<address> or the <token>:<multiaddr> form.
+func redactAPIInfo(v string) string {
+	if i := strings.LastIndex(v, "@"); i > 0 {
+		return redacted + v[i:]
+	}
+	if strings.Contains(v, "://") {
+		return v
+	}
+	if i := strings.Index(v, ":/"); i > 0 {
+		return redacted + v[i:]
+	}
+	return v
+}
+
+// configDump is the effective configuration of a running proxy: its flags
+// and the state operators may have changed at runtime.
+type configDump struct {
+	Flags   []configFlag     `json:"flags"`
+	Runtime runtimeOverrides `json:"runtime"`
+}
+
+// runtimeOverrides is the state changed through the admin api or by service
+// discovery since startup.
+type runtimeOverrides struct {
+	Upstreams  map[string][]upstreamStatus `json:"upstreams"` // by backend group
+	JobsPaused bool                        `json:"jobs_paused"`
+	Draining   bool                        `json:"draining"`
+}
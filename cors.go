@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy lets browser clients on the allowed origins call the rpc routes
+// of the proxy directly. Preflight requests are answered before
+// authentication, as browsers send them without credentials.
+type corsPolicy struct {
+	origins     []string // exact origins, globs such as https://*.example.com, or *
+	methods     []string
+	headers     []string
+	maxAge      time.Duration
+	credentials bool
+}
+
+func newCORSPolicy(origins, methods, headers []string, maxAge time.Duration, credentials bool) (*corsPolicy, error) {
+	for _, origin := range origins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return nil, fmt.Errorf("invalid cors origin %q: %w", origin, err)
+		}
+		// Any page could then make calls carrying the cookies and client
+		// certificates of the browser.
+		if origin == "*" && credentials {
+			return nil, fmt.Errorf("--cors-allow-credentials cannot be combined with the origin *, list the origins instead")
+		}
+	}
+	return &corsPolicy{
+		origins:     origins,
+		methods:     methods,
+		headers:     headers,
+		maxAge:      maxAge,
+		credentials: credentials,
+	}, nil
+}
+
+func (c *corsPolicy) allows(origin string) bool {
+	for _, pattern := range c.origins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isCORSPath reports whether the path is an rpc route, of the proxy or of one
+// of its miners.
+func isCORSPath(p string) bool {
+	if isRPCPath(p) {
+		return true
+	}
+	i := strings.LastIndex(p, "/rpc/")
+	return strings.HasPrefix(p, "/miner/") && i > 0 && isRPCPath(p[i:])
+}
+
+// handler answers preflight requests to the rpc routes and adds the CORS
+// headers to the responses of allowed origins.
+func (c *corsPolicy) handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !isCORSPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !c.allows(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.allowsAny() {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", "Retry-After")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+		if c.maxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (c *corsPolicy) allowsAny() bool {
+	for _, origin := range c.origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
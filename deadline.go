@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// defaultHeavyMethods are miner methods that are expensive enough to compete
+// with window post for the miner's resources.
+var defaultHeavyMethods = []string{
+	"SectorsList",
+	"SectorsListInStates",
+	"SectorsSummary",
+	"StorageList",
+	"StorageLocks",
+	"WorkerJobs",
+	"WorkerStats",
+	"SealingSchedDiag",
+	"MarketListDeals",
+	"MarketListIncompleteDeals",
+	"MarketListRetrievalDeals",
+}
+
+// deadlineThrottle limits the concurrency of heavy methods while the miner
+// is proving a window post deadline, or is about to, so that dashboards
+// cannot starve the proving process.
+type deadlineThrottle struct {
+	miner lotusapi.StorageMiner
+	full  lotusapi.FullNode
+	lead  abi.ChainEpoch
+	heavy methodRules
+	sem   chan struct{}
+
+	maddr  address.Address
+	active int32 // 1 while a deadline with partitions is open or imminent
+}
+
+func newDeadlineThrottle(miner lotusapi.StorageMiner, full lotusapi.FullNode, lead abi.ChainEpoch, heavy methodRules, concurrency int) *deadlineThrottle {
+	return &deadlineThrottle{
+		miner: miner,
+		full:  full,
+		lead:  lead,
+		heavy: heavy,
+		sem:   make(chan struct{}, concurrency),
+	}
+}
+
+// onHead is registered with the chain follower.
+func (t *deadlineThrottle) onHead(ctx context.Context, prev, head *types.TipSet) {
+	proving, err := t.proving(ctx, head)
+	if err != nil {
+		log.Println("failed to check proving deadline", "height", head.Height(), "error", err)
+		return
+	}
+
+	var v int32
+	if proving {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.active, v) != v {
+		log.Println("deadline throttle changed", "active", proving, "height", head.Height())
+	}
+}
+
+// proving reports whether the current deadline, or the next one when it opens
+// within the lead time, has partitions the miner must prove.
+func (t *deadlineThrottle) proving(ctx context.Context, head *types.TipSet) (bool, error) {
+	if t.maddr == address.Undef {
+		maddr, err := t.miner.ActorAddress(ctx)
+		if err != nil {
+			return false, fmt.Errorf("actor address: %w", err)
+		}
+		t.maddr = maddr
+	}
+
+	dl, err := t.full.StateMinerProvingDeadline(ctx, t.maddr, head.Key())
+	if err != nil {
+		return false, fmt.Errorf("proving deadline: %w", err)
+	}
+
+	idx := []uint64{dl.Index}
+	if dl.Close-dl.CurrentEpoch <= t.lead {
+		idx = append(idx, (dl.Index+1)%dl.WPoStPeriodDeadlines)
+	}
+
+	for _, i := range idx {
+		parts, err := t.full.StateMinerPartitions(ctx, t.maddr, i, head.Key())
+		if err != nil {
+			return false, fmt.Errorf("partitions of deadline %d: %w", i, err)
+		}
+		if len(parts) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// interceptor queues heavy calls behind the proving concurrency limit while
+// the throttle is active.
+func (t *deadlineThrottle) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if !t.heavy.match(call.Method) || atomic.LoadInt32(&t.active) == 0 {
+			return next(ctx, call)
+		}
+
+		select {
+		case t.sem <- struct{}{}:
+		case <-ctx.Done():
+			return call.errorResult(ctx.Err())
+		}
+		defer func() { <-t.sem }()
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulTokenMeta is the service meta key holding the api token of a node
+// registered in consul.
+const consulTokenMeta = "lotus_api_token"
+
+// consulDiscovery watches the passing instances of a consul service and makes
+// them the balanced upstreams of a pool.
+type consulDiscovery struct {
+	addr    string // consul http api, e.g. http://127.0.0.1:8500
+	service string
+	tag     string // optional
+	token   string // optional acl token
+	pool    *upstreamPool
+	client  *http.Client
+	backoff backoff
+}
+
+func newConsulDiscovery(addr, service, tag, token string, pool *upstreamPool) *consulDiscovery {
+	// CONSUL_HTTP_ADDR is commonly set without a scheme.
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &consulDiscovery{
+		addr:    addr,
+		service: service,
+		tag:     tag,
+		token:   token,
+		pool:    pool,
+		client:  &http.Client{},
+		backoff: backoff{
+			minDelay: time.Second,
+			maxDelay: time.Minute,
+		},
+	}
+}
+
+// consulServiceEntry is the part of a consul health service entry used.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+}
+
+// run long polls consul for changes to the service until ctx is cancelled.
+func (d *consulDiscovery) run(ctx context.Context) {
+	var (
+		index   uint64
+		current []apiInfo
+		failed  int
+	)
+	for {
+		apis, next, err := d.poll(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("failed to query consul", "service", d.service, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.backoff.next(failed)):
+			}
+			failed++
+			continue
+		}
+		failed = 0
+
+		// Consul indexes may go backwards, in which case the watch restarts.
+		if next < index {
+			next = 0
+		}
+		index = next
+
+		if reflect.DeepEqual(apis, current) {
+			continue
+		}
+		if len(apis) == 0 {
+			log.Println("consul lists no passing instances, keeping current upstreams", "service", d.service)
+			continue
+		}
+		if err := d.pool.setAPIs(apis); err != nil {
+			log.Println("failed to update upstreams from consul", "service", d.service, "error", err)
+			continue
+		}
+		current = apis
+	}
+}
+
+// poll returns the passing instances of the service once the consul index
+// moves past index, or after consul's wait time elapses.
+func (d *consulDiscovery) poll(ctx context.Context, index uint64) ([]apiInfo, uint64, error) {
+	q := url.Values{}
+	q.Set("passing", "true")
+	q.Set("index", strconv.FormatUint(index, 10))
+	q.Set("wait", "5m")
+	if d.tag != "" {
+		q.Set("tag", d.tag)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.addr+"/v1/health/service/"+url.PathEscape(d.service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.token != "" {
+		req.Header.Set("X-Consul-Token", d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid consul index: %w", err)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("decode consul response: %w", err)
+	}
+
+	apis := make([]apiInfo, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		apis = append(apis, apiInfo{
+			addr:  net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			token: e.Service.Meta[consulTokenMeta],
+		})
+	}
+	sort.Slice(apis, func(i, j int) bool {
+		return apis[i].addr < apis[j].addr
+	})
+	return apis, next, nil
+}
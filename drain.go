@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// drainTimeout bounds how long a drained upstream stays connected for the
+// calls still being answered by it.
+const drainTimeout = 10 * time.Minute
+
+var (
+	errUnknownUpstream = errors.New("unknown upstream")
+	errLastUpstream    = errors.New("cannot drain the last balanced upstream")
+)
+
+// drain removes the balanced upstream at addr from the pool, so that no new
+// call is sent to it, and closes it once the calls it is answering have
+// finished. Its subscriptions then move to the remaining upstreams. With
+// service discovery the node should also be deregistered,
+// or it is added back on the next change.
+func (p *upstreamPool) drain(addr string) (*upstream, error) {
+	p.mu.Lock()
+	var (
+		drained *upstream
+		kept    []*upstream
+	)
+	for _, u := range p.upstreams {
+		if u.addr == addr {
+			drained = u
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	switch {
+	case drained == nil:
+		p.mu.Unlock()
+		return nil, errUnknownUpstream
+	case len(kept) == 0:
+		p.mu.Unlock()
+		return nil, errLastUpstream
+	}
+	p.upstreams = kept
+	p.mu.Unlock()
+
+	log.Println("draining upstream", "upstream", addr)
+	p.retire(drained)
+	return drained, nil
+}
+
+// retire closes an upstream removed from the pool once it is idle, or after
+// drainTimeout.
+func (p *upstreamPool) retire(u *upstream) {
+	atomic.StoreInt32(&u.draining, 1)
+	p.mu.Lock()
+	p.drained[u] = true
+	p.mu.Unlock()
+
+	go func() {
+		deadline := time.Now().Add(drainTimeout)
+		for !u.idle() && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+		u.close()
+
+		p.mu.Lock()
+		delete(p.drained, u)
+		p.mu.Unlock()
+		log.Println("closed drained upstream", "upstream", u.addr)
+	}()
+}
+
+// draining returns the upstreams removed from the pool that are still open.
+func (p *upstreamPool) draining() []*upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	upstreams := make([]*upstream, 0, len(p.drained))
+	for u := range p.drained {
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+// idle reports whether the upstream is answering no call. Reader streams
+// count as calls, subscriptions do not as they can be migrated.
+func (u *upstream) idle() bool {
+	return atomic.LoadInt32(&u.inflight) == 0
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// maxDrillDuration bounds failure drills, so that a forgotten drill cannot
+// keep an upstream out of the pool for long.
+const maxDrillDuration = time.Hour
+
+var errNoDrill = errors.New("no failure drill is running on this upstream")
+
+// drilling reports whether the upstream is failed by a drill.
+func (u *upstream) drilling() bool {
+	until := atomic.LoadInt64(&u.drillUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// drillEnd returns the time the running drill of the upstream ends at, or
+// nil.
+func (u *upstream) drillEnd() *time.Time {
+	if !u.drilling() {
+		return nil
+	}
+	end := time.Unix(0, atomic.LoadInt64(&u.drillUntil))
+	return &end
+}
+
+// startDrill fails the upstream at addr for d, as if its circuit breaker was
+// open, so that operators can rehearse failover safely. The upstream is
+// restored once d has passed, and ended is then called. Starting a drill on
+// an upstream already failed by one replaces it.
+func (p *upstreamPool) startDrill(addr string, d time.Duration, ended func()) (*upstream, error) {
+	if d <= 0 || d > maxDrillDuration {
+		return nil, fmt.Errorf("drill duration must be positive and at most %s", maxDrillDuration)
+	}
+	u := p.find(addr)
+	if u == nil {
+		return nil, errUnknownUpstream
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.drillTimer != nil {
+		u.drillTimer.Stop()
+	}
+	atomic.StoreInt64(&u.drillUntil, time.Now().Add(d).UnixNano())
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		u.mu.Lock()
+		current := u.drillTimer == timer
+		if current {
+			u.drillTimer = nil
+			atomic.StoreInt64(&u.drillUntil, 0)
+		}
+		u.mu.Unlock()
+		if current {
+			ended()
+		}
+	})
+	u.drillTimer = timer
+	return u, nil
+}
+
+// stopDrill restores the upstream at addr before its drill ends.
+func (p *upstreamPool) stopDrill(addr string) (*upstream, error) {
+	u := p.find(addr)
+	if u == nil {
+		return nil, errUnknownUpstream
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.drillTimer == nil {
+		return nil, errNoDrill
+	}
+	u.drillTimer.Stop()
+	u.drillTimer = nil
+	atomic.StoreInt64(&u.drillUntil, 0)
+	return u, nil
+}
+
+// drillCommand starts and stops failure drills through the admin api of a
+// running proxy.
+var drillCommand = &cli.Command{
+	Name:  "drill",
+	Usage: "Fail an upstream node for a while, as if its circuit breaker was open, to rehearse failover",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "upstream",
+			Usage:    "Address of the upstream node to fail, as listed on /admin/upstreams.",
+			Required: true,
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "Time after which the upstream node is restored, at most an hour.",
+			Value: 5 * time.Minute,
+		},
+		&cli.BoolFlag{
+			Name:  "stop",
+			Usage: "Restore the upstream node now, ending its drill.",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Usage: "Url of the proxy. Defaults to the --listen address on localhost.",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Bearer token for the admin api. Defaults to --admin-token.",
+			EnvVars: []string{"LOTUS_PROXY_DRILL_TOKEN"},
+		},
+	},
+	Action: runDrill,
+}
+
+// proxyEndpoint returns the url of the running proxy commands talk to, and
+// the token they send, given by their --proxy and --token flags or else by
+// the flags of the proxy.
+func proxyEndpoint(cctx *cli.Context) (string, string) {
+	base := cctx.String("proxy")
+	if base == "" {
+		listen := cctx.String("listen")
+		if strings.HasPrefix(listen, ":") {
+			listen = "localhost" + listen
+		}
+		base = "http://" + listen
+	}
+	token := cctx.String("token")
+	if token == "" {
+		token = cctx.String("admin-token")
+	}
+	return strings.TrimSuffix(base, "/"), token
+}
+
+func runDrill(cctx *cli.Context) error {
+	base, token := proxyEndpoint(cctx)
+
+	form := url.Values{"addr": {cctx.String("upstream")}}
+	method := http.MethodPost
+	if cctx.Bool("stop") {
+		method = http.MethodDelete
+	} else {
+		form.Set("duration", cctx.Duration("duration").String())
+	}
+	req, err := http.NewRequestWithContext(cctx.Context, method, base+"/admin/upstreams/drill?"+form.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the proxy: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("drill failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opencensus.io/tag"
+)
+
+// ethWriteMethods are the eth methods that need write permission. Every
+// other eth method only reads.
+var ethWriteMethods = map[string]bool{
+	"eth_sendRawTransaction": true,
+}
+
+// ethImmutableMethods are the eth methods whose results do not change once
+// found, as they are looked up by hash.
+var ethImmutableMethods = map[string]bool{
+	"eth_chainId":                           true,
+	"net_version":                           true,
+	"eth_getBlockByHash":                    true,
+	"eth_getBlockTransactionCountByHash":    true,
+	"eth_getTransactionByBlockHashAndIndex": true,
+	"eth_getTransactionByHash":              true,
+	"eth_getTransactionReceipt":             true,
+	"eth_getMessageCidByTransactionHash":    true,
+	"eth_getTransactionHashByCid":           true,
+}
+
+// ethBlockParams are the eth methods taking the block they are answered at
+// as the param at the index given, whose results do not change when the
+// block is named by its hash.
+var ethBlockParams = map[string]int{
+	"eth_call":                1,
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getStorageAt":        2,
+	"eth_getTransactionCount": 1,
+}
+
+var errEthMethod = errors.New("only eth_, net_ and web3_ methods are served here")
+
+// isEthMethod reports whether method is a method of the eth JSON-RPC api
+// lotus serves on /rpc/v1, which, unlike the methods of the lotus api, has
+// no namespace.
+func isEthMethod(method string) bool {
+	return strings.HasPrefix(method, "eth_") || strings.HasPrefix(method, "net_") || strings.HasPrefix(method, "web3_")
+}
+
+// ethProxy serves the eth JSON-RPC api of the full nodes of a pool, so that
+// FEVM wallets and libraries can use the proxy as their endpoint. Calls are
+// forwarded as they are, since the proxy has no types for them, and results
+// that cannot change are cached.
+type ethProxy struct {
+	pool     *upstreamPool
+	acls     methodACLs
+	cache    *responseCache
+	ttl      time.Duration // 0 to not cache
+	readOnly bool          // reject the methods that need write permission
+	// calls checks the token of each call and applies its limits, as the
+	// interceptors do for the calls of the lotus api.
+	calls rawCalls
+}
+
+func newEthProxy(pool *upstreamPool, acls methodACLs, ttl time.Duration) *ethProxy {
+	return &ethProxy{
+		pool:  pool,
+		acls:  acls,
+		cache: newResponseCache(),
+		ttl:   ttl,
+	}
+}
+
+// ethPerm returns the permission lotus guards the eth method with: read but
+// for ethWriteMethods.
+func ethPerm(method string) string {
+	if ethWriteMethods[method] {
+		return "write"
+	}
+	return permRead
+}
+
+// permits checks method is served: the methods that need write permission
+// are not in gateway mode. The token of the call is checked by calls.
+func (e *ethProxy) permits(method string) error {
+	if e.readOnly && ethPerm(method) != permRead {
+		return fmt.Errorf("%s is not served in gateway mode: %w", method, errTokenScope)
+	}
+	return nil
+}
+
+// ethCacheable reports whether the result of a call to method with params is
+// kept, once found.
+func ethCacheable(method string, params json.RawMessage) bool {
+	if ethImmutableMethods[method] {
+		return true
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(params, &list) != nil {
+		return false
+	}
+	if i, ok := ethBlockParams[method]; ok {
+		// EIP-1898 names blocks as {"blockHash": ...}, where numbers and
+		// tags such as latest may resolve to another block later.
+		var block struct {
+			BlockHash string `json:"blockHash"`
+		}
+		return i < len(list) && json.Unmarshal(list[i], &block) == nil && block.BlockHash != ""
+	}
+	if method == "eth_getLogs" && len(list) == 1 {
+		var filter struct {
+			BlockHash string `json:"blockHash"`
+		}
+		return json.Unmarshal(list[0], &filter) == nil && filter.BlockHash != ""
+	}
+	return false
+}
+
+// handler forwards posted calls to eth methods and passes others to next.
+// Batches are passed to next, which does not serve eth methods.
+func (e *ethProxy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, req, err := peekRawRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req == nil || !isEthMethod(req.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e.serveCall(w, r, body, req)
+	})
+}
+
+// ServeHTTP serves eth methods only, over http or a websocket, on which
+// eth_subscribe is available.
+func (e *ethProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		e.serveWebsocket(w, r)
+		return
+	}
+	body, req, err := peekRawRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req == nil || !isEthMethod(req.Method) {
+		writeRPCError(w, http.StatusBadRequest, codeForbidden, errEthMethod)
+		return
+	}
+	e.serveCall(w, r, body, req)
+}
+
+func (e *ethProxy) serveCall(w http.ResponseWriter, r *http.Request, body []byte, req *rawRequest) {
+	mctx, _ := tag.New(r.Context(), tag.Upsert(methodTag, req.Method))
+	reportEvent(mctx, rpcRequest)
+	if err := e.permits(req.Method); err != nil {
+		writeCallError(w, req.ID, err)
+		return
+	}
+	e.calls.serve(w, r, req, req.Method, ethPerm(req.Method), func(ctx context.Context) (json.RawMessage, error) {
+		return e.answer(ctx, w, body, req)
+	})
+}
+
+// answer writes the response to the call of req, from the cache when it
+// holds its result, and returns the result or error.
+func (e *ethProxy) answer(ctx context.Context, w http.ResponseWriter, body []byte, req *rawRequest) (json.RawMessage, error) {
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, req.Method))
+	var key string
+	if e.ttl > 0 && ethCacheable(req.Method, req.Params) {
+		key, _ = rawCacheKey(req.Method, req.Params)
+	}
+	if key != "" {
+		cctx, _ := tag.New(cacheContext(ctx, "eth"), tag.Upsert(methodTag, req.Method))
+		reportEvent(cctx, getRequest)
+		if result, ok := e.cache.getRaw(key); ok {
+			reportEvent(cctx, getHit)
+			writeRawResult(w, req.ID, result)
+			return result, nil
+		}
+	}
+
+	status, resp, err := e.forward(ctx, body)
+	if err != nil && clientGone(ctx) {
+		reportEvent(mctx, rpcCanceled)
+		return nil, err
+	}
+	if err != nil {
+		reportEvent(mctx, rpcFailure)
+		log.Println("eth call failed", "method", req.Method, "error", err)
+		writeRPCError(w, http.StatusBadGateway, codeNoUpstream, err)
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+
+	result, err := rawOutcome(resp)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("eth call answered with status %d", status)
+	}
+	if err != nil {
+		reportEvent(mctx, rpcFailure)
+		return nil, err
+	}
+	if key != "" && ethFinal(req.Method, result) {
+		e.cache.putRaw(key, result, e.ttl)
+	}
+	return result, nil
+}
+
+// ethFinal reports whether result will not change: null results, such as the
+// receipt of a transaction not yet included, and pending transactions may.
+func ethFinal(method string, result json.RawMessage) bool {
+	if len(result) == 0 || bytes.Equal(result, []byte("null")) {
+		return false
+	}
+	if method == "eth_getTransactionByHash" {
+		var tx struct {
+			BlockHash *string `json:"blockHash"`
+		}
+		return json.Unmarshal(result, &tx) == nil && tx.BlockHash != nil
+	}
+	return true
+}
+
+// forward posts body to a full node of the pool and returns its response.
+func (e *ethProxy) forward(ctx context.Context, body []byte) (int, []byte, error) {
+	u := e.pool.pick(map[*upstream]bool{})
+	if u == nil {
+		return 0, nil, errNoUpstream
+	}
+	atomic.AddInt32(&u.inflight, 1)
+	defer atomic.AddInt32(&u.inflight, -1)
+	return postRaw(ctx, u.httpURL, u.header(), body)
+}
+
+var ethUpgrader = websocket.Upgrader{
+	// Browser clients are authenticated by their token rather than the
+	// origin of their page.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWebsocket relays the messages of a websocket client to a websocket
+// of a full node and back, so that the notifications of eth_subscribe reach
+// the client. Each call of the client passes calls as posted calls do, until
+// it is relayed, and is answered with an error rather than relayed when
+// rejected.
+func (e *ethProxy) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	u := e.pool.pick(map[*upstream]bool{})
+	if u == nil {
+		http.Error(w, errNoUpstream.Error(), http.StatusBadGateway)
+		return
+	}
+	wsURL := "ws" + strings.TrimPrefix(u.httpURL, "http")
+	up, _, err := websocket.DefaultDialer.DialContext(r.Context(), wsURL, u.header())
+	if err != nil {
+		log.Println("eth websocket failed", "upstream", u.addr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer up.Close() //nolint:errcheck
+	conn, err := ethUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close() //nolint:errcheck
+
+	atomic.AddInt32(&u.streams, 1)
+	defer atomic.AddInt32(&u.streams, -1)
+
+	// Answers to rejected calls are written alongside the relayed messages.
+	var mu sync.Mutex
+	write := func(mt int, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.WriteMessage(mt, msg)
+	}
+
+	go func() {
+		defer conn.Close() //nolint:errcheck
+		for {
+			mt, msg, err := up.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := write(mt, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req rawRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return
+		}
+		mctx, _ := tag.New(r.Context(), tag.Upsert(methodTag, req.Method))
+		reportEvent(mctx, rpcRequest)
+		rejected := errEthMethod
+		if isEthMethod(req.Method) {
+			rejected = e.permits(req.Method)
+		}
+		var relayErr error
+		if rejected == nil {
+			rejected = e.calls.call(r.Context(), newRawCall(req.Method, ethPerm(req.Method), req.Params), func(ctx context.Context) (json.RawMessage, error) {
+				relayErr = up.WriteMessage(mt, msg)
+				return nil, relayErr
+			})
+		}
+		if relayErr != nil {
+			return
+		}
+		if rejected != nil {
+			id := req.ID
+			if len(id) == 0 {
+				id = json.RawMessage("null")
+			}
+			code, retryable := classifyError(rejected)
+			answer, _ := json.Marshal(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      id,
+				"error":   rpcErrorObject{Code: code, Message: rejected.Error(), Data: &ErrorData{Retryable: retryable}},
+			})
+			if err := write(websocket.TextMessage, answer); err != nil {
+				return
+			}
+		}
+	}
+}
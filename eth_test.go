@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestEthProxyChecksCalls(t *testing.T) {
+	e := newEthProxy(nil, nil, time.Minute)
+	key, err := rawCacheKey("eth_chainId", json.RawMessage(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cache.putRaw(key, json.RawMessage(`"0x13a"`), time.Minute)
+	limits := newTokenLimits(nil, map[string]map[string]int64{"team-a": {"day": 2}})
+	e.calls = rawCalls{permissionInterceptor, signingGate, limits.interceptor}
+
+	write := &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, Allow: []string{"read", "write"}}
+	read := &jwtPayload{Payload: jwt.Payload{Subject: "team-b"}}
+	tests := []struct {
+		name    string
+		payload *jwtPayload
+		method  string
+		want    int
+		code    int
+	}{
+		{"cached read", write, "eth_chainId", http.StatusOK, 0},
+		{"token without read", read, "eth_chainId", http.StatusForbidden, codeForbidden},
+		{"signing method", write, "eth_sendRawTransaction", http.StatusForbidden, codeForbidden},
+		{"cached read again", write, "eth_chainId", http.StatusOK, 0},
+		{"over the quota", write, "eth_chainId", http.StatusTooManyRequests, codeRateLimited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(`{"jsonrpc":"2.0","id":1,"method":"` + tt.method + `","params":[]}`)
+			r := httptest.NewRequest(http.MethodPost, "/eth/rpc/v1", bytes.NewReader(body))
+			r = r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, tt.payload))
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			var resp struct {
+				Error *rpcErrorObject `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			code := 0
+			if resp.Error != nil {
+				code = resp.Error.Code
+			}
+			if code != tt.code {
+				t.Errorf("error code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a notification published by the proxy.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type eventSubscription struct {
+	prefixes []string // event types the subscriber wants, all when empty
+	ch       chan Event
+}
+
+func (s *eventSubscription) wants(typ string) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(typ, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBus distributes proxy events to server sent event subscribers and
+// webhooks.
+type eventBus struct {
+	webhooks *webhookSender
+
+	mu   sync.Mutex
+	subs map[*eventSubscription]struct{}
+}
+
+func newEventBus(webhooks *webhookSender) *eventBus {
+	return &eventBus{
+		webhooks: webhooks,
+		subs:     map[*eventSubscription]struct{}{},
+	}
+}
+
+func (b *eventBus) publish(typ string, data interface{}) {
+	ev := Event{
+		Type: typ,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+
+	if b.webhooks != nil {
+		b.webhooks.send(ev)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if !sub.wants(typ) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Println("dropping event for slow subscriber", "type", typ)
+		}
+	}
+}
+
+func (b *eventBus) subscribe(prefixes []string) *eventSubscription {
+	sub := &eventSubscription{
+		prefixes: prefixes,
+		ch:       make(chan Event, 64),
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := b.subscribe(splitValues(r.URL.Query()["type"]))
+	defer b.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sub.ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("failed to marshal event", "type", ev.Type, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
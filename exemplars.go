@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"go.opencensus.io/trace"
+)
+
+// latencyExemplars is a histogram of the time upstream nodes take to answer
+// calls, as upstream_duration_ms, whose buckets carry the trace id of a
+// recent traced call as an exemplar, so that a latency spike on a dashboard
+// leads straight to a trace of it. The opencensus exporter does not write
+// exemplars, so the histogram is kept by the prometheus client instead.
+type latencyExemplars struct {
+	hist *prom.HistogramVec
+}
+
+func newLatencyExemplars(registry prom.Registerer) *latencyExemplars {
+	hist := prom.NewHistogramVec(prom.HistogramOpts{
+		Namespace: "lotus_cpr",
+		Name:      "upstream_call_duration_seconds",
+		Help:      "Time taken by an upstream node to answer a call, with trace exemplars",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"upstream"})
+	registry.MustRegister(hist)
+	return &latencyExemplars{hist: hist}
+}
+
+// observe records the latency of a call to upstream, with the trace id of
+// the call when it is traced.
+func (e *latencyExemplars) observe(ctx context.Context, upstream string, d time.Duration) {
+	if e == nil {
+		return
+	}
+	obs := e.hist.WithLabelValues(upstream)
+	span := trace.FromContext(ctx)
+	if span == nil || !span.SpanContext().IsSampled() {
+		obs.Observe(d.Seconds())
+		return
+	}
+	if eo, ok := obs.(prom.ExemplarObserver); ok {
+		eo.ObserveWithExemplar(d.Seconds(), prom.Labels{"trace_id": span.SpanContext().TraceID.String()})
+		return
+	}
+	obs.Observe(d.Seconds())
+}
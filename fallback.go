@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// defaultFallbackMethods are read methods answered from public chain state,
+// which reveal nothing about the nodes behind the proxy.
+var defaultFallbackMethods = []string{
+	"Chain*",
+	"State*",
+	"Version",
+}
+
+// setFallback connects to the last resort node api, which serves the read
+// calls matching methods while no upstream in the pool is healthy. The node
+// is only given its own token, as it is usually run by a third party.
+func (p *upstreamPool) setFallback(api apiInfo, methods []string) error {
+	rules, err := parseMethodRules(methods)
+	if err != nil {
+		return err
+	}
+	u, err := newUpstream(api.token, api, p.cfg.transport)
+	if err != nil {
+		return err
+	}
+	u.breaker = newCircuitBreaker(p.cfg.breaker, u.addr)
+	p.fallback = u
+	p.fallbackMethods = rules
+	return nil
+}
+
+// useFallback reports whether the call should be sent to the fallback node
+// because it may be and no upstream in the pool can serve it.
+func (p *upstreamPool) useFallback(call *Call) bool {
+	if p.fallback == nil || !call.readOnly() || call.streams() || !p.fallbackMethods.match(call.Method) {
+		return false
+	}
+	for _, u := range p.readers() {
+		if u.isHealthy() && u.ready() {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *upstreamPool) callFallback(ctx context.Context, call *Call) []reflect.Value {
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+	stats.Record(mctx, fallbackRequest.M(1))
+
+	results := p.call(ctx, p.fallback, call)
+	if err := resultError(results); err != nil {
+		log.Println("fallback call failed", "upstream", p.fallback.addr, "method", call.Method, "error", err)
+	}
+	return results
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// newFullNodeClient connects to the v1 API of a Lotus full node over a
+// websocket so that subscription methods are available. It retries with
+// backoff until the node can be reached or ctx is cancelled, after which the
+// rpc client reconnects dropped websockets itself.
+func newFullNodeClient(ctx context.Context, authToken string, api apiInfo, reconnect backoff) (*lotusapi.FullNodeStruct, jsonrpc.ClientCloser, error) {
+	headers := http.Header{"Authorization": []string{"Bearer " + authToken}}
+	addr := transportConfig{websocket: true}.rpcURL(api, "/rpc/v1")
+
+	for attempt := 0; ; attempt++ {
+		var fullNodeApi lotusapi.FullNodeStruct
+
+		closer, err := jsonrpc.NewMergeClient(
+			context.Background(),
+			addr, api.rpcNamespace(),
+			lotusapi.GetInternalStructs(&fullNodeApi),
+			headers,
+			jsonrpc.WithReconnectBackoff(reconnect.minDelay, reconnect.maxDelay),
+		)
+		if err == nil {
+			return &fullNodeApi, closer, nil
+		}
+		log.Println("failed to connect to full node", "addr", addr, "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		case <-time.After(reconnect.next(attempt)):
+		}
+	}
+}
+
+// headHook is called by the chain follower whenever the chain head changes.
+// prev is nil for the first head observed.
+type headHook func(ctx context.Context, prev, head *types.TipSet)
+
+// chainFollower polls a full node for its chain head and notifies hooks when
+// it changes.
+type chainFollower struct {
+	api      lotusapi.FullNode
+	interval time.Duration
+	hooks    []headHook
+
+	mu   sync.Mutex
+	head *types.TipSet
+}
+
+func newChainFollower(api lotusapi.FullNode, interval time.Duration) *chainFollower {
+	return &chainFollower{
+		api:      api,
+		interval: interval,
+	}
+}
+
+// onHead registers a hook. It must not be called after run.
+func (f *chainFollower) onHead(h headHook) {
+	f.hooks = append(f.hooks, h)
+}
+
+// current returns the most recently observed chain head, or nil.
+func (f *chainFollower) current() *types.TipSet {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.head
+}
+
+func (f *chainFollower) run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.poll(ctx); err != nil {
+			log.Println("failed to poll chain head", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *chainFollower) poll(ctx context.Context) error {
+	head, err := f.api.ChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	prev := f.current()
+	if prev != nil && prev.Equals(head) {
+		return nil
+	}
+
+	f.mu.Lock()
+	f.head = head
+	f.mu.Unlock()
+
+	for _, h := range f.hooks {
+		h(ctx, prev, head)
+	}
+	return nil
+}
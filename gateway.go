@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// Modes of the proxy, given by --mode.
+const (
+	modeFull    = "full"
+	modeGateway = "gateway"
+)
+
+var errGatewayLookback = errors.New("lookback exceeds the limit of gateway mode")
+
+// gatewayMethods are the methods served in gateway mode: the reads of the
+// lotus gateway api, which is safe to expose to anyone.
+var gatewayMethods = map[string]bool{
+	"ChainGetBlockMessages":             true,
+	"ChainGetMessage":                   true,
+	"ChainGetPath":                      true,
+	"ChainGetTipSet":                    true,
+	"ChainGetTipSetByHeight":            true,
+	"ChainHasObj":                       true,
+	"ChainHead":                         true,
+	"ChainNotify":                       true,
+	"ChainReadObj":                      true,
+	"GasEstimateMessageGas":             true,
+	"MsigGetAvailableBalance":           true,
+	"MsigGetPending":                    true,
+	"MsigGetVested":                     true,
+	"StateAccountKey":                   true,
+	"StateDealProviderCollateralBounds": true,
+	"StateGetActor":                     true,
+	"StateListMiners":                   true,
+	"StateLookupID":                     true,
+	"StateMarketBalance":                true,
+	"StateMarketStorageDeal":            true,
+	"StateMinerInfo":                    true,
+	"StateMinerPower":                   true,
+	"StateMinerProvingDeadline":         true,
+	"StateNetworkVersion":               true,
+	"StateReadState":                    true,
+	"StateSearchMsg":                    true,
+	"StateSectorGetInfo":                true,
+	"StateVerifiedClientStatus":         true,
+	"StateWaitMsg":                      true,
+	"Version":                           true,
+	"WalletBalance":                     true,
+}
+
+// gatewayLimitMethods take the number of epochs they search back as their
+// only abi.ChainEpoch param, rather than a height.
+var gatewayLimitMethods = map[string]bool{
+	"StateSearchMsg": true,
+	"StateWaitMsg":   true,
+}
+
+var chainEpochType = reflect.TypeOf(abi.ChainEpoch(0))
+
+// gatewayMode restricts the proxy to the methods of the lotus gateway, as a
+// hardened public endpoint: other methods and any call that is not a read
+// are rejected, calls may not look further back than lookback from the
+// head, and message searches are capped to searchLimit epochs.
+type gatewayMode struct {
+	lookback    abi.ChainEpoch
+	searchLimit abi.ChainEpoch
+
+	heights *tipSetHeights // set once the full node client is created
+	head    int64          // height of the head, 0 until known
+}
+
+func newGatewayMode(lookback time.Duration, searchLimit abi.ChainEpoch) *gatewayMode {
+	return &gatewayMode{
+		lookback:    abi.ChainEpoch(lookback / epochDuration),
+		searchLimit: searchLimit,
+	}
+}
+
+// onHead follows the head the lookback is measured from.
+func (g *gatewayMode) onHead(ctx context.Context, prev, head *types.TipSet) {
+	atomic.StoreInt64(&g.head, int64(head.Height()))
+}
+
+// checkHeight rejects heights further back than the lookback.
+func (g *gatewayMode) checkHeight(h abi.ChainEpoch) error {
+	head := abi.ChainEpoch(atomic.LoadInt64(&g.head))
+	if head > 0 && h < head-g.lookback {
+		return fmt.Errorf("epoch %d is %d epochs behind the head, over %d: %w", h, head-h, g.lookback, errGatewayLookback)
+	}
+	return nil
+}
+
+// limit returns the call with its search limit capped, copying its args
+// rather than changing those of the caller.
+func (g *gatewayMode) limit(call *Call) *Call {
+	args := append([]reflect.Value(nil), call.Args...)
+	for i, a := range args {
+		if a.Type() != chainEpochType {
+			continue
+		}
+		if l := a.Interface().(abi.ChainEpoch); l < 0 || l > g.searchLimit {
+			args[i] = reflect.ValueOf(g.searchLimit)
+		}
+	}
+	limited := *call
+	limited.Args = args
+	return &limited
+}
+
+// cacheTTLs returns the ttls of the methods served in gateway mode, so that
+// answers cached for others, such as those imported from another proxy, are
+// not served past the interceptor.
+func (g *gatewayMode) cacheTTLs(ttls map[string]time.Duration) map[string]time.Duration {
+	served := map[string]time.Duration{}
+	for method, ttl := range ttls {
+		if gatewayMethods[method] {
+			served[method] = ttl
+		}
+	}
+	return served
+}
+
+// interceptor rejects the calls gateway mode does not serve, and those
+// looking back too far.
+func (g *gatewayMode) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if !gatewayMethods[call.Method] || !call.readOnly() {
+			return call.errorResult(fmt.Errorf("%s is not served in gateway mode: %w", call.Method, errTokenScope))
+		}
+		if gatewayLimitMethods[call.Method] {
+			call = g.limit(call)
+		} else {
+			for _, a := range call.Args {
+				if a.Type() != chainEpochType {
+					continue
+				}
+				if err := g.checkHeight(a.Interface().(abi.ChainEpoch)); err != nil {
+					return call.errorResult(err)
+				}
+			}
+		}
+		if g.heights != nil {
+			for _, tsk := range call.tipSetKeys() {
+				if tsk == types.EmptyTSK {
+					continue
+				}
+				h, err := g.heights.height(ctx, tsk)
+				if err != nil {
+					return call.errorResult(err)
+				}
+				if err := g.checkHeight(h); err != nil {
+					return call.errorResult(err)
+				}
+			}
+		}
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// gossipHotKeys is the number of hottest cache keys a replica advertises to
+// its peers.
+const gossipHotKeys = 256
+
+var errGossipNotFound = errors.New("cache entry not found")
+
+// gossipEntry is a cache entry advertised or served to a peer replica.
+type gossipEntry struct {
+	Key    string          `json:"key"`
+	Result json.RawMessage `json:"result,omitempty"`
+	TTL    time.Duration   `json:"ttl"` // time left before the entry expires
+}
+
+// cacheGossip shares hot cache entries between proxy replicas that do not
+// share a cache. Each replica advertises its most hit keys on an internal
+// port and periodically fetches the entries advertised by its peers that it
+// does not hold itself. Peers authenticate with a shared secret.
+type cacheGossip struct {
+	cache    *responseCache
+	name     string
+	ttls     map[string]time.Duration // cached methods and their lifetimes
+	secret   string
+	peers    []string // base urls of the peers' gossip ports
+	interval time.Duration
+	client   *http.Client
+}
+
+func newCacheGossip(cache *responseCache, name string, ttls map[string]time.Duration, secret string, peers []string, interval time.Duration) *cacheGossip {
+	for i, peer := range peers {
+		if !strings.Contains(peer, "://") {
+			peer = "http://" + peer
+		}
+		peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	return &cacheGossip{
+		cache:    cache,
+		name:     name,
+		ttls:     ttls,
+		secret:   secret,
+		peers:    peers,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// listenAndServe serves the hot keys and entries of the cache to peers on addr
+// until ctx is cancelled.
+func (g *cacheGossip) listenAndServe(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gossip/hot", g.serveHot)
+	mux.HandleFunc("/gossip/entry", g.serveEntry)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: g.authenticate(mux),
+	}
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Println(err, "failed to shut down gossip server")
+		}
+	}()
+
+	log.Println("Starting gossip server", "addr", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (g *cacheGossip) authenticate(next http.Handler) http.Handler {
+	want := []byte("Bearer " + g.secret)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (g *cacheGossip) serveHot(w http.ResponseWriter, r *http.Request) {
+	var entries []gossipEntry
+	for _, key := range g.cache.hot(gossipHotKeys) {
+		entries = append(entries, gossipEntry{Key: key})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func (g *cacheGossip) serveEntry(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	result, ttl, ok := g.cache.export(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(gossipEntry{
+		Key:    key,
+		Result: result,
+		TTL:    ttl,
+	})
+}
+
+// run fetches the hot entries of each peer every interval until ctx is
+// cancelled.
+func (g *cacheGossip) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, peer := range g.peers {
+			n, err := g.pull(ctx, peer)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Println("failed to fetch cache entries from peer", "peer", peer, "error", err)
+				continue
+			}
+			if n > 0 {
+				reportSize(cacheContext(ctx, g.name), gossipFetched, n)
+			}
+		}
+	}
+}
+
+// pull fetches the entries advertised by peer that the cache lacks and
+// returns the number added.
+func (g *cacheGossip) pull(ctx context.Context, peer string) (int, error) {
+	var hot []gossipEntry
+	if err := g.get(ctx, peer+"/gossip/hot", &hot); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, h := range hot {
+		ttl, ok := g.ttls[strings.SplitN(h.Key, ":", 2)[0]]
+		if !ok || g.cache.contains(h.Key) || g.cache.containsRaw(h.Key) {
+			continue
+		}
+
+		var e gossipEntry
+		err := g.get(ctx, peer+"/gossip/entry?key="+url.QueryEscape(h.Key), &e)
+		if err == errGossipNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if e.TTL < ttl {
+			ttl = e.TTL
+		}
+		if ttl <= 0 || len(e.Result) == 0 {
+			continue
+		}
+		g.cache.putRaw(h.Key, e.Result, ttl)
+		n++
+	}
+	return n, nil
+}
+
+func (g *cacheGossip) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.secret)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errGossipNotFound
+	default:
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode peer response: %w", err)
+	}
+	return nil
+}
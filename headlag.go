@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"go.opencensus.io/stats"
+)
+
+var tipSetKeyType = reflect.TypeOf(types.TipSetKey{})
+
+// headRelative reports whether the answer to the call depends on the chain
+// head of the node serving it: ChainHead itself, or a call given an empty
+// tipset key, which lotus resolves to its head.
+func (c *Call) headRelative() bool {
+	if c.Method == "ChainHead" {
+		return true
+	}
+	for _, a := range c.Args {
+		if a.Type() == tipSetKeyType && a.Interface().(types.TipSetKey) == types.EmptyTSK {
+			return true
+		}
+	}
+	return false
+}
+
+// headHeight returns the height of the chain head last reported by the
+// upstream, or 0 when it is unknown.
+func (u *upstream) headHeight() int64 {
+	return atomic.LoadInt64(&u.height)
+}
+
+// probeHead records the height of the chain head of the upstream. Nodes that
+// do not serve the full node API, such as miners, keep an unknown height.
+func (u *upstream) probeHead(ctx context.Context) {
+	head, err := u.full.ChainHead(ctx)
+	if err != nil || head == nil {
+		return
+	}
+	atomic.StoreInt64(&u.height, int64(head.Height()))
+	stats.Record(upstreamContext(ctx, u.addr), upstreamHeadHeight.M(int64(head.Height())))
+}
+
+// bestHeight returns the highest chain head reported by a balanced upstream.
+func (p *upstreamPool) bestHeight() int64 {
+	var best int64
+	for _, u := range p.readers() {
+		if h := u.headHeight(); h > best {
+			best = h
+		}
+	}
+	return best
+}
+
+// lagging reports whether the chain head of u is further behind best than
+// the pool allows. Upstreams whose head is unknown are not lagging.
+func (p *upstreamPool) lagging(u *upstream, best int64) bool {
+	h := u.headHeight()
+	return p.maxHeadLag > 0 && h > 0 && best-h > p.maxHeadLag
+}
+
+// pickSynced returns the candidate upstream with the highest chain head,
+// choosing among equally synced ones with the balancer.
+func (p *upstreamPool) pickSynced(tried map[*upstream]bool) *upstream {
+	candidates := p.candidates(tried)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var (
+		synced []*upstream
+		best   int64 = -1
+	)
+	for _, u := range candidates {
+		switch h := u.headHeight(); {
+		case h > best:
+			synced, best = []*upstream{u}, h
+		case h == best:
+			synced = append(synced, u)
+		}
+	}
+	return p.balancer.choose(synced)
+}
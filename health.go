@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// healthChecker periodically probes every upstream in a pool and takes those
+// that fail out of rotation until they respond again with their chain head
+// caught up.
+type healthChecker struct {
+	pool     *upstreamPool
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func newHealthChecker(pool *upstreamPool, interval, timeout time.Duration) *healthChecker {
+	return &healthChecker{
+		pool:     pool,
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, u := range h.pool.all() {
+			err := h.probe(ctx, u)
+			if err == nil && !u.isHealthy() {
+				err = h.pool.caughtUp(u)
+			}
+			if u.setHealthy(err == nil) {
+				if err != nil {
+					log.Println("upstream is unhealthy", "upstream", u.addr, "error", err)
+				} else {
+					log.Println("upstream is healthy", "upstream", u.addr)
+					u.warmUp()
+				}
+			}
+		}
+	}
+}
+
+func (h *healthChecker) probe(ctx context.Context, u *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	if _, err := u.api.Version(ctx); err != nil {
+		return err
+	}
+	if h.pool.maxHeadLag > 0 || h.pool.cfg.slowStart > 0 {
+		u.probeHead(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// heatmapBoundsMs are the upper bounds of the latency buckets of the heatmap,
+// in milliseconds. Latencies above the last bound fall in a final bucket.
+var heatmapBoundsMs = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000}
+
+// latencyHeatmap counts the latency of upstream calls by method, upstream and
+// time bucket, keeping the most recent buckets, so that the status dashboard
+// can show latency regressions, for example after a lotus upgrade.
+type latencyHeatmap struct {
+	bucket  time.Duration
+	buckets int // time buckets kept per series
+
+	mu     sync.Mutex
+	series map[heatmapKey]*heatmapSeries
+}
+
+type heatmapKey struct {
+	method   string
+	upstream string
+}
+
+// heatmapSeries is a ring of time buckets, each counting calls by latency
+// bucket.
+type heatmapSeries struct {
+	starts []time.Time
+	counts [][]uint32
+}
+
+func newLatencyHeatmap(bucket, retention time.Duration) *latencyHeatmap {
+	n := int(retention / bucket)
+	if n < 1 {
+		n = 1
+	}
+	return &latencyHeatmap{
+		bucket:  bucket,
+		buckets: n,
+		series:  map[heatmapKey]*heatmapSeries{},
+	}
+}
+
+// observe counts a call to method on upstream that took d.
+func (h *latencyHeatmap) observe(method, upstream string, d time.Duration) {
+	if h == nil {
+		return
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	lb := sort.SearchFloat64s(heatmapBoundsMs, ms)
+
+	now := time.Now()
+	start := now.Truncate(h.bucket)
+	slot := int(start.UnixNano()/int64(h.bucket)) % h.buckets
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := heatmapKey{method: method, upstream: upstream}
+	s, ok := h.series[key]
+	if !ok {
+		s = &heatmapSeries{
+			starts: make([]time.Time, h.buckets),
+			counts: make([][]uint32, h.buckets),
+		}
+		h.series[key] = s
+	}
+	if !s.starts[slot].Equal(start) {
+		s.starts[slot] = start
+		s.counts[slot] = make([]uint32, len(heatmapBoundsMs)+1)
+	}
+	s.counts[slot][lb]++
+}
+
+// heatmapCell counts the calls of a time bucket by latency bucket.
+type heatmapCell struct {
+	Start  time.Time `json:"start"`
+	Counts []uint32  `json:"counts"`
+}
+
+type heatmapRow struct {
+	Method   string        `json:"method"`
+	Upstream string        `json:"upstream"`
+	Buckets  []heatmapCell `json:"buckets"`
+}
+
+type heatmapView struct {
+	BucketSeconds float64      `json:"bucket_seconds"`
+	BoundsMs      []float64    `json:"bounds_ms"`
+	Series        []heatmapRow `json:"series"`
+}
+
+// view returns the series matching method and upstream, either of which may
+// be empty to match any, with their time buckets since the given time in
+// order.
+func (h *latencyHeatmap) view(method, upstream string, since time.Time) heatmapView {
+	oldest := time.Now().Add(-time.Duration(h.buckets) * h.bucket)
+	if since.Before(oldest) {
+		since = oldest
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := heatmapView{
+		BucketSeconds: h.bucket.Seconds(),
+		BoundsMs:      heatmapBoundsMs,
+		Series:        []heatmapRow{},
+	}
+	for key, s := range h.series {
+		if method != "" && key.method != method || upstream != "" && key.upstream != upstream {
+			continue
+		}
+		row := heatmapRow{Method: key.method, Upstream: key.upstream}
+		for i, start := range s.starts {
+			if start.IsZero() || start.Before(since.Truncate(h.bucket)) {
+				continue
+			}
+			row.Buckets = append(row.Buckets, heatmapCell{
+				Start:  start,
+				Counts: append([]uint32(nil), s.counts[i]...),
+			})
+		}
+		if len(row.Buckets) == 0 {
+			continue
+		}
+		sort.Slice(row.Buckets, func(i, j int) bool {
+			return row.Buckets[i].Start.Before(row.Buckets[j].Start)
+		})
+		v.Series = append(v.Series, row)
+	}
+	sort.Slice(v.Series, func(i, j int) bool {
+		if v.Series[i].Method != v.Series[j].Method {
+			return v.Series[i].Method < v.Series[j].Method
+		}
+		return v.Series[i].Upstream < v.Series[j].Upstream
+	})
+	return v
+}
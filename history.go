@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricexport"
+)
+
+const ringSlotSize = 16 // unix seconds and value, both 8 bytes
+
+// ringFile is a fixed size file of time stamped samples where each sample
+// overwrites the slot of the sample taken one retention period earlier.
+type ringFile struct {
+	f     *os.File
+	slots int64
+}
+
+func openRingFile(path string, slots int64) (*ringFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint
+		return nil, err
+	}
+	if fi.Size() != slots*ringSlotSize {
+		if err := f.Truncate(slots * ringSlotSize); err != nil {
+			f.Close() //nolint
+			return nil, err
+		}
+	}
+	return &ringFile{f: f, slots: slots}, nil
+}
+
+func (r *ringFile) write(slot int64, t int64, v float64) error {
+	var buf [ringSlotSize]byte
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(t))
+	binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(v))
+	_, err := r.f.WriteAt(buf[:], (slot%r.slots)*ringSlotSize)
+	return err
+}
+
+// HistoryPoint is a single sample of a series.
+type HistoryPoint struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// read returns the samples taken between from and to inclusive, ordered by
+// time.
+func (r *ringFile) read(from, to int64) ([]HistoryPoint, error) {
+	buf := make([]byte, r.slots*ringSlotSize)
+	if _, err := r.f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+
+	var points []HistoryPoint
+	for i := int64(0); i < r.slots; i++ {
+		slot := buf[i*ringSlotSize : (i+1)*ringSlotSize]
+		t := int64(binary.LittleEndian.Uint64(slot[0:8]))
+		if t == 0 || t < from || t > to {
+			continue
+		}
+		points = append(points, HistoryPoint{
+			T: t,
+			V: math.Float64frombits(binary.LittleEndian.Uint64(slot[8:16])),
+		})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].T < points[j].T })
+	return points, nil
+}
+
+// historySeries are the series retained by the metric history.
+var historySeries = []string{"request_rate", "cache_hit_rate", "upstream_latency_ms"}
+
+// metricHistory samples key operational metrics at a fixed interval and keeps
+// them in ring files so that recent history survives restarts and can be
+// queried without an external time series database.
+type metricHistory struct {
+	interval time.Duration
+	reader   *metricexport.Reader
+	rings    map[string]*ringFile
+
+	mu   sync.Mutex
+	prev map[string]float64 // cumulative totals at the previous sample
+	last time.Time
+}
+
+func newMetricHistory(dir string, interval, retention time.Duration) (*metricHistory, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	slots := int64(retention / interval)
+	h := &metricHistory{
+		interval: interval,
+		reader:   metricexport.NewReader(),
+		rings:    map[string]*ringFile{},
+	}
+	for _, name := range historySeries {
+		r, err := openRingFile(filepath.Join(dir, name+".ring"), slots)
+		if err != nil {
+			h.close()
+			return nil, fmt.Errorf("open history for %s: %w", name, err)
+		}
+		h.rings[name] = r
+	}
+	return h, nil
+}
+
+func (h *metricHistory) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.reader.ReadAndExport(h)
+		}
+	}
+}
+
+func (h *metricHistory) close() {
+	for _, r := range h.rings {
+		r.f.Close() //nolint
+	}
+}
+
+var _ metricexport.Exporter = (*metricHistory)(nil)
+
+// ExportMetrics derives the history series from the cumulative metric totals
+// and records them.
+func (h *metricHistory) ExportMetrics(ctx context.Context, metrics []*metricdata.Metric) error {
+	totals := map[string]float64{}
+	for _, m := range metrics {
+		for _, ts := range m.TimeSeries {
+			for _, p := range ts.Points {
+				switch v := p.Value.(type) {
+				case int64:
+					totals[m.Descriptor.Name] += float64(v)
+				case float64:
+					totals[m.Descriptor.Name] += v
+				case *metricdata.Distribution:
+					totals[m.Descriptor.Name+"_count"] += float64(v.Count)
+					totals[m.Descriptor.Name+"_sum"] += v.Sum
+				}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if h.prev != nil {
+		delta := func(name string) float64 { return totals[name] - h.prev[name] }
+		ratio := func(num, den string) float64 {
+			if d := delta(den); d > 0 {
+				return delta(num) / d
+			}
+			return 0
+		}
+
+		values := map[string]float64{
+			"request_rate":        delta("rpc_request_total") / now.Sub(h.last).Seconds(),
+			"cache_hit_rate":      ratio("get_hit_total", "get_request_total"),
+			"upstream_latency_ms": ratio("upstream_duration_ms_sum", "upstream_duration_ms_count"),
+		}
+		slot := now.Unix() / int64(h.interval.Seconds())
+		for name, v := range values {
+			if err := h.rings[name].write(slot, now.Unix(), v); err != nil {
+				log.Println("failed to write metric history", "series", name, "error", err)
+			}
+		}
+	}
+	h.prev = totals
+	h.last = now
+	return nil
+}
+
+// ServeHTTP answers queries of the form ?series=<name>&from=<unix>&to=<unix>
+// with the matching samples. Without a series it lists the available series.
+func (h *metricHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("series")
+	if name == "" {
+		writeJSON(w, historySeries)
+		return
+	}
+
+	ring, ok := h.rings[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown series %q", name), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().Unix()
+	from, err := parseUnixParam(q.Get("from"), now-int64(24*time.Hour/time.Second))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseUnixParam(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, err := ring.read(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, points)
+}
+
+func parseUnixParam(v string, def int64) (int64, error) {
+	if v == "" {
+		return def, nil
+	}
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %w", v, err)
+	}
+	return t, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"reflect"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// permRead is the permission required by methods that do not change the
+// state of the node.
+const permRead = "read"
+
+// Call is a single invocation of a proxied API method.
+type Call struct {
+	Method string
+	Perm   string          // permission the upstream requires to call the method
+	Type   reflect.Type    // function type of the method, including the context argument
+	Args   []reflect.Value // call arguments, excluding the context
+}
+
+// Params returns the call arguments as plain values.
+func (c *Call) Params() []interface{} {
+	params := make([]interface{}, len(c.Args))
+	for i, a := range c.Args {
+		params[i] = a.Interface()
+	}
+	return params
+}
+
+// returnsChannel reports whether the method returns a subscription channel.
+func (c *Call) returnsChannel() bool {
+	return c.Type.NumOut() == 2 && c.Type.Out(0).Kind() == reflect.Chan
+}
+
+// errorResult returns a result list for the call that carries err alongside
+// zero values for any other outputs.
+func (c *Call) errorResult(err error) []reflect.Value {
+	out := make([]reflect.Value, c.Type.NumOut())
+	for i := 0; i < len(out)-1; i++ {
+		out[i] = reflect.Zero(c.Type.Out(i))
+	}
+	out[len(out)-1] = reflect.ValueOf(&err).Elem()
+	return out
+}
+
+// resultError returns the error carried by the results of a call, if any.
+func resultError(results []reflect.Value) error {
+	if len(results) == 0 {
+		return nil
+	}
+	last := results[len(results)-1]
+	if last.IsNil() {
+		return nil
+	}
+	err, _ := last.Interface().(error)
+	return err
+}
+
+// Invoker performs a proxied call.
+type Invoker func(ctx context.Context, call *Call) []reflect.Value
+
+// Interceptor wraps an Invoker with additional behaviour such as caching.
+type Interceptor func(next Invoker) Invoker
+
+// methodInvoker returns an Invoker that calls the method of in named by the
+// call.
+func methodInvoker(in interface{}) Invoker {
+	ra := reflect.ValueOf(in)
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		args := append([]reflect.Value{reflect.ValueOf(ctx)}, call.Args...)
+		return ra.MethodByName(call.Method).Call(args)
+	}
+}
+
+// proxyAPI fills the internal function fields of outstr with functions that
+// pass each call through the interceptors, in order, before handing it to
+// invoke.
+func proxyAPI(invoke Invoker, outstr interface{}, interceptors ...Interceptor) {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoke = interceptors[i](invoke)
+	}
+
+	for _, out := range lotusapi.GetInternalStructs(outstr) {
+		rint := reflect.ValueOf(out).Elem()
+		for f := 0; f < rint.NumField(); f++ {
+			field := rint.Type().Field(f)
+			rint.Field(f).Set(reflect.MakeFunc(field.Type, func(args []reflect.Value) []reflect.Value {
+				ctx := args[0].Interface().(context.Context)
+				return invoke(ctx, &Call{
+					Method: field.Name,
+					Perm:   field.Tag.Get("perm"),
+					Type:   field.Type,
+					Args:   args[1:],
+				})
+			}))
+		}
+	}
+}
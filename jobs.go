@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobFunc executes the payload of a job.
+type JobFunc func(ctx context.Context, payload json.RawMessage) error
+
+// Job is a unit of background work run by the job scheduler.
+type Job struct {
+	ID      string          `json:"id"`
+	Kind    string          `json:"kind"`
+	Tenant  string          `json:"tenant"`
+	Payload json.RawMessage `json:"payload"`
+	// NotBefore is the time before which the job is not run, zero to run it
+	// as soon as a worker is free.
+	NotBefore time.Time `json:"not_before,omitempty"`
+}
+
+// jobScheduler runs jobs on a bounded pool of workers. Pending jobs are
+// queued per tenant and dispatched round robin across tenants so that one
+// tenant submitting many jobs cannot starve the others. When a state file is
+// configured, queued and running jobs are persisted so they resume after a
+// restart.
+type jobScheduler struct {
+	workers int
+	path    string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	handlers map[string]JobFunc
+	queues   map[string][]*Job // pending jobs per tenant
+	tenants  []string          // tenants with pending jobs, in dispatch order
+	delayed  []*Job            // jobs waiting for their NotBefore time
+	running  map[string]*Job
+	paused   bool
+	closed   bool
+}
+
+func newJobScheduler(workers int, path string) (*jobScheduler, error) {
+	s := &jobScheduler{
+		workers:  workers,
+		path:     path,
+		handlers: map[string]JobFunc{},
+		queues:   map[string][]*Job{},
+		running:  map[string]*Job{},
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load jobs: %w", err)
+	}
+	return s, nil
+}
+
+// handle registers the function used to run jobs of the given kind.
+func (s *jobScheduler) handle(kind string, fn JobFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[kind] = fn
+}
+
+// submit queues a job for the tenant and returns its id.
+func (s *jobScheduler) submit(kind, tenant string, payload interface{}) (string, error) {
+	return s.submitAt(kind, tenant, payload, time.Time{})
+}
+
+// submitAt queues a job for the tenant that is not run before notBefore and
+// returns its id. Until then the job is kept in the state file with the
+// others, so that it survives a restart.
+func (s *jobScheduler) submitAt(kind, tenant string, payload interface{}, notBefore time.Time) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshal payload: %w", err)
+	}
+
+	job := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Tenant:    tenant,
+		Payload:   data,
+		NotBefore: notBefore,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule(job, time.Now())
+	s.persist()
+	s.cond.Signal()
+	return job.ID, nil
+}
+
+// schedule queues job, or holds it until its NotBefore time when that is
+// after now, and must be called with the lock held.
+func (s *jobScheduler) schedule(job *Job, now time.Time) {
+	if !job.NotBefore.After(now) {
+		s.enqueue(job)
+		return
+	}
+	s.delayed = append(s.delayed, job)
+	time.AfterFunc(job.NotBefore.Sub(now), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.promote(time.Now())
+		s.cond.Broadcast()
+	})
+}
+
+// promote queues the delayed jobs that are due and must be called with the
+// lock held.
+func (s *jobScheduler) promote(now time.Time) {
+	waiting := s.delayed[:0]
+	for _, job := range s.delayed {
+		if job.NotBefore.After(now) {
+			waiting = append(waiting, job)
+		} else {
+			s.enqueue(job)
+		}
+	}
+	s.delayed = waiting
+}
+
+// enqueue must be called with the lock held.
+func (s *jobScheduler) enqueue(job *Job) {
+	if len(s.queues[job.Tenant]) == 0 {
+		s.tenants = append(s.tenants, job.Tenant)
+	}
+	s.queues[job.Tenant] = append(s.queues[job.Tenant], job)
+}
+
+// pause stops workers from starting new jobs. Running jobs are not affected.
+func (s *jobScheduler) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+func (s *jobScheduler) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+	s.cond.Broadcast()
+}
+
+func (s *jobScheduler) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// pending returns the number of queued jobs per tenant, including those
+// waiting for their NotBefore time.
+func (s *jobScheduler) pending() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.queues))
+	for tenant, q := range s.queues {
+		counts[tenant] = len(q)
+	}
+	for _, job := range s.delayed {
+		counts[job.Tenant]++
+	}
+	return counts
+}
+
+// run starts the workers and blocks until ctx is cancelled and all running
+// jobs have returned.
+func (s *jobScheduler) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.closed = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, fn := s.next()
+				if job == nil {
+					return
+				}
+				if err := fn(ctx, job.Payload); err != nil {
+					log.Println("job failed", "id", job.ID, "kind", job.Kind, "tenant", job.Tenant, "error", err)
+				}
+				s.finish(job, ctx.Err() == nil)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// next blocks until a job is available and returns it, or returns nil when
+// the scheduler is closed.
+func (s *jobScheduler) next() (*Job, JobFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			return nil, nil
+		}
+		if !s.paused && len(s.tenants) > 0 {
+			tenant := s.tenants[0]
+			q := s.queues[tenant]
+			job := q[0]
+			s.tenants = s.tenants[1:]
+			if len(q) > 1 {
+				s.queues[tenant] = q[1:]
+				s.tenants = append(s.tenants, tenant)
+			} else {
+				delete(s.queues, tenant)
+			}
+
+			fn, ok := s.handlers[job.Kind]
+			if !ok {
+				log.Println("dropping job with unknown kind", "id", job.ID, "kind", job.Kind)
+				s.persist()
+				continue
+			}
+			s.running[job.ID] = job
+			return job, fn
+		}
+		s.cond.Wait()
+	}
+}
+
+// finish records that a job has returned. Jobs interrupted by shutdown are
+// kept in the state file so they run again after a restart.
+func (s *jobScheduler) finish(job *Job, done bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if done {
+		delete(s.running, job.ID)
+		s.persist()
+	}
+}
+
+// persist writes queued and running jobs to the state file and must be called
+// with the lock held.
+func (s *jobScheduler) persist() {
+	if s.path == "" {
+		return
+	}
+
+	jobs := make([]*Job, 0, len(s.running))
+	for _, job := range s.running {
+		jobs = append(jobs, job)
+	}
+	for _, tenant := range s.tenants {
+		jobs = append(jobs, s.queues[tenant]...)
+	}
+	jobs = append(jobs, s.delayed...)
+
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		log.Println("failed to marshal jobs", "error", err)
+		return
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		log.Println("failed to write jobs", "path", tmp, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Println("failed to write jobs", "path", s.path, "error", err)
+	}
+}
+
+func (s *jobScheduler) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		s.schedule(job, now)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+)
+
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// sizeLimitedReader fails reads past max bytes, when max is not 0.
+type sizeLimitedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (l *sizeLimitedReader) Read(b []byte) (int, error) {
+	if l.max > 0 && l.read >= l.max {
+		// Reading one byte tells a response of exactly max bytes from a
+		// larger one.
+		var one [1]byte
+		if n, _ := l.r.Read(one[:]); n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, io.EOF
+	}
+	if l.max > 0 && int64(len(b)) > l.max-l.read {
+		b = b[:l.max-l.read]
+	}
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	return n, err
+}
+
+// responseSummary is what is learned of a JSON-RPC response while it is
+// forwarded.
+type responseSummary struct {
+	id     json.RawMessage
+	err    *rpcErrorObject // set when the call failed
+	shape  interface{}     // of the result, when asked for
+	shaped bool
+}
+
+// scanResponse reads the JSON-RPC response envelope from r token by token,
+// decoding the id and error, which are small, and only the shape of the
+// result, so that large results are never held in memory.
+func scanResponse(r io.Reader, wantShape bool) (*responseSummary, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var sum responseSummary
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case "id":
+			err = dec.Decode(&sum.id)
+		case "error":
+			err = dec.Decode(&sum.err)
+		case "result":
+			if wantShape {
+				sum.shape, err = scanShape(dec)
+				sum.shaped = err == nil
+			} else {
+				err = skipValue(dec)
+			}
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return &sum, nil
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != d {
+		return errors.New("unexpected JSON token, expected " + d.String())
+	}
+	return nil
+}
+
+// skipValue reads past the next value without keeping it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// scanShape reads the next value and returns its shape, as shapeOf does for
+// decoded values.
+func scanShape(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		if t == '{' {
+			shape := map[string]interface{}{}
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, _ := k.(string)
+				if shape[key], err = scanShape(dec); err != nil {
+					return nil, err
+				}
+			}
+			_, err := dec.Token()
+			return shape, err
+		}
+		// Elements sharing the shape of the first are counted rather than
+		// kept, so that long arrays take no more memory than one element.
+		var (
+			shapes  = []interface{}{}
+			repeats int
+		)
+		for dec.More() {
+			s, err := scanShape(dec)
+			if err != nil {
+				return nil, err
+			}
+			if len(shapes) == 1 && reflect.DeepEqual(s, shapes[0]) {
+				repeats++
+				continue
+			}
+			for ; repeats > 0; repeats-- {
+				shapes = append(shapes, shapes[0])
+			}
+			shapes = append(shapes, s)
+		}
+		_, err := dec.Token()
+		return shapes, err
+	case string:
+		return "string", nil
+	case float64:
+		return "number", nil
+	case bool:
+		return "boolean", nil
+	default:
+		return "null", nil
+	}
+}
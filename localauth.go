@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// localOwner is the owner of the calls let through without a token from
+// loopback.
+const localOwner = "local"
+
+// fromLoopback reports whether r reached the proxy over loopback on both
+// ends, and was not forwarded there by a proxy on the same host, so that
+// it was made by a process on the host itself.
+func fromLoopback(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+		return false
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok || !isLoopbackAddr(local.String()) {
+		return false
+	}
+	return isLoopbackAddr(r.RemoteAddr)
+}
+
+// fromLocalProcess reports whether r came from loopback and was not sent by a
+// browser on behalf of a page, which a site the user visits could make reach
+// the proxy on localhost. Browsers set Origin on such posts and websockets,
+// and Sec-Fetch-Site on every request.
+func fromLocalProcess(r *http.Request) bool {
+	if r.Header.Get("Origin") != "" {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "none", "same-origin":
+	default:
+		return false
+	}
+	return fromLoopback(r)
+}
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localPayload returns the payload of calls made without a token from
+// loopback, granted allow.
+func localPayload(allow []string) *jwtPayload {
+	return &jwtPayload{Payload: jwt.Payload{Subject: localOwner}, Allow: allow}
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/v0api"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
+	"go.opencensus.io/trace"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -20,17 +28,840 @@ func main() {
 		HelpName: "lotus-cpr",
 		Usage:    "A caching proxy for Lotus filecoin nodes.",
 		Flags: []cli.Flag{
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:    "api",
-				Usage:   "Address of Lotus miner node.",
-				EnvVars: []string{"LOTUS_API"},
-				Value:   "127.0.0.1:2345",
+				Usage:   "Address of Lotus miner node as host:port, url (http, https, ws or wss), multiaddr or <token>:<multiaddr>, optionally prefixed by <token>@ to give the node its own token. May be repeated or comma separated to balance requests across several nodes.",
+				EnvVars: []string{"LOTUS_API", "MINER_API_INFO"},
+				Value:   cli.NewStringSlice("127.0.0.1:2345"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "miner-api",
+				Usage:   "Address of an additional Lotus miner node served on /miner/<actor>/rpc/v0 and included in Proxy.MinerSummary. May be repeated. Accepts the same forms as --api.",
+				EnvVars: []string{"LOTUS_MINER_API"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "worker-api",
+				Usage:   "A lotus-worker served on /worker/<name>/rpc/v0, as <name>=<api>, where api accepts the same forms as --api. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_WORKER_API"},
+			},
+			&cli.StringFlag{
+				Name:    "boost-api",
+				Usage:   "A boost node whose deal and ask lookups are served on /boost/rpc/v0, as <token>:<multiaddr> or <token>@<url>.",
+				EnvVars: []string{"LOTUS_PROXY_BOOST_API", "BOOST_API_INFO"},
+			},
+			&cli.DurationFlag{
+				Name:    "boost-cache-ttl",
+				Usage:   "Time to cache the answers of boost, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_BOOST_CACHE_TTL"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "wallet-api",
+				Usage:   "A lotus wallet, such as lotus-wallet, served on /wallet/rpc/v0 under --wallet-policy. Accepts the same forms as --api.",
+				EnvVars: []string{"LOTUS_PROXY_WALLET_API"},
+			},
+			&cli.StringFlag{
+				Name:    "wallet-policy",
+				Usage:   "JSON file of the policy guarding --wallet-api: the methods served, the types of data signed, and the spend limits and destinations of each address.",
+				EnvVars: []string{"LOTUS_PROXY_WALLET_POLICY"},
+			},
+			&cli.StringFlag{
+				Name:    "wallet-spend-file",
+				Usage:   "File the spends counted against the limits of --wallet-policy are kept in, so that they survive a restart. Without it they are kept in memory and a restart resets them.",
+				EnvVars: []string{"LOTUS_PROXY_WALLET_SPEND_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "worker-cache-ttl",
+				Usage:   "How long the Version, Info, Paths and TaskTypes answers of workers are cached, 0 to not cache them.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"LOTUS_PROXY_WORKER_CACHE_TTL"},
+			},
+			&cli.StringFlag{
+				Name:    "write-api",
+				Usage:   "Address of Lotus miner node that receives every call needing more than read permission. Other calls are balanced across --api nodes. Accepts the same forms as --api.",
+				EnvVars: []string{"LOTUS_WRITE_API"},
+			},
+			&cli.StringFlag{
+				Name:    "fallback-api",
+				Usage:   "Address of a last resort node, such as a public gateway, that serves --fallback-method read calls while no --api node is healthy. It is sent its own token only. Accepts the same forms as --api.",
+				EnvVars: []string{"LOTUS_PROXY_FALLBACK_API"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "fallback-method",
+				Usage:   "Read method, glob or /regex/ that may be sent to the --fallback-api node. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_FALLBACK_METHOD"},
+				Value:   cli.NewStringSlice(defaultFallbackMethods...),
+			},
+			&cli.BoolFlag{
+				Name:    "passthrough-unknown",
+				Usage:   "Send http calls to methods the proxy does not know, such as those of custom lotus extensions, to an upstream node as they are. They are made with the token of the upstream node, whatever the permissions of the client.",
+				EnvVars: []string{"LOTUS_PROXY_PASSTHROUGH_UNKNOWN"},
+			},
+			&cli.Int64Flag{
+				Name:    "passthrough-max-response",
+				Usage:   "Size in bytes past which responses to calls sent by --passthrough-unknown are cut short, 0 for no limit.",
+				EnvVars: []string{"LOTUS_PROXY_PASSTHROUGH_MAX_RESPONSE"},
+				Value:   256 << 20,
+			},
+			&cli.BoolFlag{
+				Name:    "capture-unknown-shapes",
+				Usage:   "Record the shapes of the requests and responses of methods sent by --passthrough-unknown, listed on /admin/unknown-methods.",
+				EnvVars: []string{"LOTUS_PROXY_CAPTURE_UNKNOWN_SHAPES"},
+			},
+			&cli.StringFlag{
+				Name:    "jwt-secret-file",
+				Usage:   "File holding the secret lotus signs api tokens with, either the jwt-hmac-secret key of a lotus keystore or the secret hex encoded. When set, clients must present a lotus token signed with it.",
+				EnvVars: []string{"LOTUS_PROXY_JWT_SECRET_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "token-secret-file",
+				Usage:   "File holding the hex encoded secret the proxy signs its own tokens with, created by auth new-secret. When set, clients must present a token signed with it or with --jwt-secret-file.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_SECRET_FILE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "accept-secret-file",
+				Usage:   "File holding a secret, as --jwt-secret-file does, that tokens may also be signed with, such as the previous secret while the tokens signed with it are replaced. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_ACCEPT_SECRET_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "token-expiry-warning",
+				Usage:   "Lotus tokens in use that expire within it are logged, counted by the tokens_expiring metric and listed on /admin/token-expiry.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_EXPIRY_WARNING"},
+				Value:   72 * time.Hour,
+			},
+			&cli.StringSliceFlag{
+				Name:    "auth-backend",
+				Usage:   "Authenticators tokens are checked against, in order: tokens (--admin-token and minted tokens), jwt (--jwt-secret-file and --token-secret-file), oidc (--oidc-issuer) and upstream (AuthVerify on the upstream node). Defaults to those configured, in that order, leaving out upstream. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_AUTH_BACKEND"},
+			},
+			&cli.DurationFlag{
+				Name:    "auth-verify-cache-ttl",
+				Usage:   "Time the permissions the upstream node gives a token are remembered by the upstream auth backend.",
+				EnvVars: []string{"LOTUS_PROXY_AUTH_VERIFY_CACHE_TTL"},
+				Value:   5 * time.Minute,
+			},
+			&cli.StringFlag{
+				Name:    "oidc-issuer",
+				Usage:   "Url of an OpenID Connect provider whose RSA signed tokens are accepted.",
+				EnvVars: []string{"LOTUS_PROXY_OIDC_ISSUER"},
+			},
+			&cli.StringFlag{
+				Name:    "oidc-audience",
+				Usage:   "Audience tokens of --oidc-issuer must be issued for.",
+				EnvVars: []string{"LOTUS_PROXY_OIDC_AUDIENCE"},
+			},
+			&cli.StringFlag{
+				Name:    "oidc-perm-claim",
+				Usage:   "Claim of --oidc-issuer tokens listing the lotus permissions they grant.",
+				EnvVars: []string{"LOTUS_PROXY_OIDC_PERM_CLAIM"},
+				Value:   "allow",
+			},
+			&cli.StringFlag{
+				Name:    "oidc-groups-claim",
+				Usage:   "Claim of --oidc-issuer tokens listing the groups of their subject, for --oidc-group-perm.",
+				EnvVars: []string{"LOTUS_PROXY_OIDC_GROUPS_CLAIM"},
+				Value:   "groups",
+			},
+			&cli.StringSliceFlag{
+				Name:    "oidc-group-perm",
+				Usage:   "Permission granted to --oidc-issuer tokens whose subject is in a group, as <group>=<permission>. The permission also grants those before it. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_OIDC_GROUP_PERM"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-allow-method",
+				Usage:   "Method rule the tokens of an owner, the subject or label of a token, may call, as <owner>=<method rule>, e.g. explorer=Chain*. Tokens of an owner with allowed methods may call no other. * applies to each other owner. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_ALLOW_METHOD"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-deny-method",
+				Usage:   "Method rule the tokens of an owner may not call, as <owner>=<method rule>. * applies to each other owner. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_DENY_METHOD"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-miner",
+				Usage:   "Address of a miner the tokens of an owner may reach, as <owner>=<miner address>, making them unable to reach any other. * applies to each other owner. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_MINER"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-limit",
+				Usage:   "Rate of calls allowed to the tokens of an owner, the subject or label of a token, as <owner>=<calls per second>/<burst>. * applies to each other owner. Calls over it fail with status 429. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_LIMIT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-quota",
+				Usage:   "Calls allowed to the tokens of an owner per UTC day or month, as <owner>=<calls>/<day|month>, e.g. explorer=100000/day. * applies to each other owner. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_QUOTA"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-concurrency",
+				Usage:   "Calls a token owner may have in flight at once, as <owner>=<calls>, e.g. team-a=8. May be repeated. The limit of * applies to each owner without one of its own.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_CONCURRENCY"},
+			},
+			&cli.IntFlag{
+				Name:    "ip-concurrency",
+				Usage:   "Calls a client address may have in flight at once, 0 for no limit.",
+				EnvVars: []string{"LOTUS_PROXY_IP_CONCURRENCY"},
+			},
+			&cli.DurationFlag{
+				Name:    "concurrency-queue-timeout",
+				Usage:   "How long a call over --token-concurrency or --ip-concurrency waits for another to finish before it is rejected.",
+				Value:   2 * time.Second,
+				EnvVars: []string{"LOTUS_PROXY_CONCURRENCY_QUEUE_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "auth-failure-threshold",
+				Usage:   "Failed authentications from a client address within --auth-failure-window after which it is banned, 0 to never ban.",
+				Value:   10,
+				EnvVars: []string{"LOTUS_PROXY_AUTH_FAILURE_THRESHOLD"},
+			},
+			&cli.DurationFlag{
+				Name:    "auth-failure-window",
+				Usage:   "Period over which the failed authentications of a client address are counted.",
+				Value:   10 * time.Minute,
+				EnvVars: []string{"LOTUS_PROXY_AUTH_FAILURE_WINDOW"},
+			},
+			&cli.DurationFlag{
+				Name:    "auth-failure-delay",
+				Usage:   "Delay of the answer to the first failed authentication of a client address, doubling with each further failure up to 5s, 0 for none.",
+				Value:   100 * time.Millisecond,
+				EnvVars: []string{"LOTUS_PROXY_AUTH_FAILURE_DELAY"},
+			},
+			&cli.DurationFlag{
+				Name:    "auth-ban-duration",
+				Usage:   "How long a client address is banned after --auth-failure-threshold failed authentications, doubling with each ban up to a day.",
+				Value:   15 * time.Minute,
+				EnvVars: []string{"LOTUS_PROXY_AUTH_BAN_DURATION"},
+			},
+			&cli.StringFlag{
+				Name:    "query-templates",
+				Usage:   "JSON file of the named calls the query command runs, each with a method and params holding {{name}} placeholders.",
+				EnvVars: []string{"LOTUS_PROXY_QUERY_TEMPLATES"},
+			},
+			&cli.StringFlag{
+				Name:    "api-key-file",
+				Usage:   "File of the keys accepted in X-API-Key headers, managed with the auth add-key and revoke-key commands and reloaded when it changes.",
+				EnvVars: []string{"LOTUS_PROXY_API_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "signing-key-file",
+				Usage:   "File of the keys clients may sign requests with instead of sending a token, managed with the auth add-signing-key and revoke-signing-key commands and reloaded when it changes.",
+				EnvVars: []string{"LOTUS_PROXY_SIGNING_KEY_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "signature-max-skew",
+				Usage:   "How far the timestamp of a signed request may be from the clock of the proxy.",
+				Value:   5 * time.Minute,
+				EnvVars: []string{"LOTUS_PROXY_SIGNATURE_MAX_SKEW"},
+			},
+			&cli.BoolFlag{
+				Name:    "replay-protection",
+				Usage:   "Reject calls that change state unless their request carries an X-Request-Nonce not seen within --replay-window and a fresh X-Request-Timestamp.",
+				EnvVars: []string{"LOTUS_PROXY_REPLAY_PROTECTION"},
+			},
+			&cli.DurationFlag{
+				Name:    "replay-window",
+				Usage:   "How far the X-Request-Timestamp of a request may be from the clock of the proxy under --replay-protection.",
+				Value:   5 * time.Minute,
+				EnvVars: []string{"LOTUS_PROXY_REPLAY_WINDOW"},
+			},
+			&cli.BoolFlag{
+				Name:    "allow-signing",
+				Usage:   "Serve the methods that sign with the wallets of the node or move its funds, such as WalletSign and MpoolPush, to tokens permitted to call them. They are rejected whatever the token by default.",
+				EnvVars: []string{"LOTUS_PROXY_ALLOW_SIGNING"},
+			},
+			&cli.StringFlag{
+				Name:    "local-unauthenticated-perm",
+				Usage:   "Permission granted to calls made without a token from loopback, such as by sidecar tools, which also grants those before it. Calls forwarded by a proxy are never let through. Disabled by default.",
+				EnvVars: []string{"LOTUS_PROXY_LOCAL_UNAUTHENTICATED_PERM"},
+			},
+			&cli.BoolFlag{
+				Name:    "public-read",
+				Usage:   "Serve the methods of --public-read-method on /rpc/v0 and /rpc/v1 to calls made without a token, from a cache of their own, as the owner public. Other methods and paths still need a token.",
+				EnvVars: []string{"LOTUS_PROXY_PUBLIC_READ"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "public-read-method",
+				Usage:   "Read-only method served without a token by --public-read, named exactly. Replaces the default of miner stats and chain head methods.",
+				Value:   cli.NewStringSlice(defaultPublicMethods...),
+				EnvVars: []string{"LOTUS_PROXY_PUBLIC_READ_METHOD"},
+			},
+			&cli.DurationFlag{
+				Name:    "public-read-ttl",
+				Usage:   "How long the answers served without a token by --public-read are cached.",
+				Value:   30 * time.Second,
+				EnvVars: []string{"LOTUS_PROXY_PUBLIC_READ_TTL"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "cors-allowed-origin",
+				Usage:   "Origin of browser clients allowed to call the rpc routes, such as https://dashboard.example.com, https://*.example.com or *. May be repeated. CORS is disabled without one.",
+				EnvVars: []string{"LOTUS_PROXY_CORS_ALLOWED_ORIGIN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "cors-allowed-method",
+				Usage:   "Method browser clients may use on the rpc routes.",
+				Value:   cli.NewStringSlice(http.MethodPost, http.MethodGet, http.MethodOptions),
+				EnvVars: []string{"LOTUS_PROXY_CORS_ALLOWED_METHOD"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "cors-allowed-header",
+				Usage:   "Header browser clients may send to the rpc routes.",
+				Value:   cli.NewStringSlice("Authorization", "Content-Type", "X-API-Key", sessionHeader),
+				EnvVars: []string{"LOTUS_PROXY_CORS_ALLOWED_HEADER"},
+			},
+			&cli.DurationFlag{
+				Name:    "cors-max-age",
+				Usage:   "How long browsers may cache the answer to a preflight request.",
+				Value:   10 * time.Minute,
+				EnvVars: []string{"LOTUS_PROXY_CORS_MAX_AGE"},
+			},
+			&cli.BoolFlag{
+				Name:    "cors-allow-credentials",
+				Usage:   "Let browser clients send cookies and tls client certificates with their calls. Cannot be combined with the origin *.",
+				EnvVars: []string{"LOTUS_PROXY_CORS_ALLOW_CREDENTIALS"},
+			},
+			&cli.StringFlag{
+				Name:    "call-log-file",
+				Usage:   "File every call is appended to as a JSON line, with the owner of its token, its client address, the hash of its params, its status and latency.",
+				EnvVars: []string{"LOTUS_PROXY_CALL_LOG_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "call-log-params",
+				Usage:   "Also write the params of calls to --call-log-file, except for the methods it redacts.",
+				EnvVars: []string{"LOTUS_PROXY_CALL_LOG_PARAMS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "call-log-redact",
+				Usage:   "Method rule whose params are never written to --call-log-file, in addition to Auth*, Wallet*, *Import* and *Export*. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_CALL_LOG_REDACT"},
+			},
+			&cli.StringFlag{
+				Name:    "subscription-registry-file",
+				Usage:   "File keeping the subscriptions of websocket clients that send an X-Lotus-Proxy-Session header, which are opened again when the proxy restarts until the client connects again with the same session.",
+				EnvVars: []string{"LOTUS_PROXY_SUBSCRIPTION_REGISTRY_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "subscription-registry-ttl",
+				Usage:   "Time the subscriptions of --subscription-registry-file are kept after their client goes away.",
+				EnvVars: []string{"LOTUS_PROXY_SUBSCRIPTION_REGISTRY_TTL"},
+				Value:   10 * time.Minute,
+			},
+			&cli.IntFlag{
+				Name:    "capture-max-bytes",
+				Usage:   "Size the params and result of a call captured for a token flagged on /admin/capture are cut to.",
+				EnvVars: []string{"LOTUS_PROXY_CAPTURE_MAX_BYTES"},
+				Value:   64 << 10,
+			},
+			&cli.DurationFlag{
+				Name:    "capture-retention",
+				Usage:   "Time the calls captured for tokens flagged on /admin/capture are kept in memory.",
+				EnvVars: []string{"LOTUS_PROXY_CAPTURE_RETENTION"},
+				Value:   time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "revocation-file",
+				Usage:   "File the token revocations made on /admin/revocations are kept in, so that they survive a restart.",
+				EnvVars: []string{"LOTUS_PROXY_REVOCATION_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "admin-token",
+				Usage:   "Token that may mint scoped tokens on /admin/tokens. When set, only it, minted tokens and lotus tokens signed with --jwt-secret-file or --token-secret-file are accepted from clients.",
+				EnvVars: []string{"LOTUS_PROXY_ADMIN_TOKEN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "token-rate-class",
+				Usage:   "Rate class that minted tokens may be given, as <name>=<calls per second>/<concurrency>, e.g. slow=1/2. 0 leaves either unbounded. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_RATE_CLASS"},
+			},
+			&cli.DurationFlag{
+				Name:    "token-max-ttl",
+				Usage:   "Longest lifetime of a minted token.",
+				EnvVars: []string{"LOTUS_PROXY_TOKEN_MAX_TTL"},
+				Value:   7 * 24 * time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "api-token",
+				Usage:   "Token for lotus miner nodes given without one. Prefer --api-token-file or --api-token-vault, as command lines are visible to other users of the host.",
+				EnvVars: []string{"LOTUS_API_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "api-token-file",
+				Usage:   "File holding the token for lotus miner nodes given without one, read again every --secret-refresh-interval.",
+				EnvVars: []string{"LOTUS_PROXY_API_TOKEN_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "api-token-vault",
+				Usage:   "Vault secret holding the token for lotus miner nodes given without one, as <path>#<field>, e.g. secret/data/lotus#token. Read again every --secret-refresh-interval.",
+				EnvVars: []string{"LOTUS_PROXY_API_TOKEN_VAULT"},
+			},
+			&cli.StringFlag{
+				Name:    "vault-addr",
+				Usage:   "URL of the vault http api.",
+				EnvVars: []string{"LOTUS_PROXY_VAULT_ADDR", "VAULT_ADDR"},
+			},
+			&cli.StringFlag{
+				Name:    "vault-token",
+				Usage:   "Vault token.",
+				EnvVars: []string{"LOTUS_PROXY_VAULT_TOKEN", "VAULT_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "vault-token-file",
+				Usage:   "File holding the vault token, such as the sink of a vault agent, used when --vault-token is not set.",
+				EnvVars: []string{"LOTUS_PROXY_VAULT_TOKEN_FILE"},
+			},
+			&cli.DurationFlag{
+				Name:    "secret-refresh-interval",
+				Usage:   "How often secrets read from files or vault are read again, so that rotating them needs no restart.",
+				EnvVars: []string{"LOTUS_PROXY_SECRET_REFRESH_INTERVAL"},
+				Value:   time.Minute,
+			},
+			&cli.StringFlag{
+				Name:  "env-file",
+				Usage: "File of KEY=VALUE lines setting environment variables, such as LOTUS_API_TOKEN, that are not set already. Also read from LOTUS_PROXY_ENV_FILE.",
+			},
+			&cli.StringFlag{
+				Name:    "balancer",
+				Usage:   "Strategy used to choose an upstream node for each request: round-robin or latency.",
+				EnvVars: []string{"LOTUS_PROXY_BALANCER"},
+				Value:   "round-robin",
+			},
+			&cli.DurationFlag{
+				Name:    "hedge-delay",
+				Usage:   "Time after which a read call that has not been answered is also sent to a second upstream node, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_HEDGE_DELAY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "quorum-method",
+				Usage:   "Read method, glob or /regex/ sent to several upstream nodes at once, answered with the majority result. Disagreements are logged and counted. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_QUORUM_METHOD"},
+			},
+			&cli.IntFlag{
+				Name:    "quorum-size",
+				Usage:   "Number of upstream nodes asked for each --quorum-method call.",
+				EnvVars: []string{"LOTUS_PROXY_QUORUM_SIZE"},
+				Value:   3,
+			},
+			&cli.Int64Flag{
+				Name:    "max-head-lag",
+				Usage:   "Epochs an upstream node's chain head may lag the most synced node before it stops receiving calls, 0 to ignore chain heads. When set, calls about the head go to the most synced node. Heads are checked with the health probes.",
+				EnvVars: []string{"LOTUS_PROXY_MAX_HEAD_LAG"},
+			},
+			&cli.DurationFlag{
+				Name:    "slow-start",
+				Usage:   "Time over which an upstream node that recovers is ramped up from a trickle to its full share of calls, 0 to send it full traffic at once. Recovered nodes also wait for their chain head to catch up.",
+				EnvVars: []string{"LOTUS_PROXY_SLOW_START"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:    "backend-group",
+				Usage:   "Node of a named backend group, as <group>=<api> where api takes the same forms as --api. May be repeated. The --api nodes form the default group.",
+				EnvVars: []string{"LOTUS_PROXY_BACKEND_GROUP"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "route",
+				Usage:   "Backend group serving a method, glob or /regex/, as <rule>=<group>, e.g. Chain*=chain. May be repeated. A rule naming the method wins, then the first matching pattern. Other methods go to the default group.",
+				EnvVars: []string{"LOTUS_PROXY_ROUTE"},
+			},
+			&cli.Int64Flag{
+				Name:    "max-request-body",
+				Usage:   "Largest body in bytes of a request posted to the proxy, 0 for no limit.",
+				Value:   16 << 20,
+				EnvVars: []string{"LOTUS_PROXY_MAX_REQUEST_BODY"},
+			},
+			&cli.IntFlag{
+				Name:    "max-request-batch",
+				Usage:   "Most calls in a batch request, 0 for no limit.",
+				Value:   100,
+				EnvVars: []string{"LOTUS_PROXY_MAX_REQUEST_BATCH"},
+			},
+			&cli.IntFlag{
+				Name:    "max-request-array",
+				Usage:   "Most elements of an array in the params of a request, 0 for no limit.",
+				Value:   100000,
+				EnvVars: []string{"LOTUS_PROXY_MAX_REQUEST_ARRAY"},
+			},
+			&cli.IntFlag{
+				Name:    "max-request-depth",
+				Usage:   "Deepest nesting of arrays and objects in a request, 0 for no limit.",
+				Value:   64,
+				EnvVars: []string{"LOTUS_PROXY_MAX_REQUEST_DEPTH"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "param-rewrite",
+				Usage:   "Rewrite of a param of the calls a backend group serves, as <group>:<method rule>:<param index>=<op>:<value>, where op is max or min to bound an integer param, or set to replace it with a JSON value. Negative indexes count from the last param. May be repeated, and applied in order.",
+				EnvVars: []string{"LOTUS_PROXY_PARAM_REWRITE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "upstream-weight",
+				Usage:   "Relative share of calls sent to an upstream node, as <address>=<weight>. May be repeated. Upstreams default to a weight of 1.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_WEIGHT"},
+			},
+			&cli.StringFlag{
+				Name:    "consul-service",
+				Usage:   "Consul service whose passing instances replace the --api nodes as they change. Instances may carry their token in the lotus_api_token service meta.",
+				EnvVars: []string{"LOTUS_PROXY_CONSUL_SERVICE"},
+			},
+			&cli.StringFlag{
+				Name:    "consul-tag",
+				Usage:   "Only use instances of --consul-service with this tag.",
+				EnvVars: []string{"LOTUS_PROXY_CONSUL_TAG"},
+			},
+			&cli.StringFlag{
+				Name:    "consul-addr",
+				Usage:   "URL of the consul http api.",
+				EnvVars: []string{"LOTUS_PROXY_CONSUL_ADDR", "CONSUL_HTTP_ADDR"},
+				Value:   "http://127.0.0.1:8500",
+			},
+			&cli.StringFlag{
+				Name:    "consul-token",
+				Usage:   "Consul acl token.",
+				EnvVars: []string{"LOTUS_PROXY_CONSUL_TOKEN", "CONSUL_HTTP_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:    "shadow-api",
+				Usage:   "Address of a shadow lotus node that read calls are mirrored to. Its answers are compared with the primary's and never returned to clients. Accepts the same forms as --api.",
+				EnvVars: []string{"LOTUS_PROXY_SHADOW_API"},
+			},
+			&cli.Float64Flag{
+				Name:    "shadow-sample",
+				Usage:   "Fraction of read calls mirrored to the shadow node.",
+				EnvVars: []string{"LOTUS_PROXY_SHADOW_SAMPLE"},
+				Value:   1,
+			},
+			&cli.DurationFlag{
+				Name:    "shadow-timeout",
+				Usage:   "Time after which a mirrored call to the shadow node is abandoned.",
+				EnvVars: []string{"LOTUS_PROXY_SHADOW_TIMEOUT"},
+				Value:   30 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "shadow-concurrency",
+				Usage:   "Maximum number of mirrored calls in flight. Further calls are not mirrored.",
+				EnvVars: []string{"LOTUS_PROXY_SHADOW_CONCURRENCY"},
+				Value:   16,
+			},
+			&cli.IntFlag{
+				Name:    "breaker-failures",
+				Usage:   "Number of consecutive failed calls that open the circuit breaker of an upstream node, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_BREAKER_FAILURES"},
+				Value:   5,
+			},
+			&cli.Float64Flag{
+				Name:    "breaker-error-rate",
+				Usage:   "Ratio of failed calls within a minute that opens the circuit breaker of an upstream node.",
+				EnvVars: []string{"LOTUS_PROXY_BREAKER_ERROR_RATE"},
+				Value:   0.5,
+			},
+			&cli.IntFlag{
+				Name:    "breaker-min-requests",
+				Usage:   "Number of calls within a minute before the breaker error rate applies.",
+				EnvVars: []string{"LOTUS_PROXY_BREAKER_MIN_REQUESTS"},
+				Value:   20,
+			},
+			&cli.DurationFlag{
+				Name:    "breaker-open-timeout",
+				Usage:   "Time an open circuit breaker rejects calls before letting a probe call through.",
+				EnvVars: []string{"LOTUS_PROXY_BREAKER_OPEN_TIMEOUT"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "upstream-transport",
+				Usage:   "Connection used for calls to upstream nodes: http for a request per call or ws for a persistent websocket.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_TRANSPORT"},
+				Value:   "http",
+			},
+			&cli.StringFlag{
+				Name:    "upstream-ca-file",
+				Usage:   "PEM bundle of the certificate authorities trusted for tls connections to upstream nodes, instead of the system ones.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_CA_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "upstream-cert-file",
+				Usage:   "PEM client certificate presented to upstream nodes over tls. Requires --upstream-key-file.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_CERT_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "upstream-key-file",
+				Usage:   "PEM key of the --upstream-cert-file client certificate.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_KEY_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "upstream-insecure-skip-verify",
+				Usage:   "Do not verify the certificates of upstream nodes. Only for testing.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_INSECURE_SKIP_VERIFY"},
+			},
+			&cli.StringFlag{
+				Name:    "spiffe-svid-dir",
+				Usage:   "Directory that spiffe-helper writes the X.509 SVID of the proxy to, as svid.pem, svid_key.pem and svid_bundle.pem. The SVID is presented to upstream nodes in place of --upstream-cert-file and reloaded when rotated.",
+				EnvVars: []string{"LOTUS_PROXY_SPIFFE_SVID_DIR"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "spiffe-upstream-id",
+				Usage:   "SPIFFE ID accepted from upstream nodes. Defaults to any ID in the trust domain of the proxy. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_SPIFFE_UPSTREAM_ID"},
+			},
+			&cli.BoolFlag{
+				Name:    "listen-spiffe",
+				Usage:   "Serve the listener over mutual tls with the SVID of --spiffe-svid-dir.",
+				EnvVars: []string{"LOTUS_PROXY_LISTEN_SPIFFE"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "spiffe-client-id",
+				Usage:   "SPIFFE ID accepted from clients with --listen-spiffe. Defaults to any ID in the trust domain of the proxy. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_SPIFFE_CLIENT_ID"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-tls-cert-file",
+				Usage:   "PEM certificate the listener is served over tls with. Requires --listen-tls-key-file.",
+				EnvVars: []string{"LOTUS_PROXY_LISTEN_TLS_CERT_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-tls-key-file",
+				Usage:   "PEM private key of --listen-tls-cert-file.",
+				EnvVars: []string{"LOTUS_PROXY_LISTEN_TLS_KEY_FILE"},
+			},
+			&cli.StringFlag{
+				Name:    "listen-client-ca-file",
+				Usage:   "PEM bundle of the certificate authorities that must have issued the certificates of clients. Requires --listen-tls-cert-file.",
+				EnvVars: []string{"LOTUS_PROXY_LISTEN_CLIENT_CA_FILE"},
+			},
+			&cli.BoolFlag{
+				Name:    "require-tls",
+				Usage:   "Reject requests that did not reach the proxy over tls, but for /healthz and /readyz.",
+				EnvVars: []string{"LOTUS_PROXY_REQUIRE_TLS"},
+			},
+			&cli.BoolFlag{
+				Name:    "reject-plaintext-credentials",
+				Usage:   "Reject requests carrying a token or api key over plaintext from other hosts than the proxy's own.",
+				EnvVars: []string{"LOTUS_PROXY_REJECT_PLAINTEXT_CREDENTIALS"},
+			},
+			&cli.BoolFlag{
+				Name:    "trust-forwarded-proto",
+				Usage:   "Take requests with an X-Forwarded-Proto: https header as made over tls. Only set it behind a tls terminating proxy that sets the header.",
+				EnvVars: []string{"LOTUS_PROXY_TRUST_FORWARDED_PROTO"},
+			},
+			&cli.StringFlag{
+				Name:    "tls-redirect-listen",
+				Usage:   "Address to serve redirects from plaintext to the tls listener on, such as :80. Requires --listen-tls-cert-file or --listen-spiffe.",
+				EnvVars: []string{"LOTUS_PROXY_TLS_REDIRECT_LISTEN"},
+			},
+			&cli.DurationFlag{
+				Name:    "hsts-max-age",
+				Usage:   "Max age of the Strict-Transport-Security header set on responses over tls, 0 for none.",
+				EnvVars: []string{"LOTUS_PROXY_HSTS_MAX_AGE"},
+			},
+			&cli.BoolFlag{
+				Name:    "security-headers",
+				Usage:   "Set the X-Content-Type-Options, X-Frame-Options, Referrer-Policy and Content-Security-Policy headers on responses.",
+				Value:   true,
+				EnvVars: []string{"LOTUS_PROXY_SECURITY_HEADERS"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "client-cert-perm",
+				Usage:   "Permission granted to calls made without a token over a client certificate, as <name>=<permission> where name is the common name or a subject alternative name of the certificate. The permission also grants those before it. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_CLIENT_CERT_PERM"},
+			},
+			&cli.DurationFlag{
+				Name:    "upstream-timeout",
+				Usage:   "Time after which a call is failed if it has not been answered, 0 to wait indefinitely. Subscriptions and reader streams are not bounded.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_TIMEOUT"},
+				Value:   time.Minute,
+			},
+			&cli.StringSliceFlag{
+				Name:    "method-timeout",
+				Usage:   "Timeout of a method, glob or /regex/ overriding --upstream-timeout, as <rule>=<duration>, e.g. StateCompute=10m or ChainHead=2s. May be repeated. A rule naming the method wins, then the first matching pattern.",
+				EnvVars: []string{"LOTUS_PROXY_METHOD_TIMEOUT"},
+			},
+			&cli.IntFlag{
+				Name:    "retry-attempts",
+				Usage:   "Times an idempotent call is retried when no upstream node could answer it, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_RETRY_ATTEMPTS"},
+				Value:   2,
+			},
+			&cli.DurationFlag{
+				Name:    "retry-min-delay",
+				Usage:   "Delay before the first retry, growing with each attempt and jittered.",
+				EnvVars: []string{"LOTUS_PROXY_RETRY_MIN_DELAY"},
+				Value:   100 * time.Millisecond,
+			},
+			&cli.DurationFlag{
+				Name:    "retry-max-delay",
+				Usage:   "Maximum delay between retries.",
+				EnvVars: []string{"LOTUS_PROXY_RETRY_MAX_DELAY"},
+				Value:   2 * time.Second,
+			},
+			&cli.Float64Flag{
+				Name:    "retry-budget",
+				Usage:   "Retries allowed per call on average, bounding the extra load retries put on upstream nodes.",
+				EnvVars: []string{"LOTUS_PROXY_RETRY_BUDGET"},
+				Value:   0.1,
+			},
+			&cli.StringSliceFlag{
+				Name:    "method-class",
+				Usage:   "Class of a method, glob or /regex/ overriding the built-in registry, as <rule>=<class> where class is read-only, idempotent or mutating, e.g. MyExtension*=read-only. Read-only methods may be cached, retried, hedged and sent to the fallback node, idempotent ones retried, and mutating ones are never repeated. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_METHOD_CLASS"},
+			},
+			&cli.Float64Flag{
+				Name:    "upstream-rate",
+				Usage:   "Calls per second sent to each upstream node, 0 for no limit. Calls over the limit wait for their turn.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_RATE"},
+			},
+			&cli.IntFlag{
+				Name:    "upstream-concurrency",
+				Usage:   "Calls that may be in flight to each upstream node at once, 0 for no limit. Subscriptions and reader streams are not counted.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_CONCURRENCY"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "upstream-limit",
+				Usage:   "Limit of a class of methods given by a method, glob or /regex/, applied to each upstream node on top of --upstream-rate and --upstream-concurrency, as <rule>=<calls per second>/<concurrency>, e.g. Sectors*=5/2. 0 leaves either unbounded. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_LIMIT"},
+			},
+			&cli.Float64Flag{
+				Name:    "trace-sample-default",
+				Usage:   "Fraction of calls traced, chosen by a hash of their method and params so that a request is traced consistently.",
+				EnvVars: []string{"LOTUS_PROXY_TRACE_SAMPLE_DEFAULT"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "trace-sample",
+				Usage:   "Fraction of the calls of a method, glob or /regex/ traced, overriding --trace-sample-default, as <rule>=<fraction>, e.g. StateCompute=1 or ChainHead=0.01. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_TRACE_SAMPLE"},
+			},
+			&cli.DurationFlag{
+				Name:    "heatmap-bucket",
+				Usage:   "Width of the time buckets of the latency heatmap served on /admin/latency.",
+				EnvVars: []string{"LOTUS_PROXY_HEATMAP_BUCKET"},
+				Value:   time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "heatmap-retention",
+				Usage:   "Time the latency heatmap covers, 0 to disable it.",
+				EnvVars: []string{"LOTUS_PROXY_HEATMAP_RETENTION"},
+				Value:   time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "upstream-keepalive",
+				Usage:   "TCP keepalive period for websocket and reader stream connections to upstream nodes.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_KEEPALIVE"},
+				Value:   30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "upstream-idle-timeout",
+				Usage:   "Time an idle reader stream connection to an upstream node is kept open.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_IDLE_TIMEOUT"},
+				Value:   90 * time.Second,
+			},
+			&cli.IntFlag{
+				Name:    "upstream-max-idle-conns",
+				Usage:   "Maximum number of idle reader stream connections kept open per upstream node.",
+				EnvVars: []string{"LOTUS_PROXY_UPSTREAM_MAX_IDLE_CONNS"},
+				Value:   100,
+			},
+			&cli.DurationFlag{
+				Name:    "reconnect-min-delay",
+				Usage:   "Delay before the first attempt to reconnect to an unreachable node, growing with each attempt.",
+				EnvVars: []string{"LOTUS_PROXY_RECONNECT_MIN_DELAY"},
+				Value:   100 * time.Millisecond,
+			},
+			&cli.DurationFlag{
+				Name:    "reconnect-max-delay",
+				Usage:   "Maximum delay between attempts to reconnect to an unreachable node.",
+				EnvVars: []string{"LOTUS_PROXY_RECONNECT_MAX_DELAY"},
+				Value:   5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "reconnect-wait",
+				Usage:   "Time a call waits for a disconnected upstream node to reconnect before failing.",
+				EnvVars: []string{"LOTUS_PROXY_RECONNECT_WAIT"},
+				Value:   10 * time.Second,
 			},
 			&cli.StringFlag{
-				Name:     "api-token",
-				Usage:    "Token for lotus miner node..",
-				EnvVars:  []string{"LOTUS_API_TOKEN"},
-				Required: true,
+				Name:    "fullnode-api",
+				Usage:   "Address of Lotus full node used to follow the chain, as host:port, multiaddr or <token>:<multiaddr>.",
+				EnvVars: []string{"LOTUS_FULLNODE_API", "FULLNODE_API_INFO"},
+			},
+			&cli.StringFlag{
+				Name:    "fullnode-api-token",
+				Usage:   "Token for lotus full node.",
+				EnvVars: []string{"LOTUS_FULLNODE_API_TOKEN"},
+			},
+			&cli.BoolFlag{
+				Name:    "serve-fullnode",
+				Usage:   "Serve the methods of the full node api the miner api lacks, such as ChainHead and MpoolPending, from --fullnode-api on the rpc endpoints, through the fullnode backend group.",
+				EnvVars: []string{"LOTUS_PROXY_SERVE_FULLNODE"},
+			},
+			&cli.BoolFlag{
+				Name:    "eth-rpc",
+				Usage:   "Serve the eth JSON-RPC api of the fullnode backend group, for FEVM clients, on /rpc/v1 and, with eth_subscribe over websockets, on /eth/rpc/v1.",
+				EnvVars: []string{"LOTUS_PROXY_ETH_RPC"},
+			},
+			&cli.DurationFlag{
+				Name:    "eth-cache-ttl",
+				Usage:   "Time to cache the eth results that do not change, such as blocks and receipts looked up by hash, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_ETH_CACHE_TTL"},
+				Value:   time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "mode",
+				Usage:   "Mode of the proxy: full, or gateway to serve only the reads of the lotus gateway api from --fullnode-api, as a public endpoint.",
+				EnvVars: []string{"LOTUS_PROXY_MODE"},
+				Value:   modeFull,
+			},
+			&cli.DurationFlag{
+				Name:    "gateway-lookback",
+				Usage:   "How far behind the head calls may look in gateway mode.",
+				EnvVars: []string{"LOTUS_PROXY_GATEWAY_LOOKBACK"},
+				Value:   24 * time.Hour,
+			},
+			&cli.Int64Flag{
+				Name:    "gateway-search-limit",
+				Usage:   "Epochs StateSearchMsg and StateWaitMsg may search back in gateway mode, capping the limits given by callers.",
+				EnvVars: []string{"LOTUS_PROXY_GATEWAY_SEARCH_LIMIT"},
+				Value:   20,
+			},
+			&cli.DurationFlag{
+				Name:    "follow-interval",
+				Usage:   "Interval between polls of the full node for a new chain head.",
+				EnvVars: []string{"LOTUS_PROXY_FOLLOW_INTERVAL"},
+				Value:   5 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:    "heavy-method",
+				Usage:   "Method, glob or /regex/ throttled while the miner proves a window post deadline. May be repeated. Requires --fullnode-api.",
+				EnvVars: []string{"LOTUS_PROXY_HEAVY_METHOD"},
+				Value:   cli.NewStringSlice(defaultHeavyMethods...),
+			},
+			&cli.Int64Flag{
+				Name:    "proving-lead-epochs",
+				Usage:   "Epochs before a deadline with partitions opens from which heavy methods are throttled.",
+				EnvVars: []string{"LOTUS_PROXY_PROVING_LEAD_EPOCHS"},
+				Value:   10,
+			},
+			&cli.IntFlag{
+				Name:    "proving-heavy-concurrency",
+				Usage:   "Number of heavy method calls that may run at once while the throttle is active.",
+				EnvVars: []string{"LOTUS_PROXY_PROVING_HEAVY_CONCURRENCY"},
+				Value:   1,
+			},
+			&cli.StringSliceFlag{
+				Name:    "balance-watch",
+				Usage:   "Address and minimum balance in FIL, as <address>=<FIL>, that raises an alert when the balance falls below it. May be repeated. Requires --fullnode-api.",
+				EnvVars: []string{"LOTUS_PROXY_BALANCE_WATCH"},
+			},
+			&cli.StringFlag{
+				Name:    "history-dir",
+				Usage:   "Directory used to retain the history of key metrics, queried on /history. Disabled when empty.",
+				EnvVars: []string{"LOTUS_PROXY_HISTORY_DIR"},
+			},
+			&cli.DurationFlag{
+				Name:    "history-interval",
+				Usage:   "Interval between samples of the metric history.",
+				EnvVars: []string{"LOTUS_PROXY_HISTORY_INTERVAL"},
+				Value:   time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "history-retention",
+				Usage:   "Length of metric history retained.",
+				EnvVars: []string{"LOTUS_PROXY_HISTORY_RETENTION"},
+				Value:   7 * 24 * time.Hour,
 			},
 			&cli.StringFlag{
 				Name:    "listen",
@@ -38,11 +869,180 @@ func main() {
 				EnvVars: []string{"LOTUS_PROXY_LISTEN"},
 				Value:   ":33111",
 			},
+			&cli.DurationFlag{
+				Name:    "health-check-interval",
+				Usage:   "Interval between health probes of each upstream node.",
+				EnvVars: []string{"LOTUS_PROXY_HEALTH_CHECK_INTERVAL"},
+				Value:   10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "health-check-timeout",
+				Usage:   "Time after which a health probe of an upstream node is considered failed.",
+				EnvVars: []string{"LOTUS_PROXY_HEALTH_CHECK_TIMEOUT"},
+				Value:   5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "sector-cache-ttl",
+				Usage:   "Maximum time to cache sector status responses, 0 to disable.",
+				EnvVars: []string{"LOTUS_PROXY_SECTOR_CACHE_TTL"},
+				Value:   10 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "tipset-cache-ttl",
+				Usage:   "Time to cache the responses of read-only calls that name their tipsets, which do not change, 0 to disable. Needs --sector-cache-ttl.",
+				EnvVars: []string{"LOTUS_PROXY_TIPSET_CACHE_TTL"},
+				Value:   time.Hour,
+			},
+			&cli.StringFlag{
+				Name:    "cache-codec",
+				Usage:   "Encoding of cached results: none to keep decoded values, json, gzip-json, or cbor, which encodes chain types in their compact CBOR form and others as json, to save memory at the cost of CPU on each hit.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_CODEC"},
+				Value:   "none",
+			},
+			&cli.IntFlag{
+				Name:    "cache-max-entries",
+				Usage:   "Entries each cache holds at most, 0 for no limit. A full cache drops the entries closest to expiry.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_MAX_ENTRIES"},
+				Value:   100000,
+			},
+			&cli.StringSliceFlag{
+				Name:    "cache-pin",
+				Usage:   "Pattern of cache keys, <method>:<json params> matched as a shell glob, that are kept past expiry and refreshed ahead of it once filled. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_PIN"},
+			},
+			&cli.StringFlag{
+				Name:    "gossip-listen",
+				Usage:   "Internal address on which hot cache entries are served to peer replicas, e.g. :8091.",
+				EnvVars: []string{"LOTUS_PROXY_GOSSIP_LISTEN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "gossip-peer",
+				Usage:   "Gossip address of a peer replica whose hot cache entries are fetched. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_GOSSIP_PEER"},
+			},
+			&cli.StringFlag{
+				Name:    "gossip-secret",
+				Usage:   "Secret shared by the replicas to authenticate gossip, required with --gossip-listen or --gossip-peer.",
+				EnvVars: []string{"LOTUS_PROXY_GOSSIP_SECRET"},
+			},
+			&cli.DurationFlag{
+				Name:    "gossip-interval",
+				Usage:   "Time between fetches of the hot cache entries of peer replicas.",
+				EnvVars: []string{"LOTUS_PROXY_GOSSIP_INTERVAL"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "cache-import-url",
+				Usage:   "Url of a proxy, such as production, whose immutable cache entries are imported at startup. Needs --sector-cache-ttl and --tipset-cache-ttl.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_IMPORT_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "cache-import-token",
+				Usage:   "Token with admin permission on the proxy of --cache-import-url.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_IMPORT_TOKEN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "cache-import-prefix",
+				Usage:   "Prefix of the keys of the cache entries imported, such as StateMinerInfo:. May be repeated. All immutable entries are imported by default.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_IMPORT_PREFIX"},
+			},
+			&cli.Int64Flag{
+				Name:    "cache-import-from-epoch",
+				Usage:   "Earliest epoch of the tipsets of the cache entries imported, -1 for no bound.",
+				Value:   -1,
+				EnvVars: []string{"LOTUS_PROXY_CACHE_IMPORT_FROM_EPOCH"},
+			},
+			&cli.Int64Flag{
+				Name:    "cache-import-to-epoch",
+				Usage:   "Latest epoch of the tipsets of the cache entries imported, -1 for no bound.",
+				Value:   -1,
+				EnvVars: []string{"LOTUS_PROXY_CACHE_IMPORT_TO_EPOCH"},
+			},
+			&cli.BoolFlag{
+				Name:    "cache-ttl-learning",
+				Usage:   "Tune the cache lifetime of each method from how often its results change, starting from --sector-cache-ttl.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_TTL_LEARNING"},
+			},
+			&cli.DurationFlag{
+				Name:    "cache-ttl-min",
+				Usage:   "Shortest cache lifetime --cache-ttl-learning may choose.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_TTL_MIN"},
+				Value:   10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "cache-ttl-max",
+				Usage:   "Longest cache lifetime --cache-ttl-learning may choose.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_TTL_MAX"},
+				Value:   time.Hour,
+			},
+			&cli.DurationFlag{
+				Name:    "cache-revalidate-interval",
+				Usage:   "Interval between background refills of invalidated cache entries, most hit first. 0 drops invalidated entries until a client asks for them again.",
+				EnvVars: []string{"LOTUS_PROXY_CACHE_REVALIDATE_INTERVAL"},
+				Value:   50 * time.Millisecond,
+			},
+			&cli.DurationFlag{
+				Name:    "sector-poll-interval",
+				Usage:   "Interval between polls of the miner for sector state changes.",
+				EnvVars: []string{"LOTUS_PROXY_SECTOR_POLL_INTERVAL"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "ready-when",
+				Usage:   "Expression /readyz reports ready on, of the checks warm, upstream, primary, writer, group:<name>, healthy-upstreams and head-lag joined by AND, OR and NOT, e.g. 'warm AND primary AND head-lag < 3'.",
+				Value:   defaultReadyExpr,
+				EnvVars: []string{"LOTUS_PROXY_READY_WHEN"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "warmup-method",
+				Usage:   "Miner API method without arguments that is called at startup to warm the cache before /readyz reports ready. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_WARMUP_METHOD"},
+			},
+			&cli.StringSliceFlag{
+				Name:    "webhook-url",
+				Usage:   "URL that proxy events are posted to. May be repeated.",
+				EnvVars: []string{"LOTUS_PROXY_WEBHOOK_URL"},
+			},
+			&cli.DurationFlag{
+				Name:    "shutdown-timeout",
+				Usage:   "Time given to calls in flight to finish when the proxy is stopped.",
+				EnvVars: []string{"LOTUS_PROXY_SHUTDOWN_TIMEOUT"},
+				Value:   30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "drain-grace",
+				Usage:   "Time between POST /admin/drain, which makes /readyz report not ready, and the proxy shutting down, giving load balancers time to stop sending it traffic.",
+				EnvVars: []string{"LOTUS_PROXY_DRAIN_GRACE"},
+				Value:   30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:    "shutdown-webhook",
+				Usage:   "URL that a JSON summary of the run is posted to when the proxy stops.",
+				EnvVars: []string{"LOTUS_PROXY_SHUTDOWN_WEBHOOK"},
+			},
+			&cli.IntFlag{
+				Name:    "job-workers",
+				Usage:   "Number of background jobs that may run concurrently.",
+				EnvVars: []string{"LOTUS_PROXY_JOB_WORKERS"},
+				Value:   4,
+			},
+			&cli.StringFlag{
+				Name:    "job-state-file",
+				Usage:   "File used to persist pending background jobs across restarts.",
+				EnvVars: []string{"LOTUS_PROXY_JOB_STATE_FILE"},
+			},
 		},
 		Action:          run,
+		Commands:        []*cli.Command{policyCommand, drillCommand, authCommand, queryCommand},
 		HideHelpCommand: true,
 	}
 
+	if path := envFileArg(os.Args[1:]); path != "" {
+		if err := loadEnvFile(path); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -50,18 +1050,786 @@ func main() {
 }
 
 func run(cctx *cli.Context) error {
+	started := time.Now()
 	ctx, cancel := context.WithCancel(cctx.Context)
 	defer cancel()
 
-	rpcAPI, err := NewProxiedRpcAPI(cctx.String("api-token"), cctx.String("api"))
+	if err := initMetricReporting(15 * time.Second); err != nil {
+		return fmt.Errorf("failed to initialize metrics: %w", err)
+	}
+	pe, promRegistry, err := registerPrometheusExporter("lotus_cpr")
+	if err != nil {
+		return fmt.Errorf("failed to register prometheus exporter: %w", err)
+	}
+
+	balancer, err := newBalancer(cctx.String("balancer"))
+	if err != nil {
+		return err
+	}
+
+	switch cctx.String("upstream-transport") {
+	case "http", "ws":
+	default:
+		return fmt.Errorf("unknown upstream transport %q", cctx.String("upstream-transport"))
+	}
+	tlsConfig, err := loadTLSConfig(cctx.String("upstream-ca-file"), cctx.String("upstream-cert-file"), cctx.String("upstream-key-file"), cctx.Bool("upstream-insecure-skip-verify"))
+	if err != nil {
+		return err
+	}
+	var svid *svidSource
+	if dir := cctx.String("spiffe-svid-dir"); dir != "" {
+		if tlsConfig != nil {
+			return fmt.Errorf("--spiffe-svid-dir cannot be combined with the --upstream-ca-file, --upstream-cert-file, --upstream-key-file and --upstream-insecure-skip-verify flags")
+		}
+		svid, err = newSVIDSource(dir)
+		if err != nil {
+			return fmt.Errorf("failed to load svid: %w", err)
+		}
+		go svid.run(ctx)
+		tlsConfig = svid.clientConfig(splitValues(cctx.StringSlice("spiffe-upstream-id")))
+	} else if cctx.Bool("listen-spiffe") {
+		return fmt.Errorf("--listen-spiffe requires --spiffe-svid-dir")
+	}
+	transport := transportConfig{
+		websocket:    cctx.String("upstream-transport") == "ws",
+		keepAlive:    cctx.Duration("upstream-keepalive"),
+		idleTimeout:  cctx.Duration("upstream-idle-timeout"),
+		maxIdleConns: cctx.Int("upstream-max-idle-conns"),
+		reconnect: backoff{
+			minDelay: cctx.Duration("reconnect-min-delay"),
+			maxDelay: cctx.Duration("reconnect-max-delay"),
+		},
+		reconnectWait: cctx.Duration("reconnect-wait"),
+		tls:           tlsConfig,
+	}
+	transport.apply()
+
+	weights, err := parseWeights(cctx.StringSlice("upstream-weight"))
+	if err != nil {
+		return err
+	}
+
+	apis, err := parseAPIInfos(cctx.StringSlice("api"))
+	if err != nil {
+		return err
+	}
+	var writeAPI *apiInfo
+	if v := cctx.String("write-api"); v != "" {
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		writeAPI = &api
+	}
+	var fallbackAPI *apiInfo
+	if v := cctx.String("fallback-api"); v != "" {
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		fallbackAPI = &api
+	}
+
+	limits, err := parseUpstreamLimits(limitConfig{
+		rate:        cctx.Float64("upstream-rate"),
+		concurrency: cctx.Int("upstream-concurrency"),
+	}, cctx.StringSlice("upstream-limit"))
+	if err != nil {
+		return err
+	}
+
+	groups, err := parseBackendGroups(cctx.StringSlice("backend-group"))
+	if err != nil {
+		return err
+	}
+	var gateway *gatewayMode
+	switch cctx.String("mode") {
+	case modeFull:
+	case modeGateway:
+		switch {
+		case cctx.String("fullnode-api") == "":
+			return fmt.Errorf("--mode gateway needs --fullnode-api")
+		case cctx.Bool("passthrough-unknown"):
+			return fmt.Errorf("--mode gateway cannot be combined with --passthrough-unknown")
+		case len(cctx.StringSlice("miner-api")) > 0 || len(cctx.StringSlice("worker-api")) > 0 || cctx.String("wallet-api") != "" || cctx.String("boost-api") != "":
+			return fmt.Errorf("--mode gateway cannot be combined with --miner-api, --worker-api, --wallet-api or --boost-api")
+		case cctx.Duration("sector-cache-ttl") <= 0 || cctx.Duration("tipset-cache-ttl") <= 0:
+			return fmt.Errorf("--mode gateway needs --sector-cache-ttl and --tipset-cache-ttl")
+		case cctx.Int64("gateway-search-limit") <= 0:
+			return fmt.Errorf("--gateway-search-limit must be positive")
+		}
+		gateway = newGatewayMode(cctx.Duration("gateway-lookback"), abi.ChainEpoch(cctx.Int64("gateway-search-limit")))
+	default:
+		return fmt.Errorf("invalid mode %q, expected %s or %s", cctx.String("mode"), modeFull, modeGateway)
+	}
+	var fullNodeMethods map[string]string
+	if cctx.Bool("serve-fullnode") || gateway != nil {
+		if cctx.String("fullnode-api") == "" {
+			return fmt.Errorf("--serve-fullnode needs --fullnode-api")
+		}
+		api, err := parseAPIInfo(cctx.String("fullnode-api"))
+		if err != nil {
+			return err
+		}
+		if api.token == "" {
+			api.token = cctx.String("fullnode-api-token")
+		}
+		fullNodeMethods = serveFullNode(api, groups)
+		if gateway != nil {
+			// Methods both apis have, such as Version, are answered by the
+			// full node too.
+			for method := range gatewayMethods {
+				fullNodeMethods[method] = fullNodeBackend
+			}
+		}
+	}
+	routes, err := parseBackendRoutes(cctx.StringSlice("route"), groups)
+	if err != nil {
+		return err
+	}
+	routes.methods = fullNodeMethods
+	rewrites, err := parseParamRewrites(cctx.StringSlice("param-rewrite"), groups)
+	if err != nil {
+		return err
+	}
+
+	methodClasses, err = newMethodRegistry(splitValues(cctx.StringSlice("method-class")))
+	if err != nil {
+		return err
+	}
+	if cacheMaxEntries = cctx.Int("cache-max-entries"); cacheMaxEntries < 0 {
+		return fmt.Errorf("--cache-max-entries must not be negative")
+	}
+
+	traceRules, traceRates, err := parseTraceSamples(cctx.StringSlice("trace-sample"))
+	if err != nil {
+		return err
+	}
+	var (
+		tracer    *callTracer
+		exemplars *latencyExemplars
+	)
+	if t := newCallTracer(cctx.Float64("trace-sample-default"), traceRules, traceRates); t.enabled() {
+		tracer = t
+		exemplars = newLatencyExemplars(promRegistry)
+	}
+
+	var heatmap *latencyHeatmap
+	if retention := cctx.Duration("heatmap-retention"); retention > 0 {
+		bucket := cctx.Duration("heatmap-bucket")
+		if bucket <= 0 || bucket > retention {
+			return fmt.Errorf("--heatmap-bucket must be positive and at most --heatmap-retention")
+		}
+		heatmap = newLatencyHeatmap(bucket, retention)
+	}
+
+	apiToken := cctx.String("api-token")
+	tokenSource, err := apiTokenSource(cctx)
+	if err != nil {
+		return err
+	}
+	if tokenSource != nil {
+		if cctx.Duration("secret-refresh-interval") <= 0 {
+			return fmt.Errorf("--secret-refresh-interval must be positive")
+		}
+		if apiToken, err = tokenSource.read(ctx); err != nil {
+			return fmt.Errorf("failed to read api token from %s: %w", tokenSource, err)
+		}
+	}
+	// Upstreams outside the pools that take the token of --api-token.
+	var tokenUpstreams []*upstream
+
+	rpcAPI, err := NewProxiedRpcAPI(poolConfig{
+		authToken:  apiToken,
+		apis:       apis,
+		writeAPI:   writeAPI,
+		balancer:   balancer,
+		hedgeDelay: cctx.Duration("hedge-delay"),
+		breaker: breakerConfig{
+			maxFailures: cctx.Int("breaker-failures"),
+			errorRate:   cctx.Float64("breaker-error-rate"),
+			minRequests: cctx.Int("breaker-min-requests"),
+			window:      time.Minute,
+			openTimeout: cctx.Duration("breaker-open-timeout"),
+		},
+		limits:        limits,
+		transport:     transport,
+		weights:       weights,
+		quorumMethods: splitValues(cctx.StringSlice("quorum-method")),
+		quorumSize:    cctx.Int("quorum-size"),
+		maxHeadLag:    cctx.Int64("max-head-lag"),
+		slowStart:     cctx.Duration("slow-start"),
+
+		fallbackAPI:     fallbackAPI,
+		fallbackMethods: splitValues(cctx.StringSlice("fallback-method")),
+
+		retry: retryConfig{
+			attempts: cctx.Int("retry-attempts"),
+			backoff: backoff{
+				minDelay: cctx.Duration("retry-min-delay"),
+				maxDelay: cctx.Duration("retry-max-delay"),
+			},
+			budget: cctx.Float64("retry-budget"),
+		},
+
+		heatmap:   heatmap,
+		exemplars: exemplars,
+	}, groups, routes, rewrites)
 
 	if err != nil {
 		return fmt.Errorf("failed to create api client: %w", err)
 	}
 	defer rpcAPI.closer()
 
-	rpcServer := jsonrpc.NewServer()
+	if service := cctx.String("consul-service"); service != "" {
+		discovery := newConsulDiscovery(cctx.String("consul-addr"), service, cctx.String("consul-tag"), cctx.String("consul-token"), rpcAPI.pool)
+		go discovery.run(ctx)
+	}
+
+	for _, pool := range rpcAPI.router.groups {
+		health := newHealthChecker(pool, cctx.Duration("health-check-interval"), cctx.Duration("health-check-timeout"))
+		go health.run(ctx)
+	}
+
+	ready := newReadiness(rpcAPI.pool)
+	ready.router = rpcAPI.router
+	if ready.expr, err = parseReadyExpr(cctx.String("ready-when"), groups); err != nil {
+		return err
+	}
+	if usesCheck(ready.expr, "head-lag") && cctx.String("fullnode-api") == "" {
+		return fmt.Errorf("the head-lag check of --ready-when needs --fullnode-api")
+	}
+	if usesCheck(ready.expr, "writer") && writeAPI == nil {
+		return fmt.Errorf("the writer check of --ready-when needs --write-api")
+	}
+
+	jobs, err := newJobScheduler(cctx.Int("job-workers"), cctx.String("job-state-file"))
+	if err != nil {
+		return fmt.Errorf("failed to create job scheduler: %w", err)
+	}
+
+	var webhooks *webhookSender
+	if urls := cctx.StringSlice("webhook-url"); len(urls) > 0 {
+		webhooks = newWebhookSender(urls, jobs)
+	}
+	events := newEventBus(webhooks)
+	go jobs.run(ctx)
+
+	var history *metricHistory
+	if dir := cctx.String("history-dir"); dir != "" {
+		history, err = newMetricHistory(dir, cctx.Duration("history-interval"), cctx.Duration("history-retention"))
+		if err != nil {
+			return fmt.Errorf("failed to open metric history: %w", err)
+		}
+		defer history.close()
+		go history.run(ctx)
+	}
+
+	timeoutRules, timeouts, err := parseMethodTimeouts(cctx.StringSlice("method-timeout"))
+	if err != nil {
+		return err
+	}
+	interceptors := []Interceptor{errorInfoInterceptor, metricsInterceptor}
+	var calls *callLog
+	if file := cctx.String("call-log-file"); file != "" {
+		calls, err = newCallLog(file, cctx.Bool("call-log-params"), splitValues(cctx.StringSlice("call-log-redact")))
+		if err != nil {
+			return err
+		}
+		defer calls.close()
+		go calls.run(ctx)
+		interceptors = append(interceptors, calls.interceptor)
+	}
+	if cctx.Int("capture-max-bytes") <= 0 || cctx.Duration("capture-retention") <= 0 {
+		return fmt.Errorf("--capture-max-bytes and --capture-retention must be positive")
+	}
+	audit := newAuditLog()
+	capture := newPayloadCapture(cctx.Int("capture-max-bytes"), cctx.Duration("capture-retention"), audit)
+	interceptors = append(interceptors, capture.interceptor)
+	interceptors = append(interceptors, permissionInterceptor)
+	if cctx.Bool("allow-signing") {
+		log.Println("signing and fund moving methods are allowed")
+	} else {
+		interceptors = append(interceptors, signingGate)
+	}
+	if gateway != nil {
+		interceptors = append(interceptors, gateway.interceptor)
+	}
+
+	var tokens *tokenIssuer
+	if admin := cctx.String("admin-token"); admin != "" {
+		classes, err := parseRateClasses(cctx.StringSlice("token-rate-class"))
+		if err != nil {
+			return err
+		}
+		tokens = newTokenIssuer(admin, classes, cctx.Duration("token-max-ttl"))
+		interceptors = append(interceptors, tokens.interceptor)
+	}
+	revocations, err := newRevocationList(cctx.String("revocation-file"))
+	if err != nil {
+		return err
+	}
+	expiry := newTokenExpiry(cctx.Duration("token-expiry-warning"))
+	go expiry.run(ctx)
+	authenticators, err := newAuthenticators(cctx, tokens, rpcAPI.upstream, expiry)
+	if err != nil {
+		return err
+	}
+	certPerms, err := parseClientCertPerms(cctx.StringSlice("client-cert-perm"))
+	if err != nil {
+		return err
+	}
+	if len(certPerms) > 0 && cctx.String("listen-client-ca-file") == "" && !cctx.Bool("listen-spiffe") {
+		return fmt.Errorf("--client-cert-perm needs --listen-client-ca-file or --listen-spiffe")
+	}
+	auth := &authStack{authenticators: authenticators, revocations: revocations, certs: certPerms}
+	if cctx.Int("auth-failure-threshold") > 0 || cctx.Duration("auth-failure-delay") > 0 {
+		if cctx.Duration("auth-failure-window") <= 0 {
+			return fmt.Errorf("--auth-failure-window must be positive")
+		}
+		auth.throttle = newAuthThrottle(cctx.Int("auth-failure-threshold"), cctx.Duration("auth-failure-window"), cctx.Duration("auth-failure-delay"), cctx.Duration("auth-ban-duration"))
+	}
+	if perm := cctx.String("local-unauthenticated-perm"); perm != "" {
+		auth.localAllow, err = permissionsUpTo(perm)
+		if err != nil {
+			return err
+		}
+		log.Println("calls from loopback are allowed without a token", "perm", perm)
+	}
+	if file := cctx.String("api-key-file"); file != "" {
+		auth.apiKeys, err = newAPIKeyStore(file)
+		if err != nil {
+			return err
+		}
+		go auth.apiKeys.run(ctx)
+	}
+	if file := cctx.String("signing-key-file"); file != "" {
+		auth.signer, err = newRequestSigner(file, cctx.Duration("signature-max-skew"), cctx.Int64("max-request-body"))
+		if err != nil {
+			return err
+		}
+		go auth.signer.run(ctx)
+	}
+	interceptors = append(interceptors, auth.revocationInterceptor)
+	tokenACLs, err := parseOwnerACLs(cctx.StringSlice("token-allow-method"), cctx.StringSlice("token-deny-method"))
+	if err != nil {
+		return err
+	}
+	interceptors = append(interceptors, tokenACLs.interceptor)
+	scopes, err := parseMinerScopes(cctx.StringSlice("token-miner"))
+	if err != nil {
+		return err
+	}
+	interceptors = append(interceptors, scopes.interceptor(newMinerSelf(rpcAPI.upstream)))
+	var replays *replayGuard
+	if cctx.Bool("replay-protection") {
+		if cctx.Duration("replay-window") <= 0 {
+			return fmt.Errorf("--replay-window must be positive")
+		}
+		replays = newReplayGuard(cctx.Duration("replay-window"))
+		interceptors = append(interceptors, replays.interceptor)
+		log.Println("calls that change state need a request nonce", "window", cctx.Duration("replay-window"))
+	}
+	tokenRates, err := parseTokenRates(cctx.StringSlice("token-limit"))
+	if err != nil {
+		return err
+	}
+	tokenQuotas, err := parseTokenQuotas(cctx.StringSlice("token-quota"))
+	if err != nil {
+		return err
+	}
+	var tokenLimiter *tokenLimits
+	if len(tokenRates) > 0 || len(tokenQuotas) > 0 {
+		tokenLimiter = newTokenLimits(tokenRates, tokenQuotas)
+		interceptors = append(interceptors, tokenLimiter.interceptor)
+	}
+	// access are the interceptors above checking the token of a call, which
+	// the other apis served apply as the rpc endpoints do.
+	access := []Interceptor{permissionInterceptor}
+	if !cctx.Bool("allow-signing") {
+		access = append(access, signingGate)
+	}
+	if tokens != nil {
+		access = append(access, tokens.interceptor)
+	}
+	access = append(access, auth.revocationInterceptor, tokenACLs.interceptor)
+	if replays != nil {
+		access = append(access, replays.interceptor)
+	}
+	if tokenLimiter != nil {
+		access = append(access, tokenLimiter.interceptor)
+	}
+	tokenConcurrency, err := parseTokenConcurrency(cctx.StringSlice("token-concurrency"))
+	if err != nil {
+		return err
+	}
+	var concurrency *concurrencyLimits
+	if len(tokenConcurrency) > 0 || cctx.Int("ip-concurrency") > 0 {
+		concurrency = newConcurrencyLimits(tokenConcurrency, cctx.Int("ip-concurrency"), cctx.Duration("concurrency-queue-timeout"))
+		interceptors = append(interceptors, concurrency.interceptor)
+	}
+	// raw are the interceptors above applied to the calls answered from raw
+	// JSON, such as raw cache hits and eth calls, which do not pass them.
+	var raw rawCalls
+	if calls != nil {
+		raw = append(raw, calls.interceptor)
+	}
+	raw = append(raw, capture.interceptor)
+	raw = append(raw, access...)
+	if concurrency != nil {
+		raw = append(raw, concurrency.interceptor)
+	}
+	if file := cctx.String("subscription-registry-file"); file != "" {
+		if cctx.Duration("subscription-registry-ttl") <= 0 {
+			return fmt.Errorf("--subscription-registry-ttl must be positive")
+		}
+		registry, err := newSubscriptionRegistry(file, cctx.Duration("subscription-registry-ttl"))
+		if err != nil {
+			return err
+		}
+		interceptors = append(interceptors, registry.interceptor)
+		go registry.restore(ctx, rpcAPI.router.invoke)
+	}
+	if cctx.Bool("public-read") {
+		public, err := newPublicRead(splitValues(cctx.StringSlice("public-read-method")), cctx.Duration("public-read-ttl"))
+		if err != nil {
+			return err
+		}
+		auth.public = public.payload
+		interceptors = append(interceptors, public.interceptor)
+		log.Println("calls without a token are served the public methods", "ttl", cctx.Duration("public-read-ttl"))
+	}
+
+	if tracer != nil {
+		trace.RegisterExporter(tracer)
+		interceptors = append(interceptors, tracer.interceptor)
+	}
+	interceptors = append(interceptors, timeoutInterceptor(cctx.Duration("upstream-timeout"), timeoutRules, timeouts))
+	var sectorCache *responseCache
+	if ttl := cctx.Duration("sector-cache-ttl"); ttl > 0 {
+		sectorCache = newResponseCache()
+		sectorCache.codec, err = newCacheCodec(cctx.String("cache-codec"))
+		if err != nil {
+			return err
+		}
+		if pins := cctx.StringSlice("cache-pin"); len(pins) > 0 {
+			for _, pattern := range pins {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid cache pin %q: %w", pattern, err)
+				}
+			}
+			sectorCache.pins = pins
+			go sectorCache.refreshPins(ctx, time.Second)
+		}
+		if cctx.Bool("cache-ttl-learning") {
+			sectorCache.learn = newTTLLearner("sectors", cctx.Duration("cache-ttl-min"), cctx.Duration("cache-ttl-max"))
+		}
+		if interval := cctx.Duration("cache-revalidate-interval"); interval > 0 {
+			sectorCache.revalidate = newRevalidator("sectors", interval)
+			go sectorCache.revalidate.run(ctx)
+		}
+		interceptors = append(interceptors, cachingInterceptor(sectorCache, "sectors", sectorCacheTTLs(ttl), cctx.Duration("tipset-cache-ttl")))
+
+		listen, peers := cctx.String("gossip-listen"), cctx.StringSlice("gossip-peer")
+		if listen != "" || len(peers) > 0 {
+			secret := cctx.String("gossip-secret")
+			if secret == "" {
+				return fmt.Errorf("--gossip-secret is required for cache gossip")
+			}
+			gossip := newCacheGossip(sectorCache, "sectors", sectorCacheTTLs(ttl), secret, peers, cctx.Duration("gossip-interval"))
+			if listen != "" {
+				go func() {
+					if err := gossip.listenAndServe(ctx, listen); err != nil {
+						log.Println("gossip server failed", "error", err)
+					}
+				}()
+			}
+			if len(peers) > 0 {
+				go gossip.run(ctx)
+			}
+		}
+	}
+	watcher := newSectorWatcher(rpcAPI.upstream, sectorCache, events, cctx.Duration("sector-poll-interval"))
+	go watcher.run(ctx)
+
+	var (
+		feed        *actorFeed
+		mpoolSubs   *mpoolFeed
+		fullNodeAPI lotusapi.FullNode
+	)
+	if v := cctx.String("fullnode-api"); v != "" {
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		fullNodeClient, fullNodeCloser, err := newFullNodeClient(ctx, api.tokenOr(cctx.String("fullnode-api-token")), api, transport.reconnect)
+		if err != nil {
+			return fmt.Errorf("failed to create full node client: %w", err)
+		}
+		defer fullNodeCloser()
+		fullNodeAPI = fullNodeClient
+
+		follower := newChainFollower(fullNodeAPI, cctx.Duration("follow-interval"))
+		ready.requireHead(follower)
+		if gateway != nil {
+			gateway.heights = newTipSetHeights(fullNodeAPI)
+			follower.onHead(gateway.onHead)
+		}
+		feed = newActorFeed(fullNodeAPI)
+		follower.onHead(feed.onHead)
+
+		heavy, err := parseMethodRules(splitValues(cctx.StringSlice("heavy-method")))
+		if err != nil {
+			return err
+		}
+		throttle := newDeadlineThrottle(rpcAPI.upstream, fullNodeAPI, abi.ChainEpoch(cctx.Int64("proving-lead-epochs")), heavy, cctx.Int("proving-heavy-concurrency"))
+		follower.onHead(throttle.onHead)
+
+		watches, err := parseBalanceWatches(cctx.StringSlice("balance-watch"))
+		if err != nil {
+			return err
+		}
+		if len(watches) > 0 {
+			follower.onHead(newBalanceWatcher(fullNodeAPI, events, watches).onHead)
+		}
+		interceptors = append(interceptors, throttle.interceptor)
+		go follower.run(ctx)
+
+		mpoolSubs = newMpoolFeed(fullNodeAPI)
+		interceptors = append(interceptors, mpoolSubs.interceptor)
+		go mpoolSubs.run(ctx)
+	}
+
+	var shadow *shadowMirror
+	if v := cctx.String("shadow-api"); v != "" {
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		u, err := newUpstream(api.tokenOr(apiToken), api, transport)
+		if err != nil {
+			return fmt.Errorf("failed to create shadow client: %w", err)
+		}
+		defer u.close()
+		u.flagToken = api.token == ""
+		tokenUpstreams = append(tokenUpstreams, u)
+
+		shadow = newShadowMirror(u, cctx.Float64("shadow-sample"), cctx.Duration("shadow-timeout"), cctx.Int("shadow-concurrency"))
+		interceptors = append(interceptors, shadow.interceptor)
+	}
+	rpcAPI.Intercept(interceptors...)
+
+	var export *cacheExport
+	if sectorCache != nil {
+		export = &cacheExport{cache: sectorCache}
+		if fullNodeAPI != nil {
+			export.heights = newTipSetHeights(fullNodeAPI)
+		}
+	}
+	if base := cctx.String("cache-import-url"); base != "" {
+		if sectorCache == nil || cctx.Duration("tipset-cache-ttl") <= 0 {
+			return fmt.Errorf("--cache-import-url needs --sector-cache-ttl and --tipset-cache-ttl")
+		}
+		imp := &cacheImport{
+			cache:    sectorCache,
+			base:     base,
+			token:    cctx.String("cache-import-token"),
+			prefixes: splitValues(cctx.StringSlice("cache-import-prefix")),
+			epochs:   epochRange{from: cctx.Int64("cache-import-from-epoch"), to: cctx.Int64("cache-import-to-epoch")},
+			ttl:      cctx.Duration("tipset-cache-ttl"),
+			client:   &http.Client{Timeout: 10 * time.Minute},
+		}
+		go func() {
+			n, err := imp.run(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("failed to import cache entries", "from", base, "imported", n, "error", err)
+				}
+				return
+			}
+			log.Println("imported cache entries", "from", base, "entries", n)
+		}()
+	}
+
+	if methods := cctx.StringSlice("warmup-method"); len(methods) > 0 {
+		prefetch, err := newPrefetcher(rpcAPI.minerAPI, methods)
+		if err != nil {
+			return fmt.Errorf("invalid warm-up method: %w", err)
+		}
+		go prefetch.run(ctx, ready.require("prefetch"))
+	}
+
+	// The miner API is the same in both versions. The full node API is
+	// served as v1 on /rpc/v1, and as v0 on /rpc/v0 through the adapter lotus
+	// serves its own v0 endpoint with, so that its calls reach the upstream
+	// nodes as v1 calls either way.
+	rpcServer, rpcServerV0 := jsonrpc.NewServer(), jsonrpc.NewServer()
+	if rpcAPI.fullAPI != nil {
+		// Registered first so that the miner API serves the methods both
+		// share. Either way they are routed by name.
+		rpcServer.Register("Filecoin", rpcAPI.fullAPI)
+		rpcServerV0.Register("Filecoin", &v0api.WrapperV1Full{FullNode: rpcAPI.fullAPI})
+	}
 	rpcServer.Register("Filecoin", rpcAPI.minerAPI)
+	rpcServerV0.Register("Filecoin", rpcAPI.minerAPI)
+
+	var rpcHandler, rpcHandlerV0 http.Handler = rpcServer, rpcServerV0
+	if sectorCache != nil {
+		ttls := sectorCacheTTLs(cctx.Duration("sector-cache-ttl"))
+		if gateway != nil {
+			ttls = gateway.cacheTTLs(ttls)
+		}
+		rpcHandler = rawCacheHandler(sectorCache, "sectors", "Filecoin", ttls, scopes, tokenACLs, raw, rpcHandler)
+		rpcHandlerV0 = rawCacheHandler(sectorCache, "sectors", "Filecoin", ttls, scopes, tokenACLs, raw, rpcHandlerV0)
+	}
+	var shapes *shapeRecorder
+	if cctx.Bool("passthrough-unknown") {
+		if cctx.Bool("capture-unknown-shapes") {
+			shapes = newShapeRecorder()
+		}
+		apis := []interface{}{rpcAPI.minerAPI}
+		if rpcAPI.fullAPI != nil {
+			apis = append(apis, rpcAPI.fullAPI)
+		}
+		passthrough := newPassthrough(rpcAPI.router, "Filecoin", shapes, tokenACLs, apis...)
+		passthrough.maxResponse = cctx.Int64("passthrough-max-response")
+		passthrough.calls = raw
+		rpcHandler = passthrough.handler(rpcHandler)
+		rpcHandlerV0 = passthrough.handler(rpcHandlerV0)
+	}
+
+	var eth *ethProxy
+	if cctx.Bool("eth-rpc") {
+		pool, ok := rpcAPI.router.groups[fullNodeBackend]
+		if !ok {
+			return fmt.Errorf("--eth-rpc needs the fullnode backend group, such as that of --serve-fullnode")
+		}
+		eth = newEthProxy(pool, tokenACLs, cctx.Duration("eth-cache-ttl"))
+		eth.readOnly = gateway != nil
+		eth.calls = raw
+		rpcHandler = eth.handler(rpcHandler)
+	}
+
+	minerAPIs, err := parseAPIInfos(cctx.StringSlice("miner-api"))
+	if err != nil {
+		return err
+	}
+	var miners []*minerNode
+	if len(minerAPIs) > 0 {
+		minerInterceptors := append([]Interceptor{errorInfoInterceptor}, access...)
+		primary, err := newMinerNode(ctx, rpcAPI.upstream, rpcAPI.minerAPI)
+		if err != nil {
+			return fmt.Errorf("failed to resolve miner: %w", err)
+		}
+		miners = append(miners, primary)
+
+		for _, api := range minerAPIs {
+			u, err := newUpstream(api.tokenOr(apiToken), api, transport)
+			if err != nil {
+				return fmt.Errorf("failed to create miner client: %w", err)
+			}
+			defer u.close()
+			u.flagToken = api.token == ""
+			tokenUpstreams = append(tokenUpstreams, u)
+
+			// Served through the token checks and miner scopes, which calls
+			// on the upstream's own api would bypass.
+			var served lotusapi.StorageMinerStruct
+			proxyAPI(u.invoke, &served, append(minerInterceptors[:len(minerInterceptors):len(minerInterceptors)], scopes.interceptor(newMinerSelf(u.api)))...)
+			m, err := newMinerNode(ctx, u.api, &served)
+			if err != nil {
+				return fmt.Errorf("failed to resolve miner at %s: %w", api.addr, err)
+			}
+			miners = append(miners, m)
+		}
+	}
+
+	workerAPIs, err := parseWorkerAPIs(cctx.StringSlice("worker-api"))
+	if err != nil {
+		return err
+	}
+	var workers []*workerNode
+	for name, api := range workerAPIs {
+		w, err := newWorkerNode(name, api.tokenOr(apiToken), api, transport, cctx.Duration("worker-cache-ttl"), append([]Interceptor{errorInfoInterceptor}, access...)...)
+		if err != nil {
+			return err
+		}
+		defer w.closer()
+		workers = append(workers, w)
+	}
+
+	var boost *boostNode
+	if v := cctx.String("boost-api"); v != "" {
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		if err := transport.check(api); err != nil {
+			return err
+		}
+		boost = newBoostNode(api.token, api, tokenACLs, cctx.Duration("boost-cache-ttl"))
+		boost.calls = raw
+	}
+
+	caches := map[string]*responseCache{}
+	if sectorCache != nil {
+		caches["sectors"] = sectorCache
+	}
+	if eth != nil {
+		caches["eth"] = eth.cache
+	}
+	if boost != nil {
+		caches["boost"] = boost.cache
+	}
+	// The Proxy namespace does not pass the interceptors restricting gateway
+	// mode, so it is left out of it.
+	if gateway == nil {
+		registerProxyNamespace(&ProxyState{
+			router: rpcAPI.router,
+			caches: caches,
+			full:   fullNodeAPI,
+			miners: miners,
+			access: access,
+		}, rpcServer, rpcServerV0)
+	}
+
+	var wallet *walletNode
+	if v := cctx.String("wallet-api"); v != "" {
+		if cctx.String("wallet-policy") == "" {
+			return fmt.Errorf("--wallet-api needs --wallet-policy")
+		}
+		if !cctx.Bool("allow-signing") {
+			return fmt.Errorf("--wallet-api needs --allow-signing")
+		}
+		policy, err := loadWalletPolicy(cctx.String("wallet-policy"), cctx.String("wallet-spend-file"))
+		if err != nil {
+			return err
+		}
+		api, err := parseAPIInfo(v)
+		if err != nil {
+			return err
+		}
+		walletInterceptors := append([]Interceptor{errorInfoInterceptor}, access...)
+		if cctx.String("wallet-spend-file") == "" {
+			log.Println("wallet spends are kept in memory, so a restart resets the spend limits")
+		}
+		wallet, err = newWalletNode(api.tokenOr(apiToken), api, transport, policy, walletInterceptors...)
+		if err != nil {
+			return err
+		}
+		defer wallet.closer()
+	}
+
+	if tokenSource != nil {
+		go watchSecret(ctx, tokenSource, cctx.Duration("secret-refresh-interval"), apiToken, func(token string) {
+			rpcAPI.router.setAuthToken(token)
+			for _, u := range tokenUpstreams {
+				if u.flagToken {
+					u.setToken(token)
+				}
+			}
+		})
+	}
 
 	// Set up a signal handler to cancel the context
 	go func() {
@@ -79,25 +1847,166 @@ func run(cctx *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %w", cctx.String("listen"), err)
 	}
+	switch certFile := cctx.String("listen-tls-cert-file"); {
+	case cctx.Bool("listen-spiffe") && certFile != "":
+		return fmt.Errorf("--listen-spiffe and --listen-tls-cert-file cannot be used together")
+	case cctx.Bool("listen-spiffe"):
+		listener = tls.NewListener(listener, svid.serverConfig(splitValues(cctx.StringSlice("spiffe-client-id"))))
+	case certFile != "":
+		cfg, err := loadListenerTLS(certFile, cctx.String("listen-tls-key-file"), cctx.String("listen-client-ca-file"))
+		if err != nil {
+			return err
+		}
+		listener = tls.NewListener(listener, cfg)
+	case cctx.String("listen-client-ca-file") != "":
+		return fmt.Errorf("--listen-client-ca-file needs --listen-tls-cert-file")
+	}
+	listenTLS := cctx.Bool("listen-spiffe") || cctx.String("listen-tls-cert-file") != ""
+	if cctx.Bool("require-tls") && !listenTLS && !cctx.Bool("trust-forwarded-proto") {
+		return fmt.Errorf("--require-tls needs --listen-tls-cert-file, --listen-spiffe or --trust-forwarded-proto")
+	}
+	if addr := cctx.String("tls-redirect-listen"); addr != "" {
+		if !listenTLS {
+			return fmt.Errorf("--tls-redirect-listen needs --listen-tls-cert-file or --listen-spiffe")
+		}
+		redirect, err := newTLSRedirect(address)
+		if err != nil {
+			return fmt.Errorf("invalid --listen %q: %w", address, err)
+		}
+		go func() {
+			if err := redirect.listenAndServe(ctx, addr); err != nil {
+				log.Println("tls redirect server failed", "error", err)
+			}
+		}()
+	}
 
 	mux := mux.NewRouter()
 
-	mux.Use(ValidateToken)
-	mux.Handle("/rpc/v0", rpcServer)
-	mux.Handle("/rpc/v1", rpcServer)
-	mux.PathPrefix("/").Handler(http.DefaultServeMux)
+	// Probes are served without a token so that load balancers can use them.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/readyz", ready)
+
+	reqLimits := requestLimits{
+		maxBody:  cctx.Int64("max-request-body"),
+		maxBatch: cctx.Int("max-request-batch"),
+		maxArray: cctx.Int("max-request-array"),
+		maxDepth: cctx.Int("max-request-depth"),
+	}
+	authed := mux.PathPrefix("/").Subrouter()
+	authed.Use(auth.ValidateToken, reqLimits.handler)
+	if replays != nil {
+		authed.Use(replays.handler)
+	}
+	authed.Use(StickySessions)
+	authed.Handle("/rpc/v0", ClassifyErrors(rpcHandlerV0))
+	authed.Handle("/rpc/v1", ClassifyErrors(rpcHandler))
+	if eth != nil {
+		authed.Handle("/eth/rpc/v1", eth)
+	}
+	authed.Handle("/events", events)
+	if exemplars != nil {
+		// Exemplars are only written in the OpenMetrics format, which the
+		// exporter does not serve.
+		authed.Handle("/metrics", promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	} else {
+		authed.Handle("/metrics", pe)
+	}
+	admin := &adminAPI{
+		pool:        rpcAPI.pool,
+		jobs:        jobs,
+		shadow:      shadow,
+		tracer:      tracer,
+		tokens:      tokens,
+		shapes:      shapes,
+		heatmap:     heatmap,
+		audit:       audit,
+		capture:     capture,
+		expiry:      expiry,
+		tokenLimits: tokenLimiter,
+		revocations: revocations,
+		router:      rpcAPI.router,
+		cacheExport: export,
+		config:      effectiveConfig(cctx),
+
+		ready:      ready,
+		drainGrace: cctx.Duration("drain-grace"),
+	}
+	admin.route(authed)
+	if history != nil {
+		authed.Handle("/history", history)
+	}
+	for _, m := range miners {
+		m.route(authed)
+	}
+	for _, w := range workers {
+		w.route(authed)
+	}
+	if wallet != nil {
+		wallet.route(authed)
+	}
+	if boost != nil {
+		boost.route(authed)
+	}
+	if feed != nil {
+		authed.Handle("/feed/actors", feed)
+	}
+	if mpoolSubs != nil {
+		authed.Handle("/feed/mpool", mpoolSubs)
+	}
+	authed.PathPrefix("/").Handler(http.DefaultServeMux)
 
+	var handler http.Handler = mux
+	if origins := splitValues(cctx.StringSlice("cors-allowed-origin")); len(origins) > 0 {
+		cors, err := newCORSPolicy(origins, splitValues(cctx.StringSlice("cors-allowed-method")), splitValues(cctx.StringSlice("cors-allowed-header")), cctx.Duration("cors-max-age"), cctx.Bool("cors-allow-credentials"))
+		if err != nil {
+			return err
+		}
+		handler = cors.handler(mux)
+	}
+	security := &transportSecurity{
+		requireTLS:       cctx.Bool("require-tls"),
+		rejectPlainCreds: cctx.Bool("reject-plaintext-credentials"),
+		trustForwarded:   cctx.Bool("trust-forwarded-proto"),
+		hstsMaxAge:       cctx.Duration("hsts-max-age"),
+		headers:          cctx.Bool("security-headers"),
+	}
+	handler = security.handler(handler)
 	srv := &http.Server{
-		Handler: mux,
+		Handler: handler,
 	}
 
+	log.Println("Starting RPC server", "addr", cctx.String("listen"))
+	served := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		if err := srv.Shutdown(context.Background()); err != nil {
-			log.Println(err, "failed to shut down RPC server")
-		}
+		served <- srv.Serve(listener)
 	}()
 
-	log.Println("Starting RPC server", "addr", cctx.String("listen"))
-	return srv.Serve(listener)
+	var serveErr error
+	reason := "signal"
+	select {
+	case serveErr = <-served:
+		reason = fmt.Sprintf("server failed: %v", serveErr)
+	case <-ctx.Done():
+	case <-ready.draining():
+		grace := cctx.Duration("drain-grace")
+		log.Println("shutting down after drain grace period", "grace", grace)
+		select {
+		case serveErr = <-served:
+			reason = fmt.Sprintf("server failed: %v", serveErr)
+		case <-ctx.Done():
+		case <-time.After(grace):
+			reason = "drained"
+		}
+	}
+
+	report := shutdown(srv, rpcAPI.router, sectorCache, started, reason, cctx.Duration("shutdown-timeout"))
+	report.log()
+	if url := cctx.String("shutdown-webhook"); url != "" {
+		if err := report.post(url, 10*time.Second); err != nil {
+			log.Println("failed to post shutdown report", "url", url, "error", err)
+		}
+	}
+	return serveErr
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// methodACL permits the methods matching allow, or every method when allow
+// is empty, except those matching deny.
+type methodACL struct {
+	allow methodRules
+	deny  methodRules
+}
+
+func newMethodACL(allow, deny []string) (methodACL, error) {
+	a, err := parseMethodRules(allow)
+	if err != nil {
+		return methodACL{}, err
+	}
+	d, err := parseMethodRules(deny)
+	if err != nil {
+		return methodACL{}, err
+	}
+	return methodACL{allow: a, deny: d}, nil
+}
+
+func (a methodACL) permits(method string) bool {
+	if a.deny.match(method) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.match(method)
+}
+
+// methodACLs holds the method lists of each token owner, with those of *
+// applying to owners without lists of their own.
+type methodACLs map[string]methodACL
+
+// parseOwnerACLs parses allow and deny values of the form
+// <owner>=<method rule> into the method lists of each token owner.
+func parseOwnerACLs(allow, deny []string) (methodACLs, error) {
+	patterns := map[string][2][]string{}
+	for i, values := range [][]string{allow, deny} {
+		for _, v := range splitValues(values) {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid token method rule %q, expected <owner>=<method rule>", v)
+			}
+			p := patterns[parts[0]]
+			p[i] = append(p[i], parts[1])
+			patterns[parts[0]] = p
+		}
+	}
+
+	acls := methodACLs{}
+	for owner, p := range patterns {
+		acl, err := newMethodACL(p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+		acls[owner] = acl
+	}
+	return acls, nil
+}
+
+// permits reports whether the token of the request ctx belongs to may call
+// method: whether the lists of its owner, and those the token carries
+// itself, permit it.
+func (a methodACLs) permits(ctx context.Context, method string) bool {
+	if p := jwtPayloadFrom(ctx); p != nil && !p.acl.permits(method) {
+		return false
+	}
+	owner := tokenOwner(ctx)
+	if owner == "" {
+		return true
+	}
+	acl, ok := a[owner]
+	if !ok {
+		acl = a["*"]
+	}
+	return acl.permits(method)
+}
+
+// interceptor rejects calls to methods the token of the request may not
+// call.
+func (a methodACLs) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if !a.permits(ctx, call.Method) {
+			return call.errorResult(fmt.Errorf("%s: %w", call.Method, errTokenScope))
+		}
+		return next(ctx, call)
+	}
+}
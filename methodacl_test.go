@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestMethodACLsPermits(t *testing.T) {
+	acls, err := parseOwnerACLs([]string{"team-a=State*", "*=Chain*"}, []string{"team-a=StateWaitMsg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenACL, err := newMethodACL([]string{"ChainHead", "StateGetActor"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload *jwtPayload
+		method  string
+		want    bool
+	}{
+		{"no token", nil, "MpoolPush", true},
+		{"owner allowed", &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}}, "StateGetActor", true},
+		{"owner denied", &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}}, "StateWaitMsg", false},
+		{"owner not allowed", &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}}, "ChainHead", false},
+		{"other owner", &jwtPayload{Payload: jwt.Payload{Subject: "team-b"}}, "ChainHead", true},
+		{"other owner not allowed", &jwtPayload{Payload: jwt.Payload{Subject: "team-b"}}, "StateGetActor", false},
+		{"token list", &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, acl: tokenACL}, "StateGetActor", true},
+		{"token list and owner", &jwtPayload{Payload: jwt.Payload{Subject: "team-b"}, acl: tokenACL}, "StateGetActor", false},
+		{"token list without owner", &jwtPayload{acl: tokenACL}, "ChainHead", true},
+		{"token list without owner, not allowed", &jwtPayload{acl: tokenACL}, "MpoolPush", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.payload != nil {
+				ctx = context.WithValue(ctx, jwtPayloadKey{}, tt.payload)
+			}
+			if got := acls.permits(ctx, tt.method); got != tt.want {
+				t.Errorf("permits(%q) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// methodClass tells how safe a method is to repeat, cache and send to any
+// upstream node.
+type methodClass int
+
+const (
+	// classReadOnly methods do not change the state of the node, so their
+	// results may be cached, and calls retried, hedged or sent to any node.
+	classReadOnly methodClass = iota
+	// classIdempotent methods change the state of the node, but repeating
+	// them has no further effect, so they may be retried.
+	classIdempotent
+	// classMutating methods change the state of the node with every call,
+	// so they are never repeated.
+	classMutating
+)
+
+var methodClassNames = []string{"read-only", "idempotent", "mutating"}
+
+func (c methodClass) String() string {
+	return methodClassNames[c]
+}
+
+func parseMethodClass(s string) (methodClass, error) {
+	for i, name := range methodClassNames {
+		if s == name {
+			return methodClass(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown method class %q, expected one of %s", s, strings.Join(methodClassNames, ", "))
+}
+
+// builtinMethodClasses classifies the lotus methods whose permission tells
+// their class wrongly. Other methods are read-only when they need read
+// permission, and mutating otherwise.
+var builtinMethodClasses = []string{
+	"MpoolPush*=mutating",
+	"DealsSet*=idempotent",
+	"MarketSetAsk=idempotent",
+	"MarketSetRetrievalAsk=idempotent",
+	"MpoolSetConfig=idempotent",
+	"NetBlockAdd=idempotent",
+	"NetBlockRemove=idempotent",
+	"NetConnect=idempotent",
+	"NetDisconnect=idempotent",
+	"SectorSetExpectedSealDuration=idempotent",
+	"SectorSetSealDelay=idempotent",
+	"SectorsUpdate=idempotent",
+	"WalletSetDefault=idempotent",
+	// Worker methods all need admin permission, those describing the
+	// worker included.
+	"Info=read-only",
+	"Paths=read-only",
+	"TaskTypes=read-only",
+}
+
+// methodRegistry classifies methods by the rules given by the operator, then
+// by the built-in rules, then by their permission. Rules given by the
+// operator win over built-in ones, globs included, so that any built-in
+// class can be overridden. The cache, retries, routing and fallback all ask
+// it, so that a method is treated the same way everywhere.
+type methodRegistry struct {
+	layers [2]classRules // the overrides, then the built-in rules
+}
+
+// classRules are rules classifying the methods they match, with the class of
+// each rule.
+type classRules struct {
+	rules   methodRules
+	classes []methodClass
+}
+
+func parseClassRules(values []string) (classRules, error) {
+	var c classRules
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return classRules{}, fmt.Errorf("invalid method class %q, expected <method rule>=<class>", v)
+		}
+		rule, err := parseMethodRule(parts[0])
+		if err != nil {
+			return classRules{}, err
+		}
+		class, err := parseMethodClass(parts[1])
+		if err != nil {
+			return classRules{}, err
+		}
+		c.rules = append(c.rules, rule)
+		c.classes = append(c.classes, class)
+	}
+	return c, nil
+}
+
+// methodClasses is the registry used by every call. It is replaced at
+// startup, before the proxy serves calls, to apply the overrides given by
+// flags.
+var methodClasses = mustMethodRegistry(nil)
+
+// newMethodRegistry returns a registry applying overrides, of the form
+// <method rule>=<class>, ahead of the built-in classes.
+func newMethodRegistry(overrides []string) (*methodRegistry, error) {
+	r := &methodRegistry{}
+	var err error
+	if r.layers[0], err = parseClassRules(overrides); err != nil {
+		return nil, err
+	}
+	if r.layers[1], err = parseClassRules(builtinMethodClasses); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func mustMethodRegistry(overrides []string) *methodRegistry {
+	r, err := newMethodRegistry(overrides)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// class returns the class of method, which needs perm.
+func (r *methodRegistry) class(method, perm string) methodClass {
+	for _, l := range r.layers {
+		if i := l.rules.find(method); i >= 0 {
+			return l.classes[i]
+		}
+	}
+	if perm == permRead {
+		return classReadOnly
+	}
+	return classMutating
+}
+
+// rule returns the rule that classifies method, or an empty string when its
+// permission does.
+func (r *methodRegistry) rule(method string) string {
+	for _, l := range r.layers {
+		if i := l.rules.find(method); i >= 0 {
+			return l.rules[i].pattern
+		}
+	}
+	return ""
+}
+
+// class returns the class of the method called.
+func (c *Call) class() methodClass {
+	return methodClasses.class(c.Method, c.Perm)
+}
+
+// readOnly reports whether the method called does not change the state of
+// the node.
+func (c *Call) readOnly() bool {
+	return c.class() == classReadOnly
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestMethodRegistryOverrides(t *testing.T) {
+	r, err := newMethodRegistry([]string{"Net*=mutating", "MpoolPushUntrusted=idempotent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		perm   string
+		want   methodClass
+	}{
+		{"NetConnect", "write", classMutating},           // glob override over a built-in exact class
+		{"MpoolPushUntrusted", "write", classIdempotent}, // exact override over a built-in glob
+		{"MpoolPushMessage", "sign", classMutating},
+		{"MarketSetAsk", "admin", classIdempotent},
+		{"ChainHead", "read", classReadOnly},
+		{"SectorsList", "admin", classMutating},
+	}
+	for _, tt := range tests {
+		if got := r.class(tt.method, tt.perm); got != tt.want {
+			t.Errorf("class(%q) = %s, want %s", tt.method, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync/atomic"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"go.opencensus.io/tag"
+)
+
+// track returns a channel that forwards the values of the subscription ch
+// opened on u by call. When u leaves the pool while the subscription is
+// open, the subscription is opened again on another upstream and the client
+// keeps receiving on the same channel.
+func (p *upstreamPool) track(ctx context.Context, u *upstream, call *Call, ch reflect.Value) reflect.Value {
+	out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, ch.Type().Elem()), 0)
+	go func() {
+		defer out.Close()
+
+		var head headBuffer
+		for {
+			atomic.AddInt32(&u.streams, 1)
+			for {
+				v, ok := ch.Recv()
+				if !ok {
+					break
+				}
+				head.observe(v)
+				out.Send(v)
+			}
+			atomic.AddInt32(&u.streams, -1)
+
+			if ctx.Err() != nil || p.isReader(u) {
+				return
+			}
+			next, nch := p.resubscribe(ctx, u, call)
+			if next == nil {
+				log.Println("failed to migrate subscription", "method", call.Method, "upstream", u.addr)
+				sessionFrom(ctx).hint(subscriptionHint{Action: hintResubscribe, Method: call.Method, From: u.addr})
+				return
+			}
+			mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+			reportEvent(mctx, sessionMigrated)
+			log.Println("migrated subscription", "method", call.Method, "from", u.addr, "to", next.addr)
+			sessionFrom(ctx).bind(next)
+
+			from := u.addr
+			u, ch = next, nch
+			open, restored := head.replay(ctx, u, ch, out)
+			if !open {
+				sessionFrom(ctx).hint(subscriptionHint{Action: hintResubscribe, Method: call.Method, From: from, To: u.addr})
+				return
+			}
+			action := hintMigrated
+			if !restored {
+				action = hintResync
+			}
+			sessionFrom(ctx).hint(subscriptionHint{Action: action, Method: call.Method, From: from, To: u.addr})
+		}
+	}()
+	return out.Convert(ch.Type())
+}
+
+// resubscribe repeats the call that opened a subscription on an upstream other
+// than from.
+func (p *upstreamPool) resubscribe(ctx context.Context, from *upstream, call *Call) (*upstream, reflect.Value) {
+	tried := map[*upstream]bool{from: true}
+	for u := p.pick(tried); u != nil; u = p.pick(tried) {
+		tried[u] = true
+		results := p.call(ctx, u, call)
+		if err := resultError(results); err != nil {
+			log.Println("failed to resubscribe", "upstream", u.addr, "method", call.Method, "error", err)
+			continue
+		}
+		if !results[0].IsNil() {
+			return u, results[0]
+		}
+	}
+	return nil, reflect.Value{}
+}
+
+// headBuffer remembers the head last sent to a ChainNotify subscriber, so
+// that a subscription moved to another upstream carries on from it instead
+// of starting over.
+type headBuffer struct {
+	key   types.TipSetKey
+	known bool
+}
+
+func (b *headBuffer) observe(v reflect.Value) {
+	changes, ok := v.Interface().([]*lotusapi.HeadChange)
+	if !ok {
+		return
+	}
+	for _, c := range changes {
+		if c.Val == nil {
+			continue
+		}
+		if c.Type == "revert" {
+			b.key = c.Val.Parents()
+		} else {
+			b.key = c.Val.Key()
+		}
+		b.known = true
+	}
+}
+
+// replay reads the current head that opens the ChainNotify subscription ch
+// on u and sends the subscriber the changes leading to it from the buffered
+// head in its place. The current head is sent unchanged when the path cannot
+// be found. It reports whether ch is still open, and whether the subscriber
+// carries on from its head without missing a change, which is only known of
+// ChainNotify subscriptions.
+func (b *headBuffer) replay(ctx context.Context, u *upstream, ch, out reflect.Value) (open, restored bool) {
+	if !b.known {
+		return true, false
+	}
+	v, ok := ch.Recv()
+	if !ok {
+		return false, false
+	}
+	changes, isHead := v.Interface().([]*lotusapi.HeadChange)
+	if !isHead || len(changes) != 1 || changes[0].Val == nil {
+		b.observe(v)
+		out.Send(v)
+		return true, false
+	}
+
+	to := changes[0].Val.Key()
+	if to == b.key {
+		return true, true
+	}
+	path, err := u.full.ChainGetPath(ctx, b.key, to)
+	if err != nil {
+		log.Println("failed to find path to migrated head", "upstream", u.addr, "error", err)
+		b.observe(v)
+		out.Send(v)
+		return true, false
+	}
+	if len(path) > 0 {
+		pv := reflect.ValueOf(path)
+		b.observe(pv)
+		out.Send(pv.Convert(v.Type()))
+	}
+	return true, true
+}
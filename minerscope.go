@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// minerSelf resolves the address of the miner a node serves, remembering it
+// once known.
+type minerSelf struct {
+	api lotusapi.StorageMiner
+
+	mu    sync.Mutex
+	maddr address.Address
+}
+
+func newMinerSelf(api lotusapi.StorageMiner) *minerSelf {
+	return &minerSelf{api: api}
+}
+
+func (m *minerSelf) address(ctx context.Context) (address.Address, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maddr == address.Undef {
+		maddr, err := m.api.ActorAddress(ctx)
+		if err != nil {
+			return address.Undef, fmt.Errorf("actor address: %w", err)
+		}
+		m.maddr = maddr
+	}
+	return m.maddr, nil
+}
+
+// minerScopes restricts the miners the tokens of each owner may reach, so
+// that one deployment can serve several storage providers apart. Miners
+// given for * apply to owners without miners of their own. Tokens may carry
+// miners of their own too, which apply on top of those of their owner.
+type minerScopes struct {
+	owners      map[string]map[string]bool
+	minerMethod map[string]bool // methods of the miner api only
+}
+
+// parseMinerScopes parses values of the form <owner>=<miner address>.
+func parseMinerScopes(values []string) (*minerScopes, error) {
+	owners := map[string]map[string]bool{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid token miner %q, expected <owner>=<miner address>", v)
+		}
+		maddr, err := address.NewFromString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid miner address in token miner %q: %w", v, err)
+		}
+		if owners[parts[0]] == nil {
+			owners[parts[0]] = map[string]bool{}
+		}
+		owners[parts[0]][maddr.String()] = true
+	}
+	return &minerScopes{
+		owners:      owners,
+		minerMethod: apiOnlyMethods(&lotusapi.StorageMinerStruct{}, &lotusapi.FullNodeStruct{}),
+	}, nil
+}
+
+// parseTokenMiners returns the miners a token carries, keyed by address.
+func parseTokenMiners(miners []string) (map[string]bool, error) {
+	if len(miners) == 0 {
+		return nil, nil
+	}
+	scope := map[string]bool{}
+	for _, m := range miners {
+		maddr, err := address.NewFromString(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid miner address %q: %w", m, err)
+		}
+		scope[maddr.String()] = true
+	}
+	return scope, nil
+}
+
+// permits reports whether the token of the request ctx belongs to may reach
+// the miner maddr.
+func (s *minerScopes) permits(ctx context.Context, maddr address.Address) bool {
+	if p := jwtPayloadFrom(ctx); p != nil && p.miners != nil && !p.miners[maddr.String()] {
+		return false
+	}
+	owner := tokenOwner(ctx)
+	if owner == "" {
+		return true
+	}
+	scope, ok := s.owners[owner]
+	if !ok {
+		scope, ok = s.owners["*"]
+	}
+	return !ok || scope[maddr.String()]
+}
+
+// scoped reports whether the token of the request ctx belongs to is limited
+// to some miners.
+func (s *minerScopes) scoped(ctx context.Context) bool {
+	if p := jwtPayloadFrom(ctx); p != nil && p.miners != nil {
+		return true
+	}
+	owner := tokenOwner(ctx)
+	if owner == "" {
+		return false
+	}
+	_, ok := s.owners[owner]
+	if !ok {
+		_, ok = s.owners["*"]
+	}
+	return ok
+}
+
+// target returns the miner a call is made for: the miner served by self for
+// the methods of the miner api, and the first param of the StateMiner and
+// StateSector methods of the full node api. It returns address.Undef for
+// other calls.
+func (s *minerScopes) target(ctx context.Context, call *Call, self *minerSelf) (address.Address, error) {
+	if s.minerMethod[call.Method] {
+		return self.address(ctx)
+	}
+	if (strings.HasPrefix(call.Method, "StateMiner") || strings.HasPrefix(call.Method, "StateSector")) && len(call.Args) > 0 {
+		if maddr, ok := call.Args[0].Interface().(address.Address); ok {
+			return maddr, nil
+		}
+	}
+	return address.Undef, nil
+}
+
+// interceptor rejects the calls of scoped tokens made for miners outside
+// their scope, for a node serving the miner of self.
+func (s *minerScopes) interceptor(self *minerSelf) Interceptor {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, call *Call) []reflect.Value {
+			if !s.scoped(ctx) {
+				return next(ctx, call)
+			}
+			maddr, err := s.target(ctx, call, self)
+			if err != nil {
+				return call.errorResult(err)
+			}
+			if maddr != address.Undef && !s.permits(ctx, maddr) {
+				return call.errorResult(fmt.Errorf("%s for miner %s: %w", call.Method, maddr, errTokenScope))
+			}
+			return next(ctx, call)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// mpoolFilter selects the mempool updates a subscriber receives. Empty sets
+// match everything.
+type mpoolFilter struct {
+	to      map[address.Address]bool
+	from    map[address.Address]bool
+	methods map[abi.MethodNum]bool
+}
+
+func parseMpoolFilter(r *http.Request) (*mpoolFilter, error) {
+	f := &mpoolFilter{
+		to:      map[address.Address]bool{},
+		from:    map[address.Address]bool{},
+		methods: map[abi.MethodNum]bool{},
+	}
+
+	q := r.URL.Query()
+	for _, addrs := range []struct {
+		param string
+		set   map[address.Address]bool
+	}{{"to", f.to}, {"from", f.from}} {
+		for _, s := range splitValues(q[addrs.param]) {
+			addr, err := address.NewFromString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s address %q: %w", addrs.param, s, err)
+			}
+			addrs.set[addr] = true
+		}
+	}
+	for _, s := range splitValues(q["method"]) {
+		m, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid method number %q: %w", s, err)
+		}
+		f.methods[abi.MethodNum(m)] = true
+	}
+	return f, nil
+}
+
+func (f *mpoolFilter) match(u lotusapi.MpoolUpdate) bool {
+	if u.Message == nil {
+		return false
+	}
+	msg := u.Message.Message
+	if len(f.to) > 0 && !f.to[msg.To] {
+		return false
+	}
+	if len(f.from) > 0 && !f.from[msg.From] {
+		return false
+	}
+	if len(f.methods) > 0 && !f.methods[msg.Method] {
+		return false
+	}
+	return true
+}
+
+type mpoolSubscription struct {
+	filter *mpoolFilter
+	ch     chan lotusapi.MpoolUpdate
+}
+
+// mpoolFeed holds a single mempool subscription to the full node while it
+// has subscribers, and fans its updates out to each of them, applying each
+// subscriber's filter in the proxy.
+type mpoolFeed struct {
+	api lotusapi.FullNode
+
+	mu     sync.Mutex
+	subs   map[*mpoolSubscription]struct{}
+	wake   chan struct{}      // closed when the first subscriber arrives
+	cancel context.CancelFunc // ends the upstream subscription
+}
+
+func newMpoolFeed(api lotusapi.FullNode) *mpoolFeed {
+	return &mpoolFeed{
+		api:  api,
+		subs: map[*mpoolSubscription]struct{}{},
+		wake: make(chan struct{}),
+	}
+}
+
+// run subscribes to the upstream mempool whenever the feed has subscribers,
+// resubscribing when the subscription ends while they remain, until ctx is
+// cancelled.
+func (f *mpoolFeed) run(ctx context.Context) {
+	for {
+		subCtx, ok := f.await(ctx)
+		if !ok {
+			return
+		}
+		updates, err := f.api.MpoolSub(subCtx)
+		if err != nil {
+			log.Println("failed to subscribe to mpool", "error", err)
+		} else {
+			for u := range updates {
+				f.publish(u)
+			}
+		}
+		// Ended by the last subscriber leaving rather than by the node.
+		if subCtx.Err() != nil && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// await blocks until the feed has subscribers and returns the context of
+// the upstream subscription made for them, cancelled once they are gone, or
+// false when ctx is cancelled first.
+func (f *mpoolFeed) await(ctx context.Context) (context.Context, bool) {
+	for {
+		f.mu.Lock()
+		if len(f.subs) > 0 {
+			subCtx, cancel := context.WithCancel(ctx)
+			f.cancel = cancel
+			f.mu.Unlock()
+			return subCtx, true
+		}
+		wake := f.wake
+		f.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-wake:
+		}
+	}
+}
+
+func (f *mpoolFeed) publish(u lotusapi.MpoolUpdate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		if !sub.filter.match(u) {
+			continue
+		}
+		select {
+		case sub.ch <- u:
+		default:
+			log.Println("dropping mpool update for slow subscriber")
+		}
+	}
+}
+
+func (f *mpoolFeed) subscribe(filter *mpoolFilter) *mpoolSubscription {
+	sub := &mpoolSubscription{
+		filter: filter,
+		ch:     make(chan lotusapi.MpoolUpdate, 256),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[sub] = struct{}{}
+	if len(f.subs) == 1 {
+		close(f.wake)
+		f.wake = make(chan struct{})
+	}
+	return sub
+}
+
+func (f *mpoolFeed) unsubscribe(sub *mpoolSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, sub)
+	if len(f.subs) == 0 && f.cancel != nil {
+		f.cancel()
+		f.cancel = nil
+	}
+}
+
+// interceptor answers MpoolSub calls from the shared subscription, so that
+// websocket clients subscribing to the mempool do not each open one on the
+// node. The channel returned is closed once the client unsubscribes.
+func (f *mpoolFeed) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if call.Method != "MpoolSub" {
+			return next(ctx, call)
+		}
+		sub := f.subscribe(&mpoolFilter{})
+		go func() {
+			<-ctx.Done()
+			// Updates are published with the lock held, so none is sent
+			// once the subscription is removed.
+			f.unsubscribe(sub)
+			close(sub.ch)
+		}()
+		return []reflect.Value{reflect.ValueOf((<-chan lotusapi.MpoolUpdate)(sub.ch)), reflect.Zero(errorType)}
+	}
+}
+
+func (f *mpoolFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseMpoolFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub := f.subscribe(filter)
+	defer f.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case u := <-sub.ch:
+			data, err := json.Marshal(u)
+			if err != nil {
+				log.Println("failed to marshal mpool update", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: mpool\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// splitValues flattens repeated and comma separated query parameter values.
+func splitValues(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
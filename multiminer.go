@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gorilla/mux"
+)
+
+// minerNode is one of the miners served in multi-miner mode.
+type minerNode struct {
+	maddr   address.Address
+	api     lotusapi.StorageMiner
+	handler http.Handler // serves the miner's rpc api on its routed path
+}
+
+func newMinerNode(ctx context.Context, api lotusapi.StorageMiner, served interface{}) (*minerNode, error) {
+	maddr, err := api.ActorAddress(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("actor address: %w", err)
+	}
+
+	srv := jsonrpc.NewServer()
+	srv.Register("Filecoin", served)
+
+	return &minerNode{
+		maddr:   maddr,
+		api:     api,
+		handler: srv,
+	}, nil
+}
+
+// route registers the miner's rpc api under /miner/<actor address>/.
+func (m *minerNode) route(r *mux.Router) {
+	r.Handle("/miner/"+m.maddr.String()+"/rpc/v0", ClassifyErrors(m.handler))
+	r.Handle("/miner/"+m.maddr.String()+"/rpc/v1", ClassifyErrors(m.handler))
+}
+
+// MinerSummary describes the state of a single miner.
+type MinerSummary struct {
+	Miner   address.Address
+	Healthy bool
+	Error   string `json:",omitempty"`
+	Sectors map[lotusapi.SectorState]int
+	Power   *lotusapi.MinerPower `json:",omitempty"`
+}
+
+// AggregateSummary combines the summaries of all miners.
+type AggregateSummary struct {
+	Miners          []MinerSummary
+	RawBytePower    types.BigInt
+	QualityAdjPower types.BigInt
+	Sectors         map[lotusapi.SectorState]int
+}
+
+// ProxyAPI holds the methods served by the proxy itself in the Proxy
+// namespace.
+type ProxyAPI struct {
+	state  *ProxyState
+	miners []*minerNode
+	full   lotusapi.FullNode // optional, needed for miner power
+}
+
+// MinerSummary returns the health, sector counts and power of every miner
+// along with their totals.
+func (a *ProxyAPI) MinerSummary(ctx context.Context) (*AggregateSummary, error) {
+	if err := a.state.requirePerm(ctx, "MinerSummary", permRead); err != nil {
+		return nil, err
+	}
+	summaries := make([]MinerSummary, len(a.miners))
+
+	var wg sync.WaitGroup
+	for i, m := range a.miners {
+		wg.Add(1)
+		go func(i int, m *minerNode) {
+			defer wg.Done()
+			summaries[i] = a.summarize(ctx, m)
+		}(i, m)
+	}
+	wg.Wait()
+
+	agg := &AggregateSummary{
+		Miners:          summaries,
+		RawBytePower:    types.NewInt(0),
+		QualityAdjPower: types.NewInt(0),
+		Sectors:         map[lotusapi.SectorState]int{},
+	}
+	for _, s := range summaries {
+		for state, n := range s.Sectors {
+			agg.Sectors[state] += n
+		}
+		if s.Power != nil {
+			agg.RawBytePower = types.BigAdd(agg.RawBytePower, s.Power.MinerPower.RawBytePower)
+			agg.QualityAdjPower = types.BigAdd(agg.QualityAdjPower, s.Power.MinerPower.QualityAdjPower)
+		}
+	}
+	return agg, nil
+}
+
+func (a *ProxyAPI) summarize(ctx context.Context, m *minerNode) MinerSummary {
+	s := MinerSummary{Miner: m.maddr}
+
+	sectors, err := m.api.SectorsSummary(ctx)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Healthy = true
+	s.Sectors = sectors
+
+	if a.full != nil {
+		power, err := a.full.StateMinerPower(ctx, m.maddr, types.EmptyTSK)
+		if err != nil {
+			s.Error = err.Error()
+			return s
+		}
+		s.Power = power
+	}
+	return s
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+const (
+	// oidcKeysMaxAge is how long the signing keys of the issuer are used
+	// before they are fetched again.
+	oidcKeysMaxAge = time.Hour
+	// oidcRefreshInterval bounds how often tokens signed with an unknown key
+	// make the keys be fetched again.
+	oidcRefreshInterval = time.Minute
+)
+
+// oidcAuthenticator accepts tokens issued by an OpenID Connect provider for
+// audience, signed with RSA keys published by the provider. The lotus
+// permissions of a token are given by its permClaim, either a list or a space
+// separated string as scopes are, and by the groups of its groupsClaim that
+// groupPerms maps to permissions.
+type oidcAuthenticator struct {
+	issuer      string
+	audience    string
+	permClaim   string
+	groupsClaim string
+	groupPerms  map[string][]string
+	client      *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey // by key id
+	fetched time.Time
+}
+
+func newOIDCAuthenticator(issuer, audience, permClaim, groupsClaim string, groupPerms map[string][]string) *oidcAuthenticator {
+	return &oidcAuthenticator{
+		issuer:      strings.TrimSuffix(issuer, "/"),
+		audience:    audience,
+		permClaim:   permClaim,
+		groupsClaim: groupsClaim,
+		groupPerms:  groupPerms,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseGroupPerms parses values of the form <group>=<permission>, the
+// permission also granting those before it.
+func parseGroupPerms(values []string) (map[string][]string, error) {
+	perms := map[string][]string{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid group permission %q, expected <group>=<permission>", v)
+		}
+		allow, err := permissionsUpTo(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		perms[parts[0]] = allow
+	}
+	return perms, nil
+}
+
+// oidcHeader is the part of the jose header needed to pick the key.
+type oidcHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+func (a *oidcAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errUnrecognizedToken
+	}
+	var claims struct {
+		jwt.Payload
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil || strings.TrimSuffix(claims.Payload.Issuer, "/") != a.issuer {
+		return nil, errUnrecognizedToken
+	}
+	var hd oidcHeader
+	if b, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(b, &hd) != nil {
+		return nil, errUnrecognizedToken
+	}
+
+	key, err := a.key(ctx, hd.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	var alg jwt.Algorithm
+	switch hd.Algorithm {
+	case "RS256":
+		alg = jwt.NewRS256(jwt.RSAPublicKey(key))
+	case "RS384":
+		alg = jwt.NewRS384(jwt.RSAPublicKey(key))
+	case "RS512":
+		alg = jwt.NewRS512(jwt.RSAPublicKey(key))
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", hd.Algorithm)
+	}
+	var raw json.RawMessage
+	if _, err := jwt.Verify([]byte(token), alg, &raw); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if exp := claims.Payload.ExpirationTime; exp == nil || !now.Before(exp.Time) {
+		return nil, errTokenExpired
+	}
+	if nbf := claims.Payload.NotBefore; nbf != nil && now.Before(nbf.Time) {
+		return nil, errTokenNotYet
+	}
+	if !a.forAudience(claims.Payload.Audience) {
+		return nil, fmt.Errorf("token is not meant for audience %q", a.audience)
+	}
+
+	allow, err := a.permissions(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{payload: &jwtPayload{Payload: claims.Payload, Allow: allow}}, nil
+}
+
+func (a *oidcAuthenticator) forAudience(aud jwt.Audience) bool {
+	for _, v := range aud {
+		if v == a.audience {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions returns the lotus permissions the claims grant, directly or
+// through groups.
+func (a *oidcAuthenticator) permissions(raw json.RawMessage) ([]string, error) {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, err
+	}
+	allow, err := claimValues(claims, a.permClaim)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.groupPerms) == 0 {
+		return allow, nil
+	}
+	groups, err := claimValues(claims, a.groupsClaim)
+	if err != nil {
+		return nil, err
+	}
+	granted := map[string]bool{}
+	for _, p := range allow {
+		granted[p] = true
+	}
+	for _, g := range groups {
+		for _, p := range a.groupPerms[g] {
+			if !granted[p] {
+				granted[p] = true
+				allow = append(allow, p)
+			}
+		}
+	}
+	return allow, nil
+}
+
+// claimValues returns the values of a claim that is either a list or a space
+// separated string, or none when the claim is missing.
+func claimValues(claims map[string]json.RawMessage, name string) ([]string, error) {
+	v, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal(v, &list); err == nil {
+		return list, nil
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, fmt.Errorf("claim %q is neither a list nor a string", name)
+	}
+	return strings.Fields(s), nil
+}
+
+// key returns the signing key with the given id, fetching the keys of the
+// issuer when they are stale or do not include it.
+func (a *oidcAuthenticator) key(ctx context.Context, id string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	age := time.Since(a.fetched)
+	if key, ok := a.keys[id]; ok && age < oidcKeysMaxAge {
+		return key, nil
+	}
+	if a.keys == nil || age >= oidcRefreshInterval {
+		keys, err := a.fetchKeys(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetch oidc keys: %w", err)
+		}
+		a.keys, a.fetched = keys, time.Now()
+	}
+	if key, ok := a.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", id)
+}
+
+// fetchKeys fetches the RSA keys of the issuer from the jwks_uri of its
+// discovery document.
+func (a *oidcAuthenticator) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := a.getJSON(ctx, a.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key %q", k.KeyID)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent of key %q", k.KeyID)
+		}
+		keys[k.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func (a *oidcAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// paramRewrite changes a param of the calls to the methods matching rule
+// before they are sent to the nodes of a backend group, to suit nodes that
+// cannot serve any param, such as a node that only keeps recent state or a
+// checkpoint node that serves a single tipset.
+type paramRewrite struct {
+	rule  methodRule
+	index int    // counted from the last param when negative
+	op    string // max, min or set
+	limit int64  // of max and min
+	value json.RawMessage
+}
+
+var paramRewriteOps = []string{"max", "min", "set"}
+
+// paramRewrites holds the rewrites of each backend group, applied in order.
+type paramRewrites map[string][]paramRewrite
+
+// parseParamRewrites parses values of the form
+// <group>:<method rule>:<param index>=<op>:<value>, where op is max or min to
+// bound an integer param, or set to replace a param with the JSON value. The
+// group must be defaultBackend or one of groups.
+func parseParamRewrites(values []string, groups map[string][]apiInfo) (paramRewrites, error) {
+	rewrites := paramRewrites{}
+	for _, v := range values {
+		invalid := fmt.Errorf("invalid param rewrite %q, expected <group>:<method rule>:<param index>=<op>:<value>", v)
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, invalid
+		}
+		first, last := strings.Index(parts[0], ":"), strings.LastIndex(parts[0], ":")
+		if first <= 0 || last == first {
+			return nil, invalid
+		}
+		group := parts[0][:first]
+		if _, ok := groups[group]; !ok && group != defaultBackend {
+			return nil, fmt.Errorf("param rewrite %q names unknown group %q", v, group)
+		}
+		rule, err := parseMethodRule(parts[0][first+1 : last])
+		if err != nil {
+			return nil, err
+		}
+		index, err := strconv.Atoi(parts[0][last+1:])
+		if err != nil {
+			return nil, invalid
+		}
+
+		action := strings.SplitN(parts[1], ":", 2)
+		if len(action) != 2 {
+			return nil, invalid
+		}
+		rw := paramRewrite{rule: rule, index: index, op: action[0]}
+		switch rw.op {
+		case "max", "min":
+			if rw.limit, err = strconv.ParseInt(action[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("param rewrite %q: %s needs an integer", v, rw.op)
+			}
+		case "set":
+			if !json.Valid([]byte(action[1])) {
+				return nil, fmt.Errorf("param rewrite %q: set needs a JSON value", v)
+			}
+			rw.value = json.RawMessage(action[1])
+		default:
+			return nil, fmt.Errorf("param rewrite %q: unknown op %q, expected one of %s", v, rw.op, strings.Join(paramRewriteOps, ", "))
+		}
+		rewrites[group] = append(rewrites[group], rw)
+	}
+	return rewrites, nil
+}
+
+// apply returns call with the rewrites of group applied, leaving call itself
+// untouched. Rewrites naming a param the method does not take are skipped.
+func (rs paramRewrites) apply(group string, call *Call) (*Call, error) {
+	var args []reflect.Value
+	for _, rw := range rs[group] {
+		if !rw.rule.match(call.Method) {
+			continue
+		}
+		i := rw.index
+		if i < 0 {
+			i += len(call.Args)
+		}
+		if i < 0 || i >= len(call.Args) {
+			continue
+		}
+		if args == nil {
+			args = append([]reflect.Value(nil), call.Args...)
+		}
+		v, err := rw.rewrite(args[i])
+		if err != nil {
+			return nil, fmt.Errorf("rewrite param %d of %s: %w", i, call.Method, err)
+		}
+		args[i] = v
+	}
+	if args == nil {
+		return call, nil
+	}
+	rewritten := *call
+	rewritten.Args = args
+	return &rewritten, nil
+}
+
+func (rw paramRewrite) rewrite(arg reflect.Value) (reflect.Value, error) {
+	if rw.op == "set" {
+		v := reflect.New(arg.Type())
+		if err := json.Unmarshal(rw.value, v.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+		return v.Elem(), nil
+	}
+
+	v := reflect.New(arg.Type()).Elem()
+	switch arg.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := arg.Int()
+		if (rw.op == "max" && n > rw.limit) || (rw.op == "min" && n < rw.limit) {
+			n = rw.limit
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rw.limit < 0 {
+			return reflect.Value{}, fmt.Errorf("%s %d of an unsigned param", rw.op, rw.limit)
+		}
+		n := arg.Uint()
+		if (rw.op == "max" && n > uint64(rw.limit)) || (rw.op == "min" && n < uint64(rw.limit)) {
+			n = uint64(rw.limit)
+		}
+		v.SetUint(n)
+	default:
+		return reflect.Value{}, fmt.Errorf("%s needs an integer param, not %s", rw.op, arg.Type())
+	}
+	return v, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+const (
+	// maxShapeMethods bounds the number of unknown methods whose shapes are
+	// recorded, as clients choose the method names.
+	maxShapeMethods = 200
+	// maxShapesPerMethod bounds the distinct shapes recorded for the requests,
+	// and for the responses, of a single method.
+	maxShapesPerMethod = 10
+)
+
+// passthrough sends http calls to methods of namespace that the served APIs
+// do not know, such as those of custom lotus extensions, to an upstream node
+// as they are, and optionally records the shapes of their requests and
+// responses.
+type passthrough struct {
+	router    *backendRouter
+	namespace string
+	known     map[string]bool
+	shapes    *shapeRecorder // optional
+	acls      methodACLs
+
+	// maxResponse bounds the size of forwarded responses, when not 0.
+	maxResponse int64
+	// calls checks the token of each call and applies its limits, as the
+	// interceptors do for the calls of the lotus api.
+	calls rawCalls
+}
+
+// newPassthrough returns a passthrough for the methods of namespace that are
+// not methods of apis, pointers to the API structs served, that the method
+// lists of tokens permit.
+func newPassthrough(router *backendRouter, namespace string, shapes *shapeRecorder, acls methodACLs, apis ...interface{}) *passthrough {
+	known := map[string]bool{}
+	for _, api := range apis {
+		t := reflect.TypeOf(api)
+		for i := 0; i < t.NumMethod(); i++ {
+			known[t.Method(i).Name] = true
+		}
+	}
+	return &passthrough{
+		router:    router,
+		namespace: namespace,
+		known:     known,
+		shapes:    shapes,
+		acls:      acls,
+	}
+}
+
+// handler forwards calls to unknown methods and passes others to next. Calls
+// made with a minted token, or a lotus token without admin permission, are
+// never forwarded, as the permission unknown methods need cannot be checked.
+func (p *passthrough) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if payload := jwtPayloadFrom(r.Context()); grantFrom(r.Context()) != nil || payload != nil && !payload.allows("admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, req, err := peekRawRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req == nil || !strings.HasPrefix(req.Method, p.namespace+".") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := strings.TrimPrefix(req.Method, p.namespace+".")
+		if p.known[method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.acls.permits(r.Context(), method) {
+			http.Error(w, method+": "+errTokenScope.Error(), http.StatusForbidden)
+			return
+		}
+		// Unknown methods are only forwarded for tokens with admin
+		// permission.
+		p.calls.serve(w, r, req, method, "admin", func(ctx context.Context) (json.RawMessage, error) {
+			return p.forward(ctx, w, method, body, req)
+		})
+	})
+}
+
+// forward writes the response of an upstream node to the call of req, and
+// returns the error it carries, if any. The result is streamed rather than
+// returned.
+func (p *passthrough) forward(ctx context.Context, w http.ResponseWriter, method string, body []byte, req *rawRequest) (json.RawMessage, error) {
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, method))
+	reportEvent(mctx, rpcRequest)
+
+	pool := p.router.pool(method)
+	u := pool.pick(map[*upstream]bool{})
+	if u == nil {
+		reportEvent(mctx, rpcFailure)
+		http.Error(w, errNoUpstream.Error(), http.StatusBadGateway)
+		return nil, errNoUpstream
+	}
+
+	preq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.httpURL, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	preq.Header = u.header()
+	preq.Header.Set("Content-Type", "application/json")
+
+	atomic.AddInt32(&u.inflight, 1)
+	resp, err := client.Do(preq)
+	atomic.AddInt32(&u.inflight, -1)
+	if err != nil && clientGone(ctx) {
+		reportEvent(mctx, rpcCanceled)
+		return nil, err
+	}
+	if err != nil {
+		reportEvent(mctx, rpcFailure)
+		log.Println("passthrough call failed", "upstream", u.addr, "method", method, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if p.maxResponse > 0 && resp.ContentLength > p.maxResponse {
+		reportEvent(mctx, rpcFailure)
+		http.Error(w, errResponseTooLarge.Error(), http.StatusBadGateway)
+		return nil, errResponseTooLarge
+	}
+
+	// The response is forwarded as it is read, and scanned on the way for
+	// its error and the shape of its result.
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	stream := io.TeeReader(&sizeLimitedReader{r: resp.Body, max: p.maxResponse}, w)
+	sum, scanErr := scanResponse(stream, p.shapes != nil)
+	// Whatever the scan left, such as the rest of a response that is not a
+	// JSON-RPC envelope, is forwarded too.
+	if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+		if clientGone(ctx) {
+			reportEvent(mctx, rpcCanceled)
+			panic(http.ErrAbortHandler)
+		}
+		// The status is sent already, so the client can only be told by
+		// cutting the response short.
+		reportEvent(mctx, rpcFailure)
+		log.Println("passthrough response failed", "upstream", u.addr, "method", method, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if p.shapes != nil {
+		p.shapes.record(method, req.Params, sum)
+	}
+	if sum.err != nil {
+		reportEvent(mctx, rpcFailure)
+		return nil, errors.New(sum.err.Message)
+	}
+	return nil, nil
+}
+
+// maxRawResponse bounds the responses of calls forwarded by postRaw, which
+// are read whole to be cached.
+const maxRawResponse = 32 << 20
+
+// postRaw posts the JSON-RPC request body to url and returns the status and
+// body of the response.
+func postRaw(ctx context.Context, url string, header http.Header, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRawResponse+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) > maxRawResponse {
+		return 0, nil, errResponseTooLarge
+	}
+	return resp.StatusCode, b, nil
+}
+
+// httpRPCURL returns the url calls are posted to over http, whatever the
+// upstream transport.
+func httpRPCURL(api apiInfo) string {
+	api.websocket = false
+	return transportConfig{}.rpcURL(api, "/rpc/v0")
+}
+
+// shapeRecorder records the shapes of the requests and responses of unknown
+// methods: their JSON structure with each value replaced by its type.
+type shapeRecorder struct {
+	mu      sync.Mutex
+	methods map[string]*methodShapes
+}
+
+func newShapeRecorder() *shapeRecorder {
+	return &shapeRecorder{methods: map[string]*methodShapes{}}
+}
+
+// methodShapes describes the calls observed to an unknown method.
+type methodShapes struct {
+	Method    string       `json:"method"`
+	Calls     int          `json:"calls"`
+	Errors    int          `json:"errors"`
+	FirstSeen time.Time    `json:"first_seen"`
+	LastSeen  time.Time    `json:"last_seen"`
+	Params    []shapeCount `json:"params"`
+	Results   []shapeCount `json:"results"`
+}
+
+type shapeCount struct {
+	Shape json.RawMessage `json:"shape"`
+	Count int             `json:"count"`
+}
+
+func (s *shapeRecorder) record(method string, params json.RawMessage, resp *responseSummary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.methods[method]
+	if !ok {
+		if len(s.methods) >= maxShapeMethods {
+			return
+		}
+		m = &methodShapes{Method: method, FirstSeen: time.Now()}
+		s.methods[method] = m
+	}
+	m.Calls++
+	m.LastSeen = time.Now()
+	m.Params = countParamsShape(m.Params, params)
+	if resp.err != nil {
+		m.Errors++
+		return
+	}
+	if resp.shaped {
+		m.Results = countShape(m.Results, resp.shape)
+	}
+}
+
+// countParamsShape counts the shape of the params raw among counts. The
+// elements of positional params are described one by one.
+func countParamsShape(counts []shapeCount, raw json.RawMessage) []shapeCount {
+	var v interface{}
+	if len(raw) > 0 && json.Unmarshal(raw, &v) != nil {
+		return counts
+	}
+	if list, ok := v.([]interface{}); ok {
+		return countShape(counts, shapesOf(list))
+	}
+	return countShape(counts, shapeOf(v))
+}
+
+// countShape counts s among counts.
+func countShape(counts []shapeCount, s interface{}) []shapeCount {
+	shape, err := json.Marshal(s)
+	if err != nil {
+		return counts
+	}
+	for i := range counts {
+		if bytes.Equal(counts[i].Shape, shape) {
+			counts[i].Count++
+			return counts
+		}
+	}
+	if len(counts) >= maxShapesPerMethod {
+		return counts
+	}
+	return append(counts, shapeCount{Shape: shape, Count: 1})
+}
+
+// shapeOf replaces each value in v, decoded from JSON, by the name of its
+// type. Arrays whose elements share a shape are described by that shape.
+func shapeOf(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		shape := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			shape[k] = shapeOf(e)
+		}
+		return shape
+	case []interface{}:
+		shapes := shapesOf(v)
+		if len(shapes) == 0 {
+			return shapes
+		}
+		for _, s := range shapes[1:] {
+			if !reflect.DeepEqual(s, shapes[0]) {
+				return shapes
+			}
+		}
+		return shapes[:1]
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// shapesOf returns the shapes of the elements of v, in order. An empty array
+// is described by an empty shape.
+func shapesOf(v []interface{}) []interface{} {
+	if len(v) == 0 {
+		return []interface{}{}
+	}
+	shapes := make([]interface{}, len(v))
+	for i, e := range v {
+		shapes[i] = shapeOf(e)
+	}
+	return shapes
+}
+
+// list returns the recorded methods by name.
+func (s *shapeRecorder) list() []methodShapes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]methodShapes, 0, len(s.methods))
+	for _, m := range s.methods {
+		c := *m
+		c.Params = append([]shapeCount(nil), m.Params...)
+		c.Results = append([]shapeCount(nil), m.Results...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
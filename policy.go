@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// methodRule matches method names against an exact name, a shell glob such
+// as State*, or a regular expression written between slashes such as
+// /Eth.*/, which must match the whole name as globs do.
+type methodRule struct {
+	pattern string
+	kind    string // exact, glob or regex
+	re      *regexp.Regexp
+}
+
+func parseMethodRule(pattern string) (methodRule, error) {
+	switch {
+	case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return methodRule{}, fmt.Errorf("invalid method pattern %q: %w", pattern, err)
+		}
+		return methodRule{pattern: pattern, kind: "regex", re: re}, nil
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return methodRule{}, fmt.Errorf("invalid method pattern %q: %w", pattern, err)
+		}
+		return methodRule{pattern: pattern, kind: "glob"}, nil
+	default:
+		return methodRule{pattern: pattern, kind: "exact"}, nil
+	}
+}
+
+func (r methodRule) match(method string) bool {
+	switch r.kind {
+	case "regex":
+		return r.re.MatchString(method)
+	case "glob":
+		ok, _ := path.Match(r.pattern, method)
+		return ok
+	default:
+		return r.pattern == method
+	}
+}
+
+// methodRules is a list of method rules. A rule naming the method exactly
+// takes precedence, otherwise the first glob or regex that matches wins.
+type methodRules []methodRule
+
+func parseMethodRules(patterns []string) (methodRules, error) {
+	rules := make(methodRules, 0, len(patterns))
+	for _, p := range patterns {
+		r, err := parseMethodRule(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// find returns the index of the rule that applies to method, or -1.
+func (rs methodRules) find(method string) int {
+	for i, r := range rs {
+		if r.kind == "exact" && r.pattern == method {
+			return i
+		}
+	}
+	for i, r := range rs {
+		if r.kind != "exact" && r.match(method) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rs methodRules) match(method string) bool {
+	return rs.find(method) >= 0
+}
+
+// policyCommand inspects the method rules given by the proxy flags.
+var policyCommand = &cli.Command{
+	Name:  "policy",
+	Usage: "Inspect the method rules given by flags",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "explain",
+			Usage:     "Show which rule of each flag applies to a method",
+			ArgsUsage: "<method>",
+			Action:    explainPolicy,
+		},
+	},
+}
+
+func explainPolicy(cctx *cli.Context) error {
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected a method name")
+	}
+	method := cctx.Args().First()
+
+	explain := func(flag string, patterns []string, values []string) error {
+		rules, err := parseMethodRules(patterns)
+		if err != nil {
+			return err
+		}
+		i := rules.find(method)
+		if i < 0 {
+			fmt.Printf("%-16s no rule applies\n", flag)
+			return nil
+		}
+		rule := rules[i].pattern
+		if values != nil {
+			rule += "=" + values[i]
+		}
+		fmt.Printf("%-16s %s (%s)\n", flag, rule, rules[i].kind)
+		return nil
+	}
+
+	routes, groups := splitRules(cctx.StringSlice("route"))
+	if err := explain("route", routes, groups); err != nil {
+		return err
+	}
+	timeouts, durations := splitRules(splitValues(cctx.StringSlice("method-timeout")))
+	if err := explain("method-timeout", timeouts, durations); err != nil {
+		return err
+	}
+	if err := explain("quorum-method", splitValues(cctx.StringSlice("quorum-method")), nil); err != nil {
+		return err
+	}
+	registry, err := newMethodRegistry(splitValues(cctx.StringSlice("method-class")))
+	if err != nil {
+		return err
+	}
+	if rule := registry.rule(method); rule != "" {
+		fmt.Printf("%-16s %s=%s\n", "method-class", rule, registry.class(method, ""))
+	} else {
+		fmt.Printf("%-16s read-only if it needs read permission, mutating otherwise\n", "method-class")
+	}
+	return explain("heavy-method", splitValues(cctx.StringSlice("heavy-method")), nil)
+}
+
+// splitRules splits values of the form <pattern>=<value>.
+func splitRules(values []string) (patterns, rest []string) {
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		patterns = append(patterns, parts[0])
+		if len(parts) == 2 {
+			rest = append(rest, parts[1])
+		} else {
+			rest = append(rest, "")
+		}
+	}
+	return patterns, rest
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestMethodRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		want    bool
+	}{
+		{"ChainHead", "ChainHead", true},
+		{"ChainHead", "ChainHeadX", false},
+		{"State*", "StateGetActor", true},
+		{"State*", "ChainHead", false},
+		{"*Sector*", "StateSectorGetInfo", true},
+		{"Mpool?ush", "MpoolPush", true},
+		{"/Eth.*/", "EthCall", true},
+		{"/Eth.*/", "NetEthPeers", false},
+		{"/Eth/", "Eth", true},
+		{"/Eth/", "EthCall", false},
+		{"/Eth/", "GetEth", false},
+		{"/Wallet(Sign|Export)/", "WalletSign", true},
+		{"/Wallet(Sign|Export)/", "WalletSignMessage", false},
+		{"/Chain|State/", "ChainHead", false},
+		{"/Chain|State/", "State", true},
+	}
+	for _, tt := range tests {
+		r, err := parseMethodRule(tt.pattern)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.pattern, err)
+		}
+		if got := r.match(tt.method); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestParseMethodRuleInvalid(t *testing.T) {
+	for _, pattern := range []string{"/Eth(/", "State[", "/[/"} {
+		if _, err := parseMethodRule(pattern); err == nil {
+			t.Errorf("parse %q succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestMethodRulesFind(t *testing.T) {
+	rules, err := parseMethodRules([]string{"State*", "/State.*Info/", "StateSectorGetInfo", "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{"StateSectorGetInfo", 2}, // exact wins over earlier patterns
+		{"StateMinerInfo", 0},     // the first pattern given wins
+		{"ChainHead", 3},
+	}
+	for _, tt := range tests {
+		if got := rules.find(tt.method); got != tt.want {
+			t.Errorf("find(%q) = %d, want %d", tt.method, got, tt.want)
+		}
+	}
+
+	none, err := parseMethodRules([]string{"State*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := none.find("ChainHead"); got != -1 {
+		t.Errorf("find without a match = %d, want -1", got)
+	}
+}
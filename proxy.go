@@ -1,39 +1,76 @@
 package main
 
 import (
-	"context"
-	"github.com/filecoin-project/go-jsonrpc"
+	"fmt"
+
 	lotusapi "github.com/filecoin-project/lotus/api"
-	"log"
-	"net/http"
 )
 
 type ProxiedRPCApi struct {
-	// TODO: Add other RPC API's
 	minerAPI *lotusapi.StorageMinerStruct
-	closer   jsonrpc.ClientCloser
+	fullAPI  *lotusapi.FullNodeStruct     // served alongside the miner API when backend groups are configured, as by --serve-fullnode
+	upstream *lotusapi.StorageMinerStruct // balanced over the pools, bypassing interceptors
+	pool     *upstreamPool                // the default backend group
+	router   *backendRouter
 }
 
-func NewProxiedRpcAPI(authToken string, addr string) (*ProxiedRPCApi, error) {
-	headers := http.Header{"Authorization": []string{"Bearer " + authToken}}
-	pushUrl, err := getPushUrl("http://" + addr + "/rpc/v0")
+// NewProxiedRpcAPI creates the pool of the default backend group from cfg and
+// a pool for each of groups, which share its settings apart from their nodes.
+// Calls are routed by routes and their params rewritten for each group by
+// rewrites.
+func NewProxiedRpcAPI(cfg poolConfig, groups map[string][]apiInfo, routes backendRoutes, rewrites paramRewrites) (*ProxiedRPCApi, error) {
+	pool, err := newUpstreamPool(cfg)
 	if err != nil {
-		log.Fatalf("connecting with lotus as stream failed: %s", err)
+		return nil, err
+	}
+
+	router := &backendRouter{
+		routes:   routes,
+		groups:   map[string]*upstreamPool{defaultBackend: pool},
+		rewrites: rewrites,
+	}
+	for name, apis := range groups {
+		gcfg := cfg
+		gcfg.apis = apis
+		gcfg.writeAPI = nil
+		gp, err := newUpstreamPool(gcfg)
+		if err != nil {
+			router.close()
+			return nil, fmt.Errorf("backend group %q: %w", name, err)
+		}
+		router.groups[name] = gp
+	}
+
+	var upstreamAPI lotusapi.StorageMinerStruct
+	proxyAPI(router.invoke, &upstreamAPI)
+
+	p := &ProxiedRPCApi{
+		minerAPI: &upstreamAPI,
+		upstream: &upstreamAPI,
+		pool:     pool,
+		router:   router,
 	}
+	if len(groups) > 0 {
+		p.fullAPI = &lotusapi.FullNodeStruct{}
+		proxyAPI(router.invoke, p.fullAPI)
+	}
+	return p, nil
+}
+
+// Intercept routes every call on the served APIs through interceptors before
+// it reaches an upstream node.
+func (p *ProxiedRPCApi) Intercept(interceptors ...Interceptor) {
+	var minerAPI lotusapi.StorageMinerStruct
+	proxyAPI(p.router.invoke, &minerAPI, interceptors...)
+	p.minerAPI = &minerAPI
+
+	if p.fullAPI != nil {
+		var fullAPI lotusapi.FullNodeStruct
+		proxyAPI(p.router.invoke, &fullAPI, interceptors...)
+		p.fullAPI = &fullAPI
+	}
+}
 
-	var workerApi lotusapi.StorageMinerStruct
-
-	closer, err := jsonrpc.NewMergeClient(
-		context.Background(),
-		"http://"+addr+"/rpc/v0", "Filecoin",
-		lotusapi.GetInternalStructs(&workerApi),
-		headers,
-		append([]jsonrpc.Option{
-			jsonrpc.Option(ReaderParamEncoder(pushUrl)),
-		})...)
-
-	return &ProxiedRPCApi{
-		&workerApi,
-		closer,
-	}, err
+func (p *ProxiedRPCApi) closer() {
+	p.router.close()
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// proxyNamespace is the namespace of the methods served by the proxy itself
+// rather than an upstream node.
+const proxyNamespace = "Proxy"
+
+// ProxyState is the running proxy, as given to the handlers of the Proxy
+// namespace.
+type ProxyState struct {
+	router *backendRouter
+	caches map[string]*responseCache // by name, as in the cache metrics
+	full   lotusapi.FullNode         // nil without --fullnode-api
+	miners []*minerNode              // of --miner-api
+	access []Interceptor             // checking the token of a call
+}
+
+// ProxyMethods returns the handler whose exported methods are served in the
+// Proxy namespace, or nil to serve none. Methods take a context first and
+// return an error last, as those of the lotus api, and are answered as
+// they are by the proxy, without passing the interceptors of upstream calls
+// but for those requirePerm runs.
+type ProxyMethods func(s *ProxyState) interface{}
+
+var proxyMethods []ProxyMethods
+
+// RegisterProxyMethods adds methods to the Proxy namespace. Deployments
+// serving methods of their own add a file calling it from init, rather than
+// changing main. Each method must check the token of the caller with
+// requirePerm before answering.
+func RegisterProxyMethods(m ProxyMethods) {
+	proxyMethods = append(proxyMethods, m)
+}
+
+// registerProxyNamespace registers the handlers of the registered methods on
+// each server.
+func registerProxyNamespace(s *ProxyState, servers ...*jsonrpc.RPCServer) {
+	for _, m := range proxyMethods {
+		handler := m(s)
+		if handler == nil {
+			continue
+		}
+		for _, srv := range servers {
+			srv.Register(proxyNamespace, handler)
+		}
+	}
+}
+
+var proxyMethodType = reflect.TypeOf(func(context.Context) error { return nil })
+
+// requirePerm returns an error unless the token of the request ctx belongs to
+// may call method of the Proxy namespace, which needs perm. The call passes
+// the interceptors checking tokens on the rpc endpoints, named with its
+// namespace, so that the method lists of owners and minted tokens and the
+// methods of --public-read apply to it as to upstream calls.
+func (s *ProxyState) requirePerm(ctx context.Context, method, perm string) error {
+	var invoke Invoker = func(ctx context.Context, call *Call) []reflect.Value {
+		return call.errorResult(nil)
+	}
+	for i := len(s.access) - 1; i >= 0; i-- {
+		invoke = s.access[i](invoke)
+	}
+	return resultError(invoke(ctx, &Call{
+		Method: proxyNamespace + "." + method,
+		Perm:   perm,
+		Type:   proxyMethodType,
+	}))
+}
+
+func init() {
+	RegisterProxyMethods(func(s *ProxyState) interface{} {
+		if len(s.miners) == 0 {
+			return nil
+		}
+		return &ProxyAPI{state: s, miners: s.miners, full: s.full}
+	})
+	RegisterProxyMethods(func(s *ProxyState) interface{} {
+		return &ProxyInfoAPI{state: s}
+	})
+}
+
+// ProxyInfoAPI describes the proxy to its callers.
+type ProxyInfoAPI struct {
+	state *ProxyState
+}
+
+// CacheStats is the size of a cache of the proxy.
+type CacheStats struct {
+	Name    string
+	Entries int // including expired ones not yet dropped
+}
+
+// CacheStats returns the size of each cache of the proxy, by name.
+func (a *ProxyInfoAPI) CacheStats(ctx context.Context) ([]CacheStats, error) {
+	if err := a.state.requirePerm(ctx, "CacheStats", "read"); err != nil {
+		return nil, err
+	}
+	stats := make([]CacheStats, 0, len(a.state.caches))
+	for name, c := range a.state.caches {
+		stats = append(stats, CacheStats{Name: name, Entries: c.len()})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats, nil
+}
+
+// Backends returns the status of the upstream nodes of each backend group,
+// including those draining.
+func (a *ProxyInfoAPI) Backends(ctx context.Context) (map[string][]upstreamStatus, error) {
+	if err := a.state.requirePerm(ctx, "Backends", "admin"); err != nil {
+		return nil, err
+	}
+	groups := map[string][]upstreamStatus{}
+	for name, p := range a.state.router.groups {
+		statuses := []upstreamStatus{}
+		for _, u := range p.all() {
+			statuses = append(statuses, u.status())
+		}
+		for _, u := range p.draining() {
+			statuses = append(statuses, u.status())
+		}
+		groups[name] = statuses
+	}
+	return groups, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// publicOwner is the owner of the calls let through without a token by
+// --public-read.
+const publicOwner = "public"
+
+// defaultPublicMethods are the methods served without a token by default:
+// the stats of the miner and the chain state they are read against.
+var defaultPublicMethods = []string{
+	"Version",
+	"ActorAddress",
+	"ActorSectorSize",
+	"SectorsSummary",
+	"ChainHead",
+	"StateMinerInfo",
+	"StateMinerPower",
+	"StateMinerFaults",
+	"StateMinerRecoveries",
+}
+
+// publicRead serves a fixed set of read-only methods to callers without a
+// token, as the lotus gateway does, from a cache of its own so that the
+// traffic of a public endpoint barely reaches the node.
+type publicRead struct {
+	payload *jwtPayload
+	cached  Interceptor
+}
+
+// newPublicRead returns the public read mode serving methods, cached for
+// ttl. Methods must be named exactly, need read permission and not open
+// subscriptions.
+func newPublicRead(methods []string, ttl time.Duration) (*publicRead, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("--public-read-ttl must be positive")
+	}
+	known := apiMethods(&lotusapi.FullNodeStruct{}, &lotusapi.StorageMinerStruct{})
+	ttls := map[string]time.Duration{}
+	for _, method := range methods {
+		f, ok := known[method]
+		if !ok {
+			return nil, fmt.Errorf("public method %q is not a lotus method", method)
+		}
+		perm := f.Tag.Get("perm")
+		if methodClasses.class(method, perm) != classReadOnly {
+			return nil, fmt.Errorf("public method %s is not read-only", method)
+		}
+		if f.Type.NumOut() == 2 && f.Type.Out(0).Kind() == reflect.Chan {
+			return nil, fmt.Errorf("public method %s opens a subscription", method)
+		}
+		ttls[method] = ttl
+	}
+	acl, err := newMethodACL(methods, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &publicRead{
+		payload: &jwtPayload{Payload: jwt.Payload{Subject: publicOwner}, Allow: []string{permRead}, acl: acl},
+		cached:  cachingInterceptor(newResponseCache(), publicOwner, ttls, 0),
+	}, nil
+}
+
+// interceptor serves the calls of public callers from the public cache.
+func (p *publicRead) interceptor(next Invoker) Invoker {
+	cached := p.cached(next)
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if jwtPayloadFrom(ctx) == p.payload {
+			return cached(ctx, call)
+		}
+		return next(ctx, call)
+	}
+}
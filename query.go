@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// queryPlaceholder matches the {{name}} placeholders of template params.
+var queryPlaceholder = regexp.MustCompile(`\{\{([A-Za-z0-9_-]+)\}\}`)
+
+// queryTemplate is a named call kept in the --query-templates file, so that
+// the diagnostics an operator team runs often are the same for everyone.
+// String params may hold {{name}} placeholders, filled with the --arg values
+// of the query command.
+type queryTemplate struct {
+	Description string        `json:"description,omitempty"`
+	Method      string        `json:"method"`
+	Params      []interface{} `json:"params"`
+}
+
+// loadQueryTemplates reads the templates of a file, by name.
+func loadQueryTemplates(path string) (map[string]queryTemplate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read query templates: %w", err)
+	}
+	var templates map[string]queryTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("parse query templates %s: %w", path, err)
+	}
+	for name, t := range templates {
+		if t.Method == "" {
+			return nil, fmt.Errorf("query template %q has no method", name)
+		}
+	}
+	return templates, nil
+}
+
+// args returns the names of the placeholders of the template, once each.
+func (t queryTemplate) args() []string {
+	seen := map[string]bool{}
+	var names []string
+	walkStrings(t.Params, func(s string) {
+		for _, m := range queryPlaceholder.FindAllStringSubmatch(s, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	})
+	return names
+}
+
+func walkStrings(v interface{}, fn func(string)) {
+	switch v := v.(type) {
+	case string:
+		fn(v)
+	case []interface{}:
+		for _, e := range v {
+			walkStrings(e, fn)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			walkStrings(e, fn)
+		}
+	}
+}
+
+// render returns the params of the template with its placeholders filled
+// from args. A param that is a placeholder alone takes the value of its arg
+// as JSON when it is valid JSON, such as a number, and as a string
+// otherwise. Placeholders within longer strings are replaced by the text of
+// their arg.
+func (t queryTemplate) render(args map[string]string) ([]interface{}, error) {
+	known := map[string]bool{}
+	for _, name := range t.args() {
+		if _, ok := args[name]; !ok {
+			return nil, fmt.Errorf("missing --arg %s", name)
+		}
+		known[name] = true
+	}
+	for name := range args {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown arg %q", name)
+		}
+	}
+	params, _ := fill(t.Params, args).([]interface{})
+	return params, nil
+}
+
+func fill(v interface{}, args map[string]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		if m := queryPlaceholder.FindStringSubmatch(v); m != nil && m[0] == v {
+			var decoded interface{}
+			if err := json.Unmarshal([]byte(args[m[1]]), &decoded); err == nil {
+				return decoded
+			}
+			return args[m[1]]
+		}
+		return queryPlaceholder.ReplaceAllStringFunc(v, func(p string) string {
+			return args[queryPlaceholder.FindStringSubmatch(p)[1]]
+		})
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = fill(e, args)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = fill(e, args)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// queryCommand runs a query template against a running proxy.
+var queryCommand = &cli.Command{
+	Name:      "query",
+	Usage:     "Run a call of --query-templates against a running proxy",
+	ArgsUsage: "<name>",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "arg",
+			Usage: "Value of a placeholder of the template, as <name>=<value>. May be repeated.",
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "List the templates and their args instead.",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Usage: "Url of the proxy. Defaults to the --listen address on localhost.",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Bearer token for the proxy. Defaults to --admin-token.",
+			EnvVars: []string{"LOTUS_PROXY_QUERY_TOKEN"},
+		},
+	},
+	Action: runQuery,
+}
+
+func runQuery(cctx *cli.Context) error {
+	file := cctx.String("query-templates")
+	if file == "" {
+		return fmt.Errorf("--query-templates must be set")
+	}
+	templates, err := loadQueryTemplates(file)
+	if err != nil {
+		return err
+	}
+	if cctx.Bool("list") {
+		names := make([]string, 0, len(templates))
+		for name := range templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			t := templates[name]
+			fmt.Printf("%-20s %-28s %s\n", name, t.Method+" "+strings.Join(t.args(), " "), t.Description)
+		}
+		return nil
+	}
+
+	if cctx.NArg() != 1 {
+		return fmt.Errorf("expected the name of a query template")
+	}
+	t, ok := templates[cctx.Args().First()]
+	if !ok {
+		return fmt.Errorf("no query template %q", cctx.Args().First())
+	}
+	args := map[string]string{}
+	for _, v := range cctx.StringSlice("arg") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid arg %q, expected <name>=<value>", v)
+		}
+		args[parts[0]] = parts[1]
+	}
+	params, err := t.render(args)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "Filecoin." + t.Method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	base, token := proxyEndpoint(cctx)
+	req, err := http.NewRequestWithContext(cctx.Context, http.MethodPost, base+"/rpc/v0", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the proxy: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var result rawResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("query failed: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if len(result.Error) > 0 && string(result.Error) != "null" {
+		return fmt.Errorf("query failed: %s", result.Error)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, result.Result, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
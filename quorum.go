@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"reflect"
+
+	"go.opencensus.io/tag"
+)
+
+var errNoQuorum = errors.New("upstream nodes did not agree on an answer")
+
+// quorumAnswer is the answer of one upstream to a quorum read.
+type quorumAnswer struct {
+	upstream *upstream
+	results  []reflect.Value
+	key      uint64 // equal for equal answers
+}
+
+// quorum sends a read call to up to quorumSize upstreams at once and returns
+// the answer given by a majority of those that could be reached. Upstreams
+// that disagree are logged and counted. The call fails with errNoQuorum when
+// no answer has a majority.
+func (p *upstreamPool) quorum(ctx context.Context, call *Call) []reflect.Value {
+	tried := map[*upstream]bool{}
+	var picked []*upstream
+	for len(picked) < p.quorumSize {
+		u := p.pick(tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+		picked = append(picked, u)
+	}
+	if len(picked) == 0 {
+		return call.errorResult(errNoUpstream)
+	}
+
+	ch := make(chan quorumAnswer, len(picked))
+	for _, u := range picked {
+		go func(u *upstream) {
+			ch <- quorumAnswer{upstream: u, results: p.call(ctx, u, call)}
+		}(u)
+	}
+
+	var (
+		answers []quorumAnswer
+		last    []reflect.Value
+		counts  = map[uint64]int{}
+	)
+	for range picked {
+		a := <-ch
+		last = a.results
+		if shouldFailover(resultError(a.results)) {
+			continue
+		}
+		a.key = answerKey(a.results)
+		counts[a.key]++
+		answers = append(answers, a)
+	}
+	if len(answers) == 0 {
+		return last
+	}
+
+	best := answers[0]
+	for _, a := range answers[1:] {
+		if counts[a.key] > counts[best.key] {
+			best = a
+		}
+	}
+
+	if len(counts) > 1 {
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		reportEvent(mctx, quorumDivergence)
+		for _, a := range answers {
+			if a.key != best.key {
+				log.Println("upstream answer diverges from quorum", "method", call.Method, "upstream", a.upstream.addr, "agreeing", counts[best.key], "answers", len(answers))
+			}
+		}
+	}
+
+	if counts[best.key]*2 <= len(answers) {
+		return call.errorResult(errNoQuorum)
+	}
+	return best.results
+}
+
+// answerKey returns a hash identifying the answer carried by results, so that
+// equal results and equal errors share a key.
+func answerKey(results []reflect.Value) uint64 {
+	if err := resultError(results); err != nil {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte("error:" + err.Error()))
+		return h.Sum64()
+	}
+	if h, ok := resultHash(results); ok {
+		return h
+	}
+	return 0
+}
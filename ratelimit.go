@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// limitConfig bounds the calls sent to an upstream node. Zero values leave
+// the rate or concurrency unbounded.
+type limitConfig struct {
+	rate        float64 // calls per second
+	concurrency int     // calls in flight
+}
+
+func (c limitConfig) unbounded() bool {
+	return c.rate <= 0 && c.concurrency <= 0
+}
+
+// upstreamLimits configures the limits each upstream node is protected by:
+// one for every call, and one for each class of methods matching rules.
+type upstreamLimits struct {
+	all     limitConfig
+	rules   methodRules
+	classes []limitConfig
+}
+
+// callLimiter holds back calls to one upstream node so that a burst of client
+// traffic cannot overload it. Calls wait for their turn rather than fail,
+// bounded by their context.
+type callLimiter struct {
+	all     *limit
+	rules   methodRules
+	classes []*limit
+}
+
+// newCallLimiter returns a limiter enforcing l, or nil when l sets no limits.
+func newCallLimiter(l upstreamLimits) *callLimiter {
+	c := &callLimiter{
+		all:   newLimit(l.all),
+		rules: l.rules,
+	}
+	bounded := c.all != nil
+	for _, class := range l.classes {
+		c.classes = append(c.classes, newLimit(class))
+		bounded = bounded || !class.unbounded()
+	}
+	for _, lim := range append([]*limit{c.all}, c.classes...) {
+		if lim != nil {
+			lim.limited = upstreamLimited
+		}
+	}
+	if !bounded {
+		return nil
+	}
+	return c
+}
+
+// acquire waits until the call may be sent and returns the function that
+// releases its slot once it has been answered. Calls that open a stream only
+// wait for the rate limit, as they would hold a slot for as long as they
+// stay open.
+func (c *callLimiter) acquire(ctx context.Context, call *Call) (func(), error) {
+	if c == nil {
+		return func() {}, nil
+	}
+	streams := call.streams()
+	release, err := c.all.acquire(ctx, streams)
+	if err != nil {
+		return nil, err
+	}
+	if i := c.rules.find(call.Method); i >= 0 {
+		releaseClass, err := c.classes[i].acquire(ctx, streams)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		return func() {
+			releaseClass()
+			release()
+		}, nil
+	}
+	return release, nil
+}
+
+// limit is a token bucket refilled at rate calls per second, holding up to
+// a second's worth of calls, together with a semaphore bounding concurrency.
+type limit struct {
+	rate  float64
+	burst float64
+	slots chan struct{} // nil for unbounded concurrency
+
+	limited *stats.Int64Measure // optional, counts the calls held back
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newLimit returns the limit for c, or nil when c is unbounded.
+func newLimit(c limitConfig) *limit {
+	if c.unbounded() {
+		return nil
+	}
+	l := &limit{rate: c.rate}
+	if c.rate > 0 {
+		l.burst = math.Max(1, math.Ceil(c.rate))
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+	if c.concurrency > 0 {
+		l.slots = make(chan struct{}, c.concurrency)
+	}
+	return l
+}
+
+func (l *limit) acquire(ctx context.Context, streams bool) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+	if l.slots == nil || streams {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	default:
+	}
+	l.record(ctx)
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait takes a token from the bucket, waiting until one is available.
+func (l *limit) wait(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	l.record(ctx)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Return the token so that abandoned calls do not delay others.
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (l *limit) record(ctx context.Context) {
+	if l.limited != nil {
+		stats.Record(ctx, l.limited.M(1))
+	}
+}
+
+// parseUpstreamLimits parses values of the form
+// <method rule>=<calls per second>/<concurrency>, either of which may be 0 for
+// no limit.
+func parseUpstreamLimits(all limitConfig, values []string) (upstreamLimits, error) {
+	limits := upstreamLimits{all: all}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return upstreamLimits{}, fmt.Errorf("invalid upstream limit %q, expected <method rule>=<rate>/<concurrency>", v)
+		}
+		rule, err := parseMethodRule(parts[0])
+		if err != nil {
+			return upstreamLimits{}, err
+		}
+		limit, err := parseLimit(parts[1])
+		if err != nil {
+			return upstreamLimits{}, fmt.Errorf("invalid upstream limit %q: %w", v, err)
+		}
+		limits.rules = append(limits.rules, rule)
+		limits.classes = append(limits.classes, limit)
+	}
+	return limits, nil
+}
+
+// parseLimit parses a limit of the form <calls per second>/<concurrency>.
+func parseLimit(v string) (limitConfig, error) {
+	bounds := strings.SplitN(v, "/", 2)
+	if len(bounds) != 2 {
+		return limitConfig{}, fmt.Errorf("expected <rate>/<concurrency>")
+	}
+	rate, err := strconv.ParseFloat(bounds[0], 64)
+	if err != nil || rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return limitConfig{}, fmt.Errorf("invalid rate %q", bounds[0])
+	}
+	concurrency, err := strconv.Atoi(bounds[1])
+	if err != nil || concurrency < 0 {
+		return limitConfig{}, fmt.Errorf("invalid concurrency %q", bounds[1])
+	}
+	return limitConfig{rate: rate, concurrency: concurrency}, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"go.opencensus.io/tag"
+)
+
+// maxRawRequestSize bounds the request bodies inspected for raw cache hits.
+// Larger requests are passed through without being read.
+const maxRawRequestSize = 64 << 10
+
+// rawRequest is the envelope of a JSON-RPC request.
+type rawRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// rawResponse is the envelope of a JSON-RPC response.
+type rawResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// peekRawRequest reads the JSON-RPC request of an http call without consuming
+// the body, which is left for the handler of the call. It returns a nil
+// request for websocket upgrades, notifications and requests too large to
+// inspect.
+func peekRawRequest(r *http.Request) ([]byte, *rawRequest, error) {
+	if r.Method != http.MethodPost || r.ContentLength > maxRawRequestSize ||
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRawRequestSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+	var req rawRequest
+	if len(body) > maxRawRequestSize || json.Unmarshal(body, &req) != nil || len(req.ID) == 0 {
+		return nil, nil, nil
+	}
+	return body, &req, nil
+}
+
+// rawCacheHandler serves http calls to the methods listed in ttls from the raw
+// JSON results held in the cache, writing them into the response envelope as
+// they are instead of decoding them into typed values and encoding them again.
+// Hits pass through calls, which check their token and apply its limits as
+// the interceptors would. On a miss the call is passed to next and the result it
+// writes is cached. Calls the token may not make are rejected with 403. Calls
+// of tokens limited to some miners, and of minted tokens, are always passed
+// to next, where their miner, and the methods and limits of their grant, are
+// checked.
+func rawCacheHandler(cache *responseCache, name, namespace string, ttls map[string]time.Duration, scopes *minerScopes, acls methodACLs, calls rawCalls, next http.Handler) http.Handler {
+	methods := apiMethods(&lotusapi.StorageMinerStruct{}, &lotusapi.FullNodeStruct{})
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		_, req, err := peekRawRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := strings.TrimPrefix(req.Method, namespace+".")
+		ttl, ok := ttls[method]
+		f, known := methods[method]
+		if !ok || !known || grantFrom(r.Context()) != nil || scopes.scoped(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The permission of the method, and the method lists of the token
+		// and its owner, are checked here, as cached answers do not reach
+		// the interceptors.
+		perm := f.Tag.Get("perm")
+		if p := jwtPayloadFrom(r.Context()); p != nil && !p.allows(perm) {
+			writeCallError(w, req.ID, fmt.Errorf("%s needs %s permission: %w", method, perm, errTokenScope))
+			return
+		}
+		if !acls.permits(r.Context(), method) {
+			writeCallError(w, req.ID, fmt.Errorf("%s: %w", method, errTokenScope))
+			return
+		}
+		key, err := rawCacheKey(method, req.Params)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if result, ok := cache.getRaw(key); ok {
+			calls.serve(w, r, req, method, perm, func(ctx context.Context) (json.RawMessage, error) {
+				mctx, _ := tag.New(cacheContext(ctx, name), tag.Upsert(methodTag, method))
+				reportEvent(mctx, rpcRequest)
+				reportEvent(mctx, getRequest)
+				reportEvent(mctx, getHit)
+
+				writeRawResult(w, req.ID, result)
+				return result, nil
+			})
+			return
+		}
+
+		tw := &teeWriter{ResponseWriter: w}
+		next.ServeHTTP(tw, r)
+		if tw.status != 0 && tw.status != http.StatusOK {
+			return
+		}
+
+		var resp rawResponse
+		if err := json.Unmarshal(tw.buf.Bytes(), &resp); err != nil || len(resp.Error) > 0 || len(resp.Result) == 0 {
+			return
+		}
+		if cache.learn != nil {
+			ttl = cache.learn.ttl(method, ttl)
+		}
+		cache.putRaw(key, resp.Result, ttl)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// writeRawResult answers the request of id with a raw JSON result.
+func writeRawResult(w http.ResponseWriter, id, result json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"jsonrpc":"2.0","result":`))
+	_, _ = w.Write(result)
+	_, _ = w.Write([]byte(`,"id":`))
+	_, _ = w.Write(id)
+	_, _ = w.Write([]byte("}\n"))
+}
+
+// rawCacheKey returns the key used to cache the raw result of a call to
+// method with the JSON encoded params. It matches the key of the typed result
+// so that invalidation by prefix removes both.
+func rawCacheKey(method string, params json.RawMessage) (string, error) {
+	if len(params) == 0 {
+		return method + ":[]", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, params); err != nil {
+		return "", err
+	}
+	return method + ":" + buf.String(), nil
+}
+
+// teeWriter copies the response written to it into a buffer.
+type teeWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *teeWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
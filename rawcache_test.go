@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestRawCacheHandlerChecksToken(t *testing.T) {
+	cache := newResponseCache()
+	ttls := map[string]time.Duration{"SectorsStatus": time.Minute, "SectorRemove": time.Minute}
+	for _, method := range []string{"SectorsStatus", "SectorRemove"} {
+		key, err := rawCacheKey(method, json.RawMessage(`[1]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.putRaw(key, json.RawMessage(`"cached"`), time.Minute)
+	}
+	scopes, err := parseMinerScopes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acls, err := parseOwnerACLs(nil, []string{"team-a=SectorsStatus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var passed bool
+	h := rawCacheHandler(cache, "sectors", "Filecoin", ttls, scopes, acls, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed = true
+	}))
+
+	read := &jwtPayload{Allow: []string{"read"}}
+	admin := &jwtPayload{Allow: []string{"read", "write", "sign", "admin"}}
+	teamA := &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, Allow: []string{"read"}}
+	tests := []struct {
+		name    string
+		payload *jwtPayload
+		method  string
+		want    int
+		cached  bool
+	}{
+		{"read method with read token", read, "SectorsStatus", http.StatusOK, true},
+		{"admin method with read token", read, "SectorRemove", http.StatusForbidden, false},
+		{"admin method with admin token", admin, "SectorRemove", http.StatusOK, true},
+		{"method denied to the owner", teamA, "SectorsStatus", http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed = false
+			body := []byte(`{"jsonrpc":"2.0","id":7,"method":"Filecoin.` + tt.method + `","params":[1]}`)
+			r := httptest.NewRequest(http.MethodPost, "/rpc/v0", bytes.NewReader(body))
+			r = r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, tt.payload))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if passed {
+				t.Error("call passed on, want it answered by the handler")
+			}
+			var resp rawResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if cached := string(resp.Result) == `"cached"`; cached != tt.cached {
+				t.Errorf("served from the cache = %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
+
+func TestRawCacheHandlerLimitsHits(t *testing.T) {
+	cache := newResponseCache()
+	key, err := rawCacheKey("SectorsStatus", json.RawMessage(`[1]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.putRaw(key, json.RawMessage(`"cached"`), time.Minute)
+	scopes, err := parseMinerScopes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := newTokenLimits(nil, map[string]map[string]int64{"team-a": {"day": 1}})
+	ttls := map[string]time.Duration{"SectorsStatus": time.Minute}
+	h := rawCacheHandler(cache, "sectors", "Filecoin", ttls, scopes, nil, rawCalls{limits.interceptor}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("cache hit passed on")
+	}))
+	payload := &jwtPayload{Payload: jwt.Payload{Subject: "team-a"}, Allow: []string{"read"}}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		body := []byte(`{"jsonrpc":"2.0","id":1,"method":"Filecoin.SectorsStatus","params":[1]}`)
+		r := httptest.NewRequest(http.MethodPost, "/rpc/v0", bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, payload))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("call %d: status = %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("quota exceeded without Retry-After")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// rawCallType is the type of the calls handlers answer from raw JSON, whose
+// args are the elements of their JSON params and whose result is raw JSON.
+var rawCallType = reflect.TypeOf(func(context.Context) (json.RawMessage, error) { return nil, nil })
+
+// newRawCall returns the call of method, which needs perm, with the JSON
+// params given. Its args are the elements of positional params, or else the
+// params themselves, kept as raw JSON.
+func newRawCall(method, perm string, params json.RawMessage) *Call {
+	var list []json.RawMessage
+	if err := json.Unmarshal(params, &list); err != nil {
+		list = nil
+		if len(params) > 0 {
+			list = []json.RawMessage{params}
+		}
+	}
+	args := make([]reflect.Value, len(list))
+	for i, p := range list {
+		args[i] = reflect.ValueOf(p)
+	}
+	return &Call{Method: method, Perm: perm, Type: rawCallType, Args: args}
+}
+
+// rawCalls are the interceptors applied to the calls that handlers answer
+// from raw JSON, such as raw cache hits and eth and passthrough calls. These
+// calls never reach the jsonrpc servers, and so the interceptors of the
+// served apis, so the checks and limits of their token are applied here
+// instead.
+type rawCalls []Interceptor
+
+// call passes call through the interceptors to answer, which makes it and
+// returns its result or error. It returns the error an interceptor rejected
+// the call with, or nil once answered.
+func (rc rawCalls) call(ctx context.Context, call *Call, answer func(ctx context.Context) (json.RawMessage, error)) error {
+	answered := false
+	var invoke Invoker = func(ctx context.Context, call *Call) []reflect.Value {
+		answered = true
+		result, err := answer(ctx)
+		return []reflect.Value{reflect.ValueOf(result), reflect.ValueOf(&err).Elem()}
+	}
+	for i := len(rc) - 1; i >= 0; i-- {
+		invoke = rc[i](invoke)
+	}
+	err := resultError(invoke(ctx, call))
+	if answered {
+		return nil
+	}
+	return err
+}
+
+// serve passes the call of req to method, which needs perm, through the
+// interceptors to answer, which writes the response of the call to w. A call
+// an interceptor rejects is answered with its error by writeCallError.
+func (rc rawCalls) serve(w http.ResponseWriter, r *http.Request, req *rawRequest, method, perm string, answer func(ctx context.Context) (json.RawMessage, error)) {
+	if err := rc.call(r.Context(), newRawCall(method, perm, req.Params), answer); err != nil {
+		writeCallError(w, req.ID, err)
+	}
+}
+
+// rawOutcome returns the result of the JSON-RPC response body, or the error
+// it carries.
+func rawOutcome(body []byte) (json.RawMessage, error) {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, errors.New(resp.Error.Message)
+	}
+	return resp.Result, nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
@@ -27,6 +29,24 @@ type backoff struct {
 	maxDelay time.Duration
 }
 
+func (b *backoff) next(attempt int) time.Duration {
+	if attempt < 0 {
+		return b.minDelay
+	}
+
+	minf := float64(b.minDelay)
+	durf := minf * math.Pow(1.5, float64(attempt))
+	durf = durf + rand.Float64()*minf
+
+	delay := time.Duration(durf)
+
+	if delay > b.maxDelay {
+		return b.maxDelay
+	}
+
+	return delay
+}
+
 type Config struct {
 	reconnectBackoff backoff
 	pingInterval     time.Duration
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// readiness tracks the warm-up conditions that must be met before /readyz
+// reports the proxy ready, so that load balancers do not send traffic to a
+// cold replica that would stampede the upstream.
+type readiness struct {
+	pool   *upstreamPool
+	router *backendRouter // optional, for group checks
+	expr   readyExpr      // of --ready-when, replaced before /readyz is served
+
+	mu        sync.Mutex
+	pending   map[string]bool
+	drainedAt time.Time
+	drained   chan struct{}
+	headTime  time.Time // of the last chain head the follower observed
+}
+
+func newReadiness(pool *upstreamPool) *readiness {
+	expr, err := parseReadyExpr(defaultReadyExpr, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &readiness{
+		pool:    pool,
+		expr:    expr,
+		pending: map[string]bool{},
+		drained: make(chan struct{}),
+	}
+}
+
+// drain reports the proxy not ready from now on, so that load balancers stop
+// sending it new traffic, and returns the time it began draining.
+func (r *readiness) drain() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.drainedAt.IsZero() {
+		r.drainedAt = time.Now()
+		close(r.drained)
+		log.Println("draining, reporting not ready")
+	}
+	return r.drainedAt
+}
+
+// draining returns a channel that is closed once the proxy begins draining.
+func (r *readiness) draining() <-chan struct{} {
+	return r.drained
+}
+
+func (r *readiness) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.drainedAt.IsZero()
+}
+
+// require adds a warm-up condition and returns the function that marks it
+// met. Conditions stay met once they have been.
+func (r *readiness) require(name string) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[name] = true
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.pending[name] {
+			delete(r.pending, name)
+			log.Println("warm-up condition met", "condition", name)
+		}
+	}
+}
+
+// unmet returns the conditions that prevent the proxy from being ready: the
+// checks of the readiness expression that fail, with the pending warm-up
+// conditions in place of warm, and draining.
+func (r *readiness) unmet() []string {
+	var unmet []string
+	for _, check := range r.expr.failing(r) {
+		if check != "warm" {
+			unmet = append(unmet, check)
+			continue
+		}
+		r.mu.Lock()
+		for name := range r.pending {
+			unmet = append(unmet, name)
+		}
+		r.mu.Unlock()
+	}
+	if r.isDraining() {
+		unmet = append(unmet, "draining")
+	}
+	sort.Strings(unmet)
+	return unmet
+}
+
+// check answers the boolean checks of readiness expressions.
+func (r *readiness) check(name string) bool {
+	switch name {
+	case "warm":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.pending) == 0
+	case "upstream":
+		return countHealthy(r.pool.all()) > 0
+	case "primary":
+		all := r.pool.all()
+		return len(all) > 0 && all[0].isHealthy()
+	case "writer":
+		return r.pool.writer != nil && r.pool.writer.isHealthy()
+	}
+	if group := strings.TrimPrefix(name, "group:"); group != name && r.router != nil {
+		p, ok := r.router.groups[group]
+		return ok && countHealthy(p.all()) > 0
+	}
+	return false
+}
+
+// value answers the numeric checks of readiness expressions, when known.
+func (r *readiness) value(name string) (int64, bool) {
+	switch name {
+	case "healthy-upstreams":
+		return int64(countHealthy(r.pool.all())), true
+	case "head-lag":
+		r.mu.Lock()
+		head := r.headTime
+		r.mu.Unlock()
+		if head.IsZero() {
+			return 0, false
+		}
+		return int64(time.Since(head) / epochDuration), true
+	}
+	return 0, false
+}
+
+func countHealthy(upstreams []*upstream) int {
+	n := 0
+	for _, u := range upstreams {
+		if u.isHealthy() {
+			n++
+		}
+	}
+	return n
+}
+
+// requireHead adds a condition that is met once the follower has observed a
+// chain head, and follows the time of the heads it observes.
+func (r *readiness) requireHead(f *chainFollower) {
+	met := r.require("head")
+	f.onHead(func(ctx context.Context, prev, head *types.TipSet) {
+		r.mu.Lock()
+		r.headTime = time.Unix(int64(head.MinTimestamp()), 0)
+		r.mu.Unlock()
+		met()
+	})
+}
+
+type readyStatus struct {
+	Ready bool     `json:"ready"`
+	Unmet []string `json:"unmet,omitempty"`
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	unmet := r.unmet()
+	if len(unmet) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, readyStatus{
+		Ready: len(unmet) == 0,
+		Unmet: unmet,
+	})
+}
+
+// prefetcher calls methods that take no arguments through the proxied API at
+// startup so that their responses are cached before traffic arrives.
+type prefetcher struct {
+	invoke  Invoker
+	calls   []*Call
+	backoff backoff
+}
+
+// newPrefetcher returns a prefetcher for the named methods of api, which must
+// be a pointer to an API struct whose functions have been filled by proxyAPI.
+func newPrefetcher(api interface{}, methods []string) (*prefetcher, error) {
+	ra := reflect.ValueOf(api)
+	p := &prefetcher{
+		invoke: methodInvoker(api),
+		backoff: backoff{
+			minDelay: time.Second,
+			maxDelay: 30 * time.Second,
+		},
+	}
+	for _, name := range methods {
+		m := ra.MethodByName(name)
+		if !m.IsValid() {
+			return nil, fmt.Errorf("unknown method %q", name)
+		}
+		// Method values exclude the receiver, leaving the context as the
+		// only argument.
+		if m.Type().NumIn() != 1 {
+			return nil, fmt.Errorf("method %q takes arguments and cannot be prefetched", name)
+		}
+		p.calls = append(p.calls, &Call{
+			Method: name,
+			Type:   m.Type(),
+		})
+	}
+	return p, nil
+}
+
+// run calls each method until it succeeds and then calls met.
+func (p *prefetcher) run(ctx context.Context, met func()) {
+	var wg sync.WaitGroup
+	for _, call := range p.calls {
+		wg.Add(1)
+		go func(call *Call) {
+			defer wg.Done()
+			for attempt := 0; ; attempt++ {
+				err := resultError(p.invoke(ctx, call))
+				if err == nil {
+					return
+				}
+				log.Println("failed to prefetch", "method", call.Method, "error", err)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(p.backoff.next(attempt)):
+				}
+			}
+		}(call)
+	}
+	wg.Wait()
+
+	if ctx.Err() == nil {
+		met()
+	}
+}
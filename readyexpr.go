@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// epochDuration is the time between Filecoin epochs.
+const epochDuration = 30 * time.Second
+
+// defaultReadyExpr is the readiness of the proxy when --ready-when is not
+// given: warmed up, with a healthy upstream node.
+const defaultReadyExpr = "warm AND upstream"
+
+// readyChecks are the checks readiness expressions are made of. Numeric
+// checks are compared to a number, e.g. head-lag < 3.
+var readyChecks = map[string]bool{
+	"warm":              false, // the warm-up conditions are met
+	"upstream":          false, // an upstream of the default group is healthy
+	"primary":           false, // the first --api upstream is healthy
+	"writer":            false, // the --write-api upstream is healthy
+	"healthy-upstreams": true,  // number of healthy upstreams in the default group
+	"head-lag":          true,  // epochs the chain head seen by --fullnode-api lags the clock
+}
+
+// readyEnv answers the checks of a readiness expression.
+type readyEnv interface {
+	check(name string) bool
+	value(name string) (int64, bool)
+}
+
+// readyExpr is a parsed readiness expression.
+type readyExpr interface {
+	eval(env readyEnv) bool
+	// failing returns the checks that make the expression false.
+	failing(env readyEnv) []string
+	String() string
+}
+
+type readyAnd []readyExpr
+type readyOr []readyExpr
+type readyNot struct{ x readyExpr }
+
+// readyCheck is a boolean check, or a numeric one when op is set.
+type readyCheck struct {
+	name  string
+	op    string
+	limit int64
+}
+
+func (e readyAnd) eval(env readyEnv) bool {
+	for _, x := range e {
+		if !x.eval(env) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e readyAnd) failing(env readyEnv) []string {
+	var failing []string
+	for _, x := range e {
+		failing = append(failing, x.failing(env)...)
+	}
+	return failing
+}
+
+func (e readyAnd) String() string {
+	return joinReadyExprs(e, " AND ")
+}
+
+func (e readyOr) eval(env readyEnv) bool {
+	for _, x := range e {
+		if x.eval(env) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e readyOr) failing(env readyEnv) []string {
+	if e.eval(env) {
+		return nil
+	}
+	var failing []string
+	for _, x := range e {
+		failing = append(failing, x.failing(env)...)
+	}
+	return failing
+}
+
+func (e readyOr) String() string {
+	return "(" + joinReadyExprs(e, " OR ") + ")"
+}
+
+func (e readyNot) eval(env readyEnv) bool {
+	return !e.x.eval(env)
+}
+
+func (e readyNot) failing(env readyEnv) []string {
+	if e.eval(env) {
+		return nil
+	}
+	return []string{e.String()}
+}
+
+func (e readyNot) String() string {
+	return "NOT " + e.x.String()
+}
+
+func (c readyCheck) eval(env readyEnv) bool {
+	if c.op == "" {
+		return env.check(c.name)
+	}
+	v, ok := env.value(c.name)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return v < c.limit
+	case "<=":
+		return v <= c.limit
+	case ">":
+		return v > c.limit
+	case ">=":
+		return v >= c.limit
+	case "==":
+		return v == c.limit
+	default:
+		return v != c.limit
+	}
+}
+
+func (c readyCheck) failing(env readyEnv) []string {
+	if c.eval(env) {
+		return nil
+	}
+	return []string{c.String()}
+}
+
+func (c readyCheck) String() string {
+	if c.op == "" {
+		return c.name
+	}
+	return fmt.Sprintf("%s %s %d", c.name, c.op, c.limit)
+}
+
+// usesCheck reports whether the expression e uses the check name.
+func usesCheck(e readyExpr, name string) bool {
+	switch e := e.(type) {
+	case readyAnd:
+		for _, x := range e {
+			if usesCheck(x, name) {
+				return true
+			}
+		}
+	case readyOr:
+		for _, x := range e {
+			if usesCheck(x, name) {
+				return true
+			}
+		}
+	case readyNot:
+		return usesCheck(e.x, name)
+	case readyCheck:
+		return e.name == name
+	}
+	return false
+}
+
+func joinReadyExprs(xs []readyExpr, sep string) string {
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		parts[i] = x.String()
+	}
+	return strings.Join(parts, sep)
+}
+
+// parseReadyExpr parses a readiness expression such as
+// "primary AND head-lag < 3 AND (writer OR NOT group:chain)": checks joined by
+// AND, OR and NOT, with parentheses. group:<name> checks that an upstream of
+// the backend group is healthy, and must name one of groups.
+func parseReadyExpr(s string, groups map[string][]apiInfo) (readyExpr, error) {
+	p := &readyParser{tokens: tokenizeReadyExpr(s), groups: groups}
+	e, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid readiness expression %q: %w", s, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid readiness expression %q: unexpected %q", s, p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func tokenizeReadyExpr(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.ContainsRune("<>=!&|", rune(c)):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("<>=!&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i + 1
+			for j < len(s) && !strings.ContainsRune(" \t()<>=!&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type readyParser struct {
+	tokens []string
+	pos    int
+	groups map[string][]apiInfo
+}
+
+func (p *readyParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *readyParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *readyParser) or() (readyExpr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	xs := readyOr{x}
+	for t := p.peek(); strings.EqualFold(t, "OR") || t == "||"; t = p.peek() {
+		p.next()
+		x, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+	}
+	if len(xs) == 1 {
+		return x, nil
+	}
+	return xs, nil
+}
+
+func (p *readyParser) and() (readyExpr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	xs := readyAnd{x}
+	for t := p.peek(); strings.EqualFold(t, "AND") || t == "&&"; t = p.peek() {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, x)
+	}
+	if len(xs) == 1 {
+		return x, nil
+	}
+	return xs, nil
+}
+
+func (p *readyParser) unary() (readyExpr, error) {
+	switch t := p.next(); {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end")
+	case strings.EqualFold(t, "NOT") || t == "!":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return readyNot{x}, nil
+	case t == "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return x, nil
+	default:
+		return p.check(t)
+	}
+}
+
+func (p *readyParser) check(name string) (readyExpr, error) {
+	if group := strings.TrimPrefix(name, "group:"); group != name {
+		if _, ok := p.groups[group]; !ok && group != defaultBackend {
+			return nil, fmt.Errorf("unknown backend group %q", group)
+		}
+		return readyCheck{name: name}, nil
+	}
+	numeric, ok := readyChecks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown check %q", name)
+	}
+	if !numeric {
+		return readyCheck{name: name}, nil
+	}
+	op := p.next()
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default:
+		return nil, fmt.Errorf("%s must be compared to a number", name)
+	}
+	limit, err := strconv.ParseInt(p.next(), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be compared to a number", name)
+	}
+	return readyCheck{name: name, op: op, limit: limit}, nil
+}
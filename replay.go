@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of requests protected from replay.
+const (
+	nonceHeader          = "X-Request-Nonce"
+	nonceTimestampHeader = "X-Request-Timestamp"
+)
+
+var (
+	errReplayed      = errors.New("request has already been received")
+	errNonceRequired = errors.New("calls that change state need X-Request-Nonce and X-Request-Timestamp headers, see --replay-protection")
+)
+
+// replayGuard remembers the requests seen within a window, so that a
+// captured request cannot be sent again to push the same message twice.
+// Requests older than the window are rejected by their timestamp, so their
+// keys need not be kept longer.
+type replayGuard struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time // expiry by key
+	pruned time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{window: window, seen: map[string]time.Time{}}
+}
+
+// fresh reports whether the unix timestamp ts is within the window of now.
+func (g *replayGuard) fresh(ts string, now time.Time) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", ts)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > g.window || d < -g.window {
+		return fmt.Errorf("timestamp is more than %s off", g.window)
+	}
+	return nil
+}
+
+// seenBefore records key and reports whether it was already recorded. Keys
+// are kept for twice the window, as timestamps may be as far ahead of the
+// clock as behind it.
+func (g *replayGuard) seenBefore(key string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.pruned) > g.window {
+		for k, expiry := range g.seen {
+			if now.After(expiry) {
+				delete(g.seen, k)
+			}
+		}
+		g.pruned = now
+	}
+	if expiry, ok := g.seen[key]; ok && !now.After(expiry) {
+		return true
+	}
+	g.seen[key] = now.Add(2 * g.window)
+	return false
+}
+
+type replayCheckedKey struct{}
+
+// withReplayChecked marks the request of ctx as seen once only, by its nonce
+// or its signature.
+func withReplayChecked(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayCheckedKey{}, true)
+}
+
+func replayChecked(ctx context.Context) bool {
+	checked, _ := ctx.Value(replayCheckedKey{}).(bool)
+	return checked
+}
+
+// handler rejects requests whose nonce the owner of their token already
+// sent within the window with 409, and those with a stale timestamp with
+// 400. The nonce of a websocket upgrade covers the calls made over the
+// connection.
+func (g *replayGuard) handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		nonce := r.Header.Get(nonceHeader)
+		if nonce == "" || replayChecked(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		if err := g.fresh(r.Header.Get(nonceTimestampHeader), now); err != nil {
+			writeRPCError(w, http.StatusBadRequest, codeReplay, err)
+			return
+		}
+		if g.seenBefore(tokenOwner(r.Context())+" "+nonce, now) {
+			writeRPCError(w, http.StatusConflict, codeReplay, errReplayed)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withReplayChecked(r.Context())))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// interceptor rejects calls that change state made in requests without a
+// nonce.
+func (g *replayGuard) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if !call.readOnly() && !replayChecked(ctx) {
+			return call.errorResult(errNonceRequired)
+		}
+		return next(ctx, call)
+	}
+}
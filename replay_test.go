@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+func TestReplayGuardHandler(t *testing.T) {
+	g := newReplayGuard(time.Minute)
+	h := g.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name  string
+		owner string
+		nonce string
+		ts    string
+		want  int
+	}{
+		{"no nonce", "alice", "", "", http.StatusOK},
+		{"first nonce", "alice", "n1", now, http.StatusOK},
+		{"nonce sent again", "alice", "n1", now, http.StatusConflict},
+		{"nonce of another owner", "bob", "n1", now, http.StatusOK},
+		{"new nonce", "alice", "n2", now, http.StatusOK},
+		{"stale timestamp", "alice", "n3", stale, http.StatusBadRequest},
+		{"invalid timestamp", "alice", "n4", "yesterday", http.StatusBadRequest},
+		{"missing timestamp", "alice", "n5", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/rpc/v1", nil)
+			payload := &jwtPayload{Payload: jwt.Payload{Subject: tt.owner}, Allow: []string{"read", "write"}}
+			r = r.WithContext(context.WithValue(r.Context(), jwtPayloadKey{}, payload))
+			if tt.nonce != "" {
+				r.Header.Set(nonceHeader, tt.nonce)
+			}
+			if tt.ts != "" {
+				r.Header.Set(nonceTimestampHeader, tt.ts)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayGuardInterceptor(t *testing.T) {
+	g := newReplayGuard(time.Minute)
+	invoke := g.interceptor(func(ctx context.Context, call *Call) []reflect.Value {
+		return call.errorResult(nil)
+	})
+	callType := reflect.TypeOf(func(context.Context) error { return nil })
+
+	tests := []struct {
+		name    string
+		method  string
+		perm    string
+		checked bool
+		wantErr error
+	}{
+		{"read without nonce", "StateGetActor", "read", false, nil},
+		{"write without nonce", "MpoolPushMessage", "sign", false, errNonceRequired},
+		{"write with nonce", "MpoolPushMessage", "sign", true, nil},
+		{"idempotent without nonce", "NetConnect", "write", false, errNonceRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.checked {
+				ctx = withReplayChecked(ctx)
+			}
+			err := resultError(invoke(ctx, &Call{Method: tt.method, Perm: tt.perm, Type: callType}))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayGuardSeenBefore(t *testing.T) {
+	g := newReplayGuard(time.Minute)
+	now := time.Now()
+	if g.seenBefore("k", now) {
+		t.Fatal("new key reported as seen")
+	}
+	if !g.seenBefore("k", now.Add(time.Minute)) {
+		t.Error("key not reported as seen within twice the window")
+	}
+	if g.seenBefore("k", now.Add(3*time.Minute)) {
+		t.Error("key reported as seen after twice the window")
+	}
+}
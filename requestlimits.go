@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// requestLimits bound the JSON-RPC requests posted to the proxy, which are
+// checked as they are read and before they are decoded, so that a huge or
+// deeply nested request cannot exhaust its memory. Limits of 0 are not
+// enforced.
+type requestLimits struct {
+	maxBody  int64 // bytes
+	maxBatch int   // calls in a batch request
+	maxArray int   // elements of any array in the params
+	maxDepth int   // nesting of arrays and objects
+}
+
+// handler rejects posted requests over the limits with a JSON-RPC error of
+// code codeRequestLimit, and status 413 when the body is too large or 400
+// otherwise. Websocket upgrades are passed through.
+func (l requestLimits) handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if l.maxBody > 0 && r.ContentLength > l.maxBody {
+			writeRPCError(w, http.StatusRequestEntityTooLarge, codeRequestLimit, fmt.Errorf("request body of %d bytes exceeds the limit of %d", r.ContentLength, l.maxBody))
+			return
+		}
+		body := r.Body
+		if l.maxBody > 0 {
+			body = ioutil.NopCloser(io.LimitReader(r.Body, l.maxBody+1))
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("read request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if l.maxBody > 0 && int64(len(data)) > l.maxBody {
+			writeRPCError(w, http.StatusRequestEntityTooLarge, codeRequestLimit, fmt.Errorf("request body exceeds the limit of %d bytes", l.maxBody))
+			return
+		}
+		if err := l.check(data); err != nil {
+			writeRPCError(w, http.StatusBadRequest, codeRequestLimit, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// check walks the tokens of the request in data against the limits on
+// batches, arrays and nesting. Malformed JSON is left for the JSON-RPC
+// server to report.
+func (l requestLimits) check(data []byte) error {
+	if l.maxBatch <= 0 && l.maxArray <= 0 && l.maxDepth <= 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Elements read so far of each array open, or -1 for objects.
+	var open []int
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if len(open) > 0 && open[len(open)-1] >= 0 {
+			if d, ok := tok.(json.Delim); !ok || (d != ']' && d != '}') {
+				open[len(open)-1]++
+				n := open[len(open)-1]
+				if len(open) == 1 && l.maxBatch > 0 && n > l.maxBatch {
+					return fmt.Errorf("batch of more than %d calls exceeds the limit", l.maxBatch)
+				}
+				if len(open) > 1 && l.maxArray > 0 && n > l.maxArray {
+					return fmt.Errorf("array of more than %d elements exceeds the limit", l.maxArray)
+				}
+			}
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			if l.maxDepth > 0 && len(open) >= l.maxDepth {
+				return fmt.Errorf("nesting deeper than %d exceeds the limit", l.maxDepth)
+			}
+			if tok == json.Delim('[') {
+				open = append(open, 0)
+			} else {
+				open = append(open, -1)
+			}
+		case json.Delim(']'), json.Delim('}'):
+			open = open[:len(open)-1]
+			if len(open) == 0 {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// retryConfig configures how calls that failed transiently are retried.
+type retryConfig struct {
+	attempts int     // retries after the first attempt, 0 to disable
+	backoff  backoff // delay between attempts
+	budget   float64 // retries allowed per call, on average
+}
+
+// retryPolicy retries idempotent calls that no upstream could answer, after
+// a jittered backoff. Retries draw from a budget that grows with the calls
+// made, so that retries cannot multiply the load on struggling upstreams.
+type retryPolicy struct {
+	attempts int
+	backoff  backoff
+	budget   *retryBudget
+}
+
+func newRetryPolicy(cfg retryConfig) *retryPolicy {
+	return &retryPolicy{
+		attempts: cfg.attempts,
+		backoff:  cfg.backoff,
+		budget:   newRetryBudget(cfg.budget),
+	}
+}
+
+// idempotentCall reports whether the call may be sent again after it may
+// have reached an upstream: whether its method is not mutating, as classified
+// by the method registry. Streams never are.
+func (r *retryPolicy) idempotentCall(call *Call) bool {
+	return !call.streams() && call.class() != classMutating
+}
+
+// notSent reports whether a call that failed with err never reached an
+// upstream, so that it may be sent elsewhere whatever its method.
+func notSent(err error) bool {
+	return errors.Is(err, errUpstreamDisconnected) || errors.Is(err, errCircuitOpen)
+}
+
+// do calls invoke, and calls it again while it fails transiently, the call is
+// idempotent and attempts and budget remain.
+func (r *retryPolicy) do(ctx context.Context, call *Call, invoke func() []reflect.Value) []reflect.Value {
+	r.budget.deposit()
+	results := invoke()
+	if r.attempts <= 0 || !r.idempotentCall(call) {
+		return results
+	}
+
+	for attempt := 0; attempt < r.attempts; attempt++ {
+		err := resultError(results)
+		if ctx.Err() != nil || !(shouldFailover(err) || errors.Is(err, errNoUpstream)) {
+			return results
+		}
+		if !r.budget.withdraw() {
+			log.Println("retry budget exhausted", "method", call.Method, "error", err)
+			return results
+		}
+
+		timer := time.NewTimer(r.backoff.next(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return results
+		}
+
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		stats.Record(mctx, upstreamRetry.M(1))
+		results = invoke()
+	}
+	return results
+}
+
+// retryBudget allows on average ratio retries per call, up to a reserve that
+// lets a burst of failures be retried.
+type retryBudget struct {
+	ratio float64
+	max   float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// retryBudgetReserve is the number of retries the budget can hold.
+const retryBudgetReserve = 10
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{
+		ratio:  ratio,
+		max:    retryBudgetReserve,
+		tokens: retryBudgetReserve,
+	}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
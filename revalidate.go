@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+)
+
+// revalidateTimeout bounds the upstream call made to refill an entry.
+const revalidateTimeout = 30 * time.Second
+
+// revalidator refills invalidated cache entries in the background, most hit
+// first and one at a time at a fixed interval, so that invalidating many keys
+// at once does not turn the next burst of clients into a burst of upstream
+// calls.
+type revalidator struct {
+	name     string
+	interval time.Duration
+
+	mu     sync.Mutex
+	queue  revalidateQueue
+	queued map[string]*revalidation
+	wake   chan struct{}
+}
+
+type revalidation struct {
+	key    string
+	hits   int64
+	refill func(ctx context.Context)
+	index  int
+}
+
+func newRevalidator(name string, interval time.Duration) *revalidator {
+	return &revalidator{
+		name:     name,
+		interval: interval,
+		queued:   map[string]*revalidation{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// add queues an invalidated entry for refilling. An entry already queued
+// keeps its place, raised by the hits of the newer entry.
+func (r *revalidator) add(key string, hits int64, refill func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rv, ok := r.queued[key]; ok {
+		rv.hits += hits
+		rv.refill = refill
+		heap.Fix(&r.queue, rv.index)
+		return
+	}
+
+	rv := &revalidation{key: key, hits: hits, refill: refill}
+	heap.Push(&r.queue, rv)
+	r.queued[key] = rv
+	r.reportDepth()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *revalidator) next() *revalidation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queue.Len() == 0 {
+		return nil
+	}
+	rv := heap.Pop(&r.queue).(*revalidation)
+	delete(r.queued, rv.key)
+	r.reportDepth()
+	return rv
+}
+
+// reportDepth must be called with the lock held.
+func (r *revalidator) reportDepth() {
+	stats.Record(cacheContext(context.Background(), r.name), revalidateQueueDepth.M(int64(r.queue.Len())))
+}
+
+func (r *revalidator) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		rv := r.next()
+		if rv == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.wake:
+			}
+			continue
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+		rv.refill(rctx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// revalidateQueue is a max heap of revalidations ordered by hits.
+type revalidateQueue []*revalidation
+
+func (q revalidateQueue) Len() int           { return len(q) }
+func (q revalidateQueue) Less(i, j int) bool { return q[i].hits > q[j].hits }
+
+func (q revalidateQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *revalidateQueue) Push(x interface{}) {
+	rv := x.(*revalidation)
+	rv.index = len(*q)
+	*q = append(*q, rv)
+}
+
+func (q *revalidateQueue) Pop() interface{} {
+	old := *q
+	rv := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return rv
+}
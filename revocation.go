@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTokenRevoked = errors.New("token has been revoked")
+
+// revocation revokes the tokens with a jwt id, or the token with a hash.
+type revocation struct {
+	JTI     string    `json:"jti,omitempty"`
+	Hash    string    `json:"hash,omitempty"` // hex encoded sha256 of the token
+	Reason  string    `json:"reason,omitempty"`
+	Revoked time.Time `json:"revoked"`
+}
+
+// revocationList rejects leaked tokens before they expire, without rotating
+// the secret they are signed with. Revocations are written to path, when
+// set, so that they survive a restart.
+type revocationList struct {
+	path string
+
+	mu     sync.RWMutex
+	byJTI  map[string]revocation
+	byHash map[string]revocation
+}
+
+func newRevocationList(path string) (*revocationList, error) {
+	l := &revocationList{
+		path:   path,
+		byJTI:  map[string]revocation{},
+		byHash: map[string]revocation{},
+	}
+	if err := l.load(); err != nil {
+		return nil, fmt.Errorf("load revocations: %w", err)
+	}
+	return l, nil
+}
+
+// tokenHash returns the hash a token is revoked by, as printed by
+// printf %s <token> | sha256sum.
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// revoke adds rev to the list and writes the list out. The revocation is
+// undone when it cannot be written.
+func (l *revocationList) revoke(rev revocation) (revocation, error) {
+	if (rev.JTI == "") == (rev.Hash == "") {
+		return revocation{}, fmt.Errorf("a revocation needs either a jti or a hash")
+	}
+	if rev.Hash != "" {
+		if b, err := hex.DecodeString(rev.Hash); err != nil || len(b) != sha256.Size {
+			return revocation{}, fmt.Errorf("hash must be a hex encoded sha256")
+		}
+	}
+	rev.Hash = strings.ToLower(rev.Hash)
+	rev.Revoked = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index, key := l.byJTI, rev.JTI
+	if rev.Hash != "" {
+		index, key = l.byHash, rev.Hash
+	}
+	prev, existed := index[key]
+	index[key] = rev
+	if err := l.persist(); err != nil {
+		if existed {
+			index[key] = prev
+		} else {
+			delete(index, key)
+		}
+		return revocation{}, err
+	}
+	log.Println("revoked token", "jti", rev.JTI, "hash", rev.Hash, "reason", rev.Reason)
+	return rev, nil
+}
+
+// revoked reports whether the token with the given jwt id, which may be
+// empty, and hash is revoked.
+func (l *revocationList) revoked(jti, hash string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.byHash[hash]; ok {
+		return true
+	}
+	_, ok := l.byJTI[jti]
+	return ok && jti != ""
+}
+
+// list returns the revocations, oldest first.
+func (l *revocationList) list() []revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	revs := l.entries()
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Revoked.Before(revs[j].Revoked)
+	})
+	return revs
+}
+
+// entries returns the revocations and must be called with the lock held.
+func (l *revocationList) entries() []revocation {
+	revs := make([]revocation, 0, len(l.byJTI)+len(l.byHash))
+	for _, rev := range l.byJTI {
+		revs = append(revs, rev)
+	}
+	for _, rev := range l.byHash {
+		revs = append(revs, rev)
+	}
+	return revs
+}
+
+// persist writes the list to its file and must be called with the lock held.
+func (l *revocationList) persist() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(l.entries())
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write revocations: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("write revocations: %w", err)
+	}
+	return nil
+}
+
+func (l *revocationList) load() error {
+	if l.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var revs []revocation
+	if err := json.Unmarshal(data, &revs); err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		if rev.Hash != "" {
+			l.byHash[rev.Hash] = rev
+		} else if rev.JTI != "" {
+			l.byJTI[rev.JTI] = rev
+		}
+	}
+	return nil
+}
+
+// revocationInterceptor rejects calls made with a lotus token revoked after
+// the connection was opened, as websocket connections outlive revocation.
+func (a *authStack) revocationInterceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if p := jwtPayloadFrom(ctx); p != nil && a.revocations.revoked(p.Payload.JWTID, p.hash) {
+			return call.errorResult(fmt.Errorf("%s: %w", call.Method, errTokenRevoked))
+		}
+		return next(ctx, call)
+	}
+}
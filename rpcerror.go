@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Error codes set in JSON-RPC error objects. Codes are stable across releases:
+// a failure class keeps its code and new classes get new codes. Messages are
+// not stable and should not be matched on.
+const (
+	// codeUpstream marks an error returned by the upstream node itself, with
+	// the code lotus uses for all method errors.
+	codeUpstream = 1
+	// codeNoUpstream is returned when no upstream node could take the call.
+	codeNoUpstream = -32001
+	// codeCircuitOpen is returned when the circuit breaker of every
+	// candidate upstream node is open.
+	codeCircuitOpen = -32002
+	// codeTransport is returned when the upstream node could not be reached
+	// or dropped the connection.
+	codeTransport = -32003
+	// codeTimeout is returned when the call was cancelled or timed out
+	// before an answer arrived.
+	codeTimeout = -32004
+	// codeNoQuorum is returned when the upstream nodes asked for a quorum
+	// read gave no majority answer.
+	codeNoQuorum = -32005
+	// codeForbidden is returned when the token of the request does not allow
+	// the method, or has expired or been revoked, for signing methods
+	// without --allow-signing, and for wallet calls the wallet policy
+	// rejects.
+	codeForbidden = -32006
+	// codeRateLimited is returned when the owner of the token of the request
+	// exceeded its rate or quota. Over http the response also has status 429
+	// and a Retry-After header.
+	codeRateLimited = -32007
+	// codeRequestLimit is returned over http for requests over the size or
+	// complexity limits, such as --max-request-body, before they are decoded.
+	codeRequestLimit = -32008
+	// codeReplay is returned for requests whose nonce or signature was
+	// already received, or with a stale timestamp, and for calls that change
+	// state made without a nonce under --replay-protection.
+	codeReplay = -32009
+)
+
+// ErrorData is set as the data of JSON-RPC error objects returned over http.
+// Fields are only ever added to it.
+type ErrorData struct {
+	Retryable bool   `json:"retryable"`          // the same call may succeed if retried
+	Upstream  string `json:"upstream,omitempty"` // last upstream node tried
+	Cache     string `json:"cache,omitempty"`    // "hit" or "miss" for cached methods
+}
+
+type rpcErrorObject struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *ErrorData `json:"data"`
+}
+
+// classifyError returns the error code of err and whether the call that
+// failed with it may be retried.
+func classifyError(err error) (int, bool) {
+	switch {
+	case errors.Is(err, errNoUpstream):
+		return codeNoUpstream, true
+	case errors.Is(err, errCircuitOpen):
+		return codeCircuitOpen, true
+	case errors.Is(err, errNoQuorum):
+		return codeNoQuorum, true
+	case errors.Is(err, errTokenScope), errors.Is(err, errTokenRevoked), errors.Is(err, errSigningDisabled), errors.Is(err, errWalletPolicy):
+		return codeForbidden, false
+	case errors.Is(err, errNonceRequired):
+		return codeReplay, false
+	case errors.Is(err, errRateLimited):
+		return codeRateLimited, true
+	case isTransportError(err):
+		return codeTransport, true
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout, true
+	default:
+		return codeUpstream, false
+	}
+}
+
+// writeRPCError answers a request rejected before its calls are decoded
+// with status and a JSON-RPC error of code.
+func writeRPCError(w http.ResponseWriter, status, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      nil,
+		"error": rpcErrorObject{
+			Code:    code,
+			Message: err.Error(),
+			Data:    &ErrorData{},
+		},
+	})
+}
+
+// writeCallError answers the call of id, rejected before it was made, with
+// a JSON-RPC error classified as ClassifyErrors classifies it: with status
+// 429 and a Retry-After header when over the limits of its token, and with
+// status 403 when its token may not make it.
+func writeCallError(w http.ResponseWriter, id json.RawMessage, err error) {
+	code, retryable := classifyError(err)
+	status := http.StatusOK
+	var limited *rateLimitError
+	switch {
+	case errors.As(err, &limited):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+		status = http.StatusTooManyRequests
+	case code == codeForbidden:
+		status = http.StatusForbidden
+	}
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error": rpcErrorObject{
+			Code:    code,
+			Message: err.Error(),
+			Data:    &ErrorData{Retryable: retryable},
+		},
+	})
+}
+
+// callInfo collects what happened to a call while it passes through the
+// proxy, for reporting alongside an error.
+type callInfo struct {
+	mu       sync.Mutex
+	err      error
+	upstream string
+	cache    string
+}
+
+type callInfoKey struct{}
+
+// callInfoFrom returns the call info of the request ctx belongs to, or nil.
+func callInfoFrom(ctx context.Context) *callInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*callInfo)
+	return info
+}
+
+func (i *callInfo) setUpstream(addr string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.upstream = addr
+}
+
+func (i *callInfo) setCache(status string) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.cache = status
+}
+
+func (i *callInfo) failed() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.err != nil
+}
+
+func (i *callInfo) errorObject() rpcErrorObject {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	code, retryable := classifyError(i.err)
+	return rpcErrorObject{
+		Code:    code,
+		Message: i.err.Error(),
+		Data: &ErrorData{
+			Retryable: retryable,
+			Upstream:  i.upstream,
+			Cache:     i.cache,
+		},
+	}
+}
+
+// errorInfoInterceptor records the error a call failed with, if any.
+func errorInfoInterceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		results := next(ctx, call)
+		if info := callInfoFrom(ctx); info != nil {
+			info.mu.Lock()
+			info.err = resultError(results)
+			info.mu.Unlock()
+		}
+		return results
+	}
+}
+
+// ClassifyErrors replaces the error object of failed JSON-RPC responses served
+// over http with one carrying a classified code and ErrorData. Websocket
+// connections serve many calls on one request and are passed through.
+func ClassifyErrors(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := &callInfo{}
+		ew := &errorDataWriter{ResponseWriter: w, info: info}
+		next.ServeHTTP(ew, r.WithContext(context.WithValue(r.Context(), callInfoKey{}, info)))
+		ew.flush()
+	}
+	return http.HandlerFunc(fn)
+}
+
+// errorDataWriter buffers the response of a failed call so that its error
+// object can be rewritten. Successful responses are written straight through.
+type errorDataWriter struct {
+	http.ResponseWriter
+	info *callInfo
+
+	decided bool
+	rewrite bool
+	status  int
+	buf     bytes.Buffer
+}
+
+func (w *errorDataWriter) decide() {
+	if !w.decided {
+		w.decided = true
+		w.rewrite = w.info.failed()
+	}
+}
+
+func (w *errorDataWriter) WriteHeader(status int) {
+	w.decide()
+	if w.rewrite {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorDataWriter) Write(b []byte) (int, error) {
+	w.decide()
+	if w.rewrite {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorDataWriter) flush() {
+	if !w.rewrite {
+		return
+	}
+
+	body := w.buf.Bytes()
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err == nil && resp["error"] != nil {
+		if obj, err := json.Marshal(w.info.errorObject()); err == nil {
+			resp["error"] = obj
+			if b, err := json.Marshal(resp); err == nil {
+				body = append(b, '\n')
+			}
+		}
+	}
+
+	w.info.mu.Lock()
+	err := w.info.err
+	w.info.mu.Unlock()
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		w.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.retryAfter.Seconds()))))
+		w.status = http.StatusTooManyRequests
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	_, _ = w.ResponseWriter.Write(body)
+}
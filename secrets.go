@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// secretSource reads a secret that may change while the proxy runs, such as
+// a token rotated by an operator or by Vault.
+type secretSource interface {
+	read(ctx context.Context) (string, error)
+	String() string
+}
+
+// fileSecret is a secret held alone in a file, as lotus writes its token
+// files.
+type fileSecret string
+
+func (f fileSecret) read(context.Context) (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", string(f))
+	}
+	return secret, nil
+}
+
+func (f fileSecret) String() string {
+	return "file " + string(f)
+}
+
+// vaultSecret is a field of a secret kept in HashiCorp Vault, read over its
+// http api. Secrets of both versions of the kv engine are understood.
+type vaultSecret struct {
+	addr   string // e.g. https://vault.example.com:8200
+	token  string
+	path   string // e.g. secret/data/lotus
+	field  string
+	client *http.Client
+}
+
+// newVaultSecret returns the secret of ref, given as <path>#<field>.
+func newVaultSecret(addr, token, ref string) (*vaultSecret, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid vault secret %q, expected <path>#<field>", ref)
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("vault secret %q needs --vault-addr", ref)
+	}
+	return &vaultSecret{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.Trim(parts[0], "/"),
+		field:  parts[1],
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (v *vaultSecret) read(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return "", err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode vault secret: %w", err)
+	}
+	data := body.Data
+	// The kv engine version 2 nests the secret under data, beside metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	secret, ok := data[v.field].(string)
+	if !ok || secret == "" {
+		return "", fmt.Errorf("vault secret %s has no field %q", v.path, v.field)
+	}
+	return secret, nil
+}
+
+func (v *vaultSecret) String() string {
+	return "vault " + v.path + "#" + v.field
+}
+
+// apiTokenSource returns where the token for upstream nodes is read from,
+// or nil when it is given by --api-token or not at all.
+func apiTokenSource(cctx *cli.Context) (secretSource, error) {
+	file, ref := cctx.String("api-token-file"), cctx.String("api-token-vault")
+	set := 0
+	for _, v := range []string{cctx.String("api-token"), file, ref} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of --api-token, --api-token-file and --api-token-vault may be set")
+	}
+	switch {
+	case file != "":
+		return fileSecret(file), nil
+	case ref != "":
+		token := cctx.String("vault-token")
+		if token == "" {
+			if path := cctx.String("vault-token-file"); path != "" {
+				var err error
+				if token, err = fileSecret(path).read(cctx.Context); err != nil {
+					return nil, fmt.Errorf("read vault token: %w", err)
+				}
+			}
+		}
+		return newVaultSecret(cctx.String("vault-addr"), token, ref)
+	}
+	return nil, nil
+}
+
+// watchSecret reads src every interval and calls fn with the secret when it
+// differs from current, until ctx is cancelled.
+func watchSecret(ctx context.Context, src secretSource, interval time.Duration, current string, fn func(string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		secret, err := src.read(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("failed to read secret, keeping the current one", "source", src.String(), "error", err)
+			}
+			continue
+		}
+		if secret == current {
+			continue
+		}
+		log.Println("secret rotated", "source", src.String())
+		current = secret
+		fn(secret)
+	}
+}
+
+// loadEnvFile sets the variables of a file of KEY=VALUE lines that are not
+// set already, so that flags may be given by it as by the environment.
+// Blank lines and lines starting with # are skipped, and values may be
+// quoted.
+func loadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open env file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// envFileArg returns the env file given on the command line or by
+// LOTUS_PROXY_ENV_FILE. It must be loaded before the flags are parsed for
+// the variables it sets to be read.
+func envFileArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if len(name) == len(arg) {
+			continue
+		}
+		if v := strings.TrimPrefix(name, "env-file="); v != name {
+			return v
+		}
+		if name == "env-file" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("LOTUS_PROXY_ENV_FILE")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// sectorListMethods return information about more than one sector and must be
+// invalidated whenever any sector changes state.
+var sectorListMethods = []string{"SectorsList", "SectorsListInStates", "SectorsSummary"}
+
+// sectorCacheTTLs returns the cache lifetimes of the sector methods.
+func sectorCacheTTLs(ttl time.Duration) map[string]time.Duration {
+	ttls := map[string]time.Duration{
+		"SectorsStatus": ttl,
+	}
+	for _, m := range sectorListMethods {
+		ttls[m] = ttl
+	}
+	return ttls
+}
+
+// Sector states that produce sector events, from lotus storage-sealing.
+const (
+	sectorStateProving           = "Proving"
+	sectorStateFaulty            = "Faulty"
+	sectorStateFaultReported     = "FaultReported"
+	sectorStateTerminating       = "Terminating"
+	sectorStateTerminateWait     = "TerminateWait"
+	sectorStateTerminateFinality = "TerminateFinality"
+)
+
+// sectorEvent is published when the state of a sector changes.
+type sectorEvent struct {
+	Sector abi.SectorNumber     `json:"sector"`
+	From   lotusapi.SectorState `json:"from,omitempty"`
+	To     lotusapi.SectorState `json:"to,omitempty"`
+}
+
+// sectorEventType returns the type of event published for a sector moving
+// between the given states. An empty state means the sector was not listed.
+func sectorEventType(from, to lotusapi.SectorState) string {
+	switch {
+	case from == "":
+		return "sector.added"
+	case to == "":
+		return "sector.removed"
+	}
+
+	switch to {
+	case sectorStateProving:
+		return "sector.proving"
+	case sectorStateFaulty, sectorStateFaultReported:
+		return "sector.faulted"
+	case sectorStateTerminating, sectorStateTerminateWait, sectorStateTerminateFinality:
+		return "sector.terminated"
+	default:
+		return "sector.state"
+	}
+}
+
+// sectorWatcher polls the miner for sector state transitions, drops cached
+// sector responses that they make stale and publishes them as sector events.
+type sectorWatcher struct {
+	api      lotusapi.StorageMiner
+	cache    *responseCache // optional
+	events   *eventBus
+	interval time.Duration
+
+	states map[abi.SectorNumber]lotusapi.SectorState
+}
+
+func newSectorWatcher(api lotusapi.StorageMiner, cache *responseCache, events *eventBus, interval time.Duration) *sectorWatcher {
+	return &sectorWatcher{
+		api:      api,
+		cache:    cache,
+		events:   events,
+		interval: interval,
+	}
+}
+
+func (w *sectorWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil {
+			log.Println("failed to poll sector states", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches the current state of every sector and handles those that
+// changed since the previous poll.
+func (w *sectorWatcher) poll(ctx context.Context) error {
+	summary, err := w.api.SectorsSummary(ctx)
+	if err != nil {
+		return fmt.Errorf("sectors summary: %w", err)
+	}
+
+	states := make(map[abi.SectorNumber]lotusapi.SectorState, len(w.states))
+	for state := range summary {
+		sectors, err := w.api.SectorsListInStates(ctx, []lotusapi.SectorState{state})
+		if err != nil {
+			return fmt.Errorf("list sectors in state %q: %w", state, err)
+		}
+		for _, s := range sectors {
+			states[s] = state
+		}
+	}
+
+	var changed []abi.SectorNumber
+	for s, state := range states {
+		if prev, ok := w.states[s]; !ok || prev != state {
+			changed = append(changed, s)
+		}
+	}
+	for s := range w.states {
+		if _, ok := states[s]; !ok {
+			changed = append(changed, s)
+		}
+	}
+
+	prev := w.states
+	w.states = states
+	if prev == nil || len(changed) == 0 {
+		return nil
+	}
+
+	for _, s := range changed {
+		from, to := prev[s], states[s]
+		w.events.publish(sectorEventType(from, to), sectorEvent{
+			Sector: s,
+			From:   from,
+			To:     to,
+		})
+	}
+
+	if w.cache != nil {
+		for _, s := range changed {
+			w.cache.invalidatePrefix(fmt.Sprintf("%s[%d,", methodPrefix("SectorsStatus"), s))
+		}
+		for _, m := range sectorListMethods {
+			w.cache.invalidatePrefix(methodPrefix(m))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+const (
+	// maxShadowDiffs bounds the number of differences recorded for a single
+	// call.
+	maxShadowDiffs = 20
+	// shadowDiffsKept is the number of recent mismatches kept for /admin/shadow.
+	shadowDiffsKept = 100
+)
+
+// shadowDiff records how the answer of the shadow upstream to a call differed
+// from the answer served to the client.
+type shadowDiff struct {
+	Time   time.Time     `json:"time"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Diffs  []string      `json:"diffs"`
+}
+
+// shadowMirror duplicates read calls to a shadow upstream and compares its
+// answers with those of the primary. Shadow answers never reach clients.
+type shadowMirror struct {
+	shadow  *upstream
+	sample  float64 // fraction of read calls mirrored
+	timeout time.Duration
+	slots   chan struct{} // bounds concurrent shadow calls
+
+	mu     sync.Mutex
+	recent []shadowDiff // ring of the most recent mismatches
+	next   int
+}
+
+func newShadowMirror(shadow *upstream, sample float64, timeout time.Duration, concurrency int) *shadowMirror {
+	return &shadowMirror{
+		shadow:  shadow,
+		sample:  sample,
+		timeout: timeout,
+		slots:   make(chan struct{}, concurrency),
+		recent:  make([]shadowDiff, 0, shadowDiffsKept),
+	}
+}
+
+// interceptor mirrors read calls after the primary has answered them. Calls
+// are dropped rather than queued when too many shadow calls are in flight.
+func (s *shadowMirror) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		results := next(ctx, call)
+		if !call.readOnly() || call.returnsChannel() || rand.Float64() >= s.sample {
+			return results
+		}
+
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			reportEvent(mctx, shadowDropped)
+			return results
+		}
+
+		go func() {
+			defer func() { <-s.slots }()
+			reportEvent(mctx, shadowRequest)
+
+			sctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+			defer cancel()
+			shadowed := s.shadow.invoke(sctx, call)
+
+			diffs := diffResults(results, shadowed)
+			if len(diffs) == 0 {
+				return
+			}
+			reportEvent(mctx, shadowMismatch)
+			s.record(shadowDiff{
+				Time:   time.Now(),
+				Method: call.Method,
+				Params: call.Params(),
+				Diffs:  diffs,
+			})
+		}()
+		return results
+	}
+}
+
+func (s *shadowMirror) record(d shadowDiff) {
+	log.Println("shadow upstream answer differs", "method", d.Method, "diffs", d.Diffs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, d)
+		return
+	}
+	s.recent[s.next] = d
+	s.next = (s.next + 1) % cap(s.recent)
+}
+
+// diffs returns the recorded mismatches, oldest first.
+func (s *shadowMirror) diffs() []shadowDiff {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]shadowDiff, 0, len(s.recent))
+	out = append(out, s.recent[s.next:]...)
+	out = append(out, s.recent[:s.next]...)
+	return out
+}
+
+// diffResults compares the results of two calls by their JSON structure and
+// describes each difference by its path.
+func diffResults(primary, shadow []reflect.Value) []string {
+	perr, serr := resultError(primary), resultError(shadow)
+	switch {
+	case perr != nil && serr != nil:
+		return nil
+	case perr != nil:
+		return []string{fmt.Sprintf("error: primary %q, shadow none", perr)}
+	case serr != nil:
+		return []string{fmt.Sprintf("error: primary none, shadow %q", serr)}
+	}
+	if len(primary) < 2 {
+		return nil
+	}
+
+	pv, err := jsonValue(primary[0].Interface())
+	if err != nil {
+		return []string{fmt.Sprintf("primary: %s", err)}
+	}
+	sv, err := jsonValue(shadow[0].Interface())
+	if err != nil {
+		return []string{fmt.Sprintf("shadow: %s", err)}
+	}
+
+	var diffs []string
+	diffJSON("$", pv, sv, &diffs)
+	return diffs
+}
+
+// jsonValue returns v as decoded from its JSON encoding.
+func jsonValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func diffJSON(path string, a, b interface{}, diffs *[]string) {
+	if len(*diffs) >= maxShadowDiffs {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(path+"."+k, av[k], bv[k], diffs)
+		}
+		return
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(av) != len(bv) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: primary has %d elements, shadow %d", path, len(av), len(bv)))
+			return
+		}
+		for i := range av {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: primary %v, shadow %v", path, a, b))
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// shutdownReport summarizes a run of the proxy when it terminates.
+type shutdownReport struct {
+	Reason        string    `json:"reason"`
+	Started       time.Time `json:"started"`
+	Stopped       time.Time `json:"stopped"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+
+	Requests int64 `json:"requests"`
+	Failures int64 `json:"failures"`
+
+	CacheHits    int64 `json:"cache_hits"`
+	CacheMisses  int64 `json:"cache_misses"`
+	CacheEntries int   `json:"cache_entries"`
+
+	InFlight         int `json:"in_flight"` // upstream calls open when shutdown began
+	Drained          int `json:"drained"`   // of those, calls that finished before the timeout
+	Aborted          int `json:"aborted"`
+	StreamsCancelled int `json:"streams_cancelled"`
+}
+
+// shutdown stops srv, giving the calls in flight up to timeout to finish, and
+// returns a report of the run.
+func shutdown(srv *http.Server, router *backendRouter, cache *responseCache, started time.Time, reason string, timeout time.Duration) shutdownReport {
+	calls, streams := router.load()
+	r := shutdownReport{
+		Reason:           reason,
+		Started:          started,
+		InFlight:         calls,
+		StreamsCancelled: streams,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil && err != context.DeadlineExceeded {
+		log.Println(err, "failed to shut down RPC server")
+	}
+	// Calls made over websockets are not tracked by the server.
+	for {
+		if n, _ := router.load(); n == 0 || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	remaining, _ := router.load()
+	if remaining > r.InFlight {
+		remaining = r.InFlight
+	}
+	r.Aborted = remaining
+	r.Drained = r.InFlight - remaining
+
+	r.Stopped = time.Now()
+	r.UptimeSeconds = r.Stopped.Sub(started).Seconds()
+	r.Requests = viewTotal(rpcRequest.Name() + "_total")
+	r.Failures = viewTotal(rpcFailure.Name() + "_total")
+	r.CacheHits = viewTotal(getHit.Name() + "_total")
+	r.CacheMisses = viewTotal(getMiss.Name() + "_total")
+	if cache != nil {
+		r.CacheEntries = cache.len()
+	}
+	return r
+}
+
+func (r shutdownReport) log() {
+	log.Println("shutdown report",
+		"reason", r.Reason,
+		"uptime", time.Duration(r.UptimeSeconds*float64(time.Second)).Round(time.Second),
+		"requests", r.Requests,
+		"failures", r.Failures,
+		"cache_hits", r.CacheHits,
+		"cache_misses", r.CacheMisses,
+		"cache_entries", r.CacheEntries,
+		"in_flight", r.InFlight,
+		"drained", r.Drained,
+		"aborted", r.Aborted,
+		"streams_cancelled", r.StreamsCancelled,
+	)
+}
+
+// post sends the report to url as JSON.
+func (r shutdownReport) post(url string, timeout time.Duration) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("non-2xx status: %s", resp.Status)
+	}
+	return nil
+}
+
+// viewTotal returns the sum of the rows of a registered sum view.
+func viewTotal(name string) int64 {
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		return 0
+	}
+	var total float64
+	for _, row := range rows {
+		if sum, ok := row.Data.(*view.SumData); ok {
+			total += sum.Value
+		}
+	}
+	return int64(total)
+}
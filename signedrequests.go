@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+)
+
+// Headers of signed requests.
+const (
+	signatureHeader          = "X-Signature"
+	signatureKeyHeader       = "X-Signature-Key"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+var (
+	errSigningKeyRevoked = errors.New("signing key has been revoked")
+	errBadSignature      = errors.New("signature does not match")
+)
+
+// signingKey is a secret shared with a machine caller, which signs its
+// requests with it rather than sending a long-lived token. Unlike api keys,
+// the secret itself is kept, as the proxy needs it to check signatures.
+type signingKey struct {
+	ID      string     `json:"id"`
+	Secret  string     `json:"secret"` // hex
+	Perm    string     `json:"perm"`
+	Label   string     `json:"label,omitempty"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// newSigningKey returns a new key granting perm.
+func newSigningKey(perm, label string, now time.Time) (signingKey, error) {
+	if _, err := permissionsUpTo(perm); err != nil {
+		return signingKey{}, err
+	}
+	var id [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return signingKey{}, err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{
+		ID:      hex.EncodeToString(id[:]),
+		Secret:  hex.EncodeToString(secret[:]),
+		Perm:    perm,
+		Label:   label,
+		Created: now.UTC(),
+	}, nil
+}
+
+// loadSigningKeys reads the keys of a signing key file, which is empty when
+// missing.
+func loadSigningKeys(path string) ([]signingKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []signingKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse signing keys %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// saveSigningKeys replaces the keys of a signing key file at once.
+func saveSigningKeys(path string, keys []signingKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write signing keys: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write signing keys: %w", err)
+	}
+	return nil
+}
+
+// requestSigner checks the signatures of requests signed with the keys of a
+// signing key file, reloading them when the file changes. A signature is the
+// hex HMAC-SHA256, keyed by the secret of the key, of the timestamp, the
+// path and the body of the request, joined by newlines. As the body holds
+// the method and params of the calls, a signature cannot be moved to other
+// calls, and the timestamp must be within the skew given to newRequestSigner
+// of the clock of the proxy.
+// Each signature is accepted once, so that a captured request cannot be sent
+// again.
+type requestSigner struct {
+	path    string
+	maxBody int64 // 0 for no limit
+	replays *replayGuard
+
+	mu      sync.RWMutex
+	keys    map[string]signingKey // by id
+	modTime time.Time
+}
+
+func newRequestSigner(path string, skew time.Duration, maxBody int64) (*requestSigner, error) {
+	s := &requestSigner{path: path, maxBody: maxBody, replays: newReplayGuard(skew)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the key file if it changed since it was last read.
+func (s *requestSigner) load() error {
+	var modTime time.Time
+	if info, err := os.Stat(s.path); err == nil {
+		modTime = info.ModTime()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.mu.RLock()
+	unchanged := s.keys != nil && modTime.Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	list, err := loadSigningKeys(s.path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]signingKey, len(list))
+	for _, k := range list {
+		keys[k.ID] = k
+	}
+	s.mu.Lock()
+	s.keys, s.modTime = keys, modTime
+	s.mu.Unlock()
+	return nil
+}
+
+// run reloads the key file whenever it changes.
+func (s *requestSigner) run(ctx context.Context) {
+	ticker := time.NewTicker(apiKeyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.load(); err != nil {
+			log.Println("failed to reload signing keys", "path", s.path, "error", err)
+		}
+	}
+}
+
+// signature returns the signature of a request to path with body at ts.
+func signature(secret []byte, ts, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "\n" + path + "\n")) //nolint:errcheck
+	mac.Write(body)                            //nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate checks the signature of r and returns the payload granted to
+// its key. It reads the body of r, which it replaces for the handlers after
+// it. Only posted calls can be signed, as the calls made over a websocket
+// are not known when it is opened.
+func (s *requestSigner) authenticate(r *http.Request, now time.Time) (*jwtPayload, error) {
+	if r.Method != http.MethodPost || isUpgrade(r) {
+		return nil, fmt.Errorf("only posted calls can be signed")
+	}
+	ts := r.Header.Get(signatureTimestampHeader)
+	if err := s.replays.fresh(ts, now); err != nil {
+		return nil, fmt.Errorf("signature %w", err)
+	}
+
+	s.mu.RLock()
+	k, ok := s.keys[r.Header.Get(signatureKeyHeader)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, errUnrecognizedToken
+	}
+	secret, err := hex.DecodeString(k.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret of signing key %s", k.ID)
+	}
+
+	body := r.Body
+	if s.maxBody > 0 {
+		body = http.MaxBytesReader(nil, body, s.maxBody)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	want := signature(secret, ts, r.URL.Path, data)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(signatureHeader))) {
+		return nil, errBadSignature
+	}
+	if s.replays.seenBefore("sig "+want, now) {
+		return nil, errReplayed
+	}
+	if k.Revoked != nil {
+		return nil, errSigningKeyRevoked
+	}
+	allow, err := permissionsUpTo(k.Perm)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtPayload{
+		Payload: jwt.Payload{Subject: k.Label, JWTID: k.ID},
+		Allow:   allow,
+	}, nil
+}
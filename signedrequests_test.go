@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestSignerAuthenticate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	revoked := now.Add(-time.Hour)
+	secret := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	path := filepath.Join(t.TempDir(), "signing-keys.json")
+	if err := saveSigningKeys(path, []signingKey{
+		{ID: "k1", Secret: secret, Perm: "write", Label: "ci"},
+		{ID: "k2", Secret: secret, Perm: "read", Revoked: &revoked},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newRequestSigner(path, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"Filecoin.MpoolPushMessage","params":[]}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	key, _ := hex.DecodeString(secret)
+	valid := signature(key, ts, "/rpc/v1", body)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		key       string
+		ts        string
+		signature string
+		body      []byte
+		wantErr   error // nil for any error when ok is false
+		ok        bool
+	}{
+		{name: "valid", method: http.MethodPost, path: "/rpc/v1", key: "k1", ts: ts, signature: valid, body: body, ok: true},
+		{name: "replayed", method: http.MethodPost, path: "/rpc/v1", key: "k1", ts: ts, signature: valid, body: body, wantErr: errReplayed},
+		{name: "other body", method: http.MethodPost, path: "/rpc/v1", key: "k1", ts: ts, signature: valid, body: []byte(`{}`), wantErr: errBadSignature},
+		{name: "other path", method: http.MethodPost, path: "/rpc/v0", key: "k1", ts: ts, signature: valid, body: body, wantErr: errBadSignature},
+		{name: "stale timestamp", method: http.MethodPost, path: "/rpc/v1", key: "k1", ts: strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10), signature: valid, body: body},
+		{name: "future timestamp", method: http.MethodPost, path: "/rpc/v1", key: "k1", ts: strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10), signature: valid, body: body},
+		{name: "unknown key", method: http.MethodPost, path: "/rpc/v1", key: "k3", ts: ts, signature: valid, body: body, wantErr: errUnrecognizedToken},
+		{name: "revoked key", method: http.MethodPost, path: "/rpc/v1", key: "k2", ts: ts, signature: signature(key, ts, "/rpc/v1", []byte(`{"id":2}`)), body: []byte(`{"id":2}`), wantErr: errSigningKeyRevoked},
+		{name: "not posted", method: http.MethodGet, path: "/rpc/v1", key: "k1", ts: ts, signature: valid, body: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(tt.body))
+			r.Header.Set(signatureHeader, tt.signature)
+			r.Header.Set(signatureKeyHeader, tt.key)
+			r.Header.Set(signatureTimestampHeader, tt.ts)
+			payload, err := s.authenticate(r, now)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("authenticate: %v", err)
+				}
+				if payload.Payload.Subject != "ci" || !payload.allows("write") || payload.allows("sign") {
+					t.Errorf("payload = %+v, want the write permission of ci", payload)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("authenticate succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var errSigningDisabled = errors.New("signing and fund moving methods are disabled, see --allow-signing")
+
+// signingMethods sign with the wallets of the node or send messages moving
+// its funds. Multisig methods are left out as they only build messages, which
+// still take MpoolPushMessage to send.
+var signingMethods = mustParseMethodRules([]string{
+	"WalletSign*",
+	"WalletExport",
+	"MpoolPush*",
+	"MpoolBatchPush*",
+	"MarketAddBalance",
+	"MarketReserveFunds",
+	"MarketWithdraw",
+	"Paych*",
+	"ClientStartDeal",
+	"ClientStatelessDeal",
+	"ClientRetrieve*",
+	"ActorWithdrawBalance",
+	"eth_sendRawTransaction",
+})
+
+// paychReadMethods are the payment channel methods that only read state.
+var paychReadMethods = mustParseMethodRules([]string{
+	"PaychList",
+	"PaychStatus",
+	"PaychAvailableFunds*",
+	"PaychVoucherList",
+	"PaychVoucherCheck*",
+})
+
+// isSigningMethod reports whether method is blocked unless --allow-signing
+// is set.
+func isSigningMethod(method string) bool {
+	return signingMethods.match(method) && !paychReadMethods.match(method)
+}
+
+// signingGate rejects signing and fund moving methods whatever the token of
+// the request, so that a proxy exposed beyond localhost cannot spend the
+// funds of the node unless allowed to.
+func signingGate(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if isSigningMethod(call.Method) {
+			return call.errorResult(fmt.Errorf("%s: %w", call.Method, errSigningDisabled))
+		}
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// slowStartScale multiplies the weights seen by the balancers, so that an
+// upstream warming up can be given a fraction of its weight.
+const slowStartScale = 100
+
+// defaultRecoveryLag is the number of epochs a recovering upstream may lag
+// the most synced one when --max-head-lag is not set.
+const defaultRecoveryLag = 2
+
+// effectiveWeight returns the weight the balancers give the upstream: its
+// weight, ramped up linearly over the slow start period after it recovers.
+func (u *upstream) effectiveWeight() int {
+	w := u.getWeight() * slowStartScale
+	if f := u.warmth(time.Now()); f < 1 {
+		w = int(float64(w) * f)
+		if w < 1 && u.getWeight() > 0 {
+			w = 1
+		}
+	}
+	return w
+}
+
+// warmth returns the fraction of its weight an upstream is given, which is
+// below 1 during the slow start period.
+func (u *upstream) warmth(now time.Time) float64 {
+	start := atomic.LoadInt64(&u.warmStart)
+	if start == 0 || u.slowStart <= 0 {
+		return 1
+	}
+	f := float64(now.UnixNano()-start) / float64(u.slowStart)
+	if f >= 1 {
+		return 1
+	}
+	return f
+}
+
+// warmUp starts the slow start period of the upstream.
+func (u *upstream) warmUp() {
+	if u.slowStart > 0 {
+		atomic.StoreInt64(&u.warmStart, time.Now().UnixNano())
+	}
+}
+
+// caughtUp returns an error unless the chain head of u has caught up with
+// the most synced upstream, so that a node recovering from an outage does not
+// serve stale state. Upstreams whose head is unknown have caught up.
+func (p *upstreamPool) caughtUp(u *upstream) error {
+	if u.slowStart <= 0 && p.maxHeadLag <= 0 {
+		return nil
+	}
+	lag := p.maxHeadLag
+	if lag <= 0 {
+		lag = defaultRecoveryLag
+	}
+	h, best := u.headHeight(), p.bestHeight()
+	if h > 0 && best-h > lag {
+		return fmt.Errorf("chain head %d is %d epochs behind", h, best-h)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File names spiffe-helper writes the X.509 SVID, its key and the trust
+// bundle to.
+const (
+	svidCertFile   = "svid.pem"
+	svidKeyFile    = "svid_key.pem"
+	svidBundleFile = "svid_bundle.pem"
+)
+
+// svidReloadInterval is how often the SVID files are checked for rotation.
+const svidReloadInterval = 5 * time.Second
+
+// svidSource holds the X.509 SVID of the proxy and the trust bundle of its
+// SPIFFE trust domain, as written to a directory by spiffe-helper or another
+// agent of the SPIFFE workload API, and reloads them when they are rotated.
+type svidSource struct {
+	dir string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	id      *url.URL
+	roots   *x509.CertPool
+	modTime time.Time
+}
+
+func newSVIDSource(dir string) (*svidSource, error) {
+	s := &svidSource{dir: dir}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the SVID and bundle if they changed since they were last read.
+func (s *svidSource) load() error {
+	info, err := os.Stat(filepath.Join(s.dir, svidCertFile))
+	if err != nil {
+		return fmt.Errorf("stat svid: %w", err)
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.dir, svidCertFile), filepath.Join(s.dir, svidKeyFile))
+	if err != nil {
+		return fmt.Errorf("load svid: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse svid: %w", err)
+	}
+	id, err := spiffeID(leaf)
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	pem, err := ioutil.ReadFile(filepath.Join(s.dir, svidBundleFile))
+	if err != nil {
+		return fmt.Errorf("read trust bundle: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", filepath.Join(s.dir, svidBundleFile))
+	}
+
+	s.mu.Lock()
+	s.cert, s.id, s.roots, s.modTime = &cert, id, roots, info.ModTime()
+	s.mu.Unlock()
+	log.Println("loaded svid", "id", id, "expires", leaf.NotAfter)
+	return nil
+}
+
+// run reloads the SVID whenever it is rotated.
+func (s *svidSource) run(ctx context.Context) {
+	ticker := time.NewTicker(svidReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.load(); err != nil {
+			log.Println("failed to reload svid", "dir", s.dir, "error", err)
+		}
+	}
+}
+
+func (s *svidSource) current() (*tls.Certificate, *url.URL, *x509.CertPool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, s.id, s.roots
+}
+
+// verifier returns a function that verifies peer certificates against the
+// current trust bundle and accepts peers whose SPIFFE ID is one of allowed,
+// or any peer of the proxy's own trust domain when allowed is empty. Host
+// names are not checked, the SPIFFE ID identifies the peer instead.
+func (s *svidSource) verifier(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+		_, own, roots := s.current()
+
+		intermediates := x509.NewCertPool()
+		var leaf *x509.Certificate
+		for i, b := range raw {
+			cert, err := x509.ParseCertificate(b)
+			if err != nil {
+				return fmt.Errorf("parse peer certificate: %w", err)
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return fmt.Errorf("verify peer svid: %w", err)
+		}
+
+		id, err := spiffeID(leaf)
+		if err != nil {
+			return err
+		}
+		if len(allowed) == 0 {
+			if id.Host != own.Host {
+				return fmt.Errorf("peer %s is not in trust domain %s", id, own.Host)
+			}
+			return nil
+		}
+		for _, a := range allowed {
+			if id.String() == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer %s is not allowed", id)
+	}
+}
+
+// clientConfig returns tls settings presenting the current SVID to upstream
+// nodes and accepting those whose SPIFFE ID is allowed.
+func (s *svidSource) clientConfig(allowed []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, _ := s.current()
+			return cert, nil
+		},
+		// Verified by SPIFFE ID in VerifyPeerCertificate instead of host name.
+		InsecureSkipVerify:    true, //nolint:gosec
+		VerifyPeerCertificate: s.verifier(allowed),
+	}
+}
+
+// serverConfig returns tls settings for the listener presenting the current
+// SVID and requiring clients whose SPIFFE ID is allowed.
+func (s *svidSource) serverConfig(allowed []string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _, _ := s.current()
+			return cert, nil
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: s.verifier(allowed),
+	}
+}
+
+// spiffeID returns the SPIFFE ID of an X.509 SVID, its only URI SAN.
+func spiffeID(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" || cert.URIs[0].Host == "" {
+		return nil, fmt.Errorf("certificate %q is not an svid", cert.Subject)
+	}
+	return cert.URIs[0], nil
+}
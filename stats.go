@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 	"time"
@@ -22,7 +24,12 @@ var (
 	blockSizeDistributionBytes = view.Distribution(1<<7, 1<<8, 1<<9, 1<<10, 1<<11, 1<<12, 1<<13, 1<<14, 1<<15, 1<<16, 1<<18, 1<<19, 1<<20, 1<<21, 1<<22, 1<<23, 1<<24, 1<<25)
 )
 
-var cacheTag, _ = tag.NewKey("cache")
+var (
+	cacheTag, _    = tag.NewKey("cache")
+	addressTag, _  = tag.NewKey("address")
+	methodTag, _   = tag.NewKey("method")
+	upstreamTag, _ = tag.NewKey("upstream")
+)
 
 var (
 	fillDuration = stats.Float64("fill_duration_ms", "Time taken to fill the cache with a block", stats.UnitMilliseconds)
@@ -45,6 +52,39 @@ var (
 	circuitStatus  = stats.Int64("circuit_status", "Status of the lotus node circuit breaker, 0 when closed, 1 when open", stats.UnitDimensionless)
 	circuitRequest = stats.Int64("circuit_request", "Number of requests through the lotus node circuit breaker", stats.UnitDimensionless)
 	circuitFailure = stats.Int64("circuit_failure", "Number of failed requests through the lotus node circuit breaker", stats.UnitDimensionless)
+
+	learnedTTL           = stats.Float64("learned_ttl_seconds", "Cache lifetime learned for a method from how often its results change", stats.UnitSeconds)
+	revalidateQueueDepth = stats.Int64("revalidate_queue_depth", "Number of invalidated cache entries waiting to be refilled", stats.UnitDimensionless)
+
+	fallbackRequest = stats.Int64("fallback_request", "Number of read calls sent to the fallback node while no upstream was healthy", stats.UnitDimensionless)
+
+	gossipFetched = stats.Int64("gossip_fetched", "Number of cache entries fetched from peer replicas", stats.UnitDimensionless)
+
+	quorumDivergence = stats.Int64("quorum_divergence", "Number of quorum reads whose upstream answers disagreed", stats.UnitDimensionless)
+
+	rpcRequest         = stats.Int64("rpc_request", "Number of rpc requests served", stats.UnitDimensionless)
+	rpcFailure         = stats.Int64("rpc_failure", "Number of rpc requests that returned an error", stats.UnitDimensionless)
+	rpcCanceled        = stats.Int64("rpc_canceled", "Number of rpc requests abandoned by their client before they were answered", stats.UnitDimensionless)
+	upstreamHeadHeight = stats.Int64("upstream_head_height", "Height of the chain head last reported by an upstream node", stats.UnitDimensionless)
+	upstreamDuration   = stats.Float64("upstream_duration_ms", "Time taken by an upstream node to answer a call", stats.UnitMilliseconds)
+	upstreamRetry      = stats.Int64("upstream_retry", "Number of calls retried after no upstream node could answer them", stats.UnitDimensionless)
+	upstreamLimited    = stats.Int64("upstream_limited", "Number of calls held back by the rate or concurrency limit of an upstream node", stats.UnitDimensionless)
+
+	sessionMigrated = stats.Int64("session_migrated", "Number of client subscriptions moved to another upstream after theirs left the pool", stats.UnitDimensionless)
+
+	shadowRequest  = stats.Int64("shadow_request", "Number of read calls mirrored to the shadow upstream", stats.UnitDimensionless)
+	shadowMismatch = stats.Int64("shadow_mismatch", "Number of mirrored calls answered differently by the shadow upstream", stats.UnitDimensionless)
+	shadowDropped  = stats.Int64("shadow_dropped", "Number of read calls not mirrored because too many shadow calls were in flight", stats.UnitDimensionless)
+
+	authFailure = stats.Int64("auth_failure", "Number of requests rejected for invalid or revoked credentials", stats.UnitDimensionless)
+	authBan     = stats.Int64("auth_ban", "Number of client addresses banned for failing authentication too often", stats.UnitDimensionless)
+
+	walletRejected = stats.Int64("wallet_rejected", "Number of wallet calls rejected by the wallet policy", stats.UnitDimensionless)
+
+	tokensExpiring = stats.Int64("tokens_expiring", "Number of lotus tokens used in the last day that expire within --token-expiry-warning", stats.UnitDimensionless)
+
+	walletBalance    = stats.Float64("wallet_balance_fil", "Balance of a watched address in FIL", stats.UnitDimensionless)
+	walletBalanceLow = stats.Int64("wallet_balance_low", "Whether a watched address is below its minimum balance, 1 when below", stats.UnitDimensionless)
 )
 
 func startTimer(ctx context.Context, m *stats.Float64Measure) func() {
@@ -72,6 +112,37 @@ func cacheContext(ctx context.Context, name string) context.Context {
 	return ctx
 }
 
+func upstreamContext(ctx context.Context, addr string) context.Context {
+	ctx, _ = tag.New(ctx, tag.Upsert(upstreamTag, addr))
+	return ctx
+}
+
+// metricsInterceptor counts the rpc requests served and those that failed.
+// Requests whose client went away are counted apart, as their failure is
+// not the fault of the proxy or of the upstream nodes.
+func metricsInterceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+		reportEvent(mctx, rpcRequest)
+		results := next(ctx, call)
+		switch {
+		case resultError(results) == nil:
+		case clientGone(ctx):
+			reportEvent(mctx, rpcCanceled)
+		default:
+			reportEvent(mctx, rpcFailure)
+		}
+		return results
+	}
+}
+
+// clientGone reports whether the client of the request ctx belongs to
+// disconnected, or canceled the call, which cancels ctx and with it the
+// calls made upstream for the request.
+func clientGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
 func initMetricReporting(reportingInterval time.Duration) error {
 	view.SetReportingPeriod(reportingInterval)
 
@@ -189,6 +260,7 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			Name:        circuitStatus.Name(),
 			Measure:     circuitStatus,
 			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{upstreamTag},
 		},
 		{
 			Name:        circuitRequest.Name() + "_total",
@@ -200,12 +272,151 @@ func initMetricReporting(reportingInterval time.Duration) error {
 			Measure:     circuitFailure,
 			Aggregation: view.Sum(),
 		},
+
+		{
+			Name:        learnedTTL.Name(),
+			Measure:     learnedTTL,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag, methodTag},
+		},
+		{
+			Name:        revalidateQueueDepth.Name(),
+			Measure:     revalidateQueueDepth,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+
+		{
+			Name:        fallbackRequest.Name() + "_total",
+			Measure:     fallbackRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        gossipFetched.Name() + "_total",
+			Measure:     gossipFetched,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{cacheTag},
+		},
+
+		{
+			Name:        quorumDivergence.Name() + "_total",
+			Measure:     quorumDivergence,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        rpcRequest.Name() + "_total",
+			Measure:     rpcRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        rpcFailure.Name() + "_total",
+			Measure:     rpcFailure,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        rpcCanceled.Name() + "_total",
+			Measure:     rpcCanceled,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        upstreamHeadHeight.Name(),
+			Measure:     upstreamHeadHeight,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{upstreamTag},
+		},
+		{
+			Name:        upstreamRetry.Name() + "_total",
+			Measure:     upstreamRetry,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        upstreamLimited.Name() + "_total",
+			Measure:     upstreamLimited,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{upstreamTag},
+		},
+		{
+			Name:        upstreamDuration.Name(),
+			Measure:     upstreamDuration,
+			Aggregation: networkIODistributionMs,
+			TagKeys:     []tag.Key{upstreamTag},
+		},
+
+		{
+			Name:        sessionMigrated.Name() + "_total",
+			Measure:     sessionMigrated,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        shadowRequest.Name() + "_total",
+			Measure:     shadowRequest,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        shadowMismatch.Name() + "_total",
+			Measure:     shadowMismatch,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+		{
+			Name:        shadowDropped.Name() + "_total",
+			Measure:     shadowDropped,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        authFailure.Name() + "_total",
+			Measure:     authFailure,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        authBan.Name() + "_total",
+			Measure:     authBan,
+			Aggregation: view.Sum(),
+		},
+		{
+			Name:        walletRejected.Name() + "_total",
+			Measure:     walletRejected,
+			Aggregation: view.Sum(),
+			TagKeys:     []tag.Key{methodTag},
+		},
+
+		{
+			Name:        tokensExpiring.Name(),
+			Measure:     tokensExpiring,
+			Aggregation: view.LastValue(),
+		},
+
+		{
+			Name:        walletBalance.Name(),
+			Measure:     walletBalance,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{addressTag},
+		},
+		{
+			Name:        walletBalanceLow.Name(),
+			Measure:     walletBalanceLow,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{addressTag},
+		},
 	}
 
 	return view.Register(metricViews...)
 }
 
-func registerPrometheusExporter(namespace string) (*prometheus.Exporter, error) {
+func registerPrometheusExporter(namespace string) (*prometheus.Exporter, *prom.Registry, error) {
 	registry := prom.NewRegistry()
 	registry.MustRegister(prom.NewGoCollector(), prom.NewProcessCollector(prom.ProcessCollectorOpts{}))
 
@@ -214,12 +425,12 @@ func registerPrometheusExporter(namespace string) (*prometheus.Exporter, error)
 		Registry:  registry,
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	view.RegisterExporter(pe)
 
-	return pe, nil
+	return pe, registry, nil
 }
 
 func NewMetricLogger(logger logr.Logger) *MetricLogger {
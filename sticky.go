@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// streams reports whether the call holds a stream open on the upstream that
+// serves it, either a subscription channel or a reader pushed to the node.
+func (c *Call) streams() bool {
+	if c.returnsChannel() {
+		return true
+	}
+	for i := 1; i < c.Type.NumIn(); i++ {
+		if c.Type.In(i) == readerType {
+			return true
+		}
+	}
+	return false
+}
+
+// session binds the streaming calls made over one client connection to the
+// upstream that served the first of them. A websocket connection is one
+// session for all the calls made over it.
+type session struct {
+	remote string // address of the client
+	id     string // given by the client in sessionHeader, to resume subscriptions
+
+	mu       sync.Mutex
+	upstream *upstream
+	conn     *frameConn // of a websocket client, to send hints on
+}
+
+type sessionKey struct{}
+
+// StickySessions starts a session for each client connection.
+func StickySessions(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		s := &session{remote: r.RemoteAddr, id: r.Header.Get(sessionHeader)}
+		if len(s.id) > 128 {
+			http.Error(w, sessionHeader+" is too long", http.StatusBadRequest)
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionKey{}, s)
+		if isUpgrade(r) {
+			w = &hintWriter{ResponseWriter: w, s: s}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// sessionFrom returns the session ctx belongs to, or nil.
+func sessionFrom(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// remoteAddr returns the address of the client of the session.
+func (s *session) remoteAddr() string {
+	if s == nil {
+		return ""
+	}
+	return s.remote
+}
+
+func (s *session) get() *upstream {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstream
+}
+
+func (s *session) bind(u *upstream) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstream = u
+}
+
+// sticky sends a streaming read call to the upstream bound to the session,
+// or else to the first upstream that takes it, which is then bound to the
+// session. Calls are never hedged and only fail over before a stream opens.
+func (p *upstreamPool) sticky(ctx context.Context, call *Call) []reflect.Value {
+	s := sessionFrom(ctx)
+	if u := s.get(); u != nil && p.isReader(u) {
+		return p.stream(ctx, u, call)
+	}
+
+	tried := map[*upstream]bool{}
+
+	var results []reflect.Value
+	for u := p.pick(tried); u != nil; u = p.pick(tried) {
+		tried[u] = true
+		results = p.stream(ctx, u, call)
+
+		err := resultError(results)
+		if !shouldFailover(err) || ctx.Err() != nil {
+			if err == nil {
+				s.bind(u)
+			}
+			return results
+		}
+		log.Println("upstream call failed", "upstream", u.addr, "method", call.Method, "error", err)
+	}
+	if results == nil {
+		return call.errorResult(errNoUpstream)
+	}
+	return results
+}
+
+// stream calls a streaming method on u and tracks any subscription channel it
+// returns.
+func (p *upstreamPool) stream(ctx context.Context, u *upstream, call *Call) []reflect.Value {
+	results := p.call(ctx, u, call)
+	if call.returnsChannel() && resultError(results) == nil && !results[0].IsNil() {
+		results[0] = p.track(ctx, u, call, results[0])
+	}
+	return results
+}
+
+// isReader reports whether u is still one of the balanced upstreams.
+func (p *upstreamPool) isReader(u *upstream) bool {
+	for _, r := range p.readers() {
+		if r == u {
+			return true
+		}
+	}
+	return false
+}
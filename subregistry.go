@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/google/uuid"
+)
+
+// sessionHeader names the header a websocket client gives its session id
+// in, so that its subscriptions are registered and can be resumed when it
+// connects again with the same id.
+const sessionHeader = "X-Lotus-Proxy-Session"
+
+// subscriptionBacklog bounds the values a resumed subscription keeps for its
+// client until the client connects again. The oldest are dropped first.
+const subscriptionBacklog = 256
+
+// subscriptionDescriptor records a subscription a client opened, so that it
+// can be opened again for the client after the proxy restarts.
+type subscriptionDescriptor struct {
+	ID      string          `json:"id"`
+	Session string          `json:"session"`
+	Owner   string          `json:"owner,omitempty"` // owner of the token it was opened with
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Opened  time.Time       `json:"opened"`
+	// Disconnected is when the client of the subscription went away, and
+	// unset while it is connected.
+	Disconnected *time.Time `json:"disconnected,omitempty"`
+}
+
+func (d *subscriptionDescriptor) matches(session, owner, method string, params []byte) bool {
+	return d.Session == session && d.Owner == owner && d.Method == method && string(d.Params) == string(params)
+}
+
+// resumedSubscription is a subscription opened again after a restart, whose
+// values are kept until its client claims it.
+type resumedSubscription struct {
+	desc    *subscriptionDescriptor
+	backlog reflect.Value // buffered channel of the values kept
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	claimed bool
+}
+
+// subscriptionRegistry keeps the subscriptions of websocket clients that
+// give a session id in a file, and opens them again when the proxy starts,
+// so that clients connecting again with the same session id, such as
+// monitoring pipelines, miss as few values as possible. Subscriptions are
+// forgotten once their client has been gone for ttl.
+type subscriptionRegistry struct {
+	path string
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	subs    map[string]*subscriptionDescriptor // by id
+	resumed map[string]*resumedSubscription    // by id, until claimed
+}
+
+func newSubscriptionRegistry(path string, ttl time.Duration) (*subscriptionRegistry, error) {
+	r := &subscriptionRegistry{
+		path:    path,
+		ttl:     ttl,
+		subs:    map[string]*subscriptionDescriptor{},
+		resumed: map[string]*resumedSubscription{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("read subscription registry: %w", err)
+	}
+	var subs []*subscriptionDescriptor
+	if err := json.Unmarshal(data, &subs); err != nil {
+		return nil, fmt.Errorf("parse subscription registry %s: %w", path, err)
+	}
+	// Subscriptions still connected when the proxy stopped went away then.
+	now := time.Now().UTC()
+	for _, d := range subs {
+		if d.Disconnected == nil {
+			d.Disconnected = &now
+		}
+		if now.Sub(*d.Disconnected) < ttl {
+			r.subs[d.ID] = d
+		}
+	}
+	return r, nil
+}
+
+// persist writes the registry. It must be called with the lock held.
+func (r *subscriptionRegistry) persist() {
+	subs := make([]*subscriptionDescriptor, 0, len(r.subs))
+	for _, d := range r.subs {
+		subs = append(subs, d)
+	}
+	data, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		log.Println("failed to marshal subscription registry", "error", err)
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		log.Println("failed to write subscription registry", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		log.Println("failed to write subscription registry", "error", err)
+	}
+}
+
+// restore opens the registered subscriptions again through invoke, keeping
+// their values until their clients claim them or ttl passes.
+func (r *subscriptionRegistry) restore(ctx context.Context, invoke Invoker) {
+	methods := apiMethods(&lotusapi.FullNodeStruct{}, &lotusapi.StorageMinerStruct{})
+
+	r.mu.Lock()
+	subs := make([]*subscriptionDescriptor, 0, len(r.subs))
+	for _, d := range r.subs {
+		subs = append(subs, d)
+	}
+	r.mu.Unlock()
+
+	for _, d := range subs {
+		call, err := decodeCall(methods, d.Method, d.Params)
+		if err != nil {
+			log.Println("failed to resume subscription", "session", d.Session, "method", d.Method, "error", err)
+			r.remove(d.ID)
+			continue
+		}
+		sctx, cancel := context.WithCancel(ctx)
+		results := invoke(sctx, call)
+		if err := resultError(results); err != nil || results[0].IsNil() {
+			log.Println("failed to resume subscription", "session", d.Session, "method", d.Method, "error", err)
+			cancel()
+			r.remove(d.ID)
+			continue
+		}
+		rs := &resumedSubscription{
+			desc:    d,
+			backlog: reflect.MakeChan(reflect.ChanOf(reflect.BothDir, results[0].Type().Elem()), subscriptionBacklog),
+			ctx:     sctx,
+			cancel:  cancel,
+		}
+		r.mu.Lock()
+		r.resumed[d.ID] = rs
+		r.mu.Unlock()
+		go r.keep(rs, results[0])
+		time.AfterFunc(time.Until(d.Disconnected.Add(r.ttl)), func() { r.expire(rs) })
+		log.Println("resumed subscription", "session", d.Session, "method", d.Method)
+	}
+}
+
+// keep sends the values of the resumed subscription ch to its backlog,
+// dropping the oldest while it is full and unclaimed.
+func (r *subscriptionRegistry) keep(rs *resumedSubscription, ch reflect.Value) {
+	defer rs.backlog.Close()
+	for {
+		v, ok := ch.Recv()
+		if !ok {
+			return
+		}
+		for !rs.backlog.TrySend(v) {
+			rs.mu.Lock()
+			claimed := rs.claimed
+			rs.mu.Unlock()
+			if claimed {
+				if forwardValue(rs.ctx, v, rs.backlog) {
+					break
+				}
+				drain(ch)
+				return
+			}
+			rs.backlog.TryRecv()
+		}
+	}
+}
+
+// expire closes the resumed subscription unless it was claimed.
+func (r *subscriptionRegistry) expire(rs *resumedSubscription) {
+	rs.mu.Lock()
+	claimed := rs.claimed
+	rs.mu.Unlock()
+	if claimed {
+		return
+	}
+	r.mu.Lock()
+	delete(r.resumed, rs.desc.ID)
+	r.mu.Unlock()
+	rs.cancel()
+	r.remove(rs.desc.ID)
+}
+
+// claim returns the resumed subscription matching a call, if any.
+func (r *subscriptionRegistry) claim(session, owner, method string, params []byte) *resumedSubscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, rs := range r.resumed {
+		if !rs.desc.matches(session, owner, method, params) {
+			continue
+		}
+		delete(r.resumed, id)
+		rs.mu.Lock()
+		rs.claimed = true
+		rs.mu.Unlock()
+		return rs
+	}
+	return nil
+}
+
+// add registers a subscription whose client is connected.
+func (r *subscriptionRegistry) add(d *subscriptionDescriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d.Disconnected = nil
+	r.subs[d.ID] = d
+	r.persist()
+}
+
+func (r *subscriptionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subs[id]; !ok {
+		return
+	}
+	delete(r.subs, id)
+	r.persist()
+}
+
+// disconnected records that the client of a subscription went away, and
+// forgets the subscription after ttl unless the client resumes it.
+func (r *subscriptionRegistry) disconnected(id string) {
+	now := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.subs[id]
+	if !ok {
+		return
+	}
+	d.Disconnected = &now
+	r.persist()
+	time.AfterFunc(r.ttl, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if d, ok := r.subs[id]; ok && d.Disconnected != nil && d.Disconnected.Equal(now) {
+			delete(r.subs, id)
+			r.persist()
+		}
+	})
+}
+
+// interceptor registers the subscriptions opened by clients that give a
+// session id, and hands them those resumed for them.
+func (r *subscriptionRegistry) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		s := sessionFrom(ctx)
+		if !call.returnsChannel() || s == nil || s.id == "" {
+			return next(ctx, call)
+		}
+		params, err := json.Marshal(call.Params())
+		if err != nil {
+			return next(ctx, call)
+		}
+		owner := tokenOwner(ctx)
+
+		var (
+			ch   reflect.Value
+			desc *subscriptionDescriptor
+		)
+		if rs := r.claim(s.id, owner, call.Method, params); rs != nil {
+			go func() {
+				<-ctx.Done()
+				rs.cancel()
+			}()
+			ch, desc = rs.backlog, rs.desc
+			log.Println("client resumed subscription", "session", s.id, "method", call.Method)
+		} else {
+			results := next(ctx, call)
+			if resultError(results) != nil || results[0].IsNil() {
+				return results
+			}
+			ch = results[0]
+			desc = &subscriptionDescriptor{
+				ID:      uuid.New().String(),
+				Session: s.id,
+				Owner:   owner,
+				Method:  call.Method,
+				Params:  params,
+				Opened:  time.Now().UTC(),
+			}
+		}
+		r.add(desc)
+
+		out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, ch.Type().Elem()), 0)
+		go func() {
+			defer out.Close()
+			if forwardValues(ctx, ch, out) {
+				r.disconnected(desc.ID)
+			} else {
+				r.remove(desc.ID)
+			}
+		}()
+		return []reflect.Value{out.Convert(call.Type.Out(0)), reflect.Zero(call.Type.Out(1))}
+	}
+}
+
+// forwardValues sends the values of ch to out until ch closes, and reports
+// whether it stopped because ctx was done first.
+func forwardValues(ctx context.Context, ch, out reflect.Value) bool {
+	for {
+		v, ok := ch.Recv()
+		if !ok {
+			return ctx.Err() != nil
+		}
+		if !forwardValue(ctx, v, out) {
+			drain(ch)
+			return true
+		}
+	}
+}
+
+// forwardValue sends v to out, and reports false when ctx is done first.
+func forwardValue(ctx context.Context, v, out reflect.Value) bool {
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: out, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	})
+	return chosen == 0
+}
+
+// drain receives the values of ch until it closes, as subscriptions do once
+// the context they were opened with is done, so that their senders are not
+// left blocked.
+func drain(ch reflect.Value) {
+	go func() {
+		for {
+			if _, ok := ch.Recv(); !ok {
+				return
+			}
+		}
+	}()
+}
+
+// apiMethods returns the function fields of the internal structs of apis, by
+// method name.
+func apiMethods(apis ...interface{}) map[string]reflect.StructField {
+	methods := map[string]reflect.StructField{}
+	for _, api := range apis {
+		for _, in := range lotusapi.GetInternalStructs(api) {
+			t := reflect.TypeOf(in).Elem()
+			for i := 0; i < t.NumField(); i++ {
+				if _, ok := methods[t.Field(i).Name]; !ok {
+					methods[t.Field(i).Name] = t.Field(i)
+				}
+			}
+		}
+	}
+	return methods
+}
+
+// apiOnlyMethods returns the names of the methods of api that other lacks.
+func apiOnlyMethods(api, other interface{}) map[string]bool {
+	others := apiMethods(other)
+	only := map[string]bool{}
+	for name := range apiMethods(api) {
+		if _, ok := others[name]; !ok {
+			only[name] = true
+		}
+	}
+	return only
+}
+
+// decodeCall returns the call of method with the JSON encoded params.
+func decodeCall(methods map[string]reflect.StructField, method string, params json.RawMessage) (*Call, error) {
+	f, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(params, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw) != f.Type.NumIn()-1 {
+		return nil, fmt.Errorf("%s takes %d params, got %d", method, f.Type.NumIn()-1, len(raw))
+	}
+	args := make([]reflect.Value, len(raw))
+	for i, p := range raw {
+		v := reflect.New(f.Type.In(i + 1))
+		if err := json.Unmarshal(p, v.Interface()); err != nil {
+			return nil, fmt.Errorf("decode param %d of %s: %w", i, method, err)
+		}
+		args[i] = v.Elem()
+	}
+	return &Call{Method: method, Perm: f.Tag.Get("perm"), Type: f.Type, Args: args}, nil
+}
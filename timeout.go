@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// timeoutInterceptor bounds the time a call may take, so that a hung upstream
+// does not hold the client forever. Methods matching one of rules get the
+// timeout at the same index and others get def. A zero timeout disables the bound. Calls that
+// open a stream are only bounded by an explicit method timeout, as they are
+// expected to stay open, and a subscription ends when its timeout elapses.
+func timeoutInterceptor(def time.Duration, rules methodRules, timeouts []time.Duration) Interceptor {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, call *Call) []reflect.Value {
+			timeout := def
+			if i := rules.find(call.Method); i >= 0 {
+				timeout = timeouts[i]
+			} else if call.streams() {
+				return next(ctx, call)
+			}
+			if timeout <= 0 {
+				return next(ctx, call)
+			}
+
+			tctx, cancel := context.WithTimeout(ctx, timeout)
+			results := next(tctx, call)
+			err := resultError(results)
+			if call.returnsChannel() && err == nil {
+				time.AfterFunc(timeout, cancel)
+				return results
+			}
+			cancel()
+			if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				return call.errorResult(fmt.Errorf("%s timed out after %s: %w", call.Method, timeout, context.DeadlineExceeded))
+			}
+			return results
+		}
+	}
+}
+
+// parseMethodTimeouts parses values of the form <method rule>=<duration>.
+func parseMethodTimeouts(values []string) (methodRules, []time.Duration, error) {
+	var (
+		rules    methodRules
+		timeouts []time.Duration
+	)
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid method timeout %q, expected <method rule>=<duration>", v)
+		}
+		rule, err := parseMethodRule(parts[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return nil, nil, fmt.Errorf("invalid method timeout %q", v)
+		}
+		rules = append(rules, rule)
+		timeouts = append(timeouts, d)
+	}
+	return rules, timeouts, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// tipSetVolatileMethods answer with more than the state of the tipset they
+// are given, such as the messages pending in the pool of the node, so their
+// results are not kept for the tipset.
+var tipSetVolatileMethods = mustParseMethodRules([]string{"Mpool*"})
+
+func mustParseMethodRules(patterns []string) methodRules {
+	rules, err := parseMethodRules(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// tipSetPinned reports whether the answer to the call is fixed by the
+// tipsets it names: it is given at least one tipset key, none of them empty,
+// and reads the chain state at them. Blocks are addressed by content, so the
+// answer does not change once known, whatever the method.
+func (c *Call) tipSetPinned() bool {
+	if !c.readOnly() || tipSetVolatileMethods.match(c.Method) {
+		return false
+	}
+	pinned := false
+	for _, a := range c.Args {
+		if a.Type() != tipSetKeyType {
+			continue
+		}
+		if a.Interface().(types.TipSetKey) == types.EmptyTSK {
+			return false
+		}
+		pinned = true
+	}
+	return pinned
+}
+
+// tipSetKeys returns the tipset keys the call is given.
+func (c *Call) tipSetKeys() []types.TipSetKey {
+	var keys []types.TipSetKey
+	for _, a := range c.Args {
+		if a.Type() == tipSetKeyType {
+			keys = append(keys, a.Interface().(types.TipSetKey))
+		}
+	}
+	return keys
+}
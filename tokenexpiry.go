@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tokenSeenWindow is how long a token is still counted after it was last
+// used.
+const tokenSeenWindow = 24 * time.Hour
+
+// expiringToken is a token with an expiry that was used recently.
+type expiringToken struct {
+	Owner    string    `json:"owner"`
+	JTI      string    `json:"jti,omitempty"`
+	Expires  time.Time `json:"expires"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// tokenExpiry follows the expiry of the lotus tokens clients use, so that
+// operators can replace them before they expire and calls start failing.
+// Tokens used within tokenSeenWindow that expire within warning are counted
+// by the tokens_expiring metric and logged once.
+type tokenExpiry struct {
+	warning time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*expiringToken // by hash
+	warned map[string]bool           // by hash
+}
+
+func newTokenExpiry(warning time.Duration) *tokenExpiry {
+	return &tokenExpiry{
+		warning: warning,
+		tokens:  map[string]*expiringToken{},
+		warned:  map[string]bool{},
+	}
+}
+
+// seen records the use of the token of p.
+func (e *tokenExpiry) seen(p *jwtPayload, now time.Time) {
+	if e == nil || p.Payload.ExpirationTime == nil {
+		return
+	}
+	exp := p.Payload.ExpirationTime.Time
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t, ok := e.tokens[p.hash]
+	if !ok {
+		t = &expiringToken{Owner: p.owner(), JTI: p.Payload.JWTID, Expires: exp}
+		e.tokens[p.hash] = t
+	}
+	t.LastSeen = now
+	if exp.Sub(now) < e.warning && !e.warned[p.hash] {
+		e.warned[p.hash] = true
+		log.Println("token nearing expiry", "owner", t.Owner, "jti", t.JTI, "expires", exp)
+	}
+}
+
+// list returns the tokens used recently that have not expired, soonest to
+// expire first.
+func (e *tokenExpiry) list(now time.Time) []expiringToken {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.prune(now)
+	tokens := make([]expiringToken, 0, len(e.tokens))
+	for _, t := range e.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Expires.Before(tokens[j].Expires)
+	})
+	return tokens
+}
+
+// prune forgets expired tokens and those not used recently. It must be
+// called with the lock held.
+func (e *tokenExpiry) prune(now time.Time) {
+	for hash, t := range e.tokens {
+		if !now.Before(t.Expires) || now.Sub(t.LastSeen) > tokenSeenWindow {
+			delete(e.tokens, hash)
+			delete(e.warned, hash)
+		}
+	}
+}
+
+// run reports the number of tokens nearing expiry every minute until ctx is
+// cancelled.
+func (e *tokenExpiry) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		var expiring int64
+		for _, t := range e.list(now) {
+			if t.Expires.Sub(now) < e.warning {
+				expiring++
+			}
+		}
+		reportMeasurement(ctx, tokensExpiring.M(expiring))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
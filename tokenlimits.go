@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRateLimited = errors.New("token rate limit exceeded")
+
+// rateLimitError rejects a call over the rate or quota of its token owner.
+type rateLimitError struct {
+	owner      string
+	what       string // the rate limit or quota exceeded
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%s of %s exceeded, retry after %s", e.what, e.owner, e.retryAfter.Round(time.Second))
+}
+
+func (e *rateLimitError) Is(target error) bool {
+	return target == errRateLimited
+}
+
+// quotaNames names the quotas of each period they may be given over, each
+// period starting at midnight UTC.
+var quotaNames = map[string]string{
+	"day":   "daily quota",
+	"month": "monthly quota",
+}
+
+func periodStart(period string, now time.Time) time.Time {
+	now = now.UTC()
+	if period == "month" {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func periodEnd(period string, now time.Time) time.Time {
+	start := periodStart(period, now)
+	if period == "month" {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// tokenRate bounds the calls per second of a token owner, with bursts of up
+// to burst calls.
+type tokenRate struct {
+	rate  float64
+	burst float64
+}
+
+// tokenLimits rejects calls of a token owner over its rate or its quotas, so
+// that one team cannot starve the others. The owner of a token is its
+// subject or label, so that all the tokens of a team share its limits, and
+// the token itself otherwise. Limits given for * apply to each owner without
+// limits of its own. Quota counts are kept in memory and restart with the
+// proxy.
+type tokenLimits struct {
+	rates  map[string]tokenRate
+	quotas map[string]map[string]int64 // calls by period by owner
+
+	mu    sync.Mutex
+	usage map[string]*ownerUsage
+}
+
+type ownerUsage struct {
+	tokens float64
+	last   time.Time
+	starts map[string]time.Time // start of the current period
+	counts map[string]int64     // calls in the current period
+}
+
+func newTokenLimits(rates map[string]tokenRate, quotas map[string]map[string]int64) *tokenLimits {
+	return &tokenLimits{
+		rates:  rates,
+		quotas: quotas,
+		usage:  map[string]*ownerUsage{},
+	}
+}
+
+// tokenOwner returns the owner of the token of the request ctx belongs to,
+// or an empty string for the admin token and unauthenticated requests.
+func tokenOwner(ctx context.Context) string {
+	if g := grantFrom(ctx); g != nil {
+		if g.Label != "" {
+			return g.Label
+		}
+		return "token " + g.ID
+	}
+	if p := jwtPayloadFrom(ctx); p != nil {
+		return p.owner()
+	}
+	return ""
+}
+
+// owner returns the owner of the token of p: its subject, or else its jti or
+// hash.
+func (p *jwtPayload) owner() string {
+	switch {
+	case p.Payload.Subject != "":
+		return p.Payload.Subject
+	case p.Payload.JWTID != "":
+		return "jti " + p.Payload.JWTID
+	case len(p.hash) >= 16:
+		return "token " + p.hash[:16]
+	}
+	return ""
+}
+
+// take counts a call of owner, or returns the error rejecting it.
+func (l *tokenLimits) take(owner string, now time.Time) error {
+	rate, hasRate := l.rates[owner]
+	if !hasRate {
+		rate, hasRate = l.rates["*"]
+	}
+	quotas, ok := l.quotas[owner]
+	if !ok {
+		quotas = l.quotas["*"]
+	}
+	if !hasRate && len(quotas) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.usage[owner]
+	if !ok {
+		u = &ownerUsage{
+			tokens: rate.burst,
+			last:   now,
+			starts: map[string]time.Time{},
+			counts: map[string]int64{},
+		}
+		l.usage[owner] = u
+	}
+
+	for period, max := range quotas {
+		if start := periodStart(period, now); !u.starts[period].Equal(start) {
+			u.starts[period], u.counts[period] = start, 0
+		}
+		if u.counts[period] >= max {
+			return &rateLimitError{owner: owner, what: quotaNames[period], retryAfter: periodEnd(period, now).Sub(now)}
+		}
+	}
+	if hasRate {
+		u.tokens = math.Min(rate.burst, u.tokens+now.Sub(u.last).Seconds()*rate.rate)
+		u.last = now
+		if u.tokens < 1 {
+			wait := time.Duration((1 - u.tokens) / rate.rate * float64(time.Second))
+			return &rateLimitError{owner: owner, what: "rate limit", retryAfter: wait}
+		}
+		u.tokens--
+	}
+	for period := range quotas {
+		u.counts[period]++
+	}
+	return nil
+}
+
+// interceptor rejects calls over the limits of their token owner.
+func (l *tokenLimits) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if owner := tokenOwner(ctx); owner != "" {
+			if err := l.take(owner, time.Now()); err != nil {
+				return call.errorResult(err)
+			}
+		}
+		return next(ctx, call)
+	}
+}
+
+// ownerQuotaUsage is the use an owner has made of its quotas.
+type ownerQuotaUsage struct {
+	Owner  string           `json:"owner"`
+	Calls  map[string]int64 `json:"calls"` // by period
+	Quotas map[string]int64 `json:"quotas"`
+}
+
+// list returns the quota use of every owner that made calls, by owner.
+func (l *tokenLimits) list() []ownerQuotaUsage {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]ownerQuotaUsage, 0, len(l.usage))
+	for owner, u := range l.usage {
+		quotas, ok := l.quotas[owner]
+		if !ok {
+			quotas = l.quotas["*"]
+		}
+		calls := map[string]int64{}
+		for period := range quotas {
+			if u.starts[period].Equal(periodStart(period, now)) {
+				calls[period] = u.counts[period]
+			} else {
+				calls[period] = 0
+			}
+		}
+		out = append(out, ownerQuotaUsage{Owner: owner, Calls: calls, Quotas: quotas})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Owner < out[j].Owner
+	})
+	return out
+}
+
+// parseTokenRates parses values of the form
+// <owner>=<calls per second>/<burst>.
+func parseTokenRates(values []string) (map[string]tokenRate, error) {
+	rates := map[string]tokenRate{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid token limit %q, expected <owner>=<rate>/<burst>", v)
+		}
+		bounds := strings.SplitN(parts[1], "/", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid token limit %q, expected <owner>=<rate>/<burst>", v)
+		}
+		rate, err := strconv.ParseFloat(bounds[0], 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid rate in token limit %q", v)
+		}
+		burst, err := strconv.Atoi(bounds[1])
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst in token limit %q", v)
+		}
+		rates[parts[0]] = tokenRate{rate: rate, burst: float64(burst)}
+	}
+	return rates, nil
+}
+
+// parseTokenQuotas parses values of the form <owner>=<calls>/<day|month>.
+func parseTokenQuotas(values []string) (map[string]map[string]int64, error) {
+	quotas := map[string]map[string]int64{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid token quota %q, expected <owner>=<calls>/<day|month>", v)
+		}
+		bounds := strings.SplitN(parts[1], "/", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid token quota %q, expected <owner>=<calls>/<day|month>", v)
+		}
+		calls, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil || calls < 0 {
+			return nil, fmt.Errorf("invalid calls in token quota %q", v)
+		}
+		period := bounds[1]
+		if _, ok := quotaNames[period]; !ok {
+			return nil, fmt.Errorf("invalid period in token quota %q, expected day or month", v)
+		}
+		if quotas[parts[0]] == nil {
+			quotas[parts[0]] = map[string]int64{}
+		}
+		quotas[parts[0]][period] = calls
+	}
+	return quotas, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownToken = errors.New("unknown token")
+	errTokenScope   = errors.New("token does not allow this method")
+)
+
+// tokenGrant describes a token minted for a third party, which may only call
+// the methods matching its rules, at the rate of its class, until it expires
+// or is revoked.
+type tokenGrant struct {
+	ID        string    `json:"id"`
+	Label     string    `json:"label,omitempty"`
+	Methods   []string  `json:"methods"`
+	RateClass string    `json:"rate_class,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	Revoked   bool      `json:"revoked"`
+
+	rules methodRules
+	limit *limit // nil for no limit
+}
+
+func (g *tokenGrant) valid(now time.Time) bool {
+	return !g.Revoked && now.Before(g.Expires)
+}
+
+// tokenIssuer mints short lived tokens scoped to selected methods for callers
+// holding the admin token. Once it is configured only the admin token, minted
+// tokens and, given a jwt secret, lotus tokens are accepted. Tokens are kept
+// in memory and do not survive a restart.
+type tokenIssuer struct {
+	adminToken string
+	classes    map[string]limitConfig
+	maxTTL     time.Duration
+
+	mu     sync.Mutex
+	grants map[[sha256.Size]byte]*tokenGrant // by hash of the token
+	byID   map[string]*tokenGrant
+}
+
+func newTokenIssuer(adminToken string, classes map[string]limitConfig, maxTTL time.Duration) *tokenIssuer {
+	return &tokenIssuer{
+		adminToken: adminToken,
+		classes:    classes,
+		maxTTL:     maxTTL,
+		grants:     map[[sha256.Size]byte]*tokenGrant{},
+		byID:       map[string]*tokenGrant{},
+	}
+}
+
+// mintRequest is the body of a request for a new token.
+type mintRequest struct {
+	Label     string   `json:"label"`
+	Methods   []string `json:"methods"`
+	TTL       string   `json:"ttl"`
+	RateClass string   `json:"rate_class"`
+}
+
+// mintedToken is returned once for each minted token, which cannot be
+// retrieved again.
+type mintedToken struct {
+	Token string `json:"token"`
+	tokenGrant
+}
+
+func (t *tokenIssuer) mint(req mintRequest) (mintedToken, error) {
+	if len(req.Methods) == 0 {
+		return mintedToken{}, fmt.Errorf("a token must allow at least one method")
+	}
+	rules, err := parseMethodRules(req.Methods)
+	if err != nil {
+		return mintedToken{}, err
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		return mintedToken{}, fmt.Errorf("invalid ttl %q", req.TTL)
+	}
+	if ttl > t.maxTTL {
+		return mintedToken{}, fmt.Errorf("ttl %s exceeds the maximum of %s", ttl, t.maxTTL)
+	}
+	var limit *limit
+	if req.RateClass != "" {
+		class, ok := t.classes[req.RateClass]
+		if !ok {
+			return mintedToken{}, fmt.Errorf("unknown rate class %q", req.RateClass)
+		}
+		limit = newLimit(class)
+	}
+
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return mintedToken{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw[:])
+	hash := sha256.Sum256([]byte(token))
+
+	now := time.Now()
+	g := &tokenGrant{
+		ID:        hex.EncodeToString(hash[:8]),
+		Label:     req.Label,
+		Methods:   req.Methods,
+		RateClass: req.RateClass,
+		Created:   now,
+		Expires:   now.Add(ttl),
+		rules:     rules,
+		limit:     limit,
+	}
+
+	t.mu.Lock()
+	t.grants[hash] = g
+	t.byID[g.ID] = g
+	t.mu.Unlock()
+
+	log.Println("minted token", "id", g.ID, "label", g.Label, "methods", g.Methods, "expires", g.Expires)
+	return mintedToken{Token: token, tokenGrant: *g}, nil
+}
+
+func (t *tokenIssuer) revoke(id string) (tokenGrant, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.byID[id]
+	if !ok {
+		return tokenGrant{}, errUnknownToken
+	}
+	g.Revoked = true
+	log.Println("revoked token", "id", g.ID, "label", g.Label)
+	return *g, nil
+}
+
+// list returns the issued tokens that have not expired, oldest first, and
+// forgets the others.
+func (t *tokenIssuer) list() []tokenGrant {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	grants := make([]tokenGrant, 0, len(t.byID))
+	for hash, g := range t.grants {
+		if !now.Before(g.Expires) {
+			delete(t.grants, hash)
+			delete(t.byID, g.ID)
+			continue
+		}
+		grants = append(grants, *g)
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Created.Before(grants[j].Created)
+	})
+	return grants
+}
+
+type tokenGrantKey struct{}
+
+func grantFrom(ctx context.Context) *tokenGrant {
+	g, _ := ctx.Value(tokenGrantKey{}).(*tokenGrant)
+	return g
+}
+
+// lookup reports whether token is the admin token, or returns its grant and
+// whether it is still valid when it is a minted token.
+func (t *tokenIssuer) lookup(token string) (admin bool, grant *tokenGrant, valid bool) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t.adminToken)) == 1 {
+		return true, nil, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	grant = t.grants[sha256.Sum256([]byte(token))]
+	return false, grant, grant != nil && grant.valid(time.Now())
+}
+
+// Authenticate accepts the admin token and minted tokens.
+func (t *tokenIssuer) Authenticate(ctx context.Context, token string) (*identity, error) {
+	admin, grant, valid := t.lookup(token)
+	switch {
+	case admin:
+		return &identity{admin: true}, nil
+	case grant == nil:
+		return nil, errUnrecognizedToken
+	case !valid:
+		return nil, errors.New("token has expired or been revoked")
+	}
+	return &identity{grant: grant}, nil
+}
+
+// interceptor rejects calls that the minted token of the request does not
+// allow and holds back calls over the rate of its class. Tokens are checked
+// again on every call, as websocket connections outlive their expiry.
+func (t *tokenIssuer) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		g := grantFrom(ctx)
+		if g == nil {
+			return next(ctx, call)
+		}
+
+		t.mu.Lock()
+		valid := g.valid(time.Now())
+		t.mu.Unlock()
+		if !valid || !g.rules.match(call.Method) {
+			return call.errorResult(fmt.Errorf("%s: %w", call.Method, errTokenScope))
+		}
+
+		release, err := g.limit.acquire(ctx, call.streams())
+		if err != nil {
+			return call.errorResult(err)
+		}
+		defer release()
+		return next(ctx, call)
+	}
+}
+
+// parseRateClasses parses values of the form
+// <name>=<calls per second>/<concurrency>.
+func parseRateClasses(values []string) (map[string]limitConfig, error) {
+	classes := map[string]limitConfig{}
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate class %q, expected <name>=<rate>/<concurrency>", v)
+		}
+		limit, err := parseLimit(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate class %q: %w", v, err)
+		}
+		classes[parts[0]] = limit
+	}
+	return classes, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// tracesKept is the number of recent sampled calls kept for /admin/traces.
+const tracesKept = 200
+
+// callTracer samples calls for tracing by a hash of their method and params,
+// so that the same request is always either traced or not, whichever replica
+// serves it. Methods matching one of rules are sampled at the rate at the same
+// index and others at def.
+type callTracer struct {
+	def   float64
+	rules methodRules
+	rates []float64
+
+	mu     sync.Mutex
+	recent []tracedCall // ring of the most recent sampled calls
+	next   int
+}
+
+func newCallTracer(def float64, rules methodRules, rates []float64) *callTracer {
+	return &callTracer{
+		def:    def,
+		rules:  rules,
+		rates:  rates,
+		recent: make([]tracedCall, 0, tracesKept),
+	}
+}
+
+// enabled reports whether any call may be sampled.
+func (t *callTracer) enabled() bool {
+	if t.def > 0 {
+		return true
+	}
+	for _, r := range t.rates {
+		if r > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHash returns the hash of the method and params of the call.
+func requestHash(call *Call) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(call.Method))
+	h.Write([]byte{0})
+	if params, err := json.Marshal(call.Params()); err == nil {
+		h.Write(params)
+	}
+	return h.Sum64()
+}
+
+// sampled reports whether the call with the given request hash is traced.
+func (t *callTracer) sampled(call *Call, hash uint64) bool {
+	rate := t.def
+	if i := t.rules.find(call.Method); i >= 0 {
+		rate = t.rates[i]
+	}
+	switch {
+	case rate <= 0:
+		return false
+	case rate >= 1:
+		return true
+	}
+	// The top 53 bits of the hash are uniform over [0, 1) as a float.
+	return float64(hash>>11)/(1<<53) < rate
+}
+
+// interceptor records a span for each sampled call, exported to the
+// registered opencensus exporters.
+func (t *callTracer) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		hash := requestHash(call)
+		if !t.sampled(call, hash) {
+			return next(ctx, call)
+		}
+
+		ctx, span := trace.StartSpan(ctx, "lotus-cpr."+call.Method, trace.WithSampler(trace.AlwaysSample()))
+		defer span.End()
+		span.AddAttributes(
+			trace.StringAttribute("method", call.Method),
+			trace.StringAttribute("request_hash", strconv.FormatUint(hash, 16)),
+		)
+
+		results := next(ctx, call)
+		if info := callInfoFrom(ctx); info != nil {
+			info.mu.Lock()
+			span.AddAttributes(
+				trace.StringAttribute("upstream", info.upstream),
+				trace.StringAttribute("cache", info.cache),
+			)
+			info.mu.Unlock()
+		}
+		if err := resultError(results); err != nil {
+			code, _ := classifyError(err)
+			span.SetStatus(trace.Status{Code: int32(code), Message: err.Error()})
+		}
+		return results
+	}
+}
+
+// tracedCall summarizes a sampled call for /admin/traces.
+type tracedCall struct {
+	Time       time.Time              `json:"time"`
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	DurationMs float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// ExportSpan keeps the spans of sampled calls, making the tracer an
+// opencensus exporter.
+func (t *callTracer) ExportSpan(s *trace.SpanData) {
+	c := tracedCall{
+		Time:       s.StartTime,
+		Name:       s.Name,
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		DurationMs: float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond),
+		Attributes: s.Attributes,
+	}
+	if s.Code != 0 {
+		c.Error = s.Message
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.recent) < cap(t.recent) {
+		t.recent = append(t.recent, c)
+		return
+	}
+	t.recent[t.next] = c
+	t.next = (t.next + 1) % cap(t.recent)
+}
+
+// traces returns the recorded calls, oldest first.
+func (t *callTracer) traces() []tracedCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]tracedCall, 0, len(t.recent))
+	out = append(out, t.recent[t.next:]...)
+	out = append(out, t.recent[:t.next]...)
+	return out
+}
+
+// parseTraceSamples parses values of the form <method rule>=<fraction>.
+func parseTraceSamples(values []string) (methodRules, []float64, error) {
+	var (
+		rules methodRules
+		rates []float64
+	)
+	for _, v := range splitValues(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid trace sample %q, expected <method rule>=<fraction>", v)
+		}
+		rule, err := parseMethodRule(parts[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate < 0 || rate > 1 || math.IsNaN(rate) {
+			return nil, nil, fmt.Errorf("invalid trace sample %q, fraction must be between 0 and 1", v)
+		}
+		rules = append(rules, rule)
+		rates = append(rates, rate)
+	}
+	return rules, rates, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transportConfig tunes the connections made to upstream nodes.
+type transportConfig struct {
+	websocket    bool // hold a persistent websocket per upstream instead of a request per call
+	keepAlive    time.Duration
+	idleTimeout  time.Duration
+	maxIdleConns int
+
+	reconnect     backoff       // delay between attempts to reconnect to an upstream
+	reconnectWait time.Duration // time calls wait for a disconnected upstream
+
+	tls *tls.Config // custom tls settings, nil for the system defaults
+}
+
+// rpcURL returns the url of the rpc endpoint of the node api, at path unless
+// the api gives its own.
+func (c transportConfig) rpcURL(api apiInfo, path string) string {
+	if api.path != "" {
+		path = api.path
+	}
+	scheme := "http"
+	if c.websocket || api.websocket {
+		scheme = "ws"
+	}
+	if api.tls {
+		scheme += "s"
+	}
+	return scheme + "://" + api.addr + path
+}
+
+// check reports an error if the connection to the node api cannot use the
+// transport settings. The rpc client's http transport cannot be configured,
+// so custom tls settings only apply to websockets and reader pushes.
+func (c transportConfig) check(api apiInfo) error {
+	if c.tls != nil && api.tls && !c.websocket && !api.websocket {
+		return fmt.Errorf("custom tls settings require a websocket connection to %s, use wss:// or --upstream-transport ws", api.addr)
+	}
+	return nil
+}
+
+// loadTLSConfig returns the tls settings for upstream connections given by
+// flags, or nil when none are set.
+func loadTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: insecure, //nolint:gosec
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (c transportConfig) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: c.keepAlive,
+	}
+}
+
+// apply configures the shared websocket dialer used by rpc clients and the
+// http client used to push reader streams.
+func (c transportConfig) apply() {
+	websocket.DefaultDialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   c.dialer().DialContext,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  c.tls,
+	}
+
+	client.Transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           c.dialer().DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.maxIdleConns,
+		MaxIdleConnsPerHost:   c.maxIdleConns,
+		IdleConnTimeout:       c.idleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       c.tls,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
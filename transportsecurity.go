@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transportSecurity keeps credentials off plaintext connections when the
+// proxy is exposed beyond localhost, and sets the headers telling browsers
+// to reach it over tls only.
+type transportSecurity struct {
+	requireTLS       bool          // reject plaintext requests, but for probes
+	rejectPlainCreds bool          // reject credentials sent over plaintext from other hosts
+	trustForwarded   bool          // trust X-Forwarded-Proto, set by a tls terminating proxy
+	hstsMaxAge       time.Duration // 0 for no Strict-Transport-Security header
+	headers          bool          // set the other security headers
+}
+
+// secure reports whether r reached the proxy, or the proxy in front of it,
+// over tls.
+func (t *transportSecurity) secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return t.trustForwarded && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != ""
+}
+
+func isProbePath(p string) bool {
+	return p == "/healthz" || p == "/readyz"
+}
+
+// handler rejects plaintext requests with 403 under requireTLS, and those
+// carrying credentials from other hosts under rejectPlainCreds, and sets
+// the security headers of the responses.
+func (t *transportSecurity) handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if t.headers {
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		}
+		if t.secure(r) {
+			// Browsers ignore the header over plaintext, so it is only sent
+			// over tls.
+			if t.hstsMaxAge > 0 {
+				h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(t.hstsMaxAge.Seconds())))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch {
+		case t.requireTLS && !isProbePath(r.URL.Path):
+			http.Error(w, "the proxy is only served over tls", http.StatusForbidden)
+			return
+		case t.rejectPlainCreds && hasCredentials(r) && !fromLoopback(r):
+			log.Println("rejected credentials sent over plaintext", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "credentials must not be sent over plaintext, use tls", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// tlsRedirect answers plaintext requests with a redirect to the same url
+// over tls, on the port of the tls listener.
+type tlsRedirect struct {
+	port string // of the tls listener, empty for 443
+}
+
+func newTLSRedirect(listen string) (*tlsRedirect, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if port == "443" {
+		port = ""
+	}
+	return &tlsRedirect{port: port}, nil
+}
+
+// ServeHTTP rejects requests carrying credentials rather than redirecting
+// them, so that clients sending them over plaintext fail instead of working
+// on.
+func (t *tlsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hasCredentials(r) {
+		http.Error(w, "credentials must not be sent over plaintext, use tls", http.StatusForbidden)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t.port != "" {
+		host = net.JoinHostPort(host, t.port)
+	}
+	// 308 keeps the method and body of posted calls, which clients that
+	// follow redirects send again.
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// listenAndServe serves the redirects on addr until ctx is done.
+func (t *tlsRedirect) listenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: t}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// maxLearnedKeys bounds the number of result hashes kept to detect changes.
+// The hashes are dropped when it is exceeded and learning starts over.
+const maxLearnedKeys = 100000
+
+// ttlLearner tunes the cache lifetime of each method from how often its
+// results actually change. A refill that returns the same result as the
+// previous fill lengthens the lifetime and one that returns a different
+// result shortens it, within the configured bounds.
+type ttlLearner struct {
+	name     string
+	min, max time.Duration
+
+	mu     sync.Mutex
+	ttls   map[string]time.Duration // learned lifetime by method
+	hashes map[string]uint64        // hash of the last result by cache key
+}
+
+func newTTLLearner(name string, min, max time.Duration) *ttlLearner {
+	return &ttlLearner{
+		name:   name,
+		min:    min,
+		max:    max,
+		ttls:   map[string]time.Duration{},
+		hashes: map[string]uint64{},
+	}
+}
+
+// ttl returns the learned lifetime of method, or def before anything has been
+// learned about it.
+func (l *ttlLearner) ttl(method string, def time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ttl, ok := l.ttls[method]; ok {
+		return ttl
+	}
+	return def
+}
+
+// observe records the results a call to method filled key with and returns
+// the lifetime to cache them for.
+func (l *ttlLearner) observe(method, key string, results []reflect.Value, def time.Duration) time.Duration {
+	h, ok := resultHash(results)
+	if !ok {
+		return l.ttl(method, def)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ttl, ok := l.ttls[method]
+	if !ok {
+		ttl = def
+	}
+
+	if prev, seen := l.hashes[key]; seen {
+		if prev == h {
+			ttl = ttl * 3 / 2
+		} else {
+			ttl = ttl / 2
+		}
+		if ttl < l.min {
+			ttl = l.min
+		}
+		if ttl > l.max {
+			ttl = l.max
+		}
+	}
+
+	if len(l.hashes) >= maxLearnedKeys {
+		l.hashes = map[string]uint64{}
+	}
+	l.hashes[key] = h
+	l.ttls[method] = ttl
+
+	mctx, _ := tag.New(context.Background(), tag.Upsert(cacheTag, l.name), tag.Upsert(methodTag, method))
+	stats.Record(mctx, learnedTTL.M(ttl.Seconds()))
+	return ttl
+}
+
+// resultHash returns a hash of the JSON encoding of the value returned by a
+// call.
+func resultHash(results []reflect.Value) (uint64, bool) {
+	if len(results) != 2 {
+		return 0, false
+	}
+	b, err := json.Marshal(results[0].Interface())
+	if err != nil {
+		return 0, false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return h.Sum64(), true
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+// upstream is a client connection to a single Lotus node. When the node
+// cannot be reached the upstream reconnects in the background, and calls wait
+// a bounded time for the connection before failing.
+type upstream struct {
+	addr   string
+	api    *lotusapi.StorageMinerStruct // calls through the current connection
+	full   *lotusapi.FullNodeStruct     // full node calls through the current connection
+	invoke Invoker
+
+	httpURL   string // rpc endpoint for raw calls over http
+	flagToken bool   // authenticates with the token given by flag, which may rotate
+
+	healthy  int32           // 1 unless the last health probe failed
+	weight   int32           // relative share of calls, adjustable at runtime
+	latency  ewma            // call latency in nanoseconds
+	breaker  *circuitBreaker // optional
+	limiter  *callLimiter    // optional
+	streams  int32           // open subscription channels
+	inflight int32           // calls being answered
+	draining int32           // 1 once removed from the pool, until closed
+	height   int64           // chain head height, 0 when unknown
+
+	slowStart time.Duration // time taken to ramp up to full weight after recovering
+	warmStart int64         // unix nanoseconds the upstream last recovered at, 0 if never
+
+	drillUntil int64       // unix nanoseconds a failure drill ends at, 0 if none
+	drillTimer *time.Timer // restores the upstream after a drill, guarded by mu
+
+	dial      func() (*upstreamConn, jsonrpc.ClientCloser, error)
+	reconnect backoff
+	wait      time.Duration // time calls wait for a connection
+
+	mu         sync.Mutex
+	headers    http.Header // sent with every call, replaced when the token rotates
+	conn       *upstreamConn
+	connCloser jsonrpc.ClientCloser
+	connected  chan struct{} // closed once conn is set
+	done       chan struct{} // closed by close
+}
+
+func newUpstream(authToken string, api apiInfo, tc transportConfig) (*upstream, error) {
+	if err := tc.check(api); err != nil {
+		return nil, err
+	}
+	addr := api.addr
+	headers := http.Header{}
+	if authToken != "" {
+		headers.Set("Authorization", "Bearer "+authToken)
+	}
+	pushUrl, err := getPushUrl(tc.rpcURL(api, "/rpc/v0"))
+	if err != nil {
+		return nil, fmt.Errorf("connecting with lotus as stream failed: %w", err)
+	}
+
+	u := &upstream{
+		addr:      addr,
+		httpURL:   httpRPCURL(api),
+		headers:   headers,
+		healthy:   1,
+		weight:    1,
+		reconnect: tc.reconnect,
+		wait:      tc.reconnectWait,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	u.dial = func() (*upstreamConn, jsonrpc.ClientCloser, error) {
+		var conn upstreamConn
+		closer, err := jsonrpc.NewMergeClient(
+			context.Background(),
+			tc.rpcURL(api, "/rpc/v0"), api.rpcNamespace(),
+			append(lotusapi.GetInternalStructs(&conn.miner), lotusapi.GetInternalStructs(&conn.full)...),
+			u.header(),
+			ReaderParamEncoder(pushUrl),
+			jsonrpc.WithReconnectBackoff(tc.reconnect.minDelay, tc.reconnect.maxDelay),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &conn, closer, nil
+	}
+	u.invoke = u.invokeConn
+	u.api = &lotusapi.StorageMinerStruct{}
+	proxyAPI(u.invoke, u.api)
+	u.full = &lotusapi.FullNodeStruct{}
+	proxyAPI(u.invoke, u.full)
+
+	if !u.connect(0) {
+		go u.redial()
+	}
+	return u, nil
+}
+
+var errUpstreamDisconnected = errors.New("upstream node is not connected")
+
+// upstreamConn is a client of a lotus node covering both the miner and the
+// full node APIs, so that an upstream can serve any backend group.
+type upstreamConn struct {
+	miner lotusapi.StorageMinerStruct
+	full  lotusapi.FullNodeStruct
+}
+
+// invoke calls the method named by the call on the miner API, or on the full
+// node API for methods the miner API lacks.
+func (c *upstreamConn) invoke(ctx context.Context, call *Call) []reflect.Value {
+	if _, ok := reflect.TypeOf(&c.miner).MethodByName(call.Method); ok {
+		return methodInvoker(&c.miner)(ctx, call)
+	}
+	return methodInvoker(&c.full)(ctx, call)
+}
+
+// invokeConn invokes the call on the current connection, waiting for one to
+// be established if necessary.
+func (u *upstream) invokeConn(ctx context.Context, call *Call) []reflect.Value {
+	u.mu.Lock()
+	conn, connected := u.conn, u.connected
+	u.mu.Unlock()
+
+	if conn == nil {
+		timer := time.NewTimer(u.wait)
+		defer timer.Stop()
+
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return call.errorResult(ctx.Err())
+		case <-timer.C:
+			return call.errorResult(errUpstreamDisconnected)
+		case <-u.done:
+			return call.errorResult(errUpstreamDisconnected)
+		}
+
+		u.mu.Lock()
+		conn = u.conn
+		u.mu.Unlock()
+	}
+	return conn.invoke(ctx, call)
+}
+
+// connect dials the node once and reports whether it succeeded. Once
+// connected, the rpc client itself reconnects dropped websockets using the
+// same backoff.
+func (u *upstream) connect(attempt int) bool {
+	conn, closer, err := u.dial()
+	if err != nil {
+		log.Println("failed to connect to upstream", "upstream", u.addr, "attempt", attempt, "error", err)
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.done:
+		closer()
+		return true
+	default:
+	}
+	if u.conn != nil {
+		// A redial raced the one of setToken, which dialed last.
+		u.connCloser()
+		u.conn, u.connCloser = conn, closer
+		return true
+	}
+	u.conn, u.connCloser = conn, closer
+	close(u.connected)
+	if attempt > 0 {
+		log.Println("connected to upstream", "upstream", u.addr)
+	}
+	return true
+}
+
+// redial connects to the node with backoff until it succeeds or the upstream
+// is closed.
+func (u *upstream) redial() {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-u.done:
+			return
+		case <-time.After(u.reconnect.next(attempt - 1)):
+		}
+		if u.connect(attempt) {
+			return
+		}
+	}
+}
+
+// header returns the headers to send with calls.
+func (u *upstream) header() http.Header {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.headers.Clone()
+}
+
+// setToken makes the upstream authenticate with token from now on. It
+// connects again with it, and the calls and subscriptions left on the
+// previous connection fail over.
+func (u *upstream) setToken(token string) {
+	headers := http.Header{}
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	u.mu.Lock()
+	select {
+	case <-u.done:
+		u.mu.Unlock()
+		return
+	default:
+	}
+	u.headers = headers
+	closer := u.connCloser
+	u.conn, u.connCloser, u.connected = nil, nil, make(chan struct{})
+	u.mu.Unlock()
+
+	if closer != nil {
+		closer()
+	}
+	if !u.connect(0) {
+		go u.redial()
+	}
+}
+
+func (u *upstream) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.done:
+		return
+	default:
+	}
+	close(u.done)
+	if u.connCloser != nil {
+		u.connCloser()
+	}
+}
+
+func (u *upstream) getWeight() int {
+	return int(atomic.LoadInt32(&u.weight))
+}
+
+func (u *upstream) setWeight(w int) {
+	atomic.StoreInt32(&u.weight, int32(w))
+}
+
+// upstreamStatus describes the current state of an upstream.
+type upstreamStatus struct {
+	Addr      string  `json:"addr"`
+	Healthy   bool    `json:"healthy"`
+	Weight    int     `json:"weight"`
+	LatencyMs float64 `json:"latency_ms"`
+	Breaker   string  `json:"breaker"`
+	InFlight  int     `json:"in_flight"`
+	Streams   int     `json:"streams"`
+	Draining  bool    `json:"draining"`
+	Height    int64   `json:"height,omitempty"`
+	Warmth    float64 `json:"warmth"` // fraction of its weight given while warming up
+
+	DrillUntil *time.Time `json:"drill_until,omitempty"` // end of a running failure drill
+}
+
+func (u *upstream) status() upstreamStatus {
+	return upstreamStatus{
+		Addr:      u.addr,
+		Healthy:   u.isHealthy(),
+		Weight:    u.getWeight(),
+		LatencyMs: u.latency.value() / float64(time.Millisecond),
+		Breaker:   u.breakerState(),
+		InFlight:  int(atomic.LoadInt32(&u.inflight)),
+		Streams:   int(atomic.LoadInt32(&u.streams)),
+		Draining:  atomic.LoadInt32(&u.draining) == 1,
+		Height:    u.headHeight(),
+		Warmth:    u.warmth(time.Now()),
+
+		DrillUntil: u.drillEnd(),
+	}
+}
+
+// ready reports whether the circuit breaker of the upstream would let a call
+// through and no failure drill is running on it.
+func (u *upstream) ready() bool {
+	return !u.drilling() && u.breaker.ready()
+}
+
+// breakerState names the state of the circuit breaker of the upstream, which
+// a failure drill forces open.
+func (u *upstream) breakerState() string {
+	if u.drilling() {
+		return "forced-open"
+	}
+	return u.breaker.stateName()
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadInt32(&u.healthy) == 1
+}
+
+// setHealthy records the outcome of a health probe and reports whether it
+// changed the health of the upstream.
+func (u *upstream) setHealthy(ok bool) bool {
+	var v int32
+	if ok {
+		v = 1
+	}
+	return atomic.SwapInt32(&u.healthy, v) != v
+}
+
+// upstreamPool distributes calls across a set of upstream nodes using a
+// balancer, skipping nodes that are unhealthy. Calls that fail because an
+// upstream could not be reached are retried on the remaining nodes.
+//
+// When a writer is configured, only methods that require read permission are
+// balanced across the upstreams and all other methods are sent to the writer.
+//
+// The balanced upstreams may be replaced at runtime, for example by service
+// discovery.
+type upstreamPool struct {
+	cfg        poolConfig
+	writer     *upstream // optional
+	balancer   balancer
+	hedgeDelay time.Duration
+
+	quorumMethods methodRules
+	quorumSize    int
+	maxHeadLag    int64 // epochs an upstream may lag the best one, 0 to ignore heads
+
+	fallback        *upstream // optional
+	fallbackMethods methodRules
+
+	retry *retryPolicy
+
+	mu        sync.RWMutex
+	authToken string      // used for nodes given without a token
+	upstreams []*upstream // replaced, never modified in place
+	drained   map[*upstream]bool
+}
+
+// poolConfig configures the upstream nodes and how calls are routed to them.
+type poolConfig struct {
+	authToken  string // used for nodes given without a token
+	apis       []apiInfo
+	writeAPI   *apiInfo // optional
+	balancer   balancer
+	hedgeDelay time.Duration // zero disables hedging
+	breaker    breakerConfig
+	limits     upstreamLimits
+	transport  transportConfig
+	weights    map[string]int // initial weight by address, 1 when absent
+
+	quorumMethods []string // read methods answered by a majority of upstreams
+	quorumSize    int      // number of upstreams asked for quorum reads
+	maxHeadLag    int64    // epochs an upstream may lag the best one, 0 to ignore heads
+	slowStart     time.Duration
+
+	fallbackAPI     *apiInfo // optional last resort node, such as a public gateway
+	fallbackMethods []string // read methods that may be sent to the fallback node
+
+	retry retryConfig
+
+	heatmap   *latencyHeatmap   // optional, shared by the pools of all groups
+	exemplars *latencyExemplars // optional, shared by the pools of all groups
+}
+
+func newUpstreamPool(cfg poolConfig) (*upstreamPool, error) {
+	if len(cfg.apis) == 0 {
+		return nil, fmt.Errorf("no upstream addresses configured")
+	}
+
+	p := &upstreamPool{
+		cfg:        cfg,
+		authToken:  cfg.authToken,
+		balancer:   cfg.balancer,
+		hedgeDelay: cfg.hedgeDelay,
+		quorumSize: cfg.quorumSize,
+		drained:    map[*upstream]bool{},
+	}
+	quorumMethods, err := parseMethodRules(cfg.quorumMethods)
+	if err != nil {
+		return nil, err
+	}
+	p.quorumMethods = quorumMethods
+	p.retry = newRetryPolicy(cfg.retry)
+	for _, api := range cfg.apis {
+		u, err := p.newMember(api)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	if cfg.writeAPI != nil {
+		u, err := p.newMember(*cfg.writeAPI)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.writer = u
+	}
+
+	if cfg.fallbackAPI != nil {
+		if err := p.setFallback(*cfg.fallbackAPI, cfg.fallbackMethods); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// newMember connects to an upstream configured like the rest of the pool.
+func (p *upstreamPool) newMember(api apiInfo) (*upstream, error) {
+	p.mu.RLock()
+	token := p.authToken
+	p.mu.RUnlock()
+	u, err := newUpstream(api.tokenOr(token), api, p.cfg.transport)
+	if err != nil {
+		return nil, err
+	}
+	u.flagToken = api.token == ""
+	u.breaker = newCircuitBreaker(p.cfg.breaker, u.addr)
+	u.limiter = newCallLimiter(p.cfg.limits)
+	u.slowStart = p.cfg.slowStart
+	if w, ok := p.cfg.weights[api.addr]; ok {
+		u.setWeight(w)
+	}
+	return u, nil
+}
+
+// setAuthToken replaces the token of the upstreams given without one, as
+// when the token given by flag rotates.
+func (p *upstreamPool) setAuthToken(token string) {
+	p.mu.Lock()
+	p.authToken = token
+	p.mu.Unlock()
+	for _, u := range p.all() {
+		if u.flagToken {
+			u.setToken(token)
+		}
+	}
+}
+
+// readers returns the upstreams that read calls are balanced across.
+func (p *upstreamPool) readers() []*upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.upstreams
+}
+
+// all returns every upstream in the pool, including the writer.
+func (p *upstreamPool) all() []*upstream {
+	upstreams := p.readers()
+	if p.writer == nil {
+		return upstreams
+	}
+	return append(upstreams[:len(upstreams):len(upstreams)], p.writer)
+}
+
+// setAPIs replaces the balanced upstreams with the given nodes. Upstreams
+// that remain keep their connection and state, and those that were removed
+// are drained.
+func (p *upstreamPool) setAPIs(apis []apiInfo) error {
+	current := map[string]*upstream{}
+	for _, u := range p.readers() {
+		current[u.addr] = u
+	}
+
+	var upstreams, added []*upstream
+	seen := map[string]bool{}
+	for _, api := range apis {
+		if seen[api.addr] {
+			continue
+		}
+		seen[api.addr] = true
+		if u, ok := current[api.addr]; ok {
+			upstreams = append(upstreams, u)
+			delete(current, api.addr)
+			continue
+		}
+		u, err := p.newMember(api)
+		if err != nil {
+			for _, u := range added {
+				u.close()
+			}
+			return err
+		}
+		upstreams = append(upstreams, u)
+		added = append(added, u)
+	}
+	for _, u := range added {
+		log.Println("adding upstream", "upstream", u.addr)
+	}
+
+	p.mu.Lock()
+	p.upstreams = upstreams
+	p.mu.Unlock()
+
+	for _, u := range current {
+		log.Println("removing upstream", "upstream", u.addr)
+		p.retire(u)
+	}
+	return nil
+}
+
+// pick returns the upstream that should serve the next call, excluding those
+// already tried or whose circuit breaker is open. Unhealthy upstreams are only
+// returned when no healthy one remains. It returns nil when no upstream is
+// left.
+func (p *upstreamPool) pick(tried map[*upstream]bool) *upstream {
+	candidates := p.candidates(tried)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return p.balancer.choose(candidates)
+}
+
+// candidates returns the healthy upstreams that may serve the next call, or
+// the unhealthy ones when no healthy one remains.
+func (p *upstreamPool) candidates(tried map[*upstream]bool) []*upstream {
+	var healthy, unhealthy []*upstream
+	best := p.bestHeight()
+	for _, u := range p.readers() {
+		if tried[u] || !u.ready() || p.lagging(u, best) {
+			continue
+		}
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return unhealthy
+}
+
+// invoke sends the call to the upstreams of the pool, retrying it as the
+// retry policy allows.
+func (p *upstreamPool) invoke(ctx context.Context, call *Call) []reflect.Value {
+	return p.retry.do(ctx, call, func() []reflect.Value {
+		return p.route(ctx, call)
+	})
+}
+
+// route sends the call to the upstreams that should serve it.
+func (p *upstreamPool) route(ctx context.Context, call *Call) []reflect.Value {
+	if p.writer != nil && !call.readOnly() {
+		return p.call(ctx, p.writer, call)
+	}
+	if p.useFallback(call) {
+		return p.callFallback(ctx, call)
+	}
+	if p.quorumMethods.match(call.Method) && call.readOnly() && !call.returnsChannel() {
+		return p.quorum(ctx, call)
+	}
+	if call.streams() {
+		return p.sticky(ctx, call)
+	}
+	if p.maxHeadLag > 0 && call.headRelative() {
+		return p.failover(ctx, call, p.pickSynced)
+	}
+	if p.hedgeDelay > 0 && call.readOnly() && !call.returnsChannel() && len(p.readers()) > 1 {
+		return p.hedge(ctx, call)
+	}
+	return p.failover(ctx, call, p.pick)
+}
+
+// failover sends the call to the upstreams returned by pick in turn until
+// one answers it. Calls that are not idempotent are only sent to another
+// upstream when they did not reach the previous one.
+func (p *upstreamPool) failover(ctx context.Context, call *Call, pick func(tried map[*upstream]bool) *upstream) []reflect.Value {
+	tried := map[*upstream]bool{}
+
+	var results []reflect.Value
+	for u := pick(tried); u != nil; u = pick(tried) {
+		tried[u] = true
+		results = p.call(ctx, u, call)
+
+		err := resultError(results)
+		if !shouldFailover(err) || ctx.Err() != nil {
+			return results
+		}
+		if !notSent(err) && !p.retry.idempotentCall(call) {
+			log.Println("upstream call failed, not retrying", "upstream", u.addr, "method", call.Method, "error", err)
+			return results
+		}
+		log.Println("upstream call failed", "upstream", u.addr, "method", call.Method, "error", err)
+	}
+	if results == nil {
+		return call.errorResult(errNoUpstream)
+	}
+	return results
+}
+
+// hedge sends a read call to one upstream and, if it has not answered within
+// the hedge delay, to a second one as well. The first answer that is not a
+// transport failure wins and the other call is cancelled.
+func (p *upstreamPool) hedge(ctx context.Context, call *Call) []reflect.Value {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tried := map[*upstream]bool{}
+	ch := make(chan []reflect.Value, 2)
+	start := func(u *upstream) {
+		tried[u] = true
+		go func() {
+			ch <- p.call(ctx, u, call)
+		}()
+	}
+
+	first := p.pick(tried)
+	if first == nil {
+		return call.errorResult(errNoUpstream)
+	}
+	start(first)
+	pending := 1
+
+	timer := time.NewTimer(p.hedgeDelay)
+	defer timer.Stop()
+
+	var results []reflect.Value
+	select {
+	case results = <-ch:
+		pending--
+		if !shouldFailover(resultError(results)) {
+			return results
+		}
+	case <-timer.C:
+	}
+
+	if u := p.pick(tried); u != nil {
+		start(u)
+		pending++
+	}
+
+	for ; pending > 0; pending-- {
+		results = <-ch
+		if !shouldFailover(resultError(results)) {
+			return results
+		}
+	}
+	return results
+}
+
+// call invokes the call on a single upstream, subject to its circuit
+// breaker.
+func (p *upstreamPool) call(ctx context.Context, u *upstream, call *Call) []reflect.Value {
+	callInfoFrom(ctx).setUpstream(u.addr)
+	release, err := u.limiter.acquire(upstreamContext(ctx, u.addr), call)
+	if err != nil {
+		return call.errorResult(err)
+	}
+	defer release()
+	if u.drilling() {
+		return call.errorResult(errCircuitOpen)
+	}
+	generation, ok := u.breaker.allow()
+	if !ok {
+		return call.errorResult(errCircuitOpen)
+	}
+
+	stop := startTimer(upstreamContext(ctx, u.addr), upstreamDuration)
+	start := time.Now()
+	atomic.AddInt32(&u.inflight, 1)
+	results := u.invoke(ctx, call)
+	atomic.AddInt32(&u.inflight, -1)
+	stop()
+
+	// Calls cut short by their client say nothing of how fast the upstream
+	// answers.
+	if !clientGone(ctx) {
+		u.latency.observe(float64(time.Since(start)))
+		p.cfg.heatmap.observe(call.Method, u.addr, time.Since(start))
+		p.cfg.exemplars.observe(ctx, u.addr, time.Since(start))
+	}
+	if ctx.Err() != nil {
+		u.breaker.abandon(generation)
+	} else {
+		u.breaker.record(generation, !isTransportError(resultError(results)))
+	}
+	return results
+}
+
+var errNoUpstream = errors.New("no upstream node available")
+
+// find returns the upstream with the given address, or nil.
+func (p *upstreamPool) find(addr string) *upstream {
+	for _, u := range p.all() {
+		if u.addr == addr {
+			return u
+		}
+	}
+	return nil
+}
+
+// isTransportError reports whether err was raised by the rpc client rather
+// than returned by the upstream node.
+func isTransportError(err error) bool {
+	var clientErr *jsonrpc.ErrClient
+	return errors.As(err, &clientErr) || errors.Is(err, errUpstreamDisconnected)
+}
+
+// shouldFailover reports whether a call that failed with err should be
+// retried on another upstream.
+func shouldFailover(err error) bool {
+	return isTransportError(err) || errors.Is(err, errCircuitOpen)
+}
+
+func (p *upstreamPool) close() {
+	for _, u := range p.all() {
+		u.close()
+	}
+	for _, u := range p.draining() {
+		u.close()
+	}
+	if p.fallback != nil {
+		p.fallback.close()
+	}
+}
+
+// parseWeights parses values of the form <address>=<weight>.
+func parseWeights(values []string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, v := range upstreamAddrs(values) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid upstream weight %q, expected <address>=<weight>", v)
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid upstream weight %q", v)
+		}
+		weights[parts[0]] = w
+	}
+	return weights, nil
+}
+
+// upstreamAddrs flattens repeated and comma separated address flag values.
+func upstreamAddrs(values []string) []string {
+	var addrs []string
+	for _, v := range values {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	lotusapi "github.com/filecoin-project/lotus/api"
+)
+
+const (
+	// upstreamAuthNegativeTTL is how long tokens the upstream node rejected
+	// are remembered, sparing it repeated checks of the same bad token.
+	upstreamAuthNegativeTTL = 10 * time.Second
+	// maxUpstreamAuthEntries bounds the verifications remembered.
+	maxUpstreamAuthEntries = 10000
+)
+
+// upstreamAuthenticator accepts tokens that the upstream node verifies with
+// AuthVerify, such as those created by lotus auth create-token, so that the
+// proxy needs no copy of the secret of the node. Verifications are
+// remembered for ttl.
+type upstreamAuthenticator struct {
+	api lotusapi.StorageMiner
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]upstreamAuthEntry // by hash of the token
+}
+
+type upstreamAuthEntry struct {
+	allow   []string // nil when the node rejected the token
+	expires time.Time
+}
+
+func newUpstreamAuthenticator(api lotusapi.StorageMiner, ttl time.Duration) *upstreamAuthenticator {
+	return &upstreamAuthenticator{
+		api:     api,
+		ttl:     ttl,
+		entries: map[string]upstreamAuthEntry{},
+	}
+}
+
+func (a *upstreamAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	hash := tokenHash(token)
+	now := time.Now()
+
+	a.mu.Lock()
+	e, ok := a.entries[hash]
+	a.mu.Unlock()
+	if !ok || !now.Before(e.expires) {
+		perms, err := a.api.AuthVerify(ctx, token)
+		switch {
+		case err == nil:
+			e = upstreamAuthEntry{allow: []string{}, expires: now.Add(a.ttl)}
+			for _, p := range perms {
+				e.allow = append(e.allow, string(p))
+			}
+		case shouldFailover(err), errors.Is(err, errNoUpstream), ctx.Err() != nil:
+			// Not the token's fault, so not remembered.
+			return nil, fmt.Errorf("cannot verify token: %w", err)
+		default:
+			e = upstreamAuthEntry{expires: now.Add(upstreamAuthNegativeTTL)}
+		}
+		a.remember(hash, e, now)
+	}
+
+	if e.allow == nil {
+		return nil, errUnrecognizedToken
+	}
+	return &identity{payload: &jwtPayload{Allow: e.allow}}, nil
+}
+
+// remember records a verification, forgetting expired ones when there are
+// too many.
+func (a *upstreamAuthenticator) remember(hash string, e upstreamAuthEntry, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) >= maxUpstreamAuthEntries {
+		for h, old := range a.entries {
+			if !now.Before(old.expires) {
+				delete(a.entries, h)
+			}
+		}
+		if len(a.entries) >= maxUpstreamAuthEntries {
+			return
+		}
+	}
+	a.entries[hash] = e
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/gorilla/mux"
+	"go.opencensus.io/tag"
+)
+
+var errWalletPolicy = errors.New("rejected by the wallet policy")
+
+// defaultWalletMethods are the wallet methods served when the policy does not
+// list its own: those that neither create, export nor delete keys.
+var defaultWalletMethods = []string{"WalletHas", "WalletList", "WalletSign"}
+
+// walletPolicyConfig is the policy file given by --wallet-policy.
+type walletPolicyConfig struct {
+	// Methods are the method rules of the wallet methods served.
+	Methods []string `json:"methods"`
+	// SignTypes are the types of data WalletSign may sign, such as message
+	// or block. Signing raw bytes, of type unknown, escapes every check of
+	// the policy.
+	SignTypes []string `json:"sign_types"`
+	// Addresses are the limits of the addresses that may sign, with * for
+	// the addresses not listed. Other addresses may not sign.
+	Addresses map[string]walletAddressConfig `json:"addresses"`
+}
+
+type walletAddressConfig struct {
+	// SpendLimit is the FIL the messages signed within Window may move and
+	// spend on gas at most, empty for no limit.
+	SpendLimit string `json:"spend_limit"`
+	Window     string `json:"window"`
+	// Destinations are the addresses messages may be sent to, empty for any.
+	Destinations []string `json:"destinations"`
+}
+
+// walletLimits are the limits of an address of the policy.
+type walletLimits struct {
+	limit        big.Int // nil for no limit
+	window       time.Duration
+	destinations map[string]bool // nil for any
+}
+
+type walletSpend struct {
+	At     time.Time `json:"at"`
+	Amount big.Int   `json:"amount"`
+}
+
+// walletPolicy guards a wallet served through the proxy, so that automation
+// holding a token can sign only what the policy allows: some methods, some
+// types of data, and messages from some addresses to some destinations within
+// a spend limit.
+type walletPolicy struct {
+	methods   methodRules
+	signTypes map[string]bool
+	addresses map[string]*walletLimits
+
+	mu        sync.Mutex
+	spent     map[string][]*walletSpend // by signer, within its window
+	spentPath string                    // file spent is kept in, if any
+}
+
+// loadWalletPolicy reads the policy file at path, and the spends kept in
+// spentPath, which may be empty to keep them in memory only.
+func loadWalletPolicy(path, spentPath string) (*walletPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg walletPolicyConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse wallet policy %s: %w", path, err)
+	}
+	p, err := newWalletPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if spentPath == "" {
+		return p, nil
+	}
+	p.spentPath = spentPath
+	b, err = ioutil.ReadFile(spentPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.spent); err != nil {
+		return nil, fmt.Errorf("parse wallet spends %s: %w", spentPath, err)
+	}
+	return p, nil
+}
+
+// persist writes the spends to their file and must be called with the lock
+// held.
+func (p *walletPolicy) persist() error {
+	if p.spentPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(p.spent)
+	if err != nil {
+		return err
+	}
+
+	tmp := p.spentPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write wallet spends: %w", err)
+	}
+	if err := os.Rename(tmp, p.spentPath); err != nil {
+		return fmt.Errorf("write wallet spends: %w", err)
+	}
+	return nil
+}
+
+func newWalletPolicy(cfg walletPolicyConfig) (*walletPolicy, error) {
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = defaultWalletMethods
+	}
+	methods, err := parseMethodRules(cfg.Methods)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.SignTypes) == 0 {
+		cfg.SignTypes = []string{string(lotusapi.MTChainMsg)}
+	}
+	p := &walletPolicy{
+		methods:   methods,
+		signTypes: map[string]bool{},
+		addresses: map[string]*walletLimits{},
+		spent:     map[string][]*walletSpend{},
+	}
+	for _, t := range cfg.SignTypes {
+		p.signTypes[t] = true
+	}
+	for a, c := range cfg.Addresses {
+		key := a
+		if a != "*" {
+			addr, err := address.NewFromString(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q in wallet policy: %w", a, err)
+			}
+			key = addr.String()
+		}
+		limits := &walletLimits{}
+		if c.SpendLimit != "" {
+			fil, err := types.ParseFIL(c.SpendLimit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid spend limit of %s: %w", a, err)
+			}
+			limits.limit = big.Int(fil)
+			if limits.window, err = time.ParseDuration(c.Window); err != nil || limits.window <= 0 {
+				return nil, fmt.Errorf("spend limit of %s needs a positive window", a)
+			}
+		}
+		if len(c.Destinations) > 0 {
+			limits.destinations = map[string]bool{}
+			for _, d := range c.Destinations {
+				addr, err := address.NewFromString(d)
+				if err != nil {
+					return nil, fmt.Errorf("invalid destination %q of %s: %w", d, a, err)
+				}
+				limits.destinations[addr.String()] = true
+			}
+		}
+		p.addresses[key] = limits
+	}
+	return p, nil
+}
+
+// limits returns the limits of signer, or nil when it may not sign.
+func (p *walletPolicy) limits(signer address.Address) *walletLimits {
+	if l, ok := p.addresses[signer.String()]; ok {
+		return l
+	}
+	return p.addresses["*"]
+}
+
+// check rejects the signature of toSign by signer unless the policy allows
+// it. For messages it reserves their spend within the window of signer, and
+// returns the function releasing it should the signature fail.
+func (p *walletPolicy) check(signer address.Address, toSign []byte, meta lotusapi.MsgMeta, now time.Time) (func(), error) {
+	limits := p.limits(signer)
+	if limits == nil {
+		return nil, fmt.Errorf("%s may not sign: %w", signer, errWalletPolicy)
+	}
+	if !p.signTypes[string(meta.Type)] {
+		return nil, fmt.Errorf("signing %q data: %w", meta.Type, errWalletPolicy)
+	}
+	if meta.Type != lotusapi.MTChainMsg {
+		return func() {}, nil
+	}
+
+	msg, err := types.DecodeMessage(meta.Extra)
+	if err != nil {
+		return nil, fmt.Errorf("decode message to sign: %w", err)
+	}
+	// The bytes signed are those of the message cid, which must be the cid
+	// of the message checked.
+	if !bytes.Equal(msg.Cid().Bytes(), toSign) {
+		return nil, fmt.Errorf("data signed is not the message given: %w", errWalletPolicy)
+	}
+	if limits.destinations != nil && !limits.destinations[msg.To.String()] {
+		return nil, fmt.Errorf("%s may not send to %s: %w", signer, msg.To, errWalletPolicy)
+	}
+	if limits.limit.Nil() {
+		return func() {}, nil
+	}
+
+	spend := &walletSpend{At: now, Amount: big.Add(msg.Value, msg.RequiredFunds())}
+	key := signer.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := spend.Amount
+	kept := p.spent[key][:0]
+	for _, s := range p.spent[key] {
+		if now.Sub(s.At) < limits.window {
+			kept = append(kept, s)
+			total = big.Add(total, s.Amount)
+		}
+	}
+	p.spent[key] = kept
+	if total.GreaterThan(limits.limit) {
+		return nil, fmt.Errorf("%s would spend %s within %s, over its limit of %s: %w",
+			signer, types.FIL(total), limits.window, types.FIL(limits.limit), errWalletPolicy)
+	}
+	p.spent[key] = append(kept, spend)
+	// A spend that cannot be kept would be forgotten on restart, so the
+	// message is not signed.
+	if err := p.persist(); err != nil {
+		p.spent[key] = kept
+		return nil, err
+	}
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		spends := p.spent[key]
+		for i, s := range spends {
+			if s == spend {
+				p.spent[key] = append(spends[:i], spends[i+1:]...)
+				if err := p.persist(); err != nil {
+					log.Println("failed to release wallet spend", "signer", key, "error", err)
+				}
+				return
+			}
+		}
+	}, nil
+}
+
+// interceptor rejects the calls the policy does not allow.
+func (p *walletPolicy) interceptor(next Invoker) Invoker {
+	return func(ctx context.Context, call *Call) []reflect.Value {
+		if !p.methods.match(call.Method) {
+			return p.reject(ctx, call, fmt.Errorf("%s: %w", call.Method, errWalletPolicy))
+		}
+		if call.Method != "WalletSign" || len(call.Args) != 3 {
+			return next(ctx, call)
+		}
+		signer, _ := call.Args[0].Interface().(address.Address)
+		toSign, _ := call.Args[1].Interface().([]byte)
+		meta, _ := call.Args[2].Interface().(lotusapi.MsgMeta)
+		release, err := p.check(signer, toSign, meta, time.Now())
+		if err != nil {
+			return p.reject(ctx, call, err)
+		}
+		results := next(ctx, call)
+		if resultError(results) != nil {
+			release()
+		}
+		return results
+	}
+}
+
+func (p *walletPolicy) reject(ctx context.Context, call *Call, err error) []reflect.Value {
+	mctx, _ := tag.New(ctx, tag.Upsert(methodTag, call.Method))
+	reportEvent(mctx, walletRejected)
+	log.Println("wallet call rejected", "method", call.Method, "owner", tokenOwner(ctx), "error", err)
+	return call.errorResult(err)
+}
+
+// walletNode is a lotus wallet, such as lotus-wallet, served through the
+// proxy under its policy.
+type walletNode struct {
+	handler http.Handler
+	closer  jsonrpc.ClientCloser
+}
+
+// newWalletNode connects to the wallet api and serves it through
+// interceptors and policy.
+func newWalletNode(authToken string, api apiInfo, tc transportConfig, policy *walletPolicy, interceptors ...Interceptor) (*walletNode, error) {
+	if err := tc.check(api); err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	if authToken != "" {
+		headers.Set("Authorization", "Bearer "+authToken)
+	}
+	var client lotusapi.WalletStruct
+	closer, err := jsonrpc.NewMergeClient(
+		context.Background(),
+		tc.rpcURL(api, "/rpc/v0"), api.rpcNamespace(),
+		lotusapi.GetInternalStructs(&client),
+		headers,
+		jsonrpc.WithReconnectBackoff(tc.reconnect.minDelay, tc.reconnect.maxDelay),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connect to wallet: %w", err)
+	}
+
+	var served lotusapi.WalletStruct
+	proxyAPI(methodInvoker(&client), &served, append(interceptors, policy.interceptor)...)
+
+	srv := jsonrpc.NewServer()
+	srv.Register("Filecoin", &served)
+	return &walletNode{handler: srv, closer: closer}, nil
+}
+
+// route registers the wallet api under /wallet/.
+func (w *walletNode) route(r *mux.Router) {
+	r.Handle("/wallet/rpc/v0", ClassifyErrors(w.handler))
+	r.Handle("/wallet/rpc/v1", ClassifyErrors(w.handler))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func mustIDAddress(t *testing.T, id uint64) address.Address {
+	t.Helper()
+	a, err := address.NewIDAddress(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// walletMessage returns the bytes signed for a message from from to to
+// moving fil, and its meta.
+func walletMessage(t *testing.T, from, to address.Address, fil string) ([]byte, lotusapi.MsgMeta) {
+	t.Helper()
+	value, err := types.ParseFIL(fil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &types.Message{
+		From:       from,
+		To:         to,
+		Value:      big.Int(value),
+		GasLimit:   0,
+		GasFeeCap:  big.Zero(),
+		GasPremium: big.Zero(),
+	}
+	extra, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Cid().Bytes(), lotusapi.MsgMeta{Type: lotusapi.MTChainMsg, Extra: extra}
+}
+
+func testWalletPolicyConfig(signer, dest address.Address) walletPolicyConfig {
+	return walletPolicyConfig{
+		Addresses: map[string]walletAddressConfig{
+			signer.String(): {SpendLimit: "10", Window: "1h", Destinations: []string{dest.String()}},
+		},
+	}
+}
+
+func TestWalletPolicyCheck(t *testing.T) {
+	signer, dest, other := mustIDAddress(t, 1000), mustIDAddress(t, 1001), mustIDAddress(t, 1002)
+	now := time.Now()
+
+	toSign, meta := walletMessage(t, signer, dest, "4")
+	otherBytes, _ := walletMessage(t, signer, dest, "5")
+	elsewhere, elsewhereMeta := walletMessage(t, signer, other, "1")
+	unlisted, unlistedMeta := walletMessage(t, other, dest, "1")
+
+	tests := []struct {
+		name   string
+		signer address.Address
+		toSign []byte
+		meta   lotusapi.MsgMeta
+		ok     bool
+	}{
+		{"within limit", signer, toSign, meta, true},
+		{"unlisted signer", other, unlisted, unlistedMeta, false},
+		{"other destination", signer, elsewhere, elsewhereMeta, false},
+		{"bytes of another message", signer, otherBytes, meta, false},
+		{"block signing", signer, toSign, lotusapi.MsgMeta{Type: lotusapi.MTBlock}, false},
+		{"raw bytes", signer, []byte("anything"), lotusapi.MsgMeta{Type: lotusapi.MTUnknown}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newWalletPolicy(testWalletPolicyConfig(signer, dest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.check(tt.signer, tt.toSign, tt.meta, now)
+			if tt.ok && err != nil {
+				t.Errorf("check: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, errWalletPolicy) {
+				t.Errorf("error = %v, want %v", err, errWalletPolicy)
+			}
+		})
+	}
+}
+
+func TestWalletPolicySpendLimit(t *testing.T) {
+	signer, dest := mustIDAddress(t, 1000), mustIDAddress(t, 1001)
+	p, err := newWalletPolicy(testWalletPolicyConfig(signer, dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	toSign, meta := walletMessage(t, signer, dest, "4")
+
+	steps := []struct {
+		name    string
+		at      time.Time
+		release bool // the signature then fails
+		ok      bool
+	}{
+		{"first", now, false, true},
+		{"second", now.Add(time.Minute), false, true},
+		{"over the limit", now.Add(2 * time.Minute), false, false},
+		{"after the first leaves the window", now.Add(time.Hour), true, true},
+		{"once released", now.Add(time.Hour + time.Minute), false, true},
+		{"within the new window", now.Add(time.Hour + 2*time.Minute), false, true},
+		{"over the limit again", now.Add(time.Hour + 3*time.Minute), false, false},
+	}
+	for _, s := range steps {
+		release, err := p.check(signer, toSign, meta, s.at)
+		if s.ok != (err == nil) {
+			t.Fatalf("%s: error = %v, want ok %v", s.name, err, s.ok)
+		}
+		if err == nil && s.release {
+			release()
+		}
+	}
+}
+
+func TestWalletPolicySpendsSurviveRestart(t *testing.T) {
+	signer, dest := mustIDAddress(t, 1000), mustIDAddress(t, 1001)
+	dir := t.TempDir()
+	policyPath, spentPath := filepath.Join(dir, "policy.json"), filepath.Join(dir, "spent.json")
+	cfg, err := json.Marshal(testWalletPolicyConfig(signer, dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(policyPath, cfg, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	toSign, meta := walletMessage(t, signer, dest, "6")
+	p, err := loadWalletPolicy(policyPath, spentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.check(signer, toSign, meta, now); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := loadWalletPolicy(policyPath, spentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.check(signer, toSign, meta, now.Add(time.Minute)); !errors.Is(err, errWalletPolicy) {
+		t.Errorf("error after restart = %v, want %v", err, errWalletPolicy)
+	}
+}
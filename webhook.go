@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookJobKind     = "webhook"
+	webhookMaxAttempts = 5
+)
+
+// webhookDelivery is the job payload for delivering an event to one webhook.
+type webhookDelivery struct {
+	URL     string          `json:"url"`
+	Event   json.RawMessage `json:"event"`
+	Attempt int             `json:"attempt"`
+}
+
+// webhookSender posts events to the configured webhook urls. Deliveries are
+// run as background jobs and retried with increasing delays when they fail,
+// as jobs that are not run before their delay, so that pending retries
+// survive a restart along with the other jobs.
+type webhookSender struct {
+	urls    []string
+	jobs    *jobScheduler
+	client  *http.Client
+	backoff backoff
+}
+
+func newWebhookSender(urls []string, jobs *jobScheduler) *webhookSender {
+	s := &webhookSender{
+		urls:   urls,
+		jobs:   jobs,
+		client: &http.Client{Timeout: 30 * time.Second},
+		backoff: backoff{
+			minDelay: time.Second,
+			maxDelay: 5 * time.Minute,
+		},
+	}
+	jobs.handle(webhookJobKind, s.deliver)
+	return s
+}
+
+func (s *webhookSender) send(ev Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("failed to marshal webhook event", "type", ev.Type, "error", err)
+		return
+	}
+	for _, u := range s.urls {
+		s.submit(webhookDelivery{URL: u, Event: data}, time.Time{})
+	}
+}
+
+// submit queues the delivery d, not to be made before notBefore.
+func (s *webhookSender) submit(d webhookDelivery, notBefore time.Time) {
+	// Deliveries to the same url share a tenant so a slow endpoint does not
+	// hold up the others.
+	if _, err := s.jobs.submitAt(webhookJobKind, d.URL, d, notBefore); err != nil {
+		log.Println("failed to queue webhook delivery", "url", d.URL, "error", err)
+	}
+}
+
+func (s *webhookSender) deliver(ctx context.Context, payload json.RawMessage) error {
+	var d webhookDelivery
+	if err := json.Unmarshal(payload, &d); err != nil {
+		return fmt.Errorf("unmarshal webhook delivery: %w", err)
+	}
+
+	err := s.post(ctx, d)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+
+	d.Attempt++
+	if d.Attempt >= webhookMaxAttempts {
+		return fmt.Errorf("giving up after %d attempts: %w", d.Attempt, err)
+	}
+	s.submit(d, time.Now().Add(s.backoff.next(d.Attempt)))
+	return err
+}
+
+func (s *webhookSender) post(ctx context.Context, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("non-2xx status: %s, msg: '%s'", resp.Status, string(b))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/gorilla/mux"
+)
+
+// workerNamePattern restricts the names of workers to what fits in a path.
+var workerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// workerCacheTTLs returns the cache lifetimes of the worker methods that
+// describe the worker without changing it.
+func workerCacheTTLs(ttl time.Duration) map[string]time.Duration {
+	return map[string]time.Duration{
+		"Version":   ttl,
+		"Info":      ttl,
+		"Paths":     ttl,
+		"TaskTypes": ttl,
+	}
+}
+
+// workerNode is a lotus-worker served through the proxy, so that sealing
+// workers without a reachable address of their own get one authenticated
+// entry point.
+type workerNode struct {
+	name    string
+	handler http.Handler
+	closer  jsonrpc.ClientCloser
+}
+
+// newWorkerNode connects to the worker api and serves it through
+// interceptors, with the describing methods cached for cacheTTL unless 0.
+func newWorkerNode(name, authToken string, api apiInfo, tc transportConfig, cacheTTL time.Duration, interceptors ...Interceptor) (*workerNode, error) {
+	if !workerNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid worker name %q", name)
+	}
+	if err := tc.check(api); err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	if authToken != "" {
+		headers.Set("Authorization", "Bearer "+authToken)
+	}
+	var client lotusapi.WorkerStruct
+	closer, err := jsonrpc.NewMergeClient(
+		context.Background(),
+		tc.rpcURL(api, "/rpc/v0"), api.rpcNamespace(),
+		lotusapi.GetInternalStructs(&client),
+		headers,
+		jsonrpc.WithReconnectBackoff(tc.reconnect.minDelay, tc.reconnect.maxDelay),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connect to worker %s: %w", name, err)
+	}
+
+	if cacheTTL > 0 {
+		interceptors = append(interceptors, cachingInterceptor(newResponseCache(), "worker-"+name, workerCacheTTLs(cacheTTL), 0))
+	}
+	var served lotusapi.WorkerStruct
+	proxyAPI(methodInvoker(&client), &served, interceptors...)
+
+	srv := jsonrpc.NewServer()
+	srv.Register("Filecoin", &served)
+	return &workerNode{name: name, handler: srv, closer: closer}, nil
+}
+
+// route registers the worker api under /worker/<name>/.
+func (w *workerNode) route(r *mux.Router) {
+	r.Handle("/worker/"+w.name+"/rpc/v0", ClassifyErrors(w.handler))
+	r.Handle("/worker/"+w.name+"/rpc/v1", ClassifyErrors(w.handler))
+}
+
+// parseWorkerAPIs parses values of the form <name>=<api>, where api takes
+// the same forms as --api.
+func parseWorkerAPIs(values []string) (map[string]apiInfo, error) {
+	workers := map[string]apiInfo{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid worker api %q, expected <name>=<api>", v)
+		}
+		if _, ok := workers[parts[0]]; ok {
+			return nil, fmt.Errorf("worker %q given twice", parts[0])
+		}
+		api, err := parseAPIInfo(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		workers[parts[0]] = api
+	}
+	return workers, nil
+}
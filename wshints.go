@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// subscriptionHintMethod is the method of the JSON-RPC notifications the
+// proxy sends websocket clients about their subscriptions. Clients that do
+// not know it ignore it, as notifications get no answer.
+const subscriptionHintMethod = "xrpc.cpr.hint"
+
+// Actions advised by subscription hints.
+const (
+	// hintMigrated tells that a subscription moved to another upstream and
+	// carries on where it left off.
+	hintMigrated = "migrated"
+	// hintResync tells that a subscription moved to another upstream, but
+	// values may have been missed in between, so the client should read
+	// again the state it follows.
+	hintResync = "resync"
+	// hintResubscribe tells that a subscription was closed because no
+	// upstream could take it over, so the client should subscribe again.
+	hintResubscribe = "resubscribe"
+)
+
+// subscriptionHint advises a websocket client what to do after the proxy
+// moved or lost one of its subscriptions.
+type subscriptionHint struct {
+	Action string `json:"action"`
+	Method string `json:"method"`
+	From   string `json:"from,omitempty"` // upstream the subscription was on
+	To     string `json:"to,omitempty"`   // upstream it moved to
+}
+
+// hintWriter wraps the response writer of a websocket upgrade so that the
+// connection it hijacks can carry hints for the session.
+type hintWriter struct {
+	http.ResponseWriter
+	s *session
+}
+
+func (w *hintWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	fc := &frameConn{Conn: conn, handshake: true}
+	w.s.setConn(fc)
+	return fc, brw, nil
+}
+
+func isUpgrade(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// frameConn is the connection of a websocket client, which follows the
+// frames the server writes so that hints can be written in between whole
+// messages without garbling them.
+type frameConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	handshake bool   // the upgrade response is still being written
+	tail      []byte // last bytes of the upgrade response written
+	header    []byte // of the frame being written, while incomplete
+	remaining uint64 // payload bytes of the frame left to write
+	inMessage bool   // a fragmented message has more frames to come
+	pending   [][]byte
+}
+
+func (c *frameConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.Conn.Write(b)
+	c.follow(b[:n])
+	if err == nil && c.atBoundary() {
+		for len(c.pending) > 0 {
+			if _, err := c.Conn.Write(c.pending[0]); err != nil {
+				break
+			}
+			c.pending = c.pending[1:]
+		}
+	}
+	return n, err
+}
+
+// follow parses the bytes written to keep track of frame boundaries.
+func (c *frameConn) follow(b []byte) {
+	for len(b) > 0 {
+		switch {
+		case c.handshake:
+			c.tail = append(c.tail, b[0])
+			if len(c.tail) > 4 {
+				c.tail = c.tail[1:]
+			}
+			b = b[1:]
+			if bytes.Equal(c.tail, []byte("\r\n\r\n")) {
+				c.handshake, c.tail = false, nil
+			}
+		case c.remaining > 0:
+			n := uint64(len(b))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			b = b[n:]
+		default:
+			c.header = append(c.header, b[0])
+			b = b[1:]
+			if size, ok := frameHeaderSize(c.header); ok && len(c.header) == size {
+				c.startFrame()
+			}
+		}
+	}
+}
+
+// frameHeaderSize returns the size of the frame header h starts, once it
+// holds enough of it to tell.
+func frameHeaderSize(h []byte) (int, bool) {
+	if len(h) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4 // mask key
+	}
+	return size, true
+}
+
+func (c *frameConn) startFrame() {
+	h := c.header
+	c.header = nil
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		c.remaining = uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		c.remaining = binary.BigEndian.Uint64(h[2:10])
+	default:
+		c.remaining = uint64(n)
+	}
+	// Control frames may come between the frames of a message and do not
+	// end it.
+	if opcode := h[0] & 0x0f; opcode < 8 {
+		c.inMessage = h[0]&0x80 == 0
+	}
+}
+
+func (c *frameConn) atBoundary() bool {
+	return !c.handshake && len(c.header) == 0 && c.remaining == 0 && !c.inMessage
+}
+
+// send writes msg to the client as a text message, at once if no message is
+// being written or else once the current one is.
+func (c *frameConn) send(msg []byte) error {
+	frame := textFrame(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.atBoundary() {
+		c.pending = append(c.pending, frame)
+		return nil
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// textFrame returns a single, unmasked text frame holding msg, as servers
+// send them.
+func textFrame(msg []byte) []byte {
+	frame := []byte{0x81}
+	switch n := len(msg); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(n))
+		frame = append(append(frame, 127), size[:]...)
+	}
+	return append(frame, msg...)
+}
+
+// hint sends h to the websocket client of the session, if it has one.
+func (s *session) hint(h subscriptionHint) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	msg, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  subscriptionHintMethod,
+		"params":  []subscriptionHint{h},
+	})
+	if err != nil {
+		return
+	}
+	if err := conn.send(msg); err != nil {
+		log.Println("failed to send subscription hint", "remote", s.remote, "error", err)
+	}
+}
+
+func (s *session) setConn(c *frameConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = c
+}